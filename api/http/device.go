@@ -15,10 +15,12 @@
 package http
 
 import (
+	"container/list"
 	"context"
 	"encoding/binary"
 	"encoding/json"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -27,6 +29,8 @@ import (
 	"github.com/mendersoftware/go-lib-micro/log"
 	"github.com/mendersoftware/go-lib-micro/rest.utils"
 	"github.com/mendersoftware/go-lib-micro/ws"
+	wsft "github.com/mendersoftware/go-lib-micro/ws/filetransfer"
+	"github.com/mendersoftware/go-lib-micro/ws/portforward"
 	"github.com/mendersoftware/go-lib-micro/ws/shell"
 	natsio "github.com/nats-io/nats.go"
 	"github.com/pkg/errors"
@@ -50,22 +54,45 @@ var (
 	ErrMissingAuthentication = errors.New(
 		"missing or non-device identity in the authorization headers",
 	)
+	ErrProtocolViolation = errors.New("protocol violation")
+
+	ErrMsgDeviceDisconnected = "device disconnected"
+)
+
+// Policies applied to the device messages violating the protocol, e.g.
+// addressing sessions which do not belong to the device
+const (
+	// ViolationPolicyDrop drops the offending messages
+	ViolationPolicyDrop = "drop"
+	// ViolationPolicyDisconnect closes the device connection
+	ViolationPolicyDisconnect = "disconnect"
 )
 
+// maxDeviceSessionCache is the maximum number of sessions whose ownership
+// is cached for each device connection
+const maxDeviceSessionCache = 1024
+
 // DeviceController container for end-points
 type DeviceController struct {
-	app  app.App
-	nats nats.Client
+	app             app.App
+	nats            nats.Client
+	violationPolicy string
 }
 
-// NewDeviceController returns a new DeviceController
+// NewDeviceController returns a new DeviceController; the violation policy
+// defaults to ViolationPolicyDrop
 func NewDeviceController(
 	app app.App,
 	natsClient nats.Client,
+	violationPolicy string,
 ) *DeviceController {
+	if violationPolicy == "" {
+		violationPolicy = ViolationPolicyDrop
+	}
 	return &DeviceController{
-		app:  app,
-		nats: natsClient,
+		app:             app,
+		nats:            natsClient,
+		violationPolicy: violationPolicy,
 	}
 }
 
@@ -181,9 +208,10 @@ func (h DeviceController) Connect(c *gin.Context) {
 	defer h.app.UnregisterShutdownCancel(registerID)
 
 	// websocketWriter is responsible for closing the websocket
+	sessions := newDeviceSessions()
 	//nolint:errcheck
-	go h.connectWSWriter(ctxWithCancel, conn, msgChan, errChan)
-	err = h.ConnectServeWS(ctxWithCancel, conn)
+	go h.connectWSWriter(ctxWithCancel, conn, msgChan, errChan, sessions)
+	err = h.ConnectServeWS(ctxWithCancel, conn, sessions)
 	if err != nil {
 		select {
 		case errChan <- err:
@@ -197,23 +225,28 @@ func (h DeviceController) Connect(c *gin.Context) {
 // websocketWriter is the go-routine responsible for the writing end of the
 // websocket. The routine forwards messages posted on the NATS session subject
 // and periodically pings the connection. If the connection times out or a
-// protocol violation occurs, the routine closes the connection.
+// protocol violation occurs, the routine closes the connection. The sessions
+// of the messages forwarded are tracked as sessions of the device.
 func (h DeviceController) connectWSWriter(
 	ctx context.Context,
 	conn *websocket.Conn,
 	msgChan <-chan *natsio.Msg,
 	errChan <-chan error,
+	sessions *deviceSessions,
 ) (err error) {
 	l := log.FromContext(ctx)
+	id := identity.FromContext(ctx)
 	defer func() {
 		if err != nil {
 			if !websocket.IsUnexpectedCloseError(err) {
 				// If the peer didn't send a close message we must.
+				code := websocket.CloseInternalServerErr
+				if errors.Cause(err) == ErrProtocolViolation {
+					code = websocket.ClosePolicyViolation
+				}
 				errMsg := err.Error()
 				errBody := make([]byte, len(errMsg)+2)
-				binary.BigEndian.PutUint16(errBody,
-					websocket.CloseInternalServerErr,
-				)
+				binary.BigEndian.PutUint16(errBody, uint16(code))
 				copy(errBody[2:], errMsg)
 				errClose := conn.WriteControl(
 					websocket.CloseMessage,
@@ -262,6 +295,7 @@ Loop:
 	for {
 		select {
 		case msg := <-msgChan:
+			sessions.addressed(id.Subject, msg.Data)
 			err = conn.WriteMessage(websocket.BinaryMessage, msg.Data)
 			if err != nil {
 				l.Error(err)
@@ -285,6 +319,7 @@ Loop:
 func (h DeviceController) ConnectServeWS(
 	ctx context.Context,
 	conn *websocket.Conn,
+	sessions *deviceSessions,
 ) (err error) {
 	l := log.FromContext(ctx)
 	id := identity.FromContext(ctx)
@@ -300,26 +335,14 @@ func (h DeviceController) ConnectServeWS(
 		return
 	}
 	defer func() {
+		// notify the sessions about the device disconnecting
 		for sessionID, session := range sessMap {
-			// TODO: notify the session NATS topic about the session
-			//       being released.
-			if session.RemoteTerminal {
-				msg := ws.ProtoMsg{
-					Header: ws.ProtoHdr{
-						Proto:     ws.ProtoTypeShell,
-						MsgType:   shell.MessageTypeStopShell,
-						SessionID: sessionID,
-						Properties: map[string]interface{}{
-							"status": shell.ErrorMessage,
-						},
-					},
-					Body: []byte("device disconnected"),
+			subject := model.GetSessionSubject(id.Tenant, sessionID)
+			for _, data := range prepDeviceDisconnect(sessionID, session) {
+				if ePub := h.nats.Publish(subject, data); ePub != nil {
+					l.Errorf("failed to notify session %s about the device "+
+						"disconnecting: %s", sessionID, ePub.Error())
 				}
-				data, _ := msgpack.Marshal(msg)
-				err = h.nats.Publish(
-					model.GetSessionSubject(id.Tenant, sessionID),
-					data,
-				)
 			}
 		}
 		// update the device status on websocket closing
@@ -343,23 +366,24 @@ func (h DeviceController) ConnectServeWS(
 		if err != nil {
 			return err
 		}
+		if m.Header.Proto == ws.ProtoTypeShell && m.Header.SessionID == "" {
+			return errors.New("api: message missing required session ID")
+		}
 
-		sessMap[m.Header.SessionID] = &model.ActiveSession{}
-		switch m.Header.Proto {
-		case ws.ProtoTypeShell:
-			if m.Header.SessionID == "" {
-				return errors.New("api: message missing required session ID")
-			} else if m.Header.MsgType == shell.MessageTypeSpawnShell {
-				if session, ok := sessMap[m.Header.SessionID]; ok {
-					session.RemoteTerminal = true
-				}
-			} else if m.Header.MsgType == shell.MessageTypeStopShell {
-				delete(sessMap, m.Header.SessionID)
+		err = h.validateMessage(ctx, id.Subject, m, sessions)
+		if errors.Cause(err) == ErrProtocolViolation {
+			if h.violationPolicy == ViolationPolicyDisconnect {
+				return err
 			}
-		default:
-			// TODO: Handle protocol violation
+			l.Warnf("dropping message from the device: %s", err.Error())
+			continue
+		} else if err != nil {
+			l.Errorf("dropping message from the device: %s", err.Error())
+			continue
 		}
 
+		trackSessionProtocols(sessMap, m)
+
 		err = h.nats.Publish(
 			model.GetSessionSubject(id.Tenant, m.Header.SessionID),
 			data,
@@ -369,3 +393,186 @@ func (h DeviceController) ConnectServeWS(
 		}
 	}
 }
+
+// validateMessage verifies that the message from the device uses a known
+// protocol and addresses a session of the device (deviceID): a session of
+// the device in the session store, or a session addressed to the device,
+// e.g. a file transfer. The owners of the sessions are cached in sessions
+// for the lifetime of the connection.
+// Protocol violations are reported with errors caused by
+// ErrProtocolViolation.
+func (h DeviceController) validateMessage(
+	ctx context.Context,
+	deviceID string,
+	m *ws.ProtoMsg,
+	sessions *deviceSessions,
+) error {
+	switch m.Header.Proto {
+	case ws.ProtoTypeShell,
+		ws.ProtoTypeFileTransfer,
+		ws.ProtoTypePortForward,
+		ws.ProtoTypeMenderClient,
+		ws.ProtoTypeControl:
+	default:
+		return errors.Wrapf(ErrProtocolViolation,
+			"unknown protocol %d", m.Header.Proto)
+	}
+	sessionID := m.Header.SessionID
+	if sessionID == "" {
+		return errors.Wrap(ErrProtocolViolation,
+			"message missing required session ID")
+	}
+
+	owner, ok := sessions.owner(sessionID)
+	if !ok {
+		sess, err := h.app.GetSession(ctx, sessionID)
+		if err == nil {
+			owner = sess.DeviceID
+		} else if err != app.ErrSessionNotFound {
+			return errors.Wrapf(err, "failed to look up session %s", sessionID)
+		}
+		sessions.setOwner(sessionID, owner)
+	}
+	if owner == "" {
+		return errors.Wrapf(ErrProtocolViolation,
+			"session %s does not exist", sessionID)
+	} else if owner != deviceID {
+		return errors.Wrapf(ErrProtocolViolation,
+			"session %s does not belong to the device", sessionID)
+	}
+	return nil
+}
+
+// deviceSessions caches the owners of the sessions of a device connection:
+// the sessions looked up in the session store, and the sessions addressed to
+// the device, e.g. the file transfers, not kept in the session store. Past
+// maxDeviceSessionCache sessions, the least recently used one is evicted.
+type deviceSessions struct {
+	mutex  sync.Mutex
+	owners map[string]*list.Element
+	recent *list.List
+}
+
+// deviceSession is the owner of a session cached in deviceSessions
+type deviceSession struct {
+	sessionID string
+	owner     string
+}
+
+func newDeviceSessions() *deviceSessions {
+	return &deviceSessions{
+		owners: make(map[string]*list.Element),
+		recent: list.New(),
+	}
+}
+
+// owner returns the owner of the session, an empty owner for the sessions
+// not found, if cached
+func (s *deviceSessions) owner(sessionID string) (string, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	elem, ok := s.owners[sessionID]
+	if !ok {
+		return "", false
+	}
+	s.recent.MoveToFront(elem)
+	return elem.Value.(*deviceSession).owner, true
+}
+
+// setOwner caches the owner of the session
+func (s *deviceSessions) setOwner(sessionID, owner string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if elem, ok := s.owners[sessionID]; ok {
+		elem.Value.(*deviceSession).owner = owner
+		s.recent.MoveToFront(elem)
+		return
+	}
+	s.owners[sessionID] = s.recent.PushFront(&deviceSession{
+		sessionID: sessionID,
+		owner:     owner,
+	})
+	if s.recent.Len() > maxDeviceSessionCache {
+		oldest := s.recent.Remove(s.recent.Back()).(*deviceSession)
+		delete(s.owners, oldest.sessionID)
+	}
+}
+
+// addressed caches the device (deviceID) as the owner of the session of the
+// message addressed to the device
+func (s *deviceSessions) addressed(deviceID string, data []byte) {
+	var m struct {
+		Header ws.ProtoHdr `msgpack:"hdr"`
+	}
+	if err := msgpack.Unmarshal(data, &m); err == nil && m.Header.SessionID != "" {
+		s.setOwner(m.Header.SessionID, deviceID)
+	}
+}
+
+// trackSessionProtocols keeps track of the protocols the device uses in
+// each of its sessions, based on the message from the device.
+func trackSessionProtocols(sessMap map[string]*model.ActiveSession, m *ws.ProtoMsg) {
+	sessionID := m.Header.SessionID
+	session, ok := sessMap[sessionID]
+	if !ok {
+		session = model.NewActiveSession()
+		sessMap[sessionID] = session
+	}
+	switch m.Header.Proto {
+	case ws.ProtoTypeShell:
+		if m.Header.MsgType == shell.MessageTypeStopShell {
+			delete(session.Protocols, ws.ProtoTypeShell)
+		} else {
+			session.Protocols[ws.ProtoTypeShell] = true
+		}
+	case ws.ProtoTypePortForward, ws.ProtoTypeFileTransfer:
+		session.Protocols[m.Header.Proto] = true
+	case ws.ProtoTypeControl:
+		if m.Header.MsgType == ws.MessageTypeClose {
+			delete(sessMap, sessionID)
+		}
+	}
+}
+
+// prepDeviceDisconnect preps the messages notifying the session about the
+// device disconnecting: an error for each of the protocols in use, followed
+// by the message closing the session.
+func prepDeviceDisconnect(sessionID string, session *model.ActiveSession) [][]byte {
+	reason := ErrMsgDeviceDisconnected
+	msgs := make([][]byte, 0, len(session.Protocols)+1)
+	for proto := range session.Protocols {
+		msg := ws.ProtoMsg{
+			Header: ws.ProtoHdr{
+				Proto:     proto,
+				SessionID: sessionID,
+			},
+		}
+		switch proto {
+		case ws.ProtoTypeShell:
+			msg.Header.MsgType = shell.MessageTypeStopShell
+			msg.Header.Properties = map[string]interface{}{
+				"status": shell.ErrorMessage,
+			}
+			msg.Body = []byte(reason)
+		case ws.ProtoTypePortForward:
+			msg.Header.MsgType = portforward.MessageTypeError
+			msg.Body, _ = msgpack.Marshal(portforward.Error{Error: &reason})
+		case ws.ProtoTypeFileTransfer:
+			msg.Header.MsgType = wsft.MessageTypeError
+			msg.Body, _ = msgpack.Marshal(wsft.Error{Error: &reason})
+		default:
+			continue
+		}
+		data, _ := msgpack.Marshal(msg)
+		msgs = append(msgs, data)
+	}
+	data, _ := msgpack.Marshal(ws.ProtoMsg{
+		Header: ws.ProtoHdr{
+			Proto:     ws.ProtoTypeControl,
+			MsgType:   ws.MessageTypeClose,
+			SessionID: sessionID,
+		},
+		Body: []byte(reason),
+	})
+	return append(msgs, data)
+}
@@ -18,6 +18,7 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"strings"
@@ -25,10 +26,13 @@ import (
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/mendersoftware/deviceconnect/app"
 	app_mocks "github.com/mendersoftware/deviceconnect/app/mocks"
 	"github.com/mendersoftware/deviceconnect/model"
 	"github.com/mendersoftware/go-lib-micro/identity"
 	"github.com/mendersoftware/go-lib-micro/ws"
+	wsft "github.com/mendersoftware/go-lib-micro/ws/filetransfer"
+	"github.com/mendersoftware/go-lib-micro/ws/portforward"
 	"github.com/mendersoftware/go-lib-micro/ws/shell"
 	"github.com/nats-io/nats.go"
 	"github.com/vmihailenco/msgpack/v5"
@@ -306,6 +310,360 @@ func TestDeviceConnect(t *testing.T) {
 	app.AssertExpectations(t)
 }
 
+func TestDeviceConnectProtocolViolations(t *testing.T) {
+	Identity := identity.Identity{
+		Subject:  "00000000-0000-0000-0000-000000000000",
+		Tenant:   "000000000000000000000000",
+		IsDevice: true,
+	}
+	const (
+		sessionID      = "00000000-0000-0000-0000-000000000001"
+		validSessionID = "00000000-0000-0000-0000-000000000002"
+	)
+	testCases := []struct {
+		Name string
+
+		Policy string
+		Msg    ws.ProtoMsg
+
+		GetSession    *model.Session
+		GetSessionErr error
+		// Addressed sends a message of the session to the device first
+		Addressed bool
+
+		Forwarded bool
+		Closed    bool
+	}{{
+		Name: "ok, session of the device",
+
+		Msg: ws.ProtoMsg{Header: ws.ProtoHdr{
+			Proto:     ws.ProtoTypePortForward,
+			SessionID: sessionID,
+		}},
+		GetSession: &model.Session{ID: sessionID, DeviceID: Identity.Subject},
+		Forwarded:  true,
+	}, {
+		Name: "ok, file transfer session addressed to the device",
+
+		Msg: ws.ProtoMsg{Header: ws.ProtoHdr{
+			Proto:     ws.ProtoTypeFileTransfer,
+			SessionID: sessionID,
+		}},
+		Addressed: true,
+		Forwarded: true,
+	}, {
+		Name: "ko, file transfer session not addressed to the device",
+
+		Msg: ws.ProtoMsg{Header: ws.ProtoHdr{
+			Proto:     ws.ProtoTypeFileTransfer,
+			SessionID: sessionID,
+		}},
+		GetSessionErr: app.ErrSessionNotFound,
+	}, {
+		Name: "ko, control message closing an unknown session",
+
+		Msg: ws.ProtoMsg{Header: ws.ProtoHdr{
+			Proto:     ws.ProtoTypeControl,
+			MsgType:   ws.MessageTypeClose,
+			SessionID: sessionID,
+		}},
+		GetSessionErr: app.ErrSessionNotFound,
+	}, {
+		Name: "ko, session of another device",
+
+		Msg: ws.ProtoMsg{Header: ws.ProtoHdr{
+			Proto:     ws.ProtoTypeShell,
+			SessionID: sessionID,
+		}},
+		GetSession: &model.Session{ID: sessionID, DeviceID: "another-device"},
+	}, {
+		Name: "ko, control message for a session of another device",
+
+		Msg: ws.ProtoMsg{Header: ws.ProtoHdr{
+			Proto:     ws.ProtoTypeControl,
+			SessionID: sessionID,
+		}},
+		GetSession: &model.Session{ID: sessionID, DeviceID: "another-device"},
+	}, {
+		Name: "ko, session not found",
+
+		Msg: ws.ProtoMsg{Header: ws.ProtoHdr{
+			Proto:     ws.ProtoTypeShell,
+			SessionID: sessionID,
+		}},
+		GetSessionErr: app.ErrSessionNotFound,
+	}, {
+		Name: "ko, unknown protocol",
+
+		Msg: ws.ProtoMsg{Header: ws.ProtoHdr{
+			Proto:     ws.ProtoType(0x1234),
+			SessionID: sessionID,
+		}},
+	}, {
+		Name: "ko, session lookup error",
+
+		Policy: ViolationPolicyDisconnect,
+		Msg: ws.ProtoMsg{Header: ws.ProtoHdr{
+			Proto:     ws.ProtoTypeShell,
+			SessionID: sessionID,
+		}},
+		GetSessionErr: errors.New("internal error"),
+	}, {
+		Name: "ko, session of another device, disconnect",
+
+		Policy: ViolationPolicyDisconnect,
+		Msg: ws.ProtoMsg{Header: ws.ProtoHdr{
+			Proto:     ws.ProtoTypeShell,
+			SessionID: sessionID,
+		}},
+		GetSession: &model.Session{ID: sessionID, DeviceID: "another-device"},
+		Closed:     true,
+	}, {
+		Name: "ko, missing session ID, disconnect",
+
+		Policy: ViolationPolicyDisconnect,
+		Msg: ws.ProtoMsg{Header: ws.ProtoHdr{
+			Proto: ws.ProtoTypePortForward,
+		}},
+		Closed: true,
+	}}
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.Name, func(t *testing.T) {
+			app := &app_mocks.App{}
+			defer app.AssertExpectations(t)
+			app.On("RegisterShutdownCancel",
+				mock.AnythingOfType("context.CancelFunc"),
+			).Return(uint32(1))
+			app.On("UpdateDeviceStatus",
+				mock.MatchedBy(func(_ context.Context) bool {
+					return true
+				}),
+				Identity.Tenant,
+				Identity.Subject,
+				model.DeviceStatusConnected,
+			).Return(nil)
+			// the connection may be still closing when the test ends
+			app.On("UnregisterShutdownCancel",
+				mock.AnythingOfType("uint32"),
+			).Return().Maybe()
+			app.On("UpdateDeviceStatus",
+				mock.MatchedBy(func(_ context.Context) bool {
+					return true
+				}),
+				Identity.Tenant,
+				Identity.Subject,
+				model.DeviceStatusDisconnected,
+			).Return(nil).Maybe()
+			if tc.GetSession != nil || tc.GetSessionErr != nil {
+				app.On("GetSession",
+					mock.MatchedBy(func(_ context.Context) bool {
+						return true
+					}),
+					sessionID,
+				).Return(tc.GetSession, tc.GetSessionErr).Once()
+			}
+			if !tc.Closed {
+				app.On("GetSession",
+					mock.MatchedBy(func(_ context.Context) bool {
+						return true
+					}),
+					validSessionID,
+				).Return(&model.Session{
+					ID:       validSessionID,
+					DeviceID: Identity.Subject,
+				}, nil).Once()
+			}
+
+			natsClient := NewNATSTestClient(t)
+			router, err := NewRouter(app, natsClient, &RouterConfig{
+				DeviceViolationPolicy: tc.Policy,
+			})
+			if !assert.NoError(t, err) {
+				t.FailNow()
+			}
+			s := httptest.NewServer(router)
+			defer s.Close()
+
+			rChan := make(chan *nats.Msg, 2)
+			for _, sid := range []string{sessionID, validSessionID} {
+				sub, err := natsClient.ChanSubscribe(
+					model.GetSessionSubject(Identity.Tenant, sid),
+					rChan,
+				)
+				if !assert.NoError(t, err) {
+					t.FailNow()
+				}
+				//nolint:errcheck
+				defer sub.Unsubscribe()
+			}
+
+			headers := http.Header{}
+			headers.Set(headerAuthorization, "Bearer "+GenerateJWT(Identity))
+			url := "ws" + strings.TrimPrefix(s.URL, "http")
+			conn, _, err := websocket.DefaultDialer.Dial(url+APIURLDevicesConnect, headers)
+			if !assert.NoError(t, err) {
+				t.FailNow()
+			}
+			defer conn.Close()
+
+			if tc.Addressed {
+				request, _ := msgpack.Marshal(ws.ProtoMsg{Header: ws.ProtoHdr{
+					Proto:     tc.Msg.Header.Proto,
+					SessionID: sessionID,
+				}})
+				err = natsClient.Publish(
+					model.GetDeviceSubject(Identity.Tenant, Identity.Subject),
+					request,
+				)
+				assert.NoError(t, err)
+				_, data, err := conn.ReadMessage()
+				assert.NoError(t, err)
+				assert.Equal(t, request, data)
+			}
+
+			b, _ := msgpack.Marshal(tc.Msg)
+			err = conn.WriteMessage(websocket.BinaryMessage, b)
+			assert.NoError(t, err)
+			if tc.Closed {
+				_, _, err = conn.ReadMessage()
+				assert.True(t, websocket.IsCloseError(err,
+					websocket.ClosePolicyViolation), err)
+				return
+			}
+
+			valid, _ := msgpack.Marshal(ws.ProtoMsg{Header: ws.ProtoHdr{
+				Proto:     ws.ProtoTypeShell,
+				SessionID: validSessionID,
+			}})
+			err = conn.WriteMessage(websocket.BinaryMessage, valid)
+			assert.NoError(t, err)
+
+			expected := [][]byte{valid}
+			if tc.Forwarded {
+				expected = [][]byte{b, valid}
+			}
+			for _, data := range expected {
+				select {
+				case rMsg := <-rChan:
+					assert.Equal(t, data, rMsg.Data)
+				case <-time.After(time.Second):
+					assert.Fail(t, "timeout waiting for message to propagate")
+				}
+			}
+		})
+	}
+
+	_, err := NewRouter(nil, nil, &RouterConfig{DeviceViolationPolicy: "ignore"})
+	assert.EqualError(t, err, `invalid device protocol violation policy: "ignore"`)
+}
+
+func TestDeviceSessionsEviction(t *testing.T) {
+	sessions := newDeviceSessions()
+	for i := 0; i < maxDeviceSessionCache; i++ {
+		sessions.setOwner(fmt.Sprintf("session-%d", i), "device")
+	}
+	// the sessions in use are kept, the least recently used is evicted
+	_, ok := sessions.owner("session-0")
+	assert.True(t, ok)
+	sessions.setOwner("new-session", "device")
+	_, ok = sessions.owner("session-0")
+	assert.True(t, ok)
+	_, ok = sessions.owner("session-1")
+	assert.False(t, ok)
+	owner, ok := sessions.owner("new-session")
+	assert.True(t, ok)
+	assert.Equal(t, "device", owner)
+	assert.Len(t, sessions.owners, maxDeviceSessionCache)
+
+	// the sessions addressed to the device belong to the device
+	data, _ := msgpack.Marshal(ws.ProtoMsg{Header: ws.ProtoHdr{
+		Proto:     ws.ProtoTypeFileTransfer,
+		SessionID: "file-transfer",
+	}, Body: []byte("data")})
+	sessions.addressed("device", data)
+	owner, ok = sessions.owner("file-transfer")
+	assert.True(t, ok)
+	assert.Equal(t, "device", owner)
+}
+
+func TestDeviceDisconnectSessions(t *testing.T) {
+	const sessionID = "00000000-0000-0000-0000-000000000000"
+	testCases := []struct {
+		Name string
+
+		Messages []ws.ProtoHdr
+
+		MsgTypes map[ws.ProtoType]string
+	}{{
+		Name: "no sessions",
+	}, {
+		Name: "shell, port forward and file transfer",
+
+		Messages: []ws.ProtoHdr{
+			{Proto: ws.ProtoTypeShell, MsgType: shell.MessageTypeSpawnShell},
+			{Proto: ws.ProtoTypePortForward, MsgType: portforward.MessageTypePortForward},
+			{Proto: ws.ProtoTypeFileTransfer, MsgType: wsft.MessageTypeFileInfo},
+		},
+
+		MsgTypes: map[ws.ProtoType]string{
+			ws.ProtoTypeShell:        shell.MessageTypeStopShell,
+			ws.ProtoTypePortForward:  portforward.MessageTypeError,
+			ws.ProtoTypeFileTransfer: wsft.MessageTypeError,
+		},
+	}, {
+		Name: "shell stopped",
+
+		Messages: []ws.ProtoHdr{
+			{Proto: ws.ProtoTypeShell, MsgType: shell.MessageTypeSpawnShell},
+			{Proto: ws.ProtoTypeShell, MsgType: shell.MessageTypeStopShell},
+		},
+
+		MsgTypes: map[ws.ProtoType]string{},
+	}, {
+		Name: "session closed",
+
+		Messages: []ws.ProtoHdr{
+			{Proto: ws.ProtoTypeShell, MsgType: shell.MessageTypeSpawnShell},
+			{Proto: ws.ProtoTypeControl, MsgType: ws.MessageTypeClose},
+		},
+	}}
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			sessMap := make(map[string]*model.ActiveSession)
+			for _, hdr := range tc.Messages {
+				hdr.SessionID = sessionID
+				trackSessionProtocols(sessMap, &ws.ProtoMsg{Header: hdr})
+			}
+			session, ok := sessMap[sessionID]
+			if tc.MsgTypes == nil {
+				assert.False(t, ok)
+				return
+			} else if !assert.True(t, ok) {
+				t.FailNow()
+			}
+
+			msgs := prepDeviceDisconnect(sessionID, session)
+			if !assert.Len(t, msgs, len(tc.MsgTypes)+1) {
+				t.FailNow()
+			}
+			for i, data := range msgs {
+				var msg ws.ProtoMsg
+				err := msgpack.Unmarshal(data, &msg)
+				assert.NoError(t, err)
+				assert.Equal(t, sessionID, msg.Header.SessionID)
+				if i == len(msgs)-1 {
+					assert.Equal(t, ws.ProtoTypeControl, msg.Header.Proto)
+					assert.Equal(t, ws.MessageTypeClose, msg.Header.MsgType)
+					assert.Equal(t, []byte(ErrMsgDeviceDisconnected), msg.Body)
+					continue
+				}
+				assert.Equal(t, tc.MsgTypes[msg.Header.Proto], msg.Header.MsgType)
+			}
+		})
+	}
+}
+
 func TestDeviceConnectFailures(t *testing.T) {
 	JWT := GenerateJWT(identity.Identity{
 		Subject:  "00000000-0000-0000-0000-000000000000",
@@ -15,11 +15,14 @@
 package http
 
 import (
+	"encoding/json"
 	"net/http"
 
 	"github.com/gin-gonic/gin"
+	"github.com/mendersoftware/go-lib-micro/identity"
 	"github.com/mendersoftware/go-lib-micro/ws"
 	"github.com/mendersoftware/go-lib-micro/ws/menderclient"
+	"github.com/pkg/errors"
 	"github.com/vmihailenco/msgpack/v5"
 
 	"github.com/mendersoftware/deviceconnect/app"
@@ -27,6 +30,14 @@ import (
 	"github.com/mendersoftware/deviceconnect/model"
 )
 
+// paramRecordingsRequestedBy is the ID of the user requesting the deletion
+// of the recordings through the internal API, for the audit logs
+const paramRecordingsRequestedBy = "requested_by"
+
+var ErrMissingRequestedBy = errors.New(
+	"missing " + paramRecordingsRequestedBy + " parameter",
+)
+
 // InternalController contains status-related end-points
 type InternalController struct {
 	app  app.App
@@ -87,3 +98,90 @@ func (h InternalController) sendMenderCommand(c *gin.Context, msgType string) {
 
 	c.JSON(http.StatusAccepted, nil)
 }
+
+// GetTenantPolicy responds to GET /tenants/:tenantId/policy
+func (h InternalController) GetTenantPolicy(c *gin.Context) {
+	ctx := c.Request.Context()
+	tenantID := c.Param("tenantId")
+
+	policy, err := h.app.GetTenantPolicy(ctx, tenantID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": errors.Wrap(err, "error retrieving the tenant policy").Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, policy)
+}
+
+// SetTenantPolicy responds to PUT /tenants/:tenantId/policy
+func (h InternalController) SetTenantPolicy(c *gin.Context) {
+	ctx := c.Request.Context()
+	tenantID := c.Param("tenantId")
+
+	rawData, err := c.GetRawData()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "bad request",
+		})
+		return
+	}
+
+	policy := &model.TenantPolicy{}
+	if err = json.Unmarshal(rawData, policy); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": errors.Wrap(err, "invalid payload").Error(),
+		})
+		return
+	} else if err = policy.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": errors.Wrap(err, "invalid payload").Error(),
+		})
+		return
+	}
+
+	if err = h.app.SetTenantPolicy(ctx, tenantID, policy); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": errors.Wrap(err, "error updating the tenant policy").Error(),
+		})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// DeleteRecording responds to
+// DELETE /tenants/:tenantId/sessions/:sessionId/recording
+func (h InternalController) DeleteRecording(c *gin.Context) {
+	ctx := identity.WithContext(c.Request.Context(), &identity.Identity{
+		Tenant: c.Param("tenantId"),
+	})
+	c.Request = c.Request.WithContext(ctx)
+
+	requestedBy := c.Query(paramRecordingsRequestedBy)
+	if requestedBy == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": ErrMissingRequestedBy.Error(),
+		})
+		return
+	}
+	deleteRecording(c, c.Param(PlaybackSessionIDField), requestedBy, h.app)
+}
+
+// DeleteRecordings responds to DELETE /tenants/:tenantId/recordings
+func (h InternalController) DeleteRecordings(c *gin.Context) {
+	ctx := identity.WithContext(c.Request.Context(), &identity.Identity{
+		Tenant: c.Param("tenantId"),
+	})
+	c.Request = c.Request.WithContext(ctx)
+
+	requestedBy := c.Query(paramRecordingsRequestedBy)
+	if requestedBy == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": ErrMissingRequestedBy.Error(),
+		})
+		return
+	}
+	deleteRecordings(c, requestedBy, h.app)
+}
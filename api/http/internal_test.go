@@ -270,3 +270,140 @@ func TestInternalSendInventory(t *testing.T) {
 		})
 	}
 }
+
+func TestInternalGetTenantPolicy(t *testing.T) {
+	idleTimeout := 300
+	testCases := []struct {
+		Name string
+
+		Policy    *model.TenantPolicy
+		PolicyErr error
+
+		HTTPStatus int
+		Body       string
+	}{
+		{
+			Name: "ok",
+
+			Policy: &model.TenantPolicy{IdleTimeout: &idleTimeout},
+
+			HTTPStatus: http.StatusOK,
+			Body:       `{"idle_timeout_seconds":300}`,
+		},
+		{
+			Name: "ko, internal error",
+
+			PolicyErr: errors.New("error"),
+
+			HTTPStatus: http.StatusInternalServerError,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			app := &app_mocks.App{}
+			defer app.AssertExpectations(t)
+
+			router, _ := NewRouter(app, nil, nil)
+
+			url := strings.Replace(APIURLInternalTenantPolicy, ":tenantId", "tenant_id", 1)
+			req, err := http.NewRequest("GET", "http://localhost"+url, nil)
+			if !assert.NoError(t, err) {
+				t.FailNow()
+			}
+
+			app.On("GetTenantPolicy",
+				mock.MatchedBy(func(_ context.Context) bool {
+					return true
+				}),
+				"tenant_id",
+			).Return(tc.Policy, tc.PolicyErr)
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			assert.Equal(t, tc.HTTPStatus, w.Code)
+			if tc.Body != "" {
+				assert.JSONEq(t, tc.Body, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestInternalSetTenantPolicy(t *testing.T) {
+	idleTimeout := 300
+	testCases := []struct {
+		Name string
+		Body string
+
+		Policy    *model.TenantPolicy
+		PolicyErr error
+
+		HTTPStatus int
+	}{
+		{
+			Name: "ok",
+			Body: `{"idle_timeout_seconds":300}`,
+
+			Policy: &model.TenantPolicy{IdleTimeout: &idleTimeout},
+
+			HTTPStatus: http.StatusNoContent,
+		},
+		{
+			Name: "ko, malformed payload",
+			Body: `{"idle_timeout_seconds":"300"}`,
+
+			HTTPStatus: http.StatusBadRequest,
+		},
+		{
+			Name: "ko, invalid payload",
+			Body: `{"idle_timeout_seconds":-1}`,
+
+			HTTPStatus: http.StatusBadRequest,
+		},
+		{
+			Name: "ko, invalid limit action",
+			Body: `{"limit_action":"ignore"}`,
+
+			HTTPStatus: http.StatusBadRequest,
+		},
+		{
+			Name: "ko, internal error",
+			Body: `{}`,
+
+			Policy:    &model.TenantPolicy{},
+			PolicyErr: errors.New("error"),
+
+			HTTPStatus: http.StatusInternalServerError,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			app := &app_mocks.App{}
+			defer app.AssertExpectations(t)
+
+			router, _ := NewRouter(app, nil, nil)
+
+			url := strings.Replace(APIURLInternalTenantPolicy, ":tenantId", "tenant_id", 1)
+			req, err := http.NewRequest("PUT", "http://localhost"+url,
+				strings.NewReader(tc.Body))
+			if !assert.NoError(t, err) {
+				t.FailNow()
+			}
+
+			if tc.Policy != nil {
+				app.On("SetTenantPolicy",
+					mock.MatchedBy(func(_ context.Context) bool {
+						return true
+					}),
+					"tenant_id",
+					tc.Policy,
+				).Return(tc.PolicyErr)
+			}
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			assert.Equal(t, tc.HTTPStatus, w.Code)
+		})
+	}
+}
@@ -16,9 +16,11 @@ package http
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"encoding/binary"
 	"encoding/json"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
@@ -35,6 +37,7 @@ import (
 	"github.com/mendersoftware/go-lib-micro/rest.utils"
 	"github.com/mendersoftware/go-lib-micro/ws"
 	"github.com/mendersoftware/go-lib-micro/ws/menderclient"
+	"github.com/mendersoftware/go-lib-micro/ws/portforward"
 	"github.com/mendersoftware/go-lib-micro/ws/shell"
 	natsio "github.com/nats-io/nats.go"
 	"github.com/pkg/errors"
@@ -50,32 +53,65 @@ var (
 	ErrMissingUserAuthentication = errors.New(
 		"missing or non-user identity in the authorization headers",
 	)
-	ErrMsgSessionLimit = "session byte limit exceeded"
+	ErrRecordingFormat      = errors.New("unsupported recording format")
+	ErrRecordingNotFound    = errors.New("session recording not found")
+	ErrMsgSessionLimit      = "session byte limit exceeded"
+	ErrMsgSessionTerminated = "session terminated by an administrator"
+	ErrMsgSessionIdle       = "session closed due to inactivity"
+	ErrMsgSessionExpired    = "session maximum duration exceeded"
+	ErrMsgSessionDevice     = "session closed by the device"
+	ErrMsgRecordingLimit    = "session recording limit exceeded, " +
+		"the session is no longer recorded"
 
 	//The name of the field holding a number of milliseconds to sleep between
 	//the consecutive writes of session recording data. Note that it does not have
 	//anything to do with the sleep between the keystrokes send, lines printed,
-	//or screen blinks, we are only aware of the stream of bytes.
+	//or screen blinks, we are only aware of the stream of bytes. Without it the
+	//playback reproduces the recorded timing.
 	PlaybackSleepIntervalMsField = "sleep_ms"
 
+	//The name of the query parameter holding the maximal number of milliseconds
+	//of the recorded delays, compressing the long idle gaps of the playback
+	PlaybackMaxIdleMsField = "max_idle_ms"
+
 	//The name of the field in the query parameter to GET that holds the id of a session
 	PlaybackSessionIDField = "sessionId"
 
-	//The threshold between the shell commands received (keystrokes) above which the
-	//delay control message is saved (1.5 seconds)
-	keyStrokeDelayRecordingThresholdNs = int64(1500 * 1000000)
+	//The name of the query parameter holding the offset of the recording to start
+	//the playback from, e.g. the offset of a search match
+	PlaybackOffsetField = "offset"
 
-	//The key stroke delay is recorded in two bytes, so this is the maximal
-	//possible delay. We round down to this if the real delay is larger
-	keyStrokeMaxDelayRecording = int64(65535 * 1000000)
+	//The name of the query parameter selecting the format of the exported recording
+	RecordingFormatField = "format"
 )
 
 const channelSize = 25 // TODO make configurable
 
+// idleCheckPeriod is how often the session idle timeout is checked
+var idleCheckPeriod = time.Second
+
 const (
 	PropertyUserID = "user_id"
 )
 
+const (
+	// RecordingFormatAsciicast is the asciinema v2 cast file format
+	RecordingFormatAsciicast = "asciicast"
+)
+
+const (
+	hdrTotalCount = "X-Total-Count"
+	hdrLink       = "Link"
+
+	paramSessionsDeviceID = "device_id"
+	paramSessionsUserID   = "user_id"
+	paramSessionsType     = "type"
+
+	paramSearchQuery = "q"
+	paramSearchFrom  = "from"
+	paramSearchTo    = "to"
+)
+
 var wsUpgrader = websocket.Upgrader{
 	Subprotocols: []string{"protomsg/msgpack"},
 	CheckOrigin:  allowAllOrigins,
@@ -138,6 +174,60 @@ func (h ManagementController) GetDevice(c *gin.Context) {
 	c.JSON(http.StatusOK, device)
 }
 
+// ListSessions returns the active sessions of the tenant
+func (h ManagementController) ListSessions(c *gin.Context) {
+	ctx := c.Request.Context()
+	l := log.FromContext(ctx)
+
+	idata := identity.FromContext(ctx)
+	if idata == nil || !idata.IsUser {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": ErrMissingUserAuthentication.Error(),
+		})
+		return
+	}
+
+	page, perPage, err := rest.ParsePagingParameters(c.Request)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	filter := model.SessionFilter{
+		DeviceID: c.Query(paramSessionsDeviceID),
+		UserID:   c.Query(paramSessionsUserID),
+		Type:     c.Query(paramSessionsType),
+		Skip:     (page - 1) * perPage,
+		Limit:    perPage,
+	}
+
+	sessions, count, err := h.app.ListSessions(ctx, filter)
+	if _, ok := errors.Cause(err).(validation.Errors); ok {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	} else if err != nil {
+		l.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	links, _ := rest.MakePagingHeaders(c.Request, rest.NewPagingHints().
+		SetPage(page).
+		SetPerPage(perPage).
+		SetTotalCount(count),
+	)
+	for _, link := range links {
+		c.Writer.Header().Add(hdrLink, link)
+	}
+	c.Header(hdrTotalCount, strconv.FormatInt(count, 10))
+	c.JSON(http.StatusOK, sessions)
+}
+
 // Connect extracts identity from request, checks user permissions
 // and calls ConnectDevice
 func (h ManagementController) Connect(c *gin.Context) {
@@ -172,6 +262,13 @@ func (h ManagementController) Connect(c *gin.Context) {
 			"error": err.Error(),
 		})
 		return
+	} else if err == app.ErrTenantSessionQuota ||
+		err == app.ErrUserSessionQuota ||
+		err == app.ErrDeviceSessionQuota {
+		c.JSON(http.StatusTooManyRequests, gin.H{
+			"error": err.Error(),
+		})
+		return
 	} else if _, ok := errors.Cause(err).(validation.Errors); ok {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"error": err.Error(),
@@ -203,6 +300,45 @@ func (h ManagementController) Connect(c *gin.Context) {
 	//nolint:errcheck
 	defer sub.Unsubscribe()
 
+	controlChan := make(chan *natsio.Msg, channelSize)
+	subControl, err := h.nats.ChanSubscribe(session.ControlSubject(tenantID), controlChan)
+	if err != nil {
+		l.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "failed to establish internal device session",
+		})
+		return
+	}
+	//nolint:errcheck
+	defer subControl.Unsubscribe()
+
+	inputChan := make(chan *natsio.Msg, channelSize)
+	subInput, err := h.nats.ChanSubscribe(session.InputSubject(tenantID), inputChan)
+	if err != nil {
+		l.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "failed to establish internal device session",
+		})
+		return
+	}
+	//nolint:errcheck
+	defer subInput.Unsubscribe()
+
+	var resumeChan chan *natsio.Msg
+	if session.ResumeToken != "" {
+		resumeChan = make(chan *natsio.Msg, channelSize)
+		subResume, err := h.nats.ChanSubscribe(session.ResumeSubject(tenantID), resumeChan)
+		if err != nil {
+			l.Error(err)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": "failed to establish internal device session",
+			})
+			return
+		}
+		//nolint:errcheck
+		defer subResume.Unsubscribe()
+	}
+
 	// upgrade get request to websocket protocol
 	conn, err := wsUpgrader.Upgrade(c.Writer, c.Request, nil)
 	if err != nil {
@@ -211,10 +347,210 @@ func (h ManagementController) Connect(c *gin.Context) {
 		// upgrader.Upgrade has already responded
 		return
 	}
-	conn.SetReadLimit(int64(app.MessageSizeLimit))
+	conn.SetReadLimit(int64(newSessionLimits(session).message))
 
 	//nolint:errcheck
-	h.ConnectServeWS(ctx, conn, session, deviceChan)
+	h.ConnectServeWS(ctx, conn, session, deviceChan, controlChan, inputChan, resumeChan)
+
+	// signal the observers that the session has ended
+	err = h.publishSessionClose(session, ErrMsgSessionClosed)
+	if err != nil {
+		l.Warnf("failed to notify the session observers: %s", err.Error())
+	}
+}
+
+// SearchSessions searches the session recordings for a text, returning the
+// sessions with the matching lines and their offsets in the recordings.
+func (h ManagementController) SearchSessions(c *gin.Context) {
+	ctx := c.Request.Context()
+	l := log.FromContext(ctx)
+
+	idata := identity.FromContext(ctx)
+	if idata == nil || !idata.IsUser {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": ErrMissingUserAuthentication.Error(),
+		})
+		return
+	}
+
+	page, perPage, err := rest.ParsePagingParameters(c.Request)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	filter := model.SearchFilter{
+		Query:    c.Query(paramSearchQuery),
+		DeviceID: c.Query(paramSessionsDeviceID),
+		UserID:   c.Query(paramSessionsUserID),
+		Skip:     (page - 1) * perPage,
+		Limit:    perPage,
+	}
+	for param, ts := range map[string]**time.Time{
+		paramSearchFrom: &filter.From,
+		paramSearchTo:   &filter.To,
+	} {
+		value := c.Query(param)
+		if value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": errors.Wrapf(err,
+					"invalid %s parameter", param).Error(),
+			})
+			return
+		}
+		*ts = &t
+	}
+
+	results, err := h.app.SearchRecordings(ctx, filter)
+	if _, ok := errors.Cause(err).(validation.Errors); ok {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	} else if err != nil {
+		l.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, results)
+}
+
+// TerminateSession forcefully terminates an active session: the session is
+// released, the device is requested to stop the session and the handler
+// serving the user's websocket, on any instance, is signaled to close it.
+func (h ManagementController) TerminateSession(c *gin.Context) {
+	ctx := c.Request.Context()
+	l := log.FromContext(ctx)
+
+	idata := identity.FromContext(ctx)
+	if idata == nil || !idata.IsUser {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": ErrMissingUserAuthentication.Error(),
+		})
+		return
+	}
+	sessionID := c.Param("sessionId")
+
+	session, err := h.app.GetSession(ctx, sessionID)
+	if err == app.ErrSessionNotFound {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": err.Error(),
+		})
+		return
+	} else if err != nil {
+		l.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	err = h.app.TerminateUserSession(ctx, session, idata.Subject)
+	if err == app.ErrSessionNotFound {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": err.Error(),
+		})
+		return
+	} else if err != nil {
+		l.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	err = h.publishSessionTermination(session)
+	if err != nil {
+		l.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// publishSessionTermination requests the device to stop the protocols
+// running in the session and signals the session handlers to close
+// the user's websocket.
+func (h ManagementController) publishSessionTermination(session *model.Session) error {
+	err := h.publishSessionStop(session, session.Types, ErrMsgSessionTerminated)
+	if err != nil {
+		return err
+	}
+	return h.publishSessionClose(session, ErrMsgSessionTerminated)
+}
+
+// publishSessionStop requests the device to stop the given protocols
+// running in the session, reporting the reason.
+func (h ManagementController) publishSessionStop(
+	session *model.Session,
+	sessionTypes []string,
+	reason string,
+) error {
+	deviceSubject := model.GetDeviceSubject(session.TenantID, session.DeviceID)
+	for _, sessionType := range sessionTypes {
+		var msg ws.ProtoMsg
+		switch sessionType {
+		case model.SessionTypeTerminal:
+			msg.Header = ws.ProtoHdr{
+				Proto:   ws.ProtoTypeShell,
+				MsgType: shell.MessageTypeStopShell,
+				Properties: map[string]interface{}{
+					"status":       shell.ErrorMessage,
+					PropertyUserID: session.UserID,
+				},
+			}
+		case model.SessionTypePortForward:
+			msg.Header = ws.ProtoHdr{
+				Proto:   ws.ProtoTypePortForward,
+				MsgType: portforward.MessageTypePortForwardStop,
+				Properties: map[string]interface{}{
+					PropertyUserID: session.UserID,
+				},
+			}
+		default:
+			continue
+		}
+		msg.Header.SessionID = session.ID
+		msg.Body = []byte(reason)
+		data, _ := msgpack.Marshal(msg)
+		err := h.nats.Publish(deviceSubject, data)
+		if err != nil {
+			return errors.Wrap(err, "failed to publish stop message to the device")
+		}
+	}
+	return nil
+}
+
+// publishSessionClose signals the handlers serving the session websockets
+// to close them with the given reason.
+func (h ManagementController) publishSessionClose(
+	session *model.Session,
+	reason string,
+) error {
+	msg := ws.ProtoMsg{
+		Header: ws.ProtoHdr{
+			Proto:     ws.ProtoTypeControl,
+			MsgType:   ws.MessageTypeClose,
+			SessionID: session.ID,
+		},
+		Body: []byte(reason),
+	}
+	data, _ := msgpack.Marshal(msg)
+	err := h.nats.Publish(session.ControlSubject(session.TenantID), data)
+	if err != nil {
+		return errors.Wrap(err, "failed to publish the session close message")
+	}
+	return nil
 }
 
 func (h ManagementController) Playback(c *gin.Context) {
@@ -238,13 +574,40 @@ func (h ManagementController) Playback(c *gin.Context) {
 		StartTS:            time.Now(),
 		BytesRecordedMutex: &sync.Mutex{},
 	}
-	sleepInterval := c.Param(PlaybackSleepIntervalMsField)
-	sleepMilliseconds := uint(app.DefaultPlaybackSleepIntervalMs)
-	if len(sleepInterval) > 1 {
-		n, err := strconv.ParseUint(sleepInterval, 10, 32)
+	var options app.PlaybackOptions
+	if value := c.Query(PlaybackSleepIntervalMsField); value != "" {
+		n, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": errors.Wrapf(err,
+					"invalid %s parameter", PlaybackSleepIntervalMsField).Error(),
+			})
+			return
+		}
+		sleepMilliseconds := uint(n)
+		options.SleepMs = &sleepMilliseconds
+	}
+	if value := c.Query(PlaybackMaxIdleMsField); value != "" {
+		n, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": errors.Wrapf(err,
+					"invalid %s parameter", PlaybackMaxIdleMsField).Error(),
+			})
+			return
+		}
+		options.MaxIdleMs = uint(n)
+	}
+	if value := c.Query(PlaybackOffsetField); value != "" {
+		n, err := strconv.ParseUint(value, 10, 31)
 		if err != nil {
-			sleepMilliseconds = uint(n)
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": errors.Wrapf(err,
+					"invalid %s parameter", PlaybackOffsetField).Error(),
+			})
+			return
 		}
+		options.Offset = int(n)
 	}
 
 	l.Infof("Playing back the session session_id=%s", sessionID)
@@ -258,6 +621,10 @@ func (h ManagementController) Playback(c *gin.Context) {
 	}
 	conn.SetReadLimit(int64(app.MessageSizeLimit))
 
+	// the playback stops when the client disconnects
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
 	deviceChan := make(chan *natsio.Msg, channelSize)
 	errChan := make(chan error, 1)
 
@@ -266,25 +633,217 @@ func (h ManagementController) Playback(c *gin.Context) {
 		conn,
 		session,
 		deviceChan,
+		nil,
+		nil,
 		errChan,
 		bufio.NewWriterSize(ioutil.Discard, app.RecorderBufferSize),
-		bufio.NewWriterSize(ioutil.Discard, app.RecorderBufferSize))
+		newSyncWriter(ioutil.Discard, app.RecorderBufferSize),
+		nil,
+		nil,
+		nil,
+		nil)
 
+	playback := app.NewPlayback(ctx, sessionID, deviceChan, options)
 	go func() {
-		err = h.app.GetSessionRecording(ctx,
-			sessionID,
-			app.NewPlayback(sessionID, deviceChan, sleepMilliseconds))
+		err := playback.Play(func(w io.Writer) error {
+			return h.app.GetSessionRecording(ctx, sessionID, w)
+		})
 		if err != nil {
 			err = errors.Wrap(err, "unable to get the session.")
 			errChan <- err
 			return
 		}
 	}()
-	// We need to keep reading in order to keep ping/pong handlers functioning.
-	for ; err == nil; _, _, err = conn.NextReader() {
+	// We need to keep reading in order to keep ping/pong handlers functioning,
+	// and to receive the playback control messages.
+	var data []byte
+	for ; err == nil; _, data, err = conn.ReadMessage() {
+		if len(data) == 0 {
+			continue
+		}
+		var msg ws.ProtoMsg
+		if err = msgpack.Unmarshal(data, &msg); err != nil {
+			l.Warnf("invalid playback control message: %s", err)
+			err = nil
+			continue
+		}
+		ctl, e := model.ParsePlaybackControl(&msg)
+		if e != nil {
+			l.Warnf("invalid playback control message: %s", e)
+			continue
+		}
+		err = playback.Control(ctl)
+	}
+}
+
+// recordingExporter converts the messages of a session recording to a file
+type recordingExporter interface {
+	io.Writer
+	Close() error
+	Empty() bool
+}
+
+// ExportRecording returns the recording of a session as a file in the
+// requested format, for replaying the session offline.
+func (h ManagementController) ExportRecording(c *gin.Context) {
+	format := c.DefaultQuery(RecordingFormatField, RecordingFormatAsciicast)
+	if format != RecordingFormatAsciicast {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": errors.Wrapf(ErrRecordingFormat, "%q", format).Error(),
+		})
+		return
+	}
+	sessionID := c.Param(PlaybackSessionIDField)
+	h.exportRecording(c, func(w io.Writer) recordingExporter {
+		return app.NewAsciicastWriter(w, "session "+sessionID)
+	}, app.AsciicastContentType, sessionID+".cast")
+}
+
+// Transcript returns the readable transcript of a session recording, as
+// plain text or as JSON lines with timestamps.
+func (h ManagementController) Transcript(c *gin.Context) {
+	format := c.DefaultQuery(RecordingFormatField, app.TranscriptFormatText)
+	var contentType, ext string
+	switch format {
+	case app.TranscriptFormatText:
+		contentType, ext = app.TranscriptTextContentType, ".txt"
+	case app.TranscriptFormatJSONLines:
+		contentType, ext = app.TranscriptJSONLinesContentType, ".jsonl"
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": errors.Wrapf(ErrRecordingFormat, "%q", format).Error(),
+		})
+		return
+	}
+	sessionID := c.Param(PlaybackSessionIDField)
+	h.exportRecording(c, func(w io.Writer) recordingExporter {
+		return app.NewTranscriptWriter(w, format)
+	}, contentType, sessionID+ext)
+}
+
+// attachmentWriter streams the output of a recording exporter as an
+// attachment: the response headers are sent on the first write following
+// the first event of the exporter, the writes preceding it (e.g. the
+// asciicast header) are held back, so that an empty recording is still
+// answered with 404.
+type attachmentWriter struct {
+	c           *gin.Context
+	exporter    recordingExporter
+	contentType string
+	filename    string
+
+	held    bytes.Buffer
+	started bool
+}
+
+func (w *attachmentWriter) Write(p []byte) (int, error) {
+	if !w.started {
+		if w.exporter.Empty() {
+			return w.held.Write(p)
+		}
+		if err := w.start(); err != nil {
+			return 0, err
+		}
+	}
+	return w.c.Writer.Write(p)
+}
+
+func (w *attachmentWriter) start() error {
+	w.started = true
+	w.c.Header("Content-Disposition",
+		fmt.Sprintf("attachment; filename=\"%s\"", w.filename))
+	w.c.Header("Content-Type", w.contentType)
+	w.c.Status(http.StatusOK)
+	_, err := w.held.WriteTo(w.c.Writer)
+	return err
+}
+
+// exportRecording converts the session recording with the exporter and
+// streams the result as an attachment; the recordings have no upper bound,
+// the response is answered with an error status only when nothing was
+// sent yet.
+func (h ManagementController) exportRecording(
+	c *gin.Context,
+	newExporter func(w io.Writer) recordingExporter,
+	contentType string,
+	filename string,
+) {
+	ctx := c.Request.Context()
+	l := log.FromContext(ctx)
+
+	idata := identity.FromContext(ctx)
+	if idata == nil || !idata.IsUser {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": ErrMissingUserAuthentication.Error(),
+		})
+		return
+	}
+
+	out := &attachmentWriter{
+		c:           c,
+		contentType: contentType,
+		filename:    filename,
+	}
+	out.exporter = newExporter(out)
+
+	sessionID := c.Param(PlaybackSessionIDField)
+	err := h.app.GetSessionRecording(ctx, sessionID, out.exporter)
+	if err == nil {
+		err = out.exporter.Close()
+	}
+	if err == nil && !out.started && !out.exporter.Empty() {
+		// the closing writes were held back with the first event
+		err = out.start()
+	}
+	if err != nil {
+		err = errors.Wrap(err, "failed to export the session recording")
+		l.Error(err)
+		if !out.started {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": err.Error(),
+			})
+		}
+		// otherwise the response is under way: the client gets a
+		// truncated attachment
+	} else if !out.started {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": ErrRecordingNotFound.Error(),
+		})
 	}
 }
 
+// VerifyRecording verifies the integrity of a session recording: the hash
+// chains of the recorded chunks and the signature of the recording.
+func (h ManagementController) VerifyRecording(c *gin.Context) {
+	ctx := c.Request.Context()
+	l := log.FromContext(ctx)
+
+	idata := identity.FromContext(ctx)
+	if idata == nil || !idata.IsUser {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": ErrMissingUserAuthentication.Error(),
+		})
+		return
+	}
+
+	sessionID := c.Param(PlaybackSessionIDField)
+	verification, err := h.app.VerifySessionRecording(ctx, sessionID)
+	if err == app.ErrRecordingNotFound {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": ErrRecordingNotFound.Error(),
+		})
+		return
+	} else if err != nil {
+		err = errors.Wrap(err, "failed to verify the session recording")
+		l.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, verification)
+}
+
 func websocketPing(conn *websocket.Conn) bool {
 	pongWaitString := strconv.Itoa(int(pongWait.Seconds()))
 	if err := conn.WriteControl(
@@ -325,19 +884,36 @@ func writerFinalizer(conn *websocket.Conn, e *error, l *log.Logger) {
 
 // websocketWriter is the go-routine responsible for the writing end of the
 // websocket. The routine forwards messages posted on the NATS session subject
-// and periodically pings the connection. If the connection times out or a
-// protocol violation occurs, the routine closes the connection.
+// and periodically pings the connection. If the connection times out, a
+// protocol violation occurs or the session is terminated through the session
+// control subject, the routine closes the connection.
+// The routine also arbitrates the input of the session participants posted
+// on the NATS session input subject: only the input from the users granted
+// write access through the session control subject reaches the device.
+// If the session policy sets an idle timeout, the routine warns the user
+// when the session is about to time out and, once it does, stops the
+// session on the device and closes the connection. The same happens,
+// without warning, when the session reaches its maximum duration.
 func (h ManagementController) websocketWriter(
 	ctx context.Context,
 	conn *websocket.Conn,
 	session *model.Session,
 	deviceChan <-chan *natsio.Msg,
+	controlChan <-chan *natsio.Msg,
+	inputChan <-chan *natsio.Msg,
 	errChan <-chan error,
 	recorderBuffered *bufio.Writer,
-	controlRecorderBuffered *bufio.Writer,
+	controlRecorderBuffered *syncWriter,
+	attribution *inputAttribution,
+	input *inputRecording,
+	activity *sessionActivity,
+	out *sessionOutput,
 ) (err error) {
 	l := log.FromContext(ctx)
 	defer writerFinalizer(conn, &err, l)
+	if out == nil {
+		out = newSessionOutput(conn, session, h.nats)
+	}
 
 	// handle the ping-pong connection health check
 	err = conn.SetReadDeadline(time.Now().Add(pongWait))
@@ -371,10 +947,42 @@ func (h ManagementController) websocketWriter(
 	recordedBytes := 0
 	controlBytes := 0
 
+	limits := newSessionLimits(session)
 	sessOverLimit := false
 	sessOverLimitHandled := false
+	recordingStopped := false
 
-	lastKeystrokeAt := time.Now().UTC().UnixNano()
+	writers := make(map[string]bool, len(session.Writers))
+	for _, userID := range session.Writers {
+		writers[userID] = true
+	}
+
+	var (
+		idleTicker  <-chan time.Time
+		idleTimeout time.Duration
+		idleWarnAt  time.Duration
+		idleWarned  bool
+	)
+	if activity != nil && session.Policy != nil && session.Policy.IdleTimeout > 0 {
+		idleTimeout = session.Policy.IdleTimeout
+		idleWarnAt = idleTimeout - session.Policy.IdleWarning
+		if session.Policy.IdleWarning <= 0 {
+			idleWarnAt = idleTimeout
+		} else if idleWarnAt <= 0 {
+			idleWarnAt = idleTimeout / 2
+		}
+		t := time.NewTicker(idleCheckPeriod)
+		defer t.Stop()
+		idleTicker = t.C
+	}
+	var expireTimer <-chan time.Time
+	if activity != nil && session.Policy != nil && session.Policy.MaxDuration > 0 {
+		t := time.NewTimer(time.Until(session.StartTS.Add(session.Policy.MaxDuration)))
+		defer t.Stop()
+		expireTimer = t.C
+	}
+
+	var lastTimestampMs int64
 Loop:
 	for {
 		var forwardedMsg []byte
@@ -388,13 +996,50 @@ Loop:
 			}
 
 			forwardedMsg = msg.Data
+			if mr.Header.Proto != ws.ProtoTypeControl {
+				activity.Touch()
+			} else if mr.Header.MsgType == ws.MessageTypeClose && activity != nil {
+				// the device closed the session, e.g. disconnecting
+				reason := string(mr.Body)
+				if reason == "" {
+					reason = ErrMsgSessionDevice
+				}
+				l.Infof("session_id=%s closed by the device: %s",
+					session.ID, reason)
+				err = h.app.SetSessionEndReason(ctx, session.ID,
+					model.SessionEndReasonDeviceClosed)
+				if err != nil {
+					l.Warnf("failed to record the session end reason: %s",
+						err.Error())
+				}
+				out.Close(msg.Data, websocket.CloseGoingAway, reason)
+				err = nil
+				break Loop
+			}
 
 			if mr.Header.Proto == ws.ProtoTypeShell {
 				switch mr.Header.MsgType {
 				case shell.MessageTypeShellCommand:
 
-					if recordedBytes >= app.MessageSizeLimit ||
-						controlBytes >= app.MessageSizeLimit {
+					if recordingStopped {
+						break
+					} else if limits.stopRecording &&
+						(recordedBytes >= limits.recording ||
+							controlBytes >= limits.control) {
+						recordingStopped = true
+						l.Infof("session_id=%s recording limit reached, "+
+							"recording stopped", session.ID)
+						recorderBuffered.Flush()
+						controlRecorderBuffered.Flush()
+
+						errMsg, _ := prepLimitErrUser(ctx, session, ErrMsgRecordingLimit)
+						err = out.Write(errMsg)
+						if err != nil {
+							l.Error(err)
+							break Loop
+						}
+					} else if recordedBytes >= limits.recording ||
+						controlBytes >= limits.control {
 						sessOverLimit = true
 
 						errMsg := h.handleSessLimit(ctx,
@@ -412,8 +1057,7 @@ Loop:
 							recorderBuffered,
 							controlRecorderBuffered,
 							&recordedBytes,
-							&controlBytes,
-							&lastKeystrokeAt,
+							&lastTimestampMs,
 							session,
 						); err != nil {
 							return err
@@ -428,16 +1072,96 @@ Loop:
 			}
 
 			if !sessOverLimit {
-				err = conn.WriteMessage(websocket.BinaryMessage, forwardedMsg)
+				err = out.Write(forwardedMsg)
 				if err != nil {
 					l.Error(err)
 					break Loop
 				}
 			}
+		case msg := <-inputChan:
+			mr := &ws.ProtoMsg{}
+			err = msgpack.Unmarshal(msg.Data, mr)
+			if err != nil {
+				return err
+			}
+			userID, _ := mr.Header.Properties[PropertyUserID].(string)
+			if !writers[userID] {
+				l.Warnf("dropping input from user %s without write access "+
+					"to the session", userID)
+				continue
+			}
+			if !recordingStopped && controlBytes < limits.control {
+				controlBytes += attribution.Record(userID)
+			}
+			if mr.Header.Proto == ws.ProtoTypeShell &&
+				mr.Header.MsgType == shell.MessageTypeShellCommand {
+				input.Record(userID, mr.Body)
+			}
+			activity.Input(model.SessionTypeTerminal)
+			err = h.nats.Publish(model.GetDeviceSubject(
+				session.TenantID, session.DeviceID),
+				msg.Data,
+			)
+			if err != nil {
+				return err
+			}
+		case msg := <-controlChan:
+			mr := &ws.ProtoMsg{}
+			err = msgpack.Unmarshal(msg.Data, mr)
+			if err != nil {
+				return err
+			}
+			if mr.Header.Proto != ws.ProtoTypeControl {
+				continue
+			}
+			userID, _ := mr.Header.Properties[PropertyUserID].(string)
+			switch mr.Header.MsgType {
+			case ws.MessageTypeClose:
+				out.Close(msg.Data, websocket.ClosePolicyViolation, string(mr.Body))
+				break Loop
+			case model.SessionControlGrantWrite:
+				writers[userID] = true
+			case model.SessionControlRevokeWrite:
+				delete(writers, userID)
+			case model.SessionControlResume:
+				relayID, _ := mr.Header.Properties[PropertyRelayID].(string)
+				if err := out.Resume(relayID); err != nil {
+					l.Errorf("failed to resume the session: %s", err.Error())
+				}
+			}
+		case <-idleTicker:
+			idle := activity.IdleFor()
+			if idle >= idleTimeout {
+				l.Infof("session_id=%s idle for %s, closing the session",
+					session.ID, idle)
+				h.handleSessEnd(ctx, out, session, activity,
+					model.SessionEndReasonIdle, ErrMsgSessionIdle,
+					websocket.CloseNormalClosure)
+				break Loop
+			} else if idle < idleWarnAt {
+				idleWarned = false
+			} else if !idleWarned {
+				idleWarned = true
+				if !activity.HasType(model.SessionTypeTerminal) {
+					continue
+				}
+				err = out.Write(prepIdleWarningUser(session, idleTimeout-idle))
+				if err != nil {
+					l.Error(err)
+					break Loop
+				}
+			}
+		case <-expireTimer:
+			l.Infof("session_id=%s reached the maximum duration, "+
+				"closing the session", session.ID)
+			h.handleSessEnd(ctx, out, session, activity,
+				model.SessionEndReasonMaxDuration, ErrMsgSessionExpired,
+				websocket.ClosePolicyViolation)
+			break Loop
 		case <-ctx.Done():
 			break Loop
 		case <-ticker.C:
-			if !websocketPing(conn) {
+			if !out.Ping() {
 				err = errors.New("connection timeout")
 				break Loop
 			}
@@ -448,6 +1172,17 @@ Loop:
 	return err
 }
 
+// closeSession forwards the close message to the user and closes the
+// websocket with the given status code and reason.
+func closeSession(conn *websocket.Conn, msg []byte, code int, reason string) {
+	_ = conn.WriteMessage(websocket.BinaryMessage, msg)
+	_ = conn.WriteControl(
+		websocket.CloseMessage,
+		websocket.FormatCloseMessage(code, reason),
+		time.Now().Add(writeWait),
+	)
+}
+
 func (h ManagementController) handleSessLimit(ctx context.Context,
 	session *model.Session,
 	handled *bool,
@@ -460,7 +1195,7 @@ func (h ManagementController) handleSessLimit(ctx context.Context,
 	// attempt to clean up once
 	if !(*handled) {
 		sendLimitErrDevice(ctx, session, h.nats)
-		userErrMsg, err := prepLimitErrUser(ctx, session)
+		userErrMsg, err := prepLimitErrUser(ctx, session, ErrMsgSessionLimit)
 		if err != nil {
 			l.Errorf("session limit: " +
 				"failed to notify user")
@@ -468,6 +1203,10 @@ func (h ManagementController) handleSessLimit(ctx context.Context,
 
 		retMsg = userErrMsg
 
+		err = h.app.SetSessionEndReason(ctx, session.ID, model.SessionEndReasonByteLimit)
+		if err != nil {
+			l.Warnf("failed to record the session end reason: %s", err.Error())
+		}
 		err = h.app.FreeUserSession(ctx, session.ID, session.Types)
 		if err != nil {
 			l.Warnf("failed to free session"+
@@ -480,47 +1219,326 @@ func (h ManagementController) handleSessLimit(ctx context.Context,
 	return retMsg
 }
 
+// handleSessEnd records the end reason of the session, stops the session
+// on the device and closes the user's websocket with the reason; the
+// session is released by the handler once the websocket is closed.
+func (h ManagementController) handleSessEnd(
+	ctx context.Context,
+	out *sessionOutput,
+	session *model.Session,
+	activity *sessionActivity,
+	endReason string,
+	reason string,
+	code int,
+) {
+	l := log.FromContext(ctx)
+
+	err := h.app.SetSessionEndReason(ctx, session.ID, endReason)
+	if err != nil {
+		l.Warnf("failed to record the session end reason: %s", err.Error())
+	}
+
+	sessionTypes := activity.Types()
+	err = h.publishSessionStop(session, sessionTypes, reason)
+	if err != nil {
+		l.Warnf("failed to stop the session: %s", err.Error())
+	}
+
+	msg := ws.ProtoMsg{
+		Header: ws.ProtoHdr{
+			Proto:     ws.ProtoTypeControl,
+			MsgType:   ws.MessageTypeClose,
+			SessionID: session.ID,
+		},
+		Body: []byte(reason),
+	}
+	if activity.HasType(model.SessionTypeTerminal) {
+		msg.Header = ws.ProtoHdr{
+			Proto:     ws.ProtoTypeShell,
+			MsgType:   shell.MessageTypeStopShell,
+			SessionID: session.ID,
+			Properties: map[string]interface{}{
+				"status": shell.ErrorMessage,
+			},
+		}
+	}
+	data, _ := msgpack.Marshal(msg)
+	out.Close(data, code, reason)
+}
+
+// prepIdleWarningUser preps the warning for the user about the session
+// closing due to inactivity
+func prepIdleWarningUser(session *model.Session, remaining time.Duration) []byte {
+	msg := ws.ProtoMsg{
+		Header: ws.ProtoHdr{
+			Proto:     ws.ProtoTypeShell,
+			MsgType:   shell.MessageTypeShellCommand,
+			SessionID: session.ID,
+			Properties: map[string]interface{}{
+				"status": shell.ErrorMessage,
+			},
+		},
+		Body: []byte(fmt.Sprintf(
+			"the session will be closed in %s due to inactivity",
+			remaining.Round(time.Second),
+		)),
+	}
+	data, _ := msgpack.Marshal(msg)
+	return data
+}
+
+// sessionActivity tracks the last user input and device output of a
+// session, as well as the protocols the user interacted with.
+type sessionActivity struct {
+	mutex sync.Mutex
+	last  time.Time
+	types []string
+}
+
+func newSessionActivity() *sessionActivity {
+	return &sessionActivity{
+		last: time.Now(),
+	}
+}
+
+// Touch marks the session as active
+func (a *sessionActivity) Touch() {
+	if a == nil {
+		return
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.last = time.Now()
+}
+
+// Input marks the session as active on user input for the session type
+func (a *sessionActivity) Input(sessionType string) {
+	if a == nil {
+		return
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.last = time.Now()
+	for _, t := range a.types {
+		if t == sessionType {
+			return
+		}
+	}
+	a.types = append(a.types, sessionType)
+}
+
+// IdleFor returns for how long the session has been inactive
+func (a *sessionActivity) IdleFor() time.Duration {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return time.Since(a.last)
+}
+
+// Types returns the session types the user interacted with
+func (a *sessionActivity) Types() []string {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return append([]string{}, a.types...)
+}
+
+// HasType returns true if the user interacted with the session type
+func (a *sessionActivity) HasType(sessionType string) bool {
+	for _, t := range a.Types() {
+		if t == sessionType {
+			return true
+		}
+	}
+	return false
+}
+
+// sessionLimits are the byte limits enforced on a session
+type sessionLimits struct {
+	recording     int
+	control       int
+	message       int
+	input         int
+	stopRecording bool
+}
+
+// newSessionLimits returns the byte limits of the session policy, falling
+// back to app.MessageSizeLimit for the limits the policy does not set.
+func newSessionLimits(session *model.Session) sessionLimits {
+	limits := sessionLimits{
+		recording: app.MessageSizeLimit,
+		control:   app.MessageSizeLimit,
+		message:   app.MessageSizeLimit,
+		input:     app.MessageSizeLimit,
+	}
+	policy := session.Policy
+	if policy == nil {
+		return limits
+	}
+	if policy.MaxRecordingBytes > 0 {
+		limits.recording = policy.MaxRecordingBytes
+	}
+	if policy.MaxControlBytes > 0 {
+		limits.control = policy.MaxControlBytes
+	}
+	if policy.MaxMessageBytes > 0 {
+		limits.message = policy.MaxMessageBytes
+	}
+	if policy.MaxInputBytes > 0 {
+		limits.input = policy.MaxInputBytes
+	}
+	limits.stopRecording = policy.LimitAction == model.SessionLimitActionStopRecording
+	return limits
+}
+
+// syncWriter serializes the writes to a buffered recorder shared by the
+// reading and the writing end of the websocket.
+type syncWriter struct {
+	mutex  sync.Mutex
+	writer *bufio.Writer
+}
+
+func newSyncWriter(w io.Writer, size int) *syncWriter {
+	return &syncWriter{
+		writer: bufio.NewWriterSize(w, size),
+	}
+}
+
+func (w *syncWriter) Write(b []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.writer.Write(b)
+}
+
+func (w *syncWriter) Flush() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.writer.Flush()
+}
+
+// inputAttribution records a control message whenever the user writing to
+// the terminal changes, so that the session recording attributes the input
+// to the participants of the session.
+type inputAttribution struct {
+	mutex    sync.Mutex
+	session  *model.Session
+	userID   string
+	recorder io.Writer
+}
+
+func newInputAttribution(session *model.Session, recorder io.Writer) *inputAttribution {
+	return &inputAttribution{
+		session:  session,
+		userID:   session.UserID,
+		recorder: recorder,
+	}
+}
+
+// Record marks the user as the origin of the subsequent input and returns
+// the number of control bytes recorded.
+func (a *inputAttribution) Record(userID string) int {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if userID == a.userID {
+		return 0
+	}
+	a.userID = userID
+
+	a.session.BytesRecordedMutex.Lock()
+	controlMsg := app.Control{
+		Type:   app.UserMessage,
+		Offset: a.session.BytesRecorded,
+		UserID: userID,
+	}
+	a.session.BytesRecordedMutex.Unlock()
+
+	n, _ := a.recorder.Write(controlMsg.MarshalBinary())
+	return n
+}
+
+// inputRecording records the terminal input of the users in the input
+// recording stream of the session, up to the input limit of the session
+// policy. A nil inputRecording records nothing, e.g. when the policy does
+// not enable recording the input.
+type inputRecording struct {
+	mutex    sync.Mutex
+	session  *model.Session
+	recorder io.Writer
+	bytes    int
+	limit    int
+}
+
+func newInputRecording(session *model.Session, recorder io.Writer) *inputRecording {
+	return &inputRecording{
+		session:  session,
+		recorder: recorder,
+		limit:    newSessionLimits(session).input,
+	}
+}
+
+// Record records the input typed by the user and returns the number of
+// input bytes recorded.
+func (r *inputRecording) Record(userID string, data []byte) int {
+	if r == nil || len(data) == 0 {
+		return 0
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.bytes >= r.limit {
+		return 0
+	}
+
+	r.session.BytesRecordedMutex.Lock()
+	inputMsg := app.Control{
+		Type:      app.InputMessage,
+		Offset:    r.session.BytesRecorded,
+		Timestamp: time.Now().UTC(),
+		UserID:    userID,
+		Data:      data,
+	}
+	r.session.BytesRecordedMutex.Unlock()
+
+	n, _ := r.recorder.Write(inputMsg.MarshalBinary())
+	r.bytes += n
+	return n
+}
+
+// recordSession records the terminal output, preceded by the timestamp
+// control message of the output unless recorded in the same millisecond as
+// the previous output. The timestamps do not count against the control
+// limit of the session: they follow the recorded output, which is limited.
 func recordSession(ctx context.Context,
 	msg *ws.ProtoMsg,
 	recorder io.Writer,
 	recorderCtrl io.Writer,
 	recBytes *int,
-	ctrlBytes *int,
-	lastKeystrokeAt *int64,
+	lastTimestampMs *int64,
 	session *model.Session) error {
 	l := log.FromContext(ctx)
 
+	now := time.Now().UTC()
+	if now.UnixMilli() != *lastTimestampMs {
+		controlMsg := app.Control{
+			Type:      app.TimestampMessage,
+			Offset:    *recBytes,
+			Timestamp: now,
+		}
+		_, _ = recorderCtrl.Write(
+			controlMsg.MarshalBinary())
+		(*lastTimestampMs) = now.UnixMilli()
+	}
+
 	b, e := recorder.Write(msg.Body)
 	if e != nil {
 		l.Errorf("session logging: "+
 			"recorderBuffered.Write"+
 			"(len=%d)=%d,%+v",
 			len(msg.Body), b, e)
-	}
-	timeNowUTC := time.Now().UTC().UnixNano()
-	keystrokeDelay := timeNowUTC - (*lastKeystrokeAt)
-	if keystrokeDelay >= keyStrokeDelayRecordingThresholdNs {
-		if keystrokeDelay > keyStrokeMaxDelayRecording {
-			keystrokeDelay = keyStrokeMaxDelayRecording
+		if errors.Is(e, app.ErrRecordingFailed) {
+			// the failure policy of the recordings terminates
+			// the sessions which cannot be recorded
+			return e
 		}
-
-		controlMsg := app.Control{
-			Type:   app.DelayMessage,
-			Offset: *recBytes,
-			DelayMs: uint16(float64(keystrokeDelay) *
-				0.000001),
-			TerminalHeight: 0,
-			TerminalWidth:  0,
-		}
-		n, _ := recorderCtrl.Write(
-			controlMsg.MarshalBinary())
-		l.Debugf("saving control delay message: %+v/%d",
-			controlMsg, n)
-		(*ctrlBytes) += n
 	}
 
-	(*lastKeystrokeAt) = timeNowUTC
-
 	(*recBytes) += len(msg.Body)
 	session.BytesRecordedMutex.Lock()
 	session.BytesRecorded = *recBytes
@@ -530,7 +1548,11 @@ func recordSession(ctx context.Context,
 }
 
 // prepLimitErrUser preps a session limit exceeded error for the user (shell cmd + err status)
-func prepLimitErrUser(ctx context.Context, session *model.Session) ([]byte, error) {
+func prepLimitErrUser(
+	ctx context.Context,
+	session *model.Session,
+	errMsg string,
+) ([]byte, error) {
 	userErrMsg := ws.ProtoMsg{
 		Header: ws.ProtoHdr{
 			Proto:     ws.ProtoTypeShell,
@@ -540,7 +1562,7 @@ func prepLimitErrUser(ctx context.Context, session *model.Session) ([]byte, erro
 				"status": shell.ErrorMessage,
 			},
 		},
-		Body: []byte(ErrMsgSessionLimit),
+		Body: []byte(errMsg),
 	}
 
 	return msgpack.Marshal(userErrMsg)
@@ -592,17 +1614,52 @@ func sendLimitErrDevice(ctx context.Context, session *model.Session, nats nats.C
 
 // ConnectServeWS starts a websocket connection with the device
 // Currently this handler only properly handles a single terminal session.
+// If the session policy allows resuming the session, the user is sent
+// the resume token and the remote terminal survives the user's connection
+// dropping for the grace period of the policy; the messages of the user
+// resuming the session are posted on the session resume subject
+// (resumeChan).
 func (h ManagementController) ConnectServeWS(
 	ctx context.Context,
 	conn *websocket.Conn,
 	sess *model.Session,
 	deviceChan chan *natsio.Msg,
+	controlChan chan *natsio.Msg,
+	inputChan chan *natsio.Msg,
+	resumeChan chan *natsio.Msg,
 ) (err error) {
 	l := log.FromContext(ctx)
 	id := identity.FromContext(ctx)
 	errChan := make(chan error, 1)
 	remoteTerminalRunning := false
 
+	// the policy of the tenant may disable recording the sessions: the
+	// session is then recorded to nowhere
+	recording := sess.Policy == nil || !sess.Policy.DisableRecording
+	var controlRecorder, sessionRecorder io.Writer = ioutil.Discard, ioutil.Discard
+	if recording {
+		controlRecorder = h.app.GetControlRecorder(ctx, sess.ID)
+	}
+	controlRecorderBuffered := newSyncWriter(controlRecorder, app.RecorderBufferSize)
+	attribution := newInputAttribution(sess, controlRecorderBuffered)
+	var (
+		input                 *inputRecording
+		inputRecorder         io.Writer
+		inputRecorderBuffered *syncWriter
+	)
+	if recording && sess.Policy != nil && sess.Policy.RecordInput {
+		inputRecorder = h.app.GetInputRecorder(ctx, sess.ID)
+		inputRecorderBuffered = newSyncWriter(inputRecorder, app.RecorderBufferSize)
+		input = newInputRecording(sess, inputRecorderBuffered)
+	}
+	activity := newSessionActivity()
+
+	if recording {
+		sessionRecorder = h.app.GetRecorder(ctx, sess.ID)
+	}
+	sessionRecorderBuffered := bufio.NewWriterSize(sessionRecorder, app.RecorderBufferSize)
+	writerDone := make(chan struct{})
+
 	defer func() {
 		if err != nil {
 			select {
@@ -639,37 +1696,99 @@ func (h ManagementController) ConnectServeWS(
 			}
 		}
 		close(errChan)
-	}()
 
-	controlRecorder := h.app.GetControlRecorder(ctx, sess.ID)
-	controlRecorderBuffered := bufio.NewWriterSize(controlRecorder, app.RecorderBufferSize)
-	defer controlRecorderBuffered.Flush()
+		// the writer stops on errChan closing: the recording is complete
+		// once the writer is done
+		<-writerDone
+		sessionRecorderBuffered.Flush()
+		controlRecorderBuffered.Flush()
+		closeRecorder(l, sess.ID, sessionRecorder)
+		closeRecorder(l, sess.ID, controlRecorder)
+		if inputRecorderBuffered != nil {
+			inputRecorderBuffered.Flush()
+			closeRecorder(l, sess.ID, inputRecorder)
+		}
+		if !recording {
+			return
+		}
+		heads := recordingHeads(sessionRecorder, controlRecorder, inputRecorder)
+		if err := h.app.SignSessionRecording(ctx, sess.ID, heads); err != nil {
+			l.Errorf("session_id=%s failed to sign the recording: %s",
+				sess.ID, err.Error())
+		}
+	}()
 
-	sessionRecorder := h.app.GetRecorder(ctx, sess.ID)
-	sessionRecorderBuffered := bufio.NewWriterSize(sessionRecorder, app.RecorderBufferSize)
-	defer sessionRecorderBuffered.Flush()
+	out := newSessionOutput(conn, sess, h.nats)
+	if out.resumable {
+		err = conn.WriteMessage(websocket.BinaryMessage, prepResumeToken(sess))
+		if err != nil {
+			close(writerDone)
+			return err
+		}
+	}
+	reader := &ownerReader{
+		conn:            conn,
+		out:             out,
+		resumeChan:      resumeChan,
+		writerDone:      writerDone,
+		logger:          l,
+		terminalRunning: &remoteTerminalRunning,
+	}
 
 	// websocketWriter is responsible for closing the websocket
-	//nolint:errcheck
-	go h.websocketWriter(ctx,
-		conn,
-		sess,
-		deviceChan,
-		errChan,
-		sessionRecorderBuffered,
-		controlRecorderBuffered)
+	go func() {
+		//nolint:errcheck
+		h.websocketWriter(ctx,
+			conn,
+			sess,
+			deviceChan,
+			controlChan,
+			inputChan,
+			errChan,
+			sessionRecorderBuffered,
+			controlRecorderBuffered,
+			attribution,
+			input,
+			activity,
+			out)
+		close(writerDone)
+	}()
+
+	return h.connectServeWSProcessMessages(ctx, reader, sess, deviceChan,
+		&remoteTerminalRunning, controlRecorderBuffered, attribution, input, activity)
+}
 
-	return h.connectServeWSProcessMessages(ctx, conn, sess, deviceChan,
-		&remoteTerminalRunning, controlRecorderBuffered)
+// closeRecorder ends the compressed stream of the recorder, if any
+func closeRecorder(l *log.Logger, sessionID string, recorder io.Writer) {
+	if c, ok := recorder.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			l.Warnf("session_id=%s failed to close the recording: %s",
+				sessionID, err.Error())
+		}
+	}
+}
+
+// recordingHeads returns the heads of the chains built by the recorders
+func recordingHeads(recorders ...io.Writer) []model.RecordingStreamHead {
+	heads := make([]model.RecordingStreamHead, 0, len(recorders))
+	for _, recorder := range recorders {
+		if r, ok := recorder.(app.StreamRecorder); ok {
+			heads = append(heads, r.Head())
+		}
+	}
+	return heads
 }
 
 func (h ManagementController) connectServeWSProcessMessages(
 	ctx context.Context,
-	conn *websocket.Conn,
+	reader *ownerReader,
 	sess *model.Session,
 	deviceChan chan *natsio.Msg,
 	remoteTerminalRunning *bool,
-	controlRecorderBuffered *bufio.Writer,
+	controlRecorderBuffered *syncWriter,
+	attribution *inputAttribution,
+	input *inputRecording,
+	activity *sessionActivity,
 ) (err error) {
 	l := log.FromContext(ctx)
 	id := identity.FromContext(ctx)
@@ -678,11 +1797,12 @@ func (h ManagementController) connectServeWSProcessMessages(
 
 	var data []byte
 	controlBytes := 0
+	controlLimit := newSessionLimits(sess).control
 	ignoreControlMessages := false
 	for {
-		_, data, err = conn.ReadMessage()
+		data, err = reader.ReadMessage()
 		if err != nil {
-			if _, ok := err.(*websocket.CloseError); ok {
+			if _, ok := err.(*websocket.CloseError); ok || err == io.EOF {
 				return nil
 			}
 			return err
@@ -710,17 +1830,23 @@ func (h ManagementController) connectServeWSProcessMessages(
 				sess.Types = append(sess.Types, model.SessionTypeTerminal)
 				logTerminal = true
 			}
+			activity.Input(model.SessionTypeTerminal)
 			// handle remote terminal-specific messages
 			switch m.Header.MsgType {
 			case shell.MessageTypeSpawnShell:
 				*remoteTerminalRunning = true
 			case shell.MessageTypeStopShell:
 				*remoteTerminalRunning = false
+			case shell.MessageTypeShellCommand:
+				if !ignoreControlMessages && controlBytes < controlLimit {
+					controlBytes += attribution.Record(sess.UserID)
+				}
+				input.Record(sess.UserID, m.Body)
 			case shell.MessageTypeResizeShell:
 				if ignoreControlMessages {
 					continue
 				}
-				if controlBytes >= app.MessageSizeLimit {
+				if controlBytes >= controlLimit {
 					l.Infof("session_id=%s control data limit reached.",
 						sess.ID)
 					//see https://northerntech.atlassian.net/browse/MEN-4448
@@ -739,6 +1865,7 @@ func (h ManagementController) connectServeWSProcessMessages(
 				sess.Types = append(sess.Types, model.SessionTypePortForward)
 				logPortForward = true
 			}
+			activity.Input(model.SessionTypePortForward)
 		}
 
 		err = h.nats.Publish(model.GetDeviceSubject(id.Tenant, sess.DeviceID), data)
@@ -750,30 +1877,18 @@ func (h ManagementController) connectServeWSProcessMessages(
 
 func sendResizeMessage(m *ws.ProtoMsg,
 	sess *model.Session,
-	controlRecorderBuffered *bufio.Writer) (n int) {
-	if _, ok := m.Header.Properties[model.ResizeMessageTermHeightField]; ok {
+	controlRecorderBuffered *syncWriter) (n int) {
+	height, ok := model.PropertyUint16(m.Header.Properties,
+		model.ResizeMessageTermHeightField)
+	if !ok {
 		return 0
 	}
-	if _, ok := m.Header.Properties[model.ResizeMessageTermWidthField]; ok {
+	width, ok := model.PropertyUint16(m.Header.Properties,
+		model.ResizeMessageTermWidthField)
+	if !ok {
 		return 0
 	}
 
-	var height uint16 = 0
-	switch m.Header.Properties[model.ResizeMessageTermHeightField].(type) {
-	case uint8:
-		height = uint16(m.Header.Properties[model.ResizeMessageTermHeightField].(uint8))
-	case int8:
-		height = uint16(m.Header.Properties[model.ResizeMessageTermHeightField].(int8))
-	}
-
-	var width uint16 = 0
-	switch m.Header.Properties[model.ResizeMessageTermWidthField].(type) {
-	case uint8:
-		width = uint16(m.Header.Properties[model.ResizeMessageTermWidthField].(uint8))
-	case int8:
-		width = uint16(m.Header.Properties[model.ResizeMessageTermWidthField].(int8))
-	}
-
 	sess.BytesRecordedMutex.Lock()
 	controlMsg := app.Control{
 		Type:           app.ResizeMessage,
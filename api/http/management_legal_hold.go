@@ -0,0 +1,141 @@
+// Copyright 2023 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package http
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+
+	"github.com/mendersoftware/go-lib-micro/identity"
+	"github.com/mendersoftware/go-lib-micro/log"
+
+	"github.com/mendersoftware/deviceconnect/app"
+	"github.com/mendersoftware/deviceconnect/model"
+)
+
+// GetLegalHold returns the legal hold of the recording of the session
+func (h ManagementController) GetLegalHold(c *gin.Context) {
+	ctx := c.Request.Context()
+	l := log.FromContext(ctx)
+
+	idata := identity.FromContext(ctx)
+	if idata == nil || !idata.IsUser {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": ErrMissingUserAuthentication.Error(),
+		})
+		return
+	}
+
+	hold, err := h.app.GetLegalHold(ctx, c.Param(PlaybackSessionIDField))
+	if err == app.ErrLegalHoldNotFound {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": err.Error(),
+		})
+		return
+	} else if err != nil {
+		err = errors.Wrap(err, "failed to get the legal hold")
+		l.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, hold)
+}
+
+// SetLegalHold places the recording of the session on legal hold: the
+// recording does not expire until the hold is released
+func (h ManagementController) SetLegalHold(c *gin.Context) {
+	ctx := c.Request.Context()
+	l := log.FromContext(ctx)
+
+	idata := identity.FromContext(ctx)
+	if idata == nil || !idata.IsUser {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": ErrMissingUserAuthentication.Error(),
+		})
+		return
+	}
+
+	var request model.LegalHoldRequest
+	rawData, err := c.GetRawData()
+	if err == nil && len(rawData) > 0 {
+		err = json.Unmarshal(rawData, &request)
+	}
+	if err == nil {
+		err = request.Validate()
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": errors.Wrap(err, "invalid payload").Error(),
+		})
+		return
+	}
+
+	sessionID := c.Param(PlaybackSessionIDField)
+	hold, err := h.app.SetLegalHold(ctx, sessionID, request.Reason)
+	if err == app.ErrRecordingNotFound {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": err.Error(),
+		})
+		return
+	} else if err != nil {
+		err = errors.Wrap(err, "failed to set the legal hold")
+		l.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	l.Infof("session_id=%s placed on legal hold by user_id=%s",
+		sessionID, idata.Subject)
+	c.JSON(http.StatusOK, hold)
+}
+
+// ReleaseLegalHold releases the legal hold of the recording of the session
+func (h ManagementController) ReleaseLegalHold(c *gin.Context) {
+	ctx := c.Request.Context()
+	l := log.FromContext(ctx)
+
+	idata := identity.FromContext(ctx)
+	if idata == nil || !idata.IsUser {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": ErrMissingUserAuthentication.Error(),
+		})
+		return
+	}
+
+	sessionID := c.Param(PlaybackSessionIDField)
+	err := h.app.ReleaseLegalHold(ctx, sessionID)
+	if err == app.ErrLegalHoldNotFound {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": err.Error(),
+		})
+		return
+	} else if err != nil {
+		err = errors.Wrap(err, "failed to release the legal hold")
+		l.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	l.Infof("session_id=%s released from legal hold by user_id=%s",
+		sessionID, idata.Subject)
+	c.Status(http.StatusNoContent)
+}
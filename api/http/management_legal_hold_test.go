@@ -0,0 +1,199 @@
+// Copyright 2023 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mendersoftware/go-lib-micro/identity"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/mendersoftware/deviceconnect/app"
+	app_mocks "github.com/mendersoftware/deviceconnect/app/mocks"
+	"github.com/mendersoftware/deviceconnect/model"
+)
+
+func TestManagementLegalHold(t *testing.T) {
+	const sessionID = "00000000-0000-0000-0000-000000000001"
+	userIdentity := &identity.Identity{
+		Subject: "00000000-0000-0000-0000-000000000000",
+		Tenant:  "000000000000000000000000",
+		IsUser:  true,
+	}
+	hold := &model.LegalHold{
+		SessionID: sessionID,
+		Reason:    "case 42",
+		UserID:    userIdentity.Subject,
+		CreatedTs: time.Date(2023, 5, 1, 0, 0, 0, 0, time.UTC),
+	}
+
+	testCases := []struct {
+		Name     string
+		Method   string
+		Body     string
+		Identity *identity.Identity
+
+		AppMethod string
+		AppArgs   []interface{}
+		AppReturn []interface{}
+
+		HTTPStatus int
+		LegalHold  *model.LegalHold
+	}{{
+		Name:     "ok, get",
+		Method:   http.MethodGet,
+		Identity: userIdentity,
+
+		AppMethod: "GetLegalHold",
+		AppArgs:   []interface{}{sessionID},
+		AppReturn: []interface{}{hold, nil},
+
+		HTTPStatus: http.StatusOK,
+		LegalHold:  hold,
+	}, {
+		Name:     "ko, get, not on hold",
+		Method:   http.MethodGet,
+		Identity: userIdentity,
+
+		AppMethod: "GetLegalHold",
+		AppArgs:   []interface{}{sessionID},
+		AppReturn: []interface{}{nil, app.ErrLegalHoldNotFound},
+
+		HTTPStatus: http.StatusNotFound,
+	}, {
+		Name:     "ok, set",
+		Method:   http.MethodPut,
+		Body:     `{"reason": "case 42"}`,
+		Identity: userIdentity,
+
+		AppMethod: "SetLegalHold",
+		AppArgs:   []interface{}{sessionID, "case 42"},
+		AppReturn: []interface{}{hold, nil},
+
+		HTTPStatus: http.StatusOK,
+		LegalHold:  hold,
+	}, {
+		Name:     "ok, set without reason",
+		Method:   http.MethodPut,
+		Identity: userIdentity,
+
+		AppMethod: "SetLegalHold",
+		AppArgs:   []interface{}{sessionID, ""},
+		AppReturn: []interface{}{hold, nil},
+
+		HTTPStatus: http.StatusOK,
+		LegalHold:  hold,
+	}, {
+		Name:     "ko, set, invalid payload",
+		Method:   http.MethodPut,
+		Body:     `{"reason": 42}`,
+		Identity: userIdentity,
+
+		HTTPStatus: http.StatusBadRequest,
+	}, {
+		Name:     "ko, set, recording not found",
+		Method:   http.MethodPut,
+		Body:     `{"reason": "case 42"}`,
+		Identity: userIdentity,
+
+		AppMethod: "SetLegalHold",
+		AppArgs:   []interface{}{sessionID, "case 42"},
+		AppReturn: []interface{}{nil, app.ErrRecordingNotFound},
+
+		HTTPStatus: http.StatusNotFound,
+	}, {
+		Name:     "ko, set, internal error",
+		Method:   http.MethodPut,
+		Body:     `{"reason": "case 42"}`,
+		Identity: userIdentity,
+
+		AppMethod: "SetLegalHold",
+		AppArgs:   []interface{}{sessionID, "case 42"},
+		AppReturn: []interface{}{nil, errors.New("internal error")},
+
+		HTTPStatus: http.StatusInternalServerError,
+	}, {
+		Name:     "ok, release",
+		Method:   http.MethodDelete,
+		Identity: userIdentity,
+
+		AppMethod: "ReleaseLegalHold",
+		AppArgs:   []interface{}{sessionID},
+		AppReturn: []interface{}{nil},
+
+		HTTPStatus: http.StatusNoContent,
+	}, {
+		Name:     "ko, release, not on hold",
+		Method:   http.MethodDelete,
+		Identity: userIdentity,
+
+		AppMethod: "ReleaseLegalHold",
+		AppArgs:   []interface{}{sessionID},
+		AppReturn: []interface{}{app.ErrLegalHoldNotFound},
+
+		HTTPStatus: http.StatusNotFound,
+	}, {
+		Name:   "ko, not a user",
+		Method: http.MethodPut,
+		Identity: &identity.Identity{
+			Subject:  "00000000-0000-0000-0000-000000000000",
+			Tenant:   "000000000000000000000000",
+			IsDevice: true,
+		},
+
+		HTTPStatus: http.StatusBadRequest,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			app := &app_mocks.App{}
+			defer app.AssertExpectations(t)
+
+			router, _ := NewRouter(app, nil, nil)
+			if tc.AppMethod != "" {
+				args := append([]interface{}{
+					mock.MatchedBy(func(_ context.Context) bool {
+						return true
+					}),
+				}, tc.AppArgs...)
+				app.On(tc.AppMethod, args...).Return(tc.AppReturn...)
+			}
+
+			url := "http://localhost" + strings.Replace(
+				APIURLManagementLegalHold, ":sessionId", sessionID, 1,
+			)
+			req, _ := http.NewRequest(tc.Method, url, strings.NewReader(tc.Body))
+			req.Header.Set(headerAuthorization, "Bearer "+GenerateJWT(*tc.Identity))
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			assert.Equal(t, tc.HTTPStatus, w.Code)
+			if tc.LegalHold != nil {
+				var body model.LegalHold
+				err := json.Unmarshal(w.Body.Bytes(), &body)
+				assert.NoError(t, err)
+				assert.Equal(t, *tc.LegalHold, body)
+			}
+		})
+	}
+}
@@ -0,0 +1,424 @@
+// Copyright 2023 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package http
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	natsio "github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+	"github.com/vmihailenco/msgpack/v5"
+
+	"github.com/mendersoftware/go-lib-micro/identity"
+	"github.com/mendersoftware/go-lib-micro/log"
+	"github.com/mendersoftware/go-lib-micro/ws"
+	"github.com/mendersoftware/go-lib-micro/ws/shell"
+
+	"github.com/mendersoftware/deviceconnect/app"
+	"github.com/mendersoftware/deviceconnect/model"
+)
+
+var (
+	ErrSessionNotTerminal = errors.New("session has no remote terminal")
+	ErrSessionNotOwner    = errors.New(
+		"only the session owner can grant or revoke write access",
+	)
+
+	ErrMsgObserverReadOnly    = "observers are not allowed to send input to the session"
+	ErrMsgParticipantProtocol = "participants are only allowed to send terminal input"
+	ErrMsgSessionClosed       = "session closed"
+)
+
+// Observe attaches the user as a participant to a live terminal session:
+// the participant receives the same device output as the user who opened
+// the session. The participant's input is rejected, unless the session
+// owner grants the participant write access.
+func (h ManagementController) Observe(c *gin.Context) {
+	ctx := c.Request.Context()
+	l := log.FromContext(ctx)
+
+	idata := identity.FromContext(ctx)
+	if idata == nil || !idata.IsUser {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": ErrMissingUserAuthentication.Error(),
+		})
+		return
+	}
+	tenantID := idata.Tenant
+	sessionID := c.Param("sessionId")
+
+	session, err := h.app.GetSession(ctx, sessionID)
+	if err == app.ErrSessionNotFound {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": err.Error(),
+		})
+		return
+	} else if err != nil {
+		l.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	if !session.HasType(model.SessionTypeTerminal) {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": ErrSessionNotTerminal.Error(),
+		})
+		return
+	}
+
+	deviceChan := make(chan *natsio.Msg, channelSize)
+	sub, err := h.nats.ChanSubscribe(session.Subject(tenantID), deviceChan)
+	if err != nil {
+		l.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "failed to establish internal device session",
+		})
+		return
+	}
+	//nolint:errcheck
+	defer sub.Unsubscribe()
+
+	controlChan := make(chan *natsio.Msg, channelSize)
+	subControl, err := h.nats.ChanSubscribe(session.ControlSubject(tenantID), controlChan)
+	if err != nil {
+		l.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "failed to establish internal device session",
+		})
+		return
+	}
+	//nolint:errcheck
+	defer subControl.Unsubscribe()
+
+	err = h.app.LogObserverJoin(ctx, session, idata.Subject)
+	if err != nil {
+		l.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	defer func() {
+		err := h.app.LogObserverLeave(ctx, session, idata.Subject)
+		if err != nil {
+			l.Warnf("failed to log observer leaving the session: %s", err.Error())
+		}
+	}()
+
+	// upgrade get request to websocket protocol
+	conn, err := wsUpgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		err = errors.Wrap(err, "unable to upgrade the request to websocket protocol")
+		l.Error(err)
+		// upgrader.Upgrade has already responded
+		return
+	}
+	conn.SetReadLimit(int64(newSessionLimits(session).message))
+
+	//nolint:errcheck
+	h.ObserveServeWS(ctx, conn, session, idata.Subject, deviceChan, controlChan)
+}
+
+// ObserveServeWS serves the websocket of a session participant. The terminal
+// input of participants with write access is posted on the session input
+// subject for the handler serving the session owner to forward it to the
+// device; any other message is answered with an error message instead.
+func (h ManagementController) ObserveServeWS(
+	ctx context.Context,
+	conn *websocket.Conn,
+	session *model.Session,
+	userID string,
+	deviceChan <-chan *natsio.Msg,
+	controlChan <-chan *natsio.Msg,
+) (err error) {
+	errChan := make(chan error, 1)
+	rejectChan := make(chan []byte, channelSize)
+	var canWrite int32
+	if session.CanWrite(userID) {
+		canWrite = 1
+	}
+	defer func() {
+		if err != nil {
+			select {
+			case errChan <- err:
+
+			case <-time.After(time.Second):
+				log.FromContext(ctx).Warn("Failed to propagate error to client")
+			}
+		}
+		close(errChan)
+	}()
+
+	// observerWriter is responsible for closing the websocket
+	//nolint:errcheck
+	go h.observerWriter(ctx, conn, userID, &canWrite,
+		deviceChan, controlChan, rejectChan, errChan)
+
+	var data []byte
+	for {
+		_, data, err = conn.ReadMessage()
+		if err != nil {
+			if _, ok := err.(*websocket.CloseError); ok {
+				return nil
+			}
+			return err
+		}
+		m := &ws.ProtoMsg{}
+		err = msgpack.Unmarshal(data, m)
+		if err != nil {
+			return err
+		}
+		if m.Header.Proto == ws.ProtoTypeControl {
+			continue
+		}
+		rejectMsg := ErrMsgObserverReadOnly
+		if atomic.LoadInt32(&canWrite) == 1 {
+			if m.Header.Proto == ws.ProtoTypeShell &&
+				m.Header.MsgType == shell.MessageTypeShellCommand {
+				m.Header.SessionID = session.ID
+				if m.Header.Properties == nil {
+					m.Header.Properties = make(map[string]interface{})
+				}
+				m.Header.Properties[PropertyUserID] = userID
+				data, _ = msgpack.Marshal(m)
+				err = h.nats.Publish(session.InputSubject(session.TenantID), data)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			rejectMsg = ErrMsgParticipantProtocol
+		}
+		errMsg := ws.ProtoMsg{
+			Header: ws.ProtoHdr{
+				Proto:     ws.ProtoTypeControl,
+				MsgType:   ws.MessageTypeError,
+				SessionID: m.Header.SessionID,
+			},
+		}
+		errMsg.Body, _ = msgpack.Marshal(ws.Error{
+			Error:        rejectMsg,
+			MessageProto: m.Header.Proto,
+			MessageType:  m.Header.MsgType,
+		})
+		data, _ = msgpack.Marshal(errMsg)
+		select {
+		case rejectChan <- data:
+		default:
+		}
+	}
+}
+
+// observerWriter is the go-routine responsible for the writing end of the
+// participant's websocket. Unlike websocketWriter, it only forwards the
+// messages posted on the NATS session subject, leaving the recording and
+// the session limits to the handler serving the session owner. The routine
+// keeps track of the participant's write access (canWrite) granted and
+// revoked through the session control subject.
+func (h ManagementController) observerWriter(
+	ctx context.Context,
+	conn *websocket.Conn,
+	userID string,
+	canWrite *int32,
+	deviceChan <-chan *natsio.Msg,
+	controlChan <-chan *natsio.Msg,
+	rejectChan <-chan []byte,
+	errChan <-chan error,
+) (err error) {
+	l := log.FromContext(ctx)
+	defer writerFinalizer(conn, &err, l)
+
+	// handle the ping-pong connection health check
+	err = conn.SetReadDeadline(time.Now().Add(pongWait))
+	if err != nil {
+		l.Error(err)
+		return err
+	}
+
+	pingPeriod := (pongWait * 9) / 10
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
+	conn.SetPongHandler(func(string) error {
+		ticker.Reset(pingPeriod)
+		return conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+	conn.SetPingHandler(func(msg string) error {
+		ticker.Reset(pingPeriod)
+		err := conn.SetReadDeadline(time.Now().Add(pongWait))
+		if err != nil {
+			return err
+		}
+		return conn.WriteControl(
+			websocket.PongMessage,
+			[]byte(msg),
+			time.Now().Add(writeWait),
+		)
+	})
+
+Loop:
+	for {
+		select {
+		case msg := <-deviceChan:
+			err = conn.WriteMessage(websocket.BinaryMessage, msg.Data)
+			if err != nil {
+				l.Error(err)
+				break Loop
+			}
+		case data := <-rejectChan:
+			err = conn.WriteMessage(websocket.BinaryMessage, data)
+			if err != nil {
+				l.Error(err)
+				break Loop
+			}
+		case msg := <-controlChan:
+			mr := &ws.ProtoMsg{}
+			err = msgpack.Unmarshal(msg.Data, mr)
+			if err != nil {
+				return err
+			}
+			if mr.Header.Proto != ws.ProtoTypeControl {
+				continue
+			}
+			switch mr.Header.MsgType {
+			case ws.MessageTypeClose:
+				closeSession(conn, msg.Data, websocket.CloseNormalClosure, string(mr.Body))
+				break Loop
+			case model.SessionControlGrantWrite, model.SessionControlRevokeWrite:
+				if mr.Header.Properties[PropertyUserID] != userID {
+					continue
+				}
+				var write int32
+				if mr.Header.MsgType == model.SessionControlGrantWrite {
+					write = 1
+				}
+				atomic.StoreInt32(canWrite, write)
+				err = conn.WriteMessage(websocket.BinaryMessage, msg.Data)
+				if err != nil {
+					l.Error(err)
+					break Loop
+				}
+			}
+		case <-ctx.Done():
+			break Loop
+		case <-ticker.C:
+			if !websocketPing(conn) {
+				err = errors.New("connection timeout")
+				break Loop
+			}
+		case err := <-errChan:
+			return err
+		}
+	}
+	return err
+}
+
+// GrantSessionWrite grants a participant write access to the session
+func (h ManagementController) GrantSessionWrite(c *gin.Context) {
+	h.updateSessionWrite(c, model.SessionControlGrantWrite)
+}
+
+// RevokeSessionWrite revokes the write access to the session from
+// a participant
+func (h ManagementController) RevokeSessionWrite(c *gin.Context) {
+	h.updateSessionWrite(c, model.SessionControlRevokeWrite)
+}
+
+func (h ManagementController) updateSessionWrite(c *gin.Context, msgType string) {
+	ctx := c.Request.Context()
+	l := log.FromContext(ctx)
+
+	idata := identity.FromContext(ctx)
+	if idata == nil || !idata.IsUser {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": ErrMissingUserAuthentication.Error(),
+		})
+		return
+	}
+	sessionID := c.Param("sessionId")
+	userID := c.Param("userId")
+
+	session, err := h.app.GetSession(ctx, sessionID)
+	if err == app.ErrSessionNotFound {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": err.Error(),
+		})
+		return
+	} else if err != nil {
+		l.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	if session.UserID != idata.Subject {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": ErrSessionNotOwner.Error(),
+		})
+		return
+	}
+
+	if msgType == model.SessionControlGrantWrite {
+		err = h.app.GrantSessionWrite(ctx, session, userID)
+	} else {
+		err = h.app.RevokeSessionWrite(ctx, session, userID)
+	}
+	switch err {
+	case nil:
+	case app.ErrSessionOwnerWrite:
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	case app.ErrSessionNotFound:
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": err.Error(),
+		})
+		return
+	default:
+		l.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	msg := ws.ProtoMsg{
+		Header: ws.ProtoHdr{
+			Proto:     ws.ProtoTypeControl,
+			MsgType:   msgType,
+			SessionID: session.ID,
+			Properties: map[string]interface{}{
+				PropertyUserID: userID,
+			},
+		},
+	}
+	data, _ := msgpack.Marshal(msg)
+	err = h.nats.Publish(session.ControlSubject(session.TenantID), data)
+	if err != nil {
+		l.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "failed to publish the session write access update",
+		})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
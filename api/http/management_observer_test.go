@@ -0,0 +1,677 @@
+// Copyright 2023 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package http
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/mendersoftware/go-lib-micro/identity"
+	"github.com/mendersoftware/go-lib-micro/ws"
+	"github.com/mendersoftware/go-lib-micro/ws/shell"
+	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/vmihailenco/msgpack/v5"
+
+	"github.com/mendersoftware/deviceconnect/app"
+	app_mocks "github.com/mendersoftware/deviceconnect/app/mocks"
+	"github.com/mendersoftware/deviceconnect/model"
+)
+
+func TestManagementObserve(t *testing.T) {
+	prevWriteWait := writeWait
+	defer func() {
+		writeWait = prevWriteWait
+	}()
+	writeWait = time.Second
+
+	observer := identity.Identity{
+		Subject: "00000000-0000-0000-0000-000000000000",
+		Tenant:  "000000000000000000000000",
+		IsUser:  true,
+	}
+	const sessionID = "00000000-0000-0000-0000-000000000001"
+	testCases := []struct {
+		Name string
+
+		Session       *model.Session
+		GetSessionErr error
+		LogJoinErr    error
+
+		HTTPStatus int
+	}{
+		{
+			Name: "ok",
+
+			Session: &model.Session{
+				ID:       sessionID,
+				DeviceID: "1234567890",
+				UserID:   "00000000-0000-0000-0000-000000000002",
+				TenantID: observer.Tenant,
+				Types:    []string{model.SessionTypeTerminal},
+			},
+
+			HTTPStatus: http.StatusSwitchingProtocols,
+		},
+		{
+			Name: "ko, session not found",
+
+			GetSessionErr: app.ErrSessionNotFound,
+
+			HTTPStatus: http.StatusNotFound,
+		},
+		{
+			Name: "ko, get session internal error",
+
+			GetSessionErr: errors.New("internal error"),
+
+			HTTPStatus: http.StatusInternalServerError,
+		},
+		{
+			Name: "ko, session has no terminal",
+
+			Session: &model.Session{
+				ID:       sessionID,
+				DeviceID: "1234567890",
+				UserID:   "00000000-0000-0000-0000-000000000002",
+				TenantID: observer.Tenant,
+				Types:    []string{model.SessionTypePortForward},
+			},
+
+			HTTPStatus: http.StatusConflict,
+		},
+		{
+			Name: "ko, audit log error",
+
+			Session: &model.Session{
+				ID:       sessionID,
+				DeviceID: "1234567890",
+				UserID:   "00000000-0000-0000-0000-000000000002",
+				TenantID: observer.Tenant,
+				Types:    []string{model.SessionTypeTerminal},
+			},
+			LogJoinErr: errors.New("http error"),
+
+			HTTPStatus: http.StatusInternalServerError,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			app := &app_mocks.App{}
+			defer app.AssertExpectations(t)
+			natsClient := NewNATSTestClient(t)
+			router, _ := NewRouter(app, natsClient, nil)
+
+			app.On("GetSession",
+				mock.MatchedBy(func(_ context.Context) bool {
+					return true
+				}),
+				sessionID,
+			).Return(tc.Session, tc.GetSessionErr)
+			if tc.Session != nil && tc.Session.HasType(model.SessionTypeTerminal) {
+				app.On("LogObserverJoin",
+					mock.MatchedBy(func(_ context.Context) bool {
+						return true
+					}),
+					tc.Session,
+					observer.Subject,
+				).Return(tc.LogJoinErr)
+			}
+
+			s := httptest.NewServer(router)
+			defer s.Close()
+
+			headers := http.Header{}
+			headers.Set(headerAuthorization, "Bearer "+GenerateJWT(observer))
+			url := "ws" + strings.TrimPrefix(s.URL, "http")
+			url = url + strings.Replace(APIURLManagementObserve, ":sessionId", sessionID, 1)
+
+			if tc.HTTPStatus != http.StatusSwitchingProtocols {
+				_, rsp, err := websocket.DefaultDialer.Dial(url, headers)
+				assert.Error(t, err)
+				if assert.NotNil(t, rsp) {
+					assert.Equal(t, tc.HTTPStatus, rsp.StatusCode)
+				}
+				return
+			}
+
+			leaveLogged := make(chan struct{})
+			app.On("LogObserverLeave",
+				mock.MatchedBy(func(_ context.Context) bool {
+					return true
+				}),
+				tc.Session,
+				observer.Subject,
+			).Return(nil).Run(func(mock.Arguments) {
+				close(leaveLogged)
+			})
+
+			deviceChan := make(chan *nats.Msg, 1)
+			sub, _ := natsClient.ChanSubscribe(
+				model.GetDeviceSubject(observer.Tenant, tc.Session.DeviceID),
+				deviceChan,
+			)
+			defer sub.Unsubscribe()
+
+			conn, _, err := websocket.DefaultDialer.Dial(url, headers)
+			if !assert.NoError(t, err) {
+				t.FailNow()
+			}
+			defer conn.Close()
+			_ = conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+
+			// the observer receives the output of the device
+			msg := ws.ProtoMsg{
+				Header: ws.ProtoHdr{
+					Proto:     ws.ProtoTypeShell,
+					MsgType:   shell.MessageTypeShellCommand,
+					SessionID: sessionID,
+				},
+				Body: []byte("output"),
+			}
+			b, _ := msgpack.Marshal(msg)
+			err = natsClient.Publish(tc.Session.Subject(observer.Tenant), b)
+			assert.NoError(t, err)
+			_, data, err := conn.ReadMessage()
+			if assert.NoError(t, err) {
+				assert.Equal(t, b, data)
+			}
+
+			// input from the observer is rejected
+			msg.Body = []byte("input")
+			b, _ = msgpack.Marshal(msg)
+			err = conn.WriteMessage(websocket.BinaryMessage, b)
+			assert.NoError(t, err)
+			_, data, err = conn.ReadMessage()
+			if assert.NoError(t, err) {
+				var rsp ws.ProtoMsg
+				err = msgpack.Unmarshal(data, &rsp)
+				assert.NoError(t, err)
+				assert.Equal(t, ws.ProtoTypeControl, rsp.Header.Proto)
+				assert.Equal(t, ws.MessageTypeError, rsp.Header.MsgType)
+				var wsErr ws.Error
+				err = msgpack.Unmarshal(rsp.Body, &wsErr)
+				assert.NoError(t, err)
+				assert.Equal(t, ErrMsgObserverReadOnly, wsErr.Error)
+				assert.Equal(t, ws.ProtoTypeShell, wsErr.MessageProto)
+			}
+			select {
+			case <-deviceChan:
+				assert.Fail(t, "observer input forwarded to the device")
+			case <-time.After(time.Millisecond * 100):
+			}
+
+			// the observer is disconnected when the session ends
+			msg = ws.ProtoMsg{
+				Header: ws.ProtoHdr{
+					Proto:     ws.ProtoTypeControl,
+					MsgType:   ws.MessageTypeClose,
+					SessionID: sessionID,
+				},
+				Body: []byte(ErrMsgSessionClosed),
+			}
+			b, _ = msgpack.Marshal(msg)
+			err = natsClient.Publish(tc.Session.ControlSubject(observer.Tenant), b)
+			assert.NoError(t, err)
+			_, data, err = conn.ReadMessage()
+			if assert.NoError(t, err) {
+				assert.Equal(t, b, data)
+			}
+			_, _, err = conn.ReadMessage()
+			assert.True(t, websocket.IsCloseError(err, websocket.CloseNormalClosure))
+
+			select {
+			case <-leaveLogged:
+			case <-time.After(time.Second * 5):
+				assert.Fail(t, "observer leave not logged")
+			}
+		})
+	}
+}
+
+func TestManagementSessionWrite(t *testing.T) {
+	owner := &identity.Identity{
+		Subject: "00000000-0000-0000-0000-000000000000",
+		Tenant:  "000000000000000000000000",
+		IsUser:  true,
+	}
+	const (
+		sessionID   = "00000000-0000-0000-0000-000000000001"
+		writerID    = "00000000-0000-0000-0000-000000000002"
+		otherUserID = "00000000-0000-0000-0000-000000000003"
+	)
+	session := &model.Session{
+		ID:       sessionID,
+		DeviceID: "1234567890",
+		UserID:   owner.Subject,
+		TenantID: owner.Tenant,
+		Types:    []string{model.SessionTypeTerminal},
+	}
+	testCases := []struct {
+		Name     string
+		Method   string
+		Identity *identity.Identity
+
+		GetSessionErr error
+		SkipWrite     bool
+		WriteErr      error
+
+		HTTPStatus int
+	}{
+		{
+			Name:     "ok, grant",
+			Method:   http.MethodPut,
+			Identity: owner,
+
+			HTTPStatus: http.StatusNoContent,
+		},
+		{
+			Name:     "ok, revoke",
+			Method:   http.MethodDelete,
+			Identity: owner,
+
+			HTTPStatus: http.StatusNoContent,
+		},
+		{
+			Name:   "ko, missing auth",
+			Method: http.MethodPut,
+
+			HTTPStatus: http.StatusUnauthorized,
+		},
+		{
+			Name:     "ko, session not found",
+			Method:   http.MethodPut,
+			Identity: owner,
+
+			GetSessionErr: app.ErrSessionNotFound,
+
+			HTTPStatus: http.StatusNotFound,
+		},
+		{
+			Name:     "ko, get session internal error",
+			Method:   http.MethodDelete,
+			Identity: owner,
+
+			GetSessionErr: errors.New("internal error"),
+
+			HTTPStatus: http.StatusInternalServerError,
+		},
+		{
+			Name:   "ko, not the session owner",
+			Method: http.MethodPut,
+			Identity: &identity.Identity{
+				Subject: otherUserID,
+				Tenant:  owner.Tenant,
+				IsUser:  true,
+			},
+
+			SkipWrite: true,
+
+			HTTPStatus: http.StatusForbidden,
+		},
+		{
+			Name:     "ko, owner write access",
+			Method:   http.MethodDelete,
+			Identity: owner,
+
+			WriteErr: app.ErrSessionOwnerWrite,
+
+			HTTPStatus: http.StatusBadRequest,
+		},
+		{
+			Name:     "ko, session freed",
+			Method:   http.MethodPut,
+			Identity: owner,
+
+			WriteErr: app.ErrSessionNotFound,
+
+			HTTPStatus: http.StatusNotFound,
+		},
+		{
+			Name:     "ko, internal error",
+			Method:   http.MethodPut,
+			Identity: owner,
+
+			WriteErr: errors.New("internal error"),
+
+			HTTPStatus: http.StatusInternalServerError,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			app := &app_mocks.App{}
+			defer app.AssertExpectations(t)
+			natsClient := NewNATSTestClient(t)
+			router, _ := NewRouter(app, natsClient, nil)
+
+			if tc.Identity != nil {
+				var sess *model.Session
+				if tc.GetSessionErr == nil {
+					sess = session
+				}
+				app.On("GetSession",
+					mock.MatchedBy(func(_ context.Context) bool {
+						return true
+					}),
+					sessionID,
+				).Return(sess, tc.GetSessionErr)
+			}
+			method := "GrantSessionWrite"
+			msgType := model.SessionControlGrantWrite
+			if tc.Method == http.MethodDelete {
+				method = "RevokeSessionWrite"
+				msgType = model.SessionControlRevokeWrite
+			}
+			if tc.Identity != nil && tc.GetSessionErr == nil && !tc.SkipWrite {
+				app.On(method,
+					mock.MatchedBy(func(_ context.Context) bool {
+						return true
+					}),
+					session,
+					writerID,
+				).Return(tc.WriteErr)
+			}
+
+			controlChan := make(chan *nats.Msg, 1)
+			sub, _ := natsClient.ChanSubscribe(
+				session.ControlSubject(owner.Tenant),
+				controlChan,
+			)
+			defer sub.Unsubscribe()
+
+			url := strings.Replace(APIURLManagementSessionWriter, ":sessionId", sessionID, 1)
+			url = strings.Replace(url, ":userId", writerID, 1)
+			req, _ := http.NewRequest(tc.Method, "http://localhost"+url, nil)
+			if tc.Identity != nil {
+				req.Header.Set(headerAuthorization, "Bearer "+GenerateJWT(*tc.Identity))
+			}
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			assert.Equal(t, tc.HTTPStatus, w.Code)
+
+			if tc.HTTPStatus != http.StatusNoContent {
+				return
+			}
+			select {
+			case msg := <-controlChan:
+				var ctrlMsg ws.ProtoMsg
+				err := msgpack.Unmarshal(msg.Data, &ctrlMsg)
+				if assert.NoError(t, err) {
+					assert.Equal(t, ws.ProtoTypeControl, ctrlMsg.Header.Proto)
+					assert.Equal(t, msgType, ctrlMsg.Header.MsgType)
+					assert.Equal(t, writerID, ctrlMsg.Header.Properties[PropertyUserID])
+				}
+			case <-time.After(time.Second * 5):
+				assert.Fail(t, "timeout waiting for control message on nats channel")
+			}
+		})
+	}
+}
+
+type chanWriter chan []byte
+
+func (w chanWriter) Write(b []byte) (int, error) {
+	w <- append([]byte{}, b...)
+	return len(b), nil
+}
+
+func TestManagementSessionWriters(t *testing.T) {
+	prevWriteWait := writeWait
+	defer func() {
+		writeWait = prevWriteWait
+	}()
+	writeWait = time.Second
+
+	owner := identity.Identity{
+		Subject: "00000000-0000-0000-0000-000000000000",
+		Tenant:  "000000000000000000000000",
+		IsUser:  true,
+	}
+	participant := identity.Identity{
+		Subject: "00000000-0000-0000-0000-000000000002",
+		Tenant:  owner.Tenant,
+		IsUser:  true,
+	}
+	const (
+		deviceID  = "1234567890"
+		sessionID = "00000000-0000-0000-0000-000000000001"
+	)
+	session := &model.Session{
+		ID:       sessionID,
+		DeviceID: deviceID,
+		UserID:   owner.Subject,
+		TenantID: owner.Tenant,
+		Types:    []string{model.SessionTypeTerminal},
+	}
+
+	appMock := &app_mocks.App{}
+	defer appMock.AssertExpectations(t)
+	natsClient := NewNATSTestClient(t)
+	router, _ := NewRouter(appMock, natsClient, nil)
+	s := httptest.NewServer(router)
+	defer s.Close()
+
+	anyCtx := mock.MatchedBy(func(_ context.Context) bool {
+		return true
+	})
+	controlRecorder := make(chanWriter, 10)
+	appMock.On("PrepareUserSession", anyCtx,
+		mock.MatchedBy(func(sess *model.Session) bool {
+			sess.ID = sessionID
+			return true
+		}),
+	).Return(nil)
+	appMock.On("LogUserSession", anyCtx, mock.AnythingOfType("*model.Session"),
+		model.SessionTypeTerminal,
+	).Return(nil)
+	appMock.On("FreeUserSession", anyCtx, sessionID,
+		mock.AnythingOfType("[]string"),
+	).Return(nil)
+	appMock.On("GetControlRecorder", anyCtx, sessionID).Return(controlRecorder)
+	appMock.On("SignSessionRecording", anyCtx, sessionID,
+		mock.AnythingOfType("[]model.RecordingStreamHead"),
+	).Return(nil).Maybe()
+	appMock.On("GetRecorder", anyCtx, sessionID).Return(nil)
+	appMock.On("GetSession", anyCtx, sessionID).Return(session, nil)
+	appMock.On("LogObserverJoin", anyCtx, session, participant.Subject).Return(nil)
+	leaveLogged := make(chan struct{})
+	appMock.On("LogObserverLeave", anyCtx, session, participant.Subject).
+		Return(nil).
+		Run(func(mock.Arguments) {
+			close(leaveLogged)
+		})
+
+	deviceChan := make(chan *nats.Msg, 1)
+	sub, _ := natsClient.ChanSubscribe(
+		model.GetDeviceSubject(owner.Tenant, deviceID),
+		deviceChan,
+	)
+	defer sub.Unsubscribe()
+
+	// the owner opens the session
+	baseURL := "ws" + strings.TrimPrefix(s.URL, "http")
+	headers := http.Header{}
+	headers.Set(headerAuthorization, "Bearer "+GenerateJWT(owner))
+	ownerConn, _, err := websocket.DefaultDialer.Dial(baseURL+
+		strings.Replace(APIURLManagementDeviceConnect, ":deviceId", deviceID, 1),
+		headers,
+	)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer ownerConn.Close()
+
+	// the participant joins the session
+	headers = http.Header{}
+	headers.Set(headerAuthorization, "Bearer "+GenerateJWT(participant))
+	conn, _, err := websocket.DefaultDialer.Dial(baseURL+
+		strings.Replace(APIURLManagementObserve, ":sessionId", sessionID, 1),
+		headers,
+	)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer conn.Close()
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+
+	// input from the session owner is tagged with the owner's user ID
+	msg := ws.ProtoMsg{
+		Header: ws.ProtoHdr{
+			Proto:     ws.ProtoTypeShell,
+			MsgType:   shell.MessageTypeShellCommand,
+			SessionID: sessionID,
+		},
+		Body: []byte("ls\n"),
+	}
+	b, _ := msgpack.Marshal(msg)
+	err = ownerConn.WriteMessage(websocket.BinaryMessage, b)
+	assert.NoError(t, err)
+	select {
+	case natsMsg := <-deviceChan:
+		var rMsg ws.ProtoMsg
+		err = msgpack.Unmarshal(natsMsg.Data, &rMsg)
+		assert.NoError(t, err)
+		assert.Equal(t, owner.Subject, rMsg.Header.Properties[PropertyUserID])
+	case <-time.After(time.Second * 5):
+		assert.Fail(t, "timeout waiting for the owner input on nats channel")
+	}
+
+	// the owner grants the participant write access
+	grant := ws.ProtoMsg{
+		Header: ws.ProtoHdr{
+			Proto:     ws.ProtoTypeControl,
+			MsgType:   model.SessionControlGrantWrite,
+			SessionID: sessionID,
+			Properties: map[string]interface{}{
+				PropertyUserID: participant.Subject,
+			},
+		},
+	}
+	b, _ = msgpack.Marshal(grant)
+	err = natsClient.Publish(session.ControlSubject(owner.Tenant), b)
+	assert.NoError(t, err)
+	_, data, err := conn.ReadMessage()
+	if assert.NoError(t, err) {
+		assert.Equal(t, b, data)
+	}
+
+	// input from the participant reaches the device tagged with
+	// the participant's user ID
+	msg.Body = []byte("pwd\n")
+	b, _ = msgpack.Marshal(msg)
+	err = conn.WriteMessage(websocket.BinaryMessage, b)
+	assert.NoError(t, err)
+	select {
+	case natsMsg := <-deviceChan:
+		var rMsg ws.ProtoMsg
+		err = msgpack.Unmarshal(natsMsg.Data, &rMsg)
+		assert.NoError(t, err)
+		assert.Equal(t, participant.Subject, rMsg.Header.Properties[PropertyUserID])
+		assert.Equal(t, []byte("pwd\n"), rMsg.Body)
+	case <-time.After(time.Second * 5):
+		assert.Fail(t, "timeout waiting for the participant input on nats channel")
+	}
+
+	// participants are not allowed to control the terminal
+	spawn := ws.ProtoMsg{
+		Header: ws.ProtoHdr{
+			Proto:     ws.ProtoTypeShell,
+			MsgType:   shell.MessageTypeSpawnShell,
+			SessionID: sessionID,
+		},
+	}
+	b, _ = msgpack.Marshal(spawn)
+	err = conn.WriteMessage(websocket.BinaryMessage, b)
+	assert.NoError(t, err)
+	_, data, err = conn.ReadMessage()
+	if assert.NoError(t, err) {
+		var rsp ws.ProtoMsg
+		_ = msgpack.Unmarshal(data, &rsp)
+		var wsErr ws.Error
+		_ = msgpack.Unmarshal(rsp.Body, &wsErr)
+		assert.Equal(t, ErrMsgParticipantProtocol, wsErr.Error)
+	}
+
+	// the owner revokes the write access
+	revoke := grant
+	revoke.Header.MsgType = model.SessionControlRevokeWrite
+	b, _ = msgpack.Marshal(revoke)
+	err = natsClient.Publish(session.ControlSubject(owner.Tenant), b)
+	assert.NoError(t, err)
+	_, data, err = conn.ReadMessage()
+	if assert.NoError(t, err) {
+		assert.Equal(t, b, data)
+	}
+
+	b, _ = msgpack.Marshal(msg)
+	err = conn.WriteMessage(websocket.BinaryMessage, b)
+	assert.NoError(t, err)
+	_, data, err = conn.ReadMessage()
+	if assert.NoError(t, err) {
+		var rsp ws.ProtoMsg
+		_ = msgpack.Unmarshal(data, &rsp)
+		var wsErr ws.Error
+		_ = msgpack.Unmarshal(rsp.Body, &wsErr)
+		assert.Equal(t, ErrMsgObserverReadOnly, wsErr.Error)
+	}
+
+	// input bypassing the participant's handler is dropped by the owner's
+	msg.Header.Properties = map[string]interface{}{
+		PropertyUserID: participant.Subject,
+	}
+	b, _ = msgpack.Marshal(msg)
+	err = natsClient.Publish(session.InputSubject(owner.Tenant), b)
+	assert.NoError(t, err)
+	select {
+	case <-deviceChan:
+		assert.Fail(t, "input from a user without write access forwarded")
+	case <-time.After(time.Millisecond * 100):
+	}
+
+	// the recording attributes the input to the participant
+	ownerConn.Close()
+	select {
+	case data := <-controlRecorder:
+		var ctrl app.Control
+		err = ctrl.UnmarshalBinary(data)
+		if assert.NoError(t, err) {
+			assert.Equal(t, app.UserMessage, ctrl.Type)
+			assert.Equal(t, participant.Subject, ctrl.UserID)
+		}
+	case <-time.After(time.Second * 5):
+		assert.Fail(t, "timeout waiting for the control recording")
+	}
+
+	// the participant is disconnected when the owner leaves
+	_, _, err = conn.ReadMessage()
+	assert.NoError(t, err)
+	_, _, err = conn.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseNormalClosure))
+	select {
+	case <-leaveLogged:
+	case <-time.After(time.Second * 5):
+		assert.Fail(t, "participant leave not logged")
+	}
+}
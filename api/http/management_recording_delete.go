@@ -0,0 +1,126 @@
+// Copyright 2023 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package http
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+
+	"github.com/mendersoftware/go-lib-micro/identity"
+	"github.com/mendersoftware/go-lib-micro/log"
+
+	"github.com/mendersoftware/deviceconnect/app"
+	"github.com/mendersoftware/deviceconnect/model"
+)
+
+// DeleteRecording permanently deletes the recording of the session
+func (h ManagementController) DeleteRecording(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	idata := identity.FromContext(ctx)
+	if idata == nil || !idata.IsUser {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": ErrMissingUserAuthentication.Error(),
+		})
+		return
+	}
+	deleteRecording(c, c.Param(PlaybackSessionIDField), idata.Subject, h.app)
+}
+
+// DeleteRecordings permanently deletes the recordings of a user or of a
+// device
+func (h ManagementController) DeleteRecordings(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	idata := identity.FromContext(ctx)
+	if idata == nil || !idata.IsUser {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": ErrMissingUserAuthentication.Error(),
+		})
+		return
+	}
+	deleteRecordings(c, idata.Subject, h.app)
+}
+
+// deleteRecording deletes the recording of the session on behalf of the
+// user (userID); the recordings of the sessions on legal hold or still
+// open are kept.
+func deleteRecording(c *gin.Context, sessionID, userID string, a app.App) {
+	ctx := c.Request.Context()
+	l := log.FromContext(ctx)
+
+	err := a.DeleteSessionRecording(ctx, sessionID, userID)
+	switch err {
+	case nil:
+	case app.ErrRecordingNotFound:
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": err.Error(),
+		})
+		return
+	case app.ErrRecordingOnLegalHold, app.ErrRecordingSessionActive:
+		c.JSON(http.StatusConflict, gin.H{
+			"error": err.Error(),
+		})
+		return
+	default:
+		err = errors.Wrap(err, "failed to delete the session recording")
+		l.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	l.Infof("session_id=%s recording deleted by user_id=%s", sessionID, userID)
+	c.Status(http.StatusNoContent)
+}
+
+// deleteRecordings deletes the recordings of the user or of the device in
+// the query on behalf of the user (userID)
+func deleteRecordings(c *gin.Context, userID string, a app.App) {
+	ctx := c.Request.Context()
+	l := log.FromContext(ctx)
+
+	filter := model.RecordingFilter{
+		DeviceID: c.Query(paramSessionsDeviceID),
+		UserID:   c.Query(paramSessionsUserID),
+	}
+	if err := filter.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": errors.Wrap(err, "invalid parameters").Error(),
+		})
+		return
+	}
+
+	deletion, err := a.DeleteRecordings(ctx, filter, userID)
+	if err != nil {
+		err = errors.Wrap(err, "failed to delete the session recordings")
+		l.Error(err)
+		if deletion == nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		// the recordings deleted before failing are reported
+		deletion.Error = err.Error()
+		c.JSON(http.StatusInternalServerError, deletion)
+		return
+	}
+	l.Infof("device_id=%s user_id=%s: %d recordings deleted by user_id=%s",
+		filter.DeviceID, filter.UserID, len(deletion.Deleted), userID)
+	c.JSON(http.StatusOK, deletion)
+}
@@ -0,0 +1,266 @@
+// Copyright 2023 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mendersoftware/go-lib-micro/identity"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/mendersoftware/deviceconnect/app"
+	app_mocks "github.com/mendersoftware/deviceconnect/app/mocks"
+	"github.com/mendersoftware/deviceconnect/model"
+)
+
+func TestDeleteRecording(t *testing.T) {
+	const (
+		sessionID = "00000000-0000-0000-0000-000000000001"
+		tenantID  = "000000000000000000000000"
+		userID    = "00000000-0000-0000-0000-000000000000"
+	)
+	userIdentity := &identity.Identity{
+		Subject: userID,
+		Tenant:  tenantID,
+		IsUser:  true,
+	}
+	managementURL := strings.Replace(APIURLManagementRecording, ":sessionId", sessionID, 1)
+	internalURL := strings.NewReplacer(
+		":tenantId", tenantID,
+		":sessionId", sessionID,
+	).Replace(APIURLInternalRecording)
+
+	testCases := []struct {
+		Name     string
+		URL      string
+		Identity *identity.Identity
+
+		AppCalled bool
+		AppError  error
+
+		HTTPStatus int
+	}{{
+		Name:     "ok",
+		URL:      managementURL,
+		Identity: userIdentity,
+
+		AppCalled:  true,
+		HTTPStatus: http.StatusNoContent,
+	}, {
+		Name: "ok, internal",
+		URL:  internalURL + "?" + paramRecordingsRequestedBy + "=" + userID,
+
+		AppCalled:  true,
+		HTTPStatus: http.StatusNoContent,
+	}, {
+		Name:     "ko, not found",
+		URL:      managementURL,
+		Identity: userIdentity,
+
+		AppCalled:  true,
+		AppError:   app.ErrRecordingNotFound,
+		HTTPStatus: http.StatusNotFound,
+	}, {
+		Name:     "ko, legal hold",
+		URL:      managementURL,
+		Identity: userIdentity,
+
+		AppCalled:  true,
+		AppError:   app.ErrRecordingOnLegalHold,
+		HTTPStatus: http.StatusConflict,
+	}, {
+		Name:     "ko, session active",
+		URL:      managementURL,
+		Identity: userIdentity,
+
+		AppCalled:  true,
+		AppError:   app.ErrRecordingSessionActive,
+		HTTPStatus: http.StatusConflict,
+	}, {
+		Name:     "ko, internal error",
+		URL:      managementURL,
+		Identity: userIdentity,
+
+		AppCalled:  true,
+		AppError:   errors.New("internal error"),
+		HTTPStatus: http.StatusInternalServerError,
+	}, {
+		Name: "ko, not a user",
+		URL:  managementURL,
+		Identity: &identity.Identity{
+			Subject:  userID,
+			Tenant:   tenantID,
+			IsDevice: true,
+		},
+
+		HTTPStatus: http.StatusBadRequest,
+	}, {
+		Name: "ko, internal, missing requested_by",
+		URL:  internalURL,
+
+		HTTPStatus: http.StatusBadRequest,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			app := &app_mocks.App{}
+			defer app.AssertExpectations(t)
+
+			router, _ := NewRouter(app, nil, nil)
+			if tc.AppCalled {
+				app.On("DeleteSessionRecording",
+					mock.MatchedBy(func(ctx context.Context) bool {
+						id := identity.FromContext(ctx)
+						return id != nil && id.Tenant == tenantID
+					}),
+					sessionID,
+					userID,
+				).Return(tc.AppError)
+			}
+
+			req, _ := http.NewRequest(http.MethodDelete, "http://localhost"+tc.URL, nil)
+			if tc.Identity != nil {
+				req.Header.Set(headerAuthorization, "Bearer "+GenerateJWT(*tc.Identity))
+			}
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			assert.Equal(t, tc.HTTPStatus, w.Code)
+		})
+	}
+}
+
+func TestDeleteRecordings(t *testing.T) {
+	const (
+		tenantID = "000000000000000000000000"
+		userID   = "00000000-0000-0000-0000-000000000000"
+	)
+	userIdentity := &identity.Identity{
+		Subject: userID,
+		Tenant:  tenantID,
+		IsUser:  true,
+	}
+	internalURL := strings.Replace(APIURLInternalRecordings, ":tenantId", tenantID, 1)
+	deletion := &model.RecordingDeletion{
+		Deleted: []string{"00000000-0000-0000-0000-000000000001"},
+		Held:    []string{"00000000-0000-0000-0000-000000000002"},
+	}
+
+	testCases := []struct {
+		Name     string
+		URL      string
+		Identity *identity.Identity
+
+		Filter   *model.RecordingFilter
+		Deletion *model.RecordingDeletion
+		AppError error
+
+		HTTPStatus int
+		Body       *model.RecordingDeletion
+	}{{
+		Name:     "ok, by user",
+		URL:      APIURLManagementRecordings + "?user_id=user",
+		Identity: userIdentity,
+
+		Filter:     &model.RecordingFilter{UserID: "user"},
+		Deletion:   deletion,
+		HTTPStatus: http.StatusOK,
+		Body:       deletion,
+	}, {
+		Name: "ok, internal, by device",
+		URL: internalURL + "?device_id=device&" +
+			paramRecordingsRequestedBy + "=" + userID,
+
+		Filter:     &model.RecordingFilter{DeviceID: "device"},
+		Deletion:   deletion,
+		HTTPStatus: http.StatusOK,
+		Body:       deletion,
+	}, {
+		Name:     "ko, no filter",
+		URL:      APIURLManagementRecordings,
+		Identity: userIdentity,
+
+		HTTPStatus: http.StatusBadRequest,
+	}, {
+		Name:     "ko, internal error",
+		URL:      APIURLManagementRecordings + "?device_id=device",
+		Identity: userIdentity,
+
+		Filter:     &model.RecordingFilter{DeviceID: "device"},
+		AppError:   errors.New("internal error"),
+		HTTPStatus: http.StatusInternalServerError,
+	}, {
+		Name:     "ko, internal error, partially deleted",
+		URL:      APIURLManagementRecordings + "?device_id=device",
+		Identity: userIdentity,
+
+		Filter: &model.RecordingFilter{DeviceID: "device"},
+		Deletion: &model.RecordingDeletion{
+			Deleted: []string{"00000000-0000-0000-0000-000000000001"},
+		},
+		AppError:   errors.New("internal error"),
+		HTTPStatus: http.StatusInternalServerError,
+		Body: &model.RecordingDeletion{
+			Deleted: []string{"00000000-0000-0000-0000-000000000001"},
+			Error:   "failed to delete the session recordings: internal error",
+		},
+	}, {
+		Name: "ko, internal, missing requested_by",
+		URL:  internalURL + "?device_id=device",
+
+		HTTPStatus: http.StatusBadRequest,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			app := &app_mocks.App{}
+			defer app.AssertExpectations(t)
+
+			router, _ := NewRouter(app, nil, nil)
+			if tc.Filter != nil {
+				app.On("DeleteRecordings",
+					mock.MatchedBy(func(ctx context.Context) bool {
+						id := identity.FromContext(ctx)
+						return id != nil && id.Tenant == tenantID
+					}),
+					*tc.Filter,
+					userID,
+				).Return(tc.Deletion, tc.AppError)
+			}
+
+			req, _ := http.NewRequest(http.MethodDelete, "http://localhost"+tc.URL, nil)
+			if tc.Identity != nil {
+				req.Header.Set(headerAuthorization, "Bearer "+GenerateJWT(*tc.Identity))
+			}
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			assert.Equal(t, tc.HTTPStatus, w.Code)
+			if tc.Body != nil {
+				var body model.RecordingDeletion
+				err := json.Unmarshal(w.Body.Bytes(), &body)
+				assert.NoError(t, err)
+				assert.Equal(t, *tc.Body, body)
+			}
+		})
+	}
+}
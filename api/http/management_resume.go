@@ -0,0 +1,696 @@
+// Copyright 2023 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package http
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	natsio "github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+	"github.com/vmihailenco/msgpack/v5"
+
+	"github.com/mendersoftware/go-lib-micro/identity"
+	"github.com/mendersoftware/go-lib-micro/log"
+	"github.com/mendersoftware/go-lib-micro/ws"
+	"github.com/mendersoftware/go-lib-micro/ws/shell"
+
+	"github.com/mendersoftware/deviceconnect/app"
+	"github.com/mendersoftware/deviceconnect/client/nats"
+	"github.com/mendersoftware/deviceconnect/model"
+)
+
+const (
+	// MessageTypeResumeToken is the type of the control message sending
+	// the session owner the token for resuming the session
+	MessageTypeResumeToken = "resume_token"
+
+	// PropertyResumeToken and PropertyResumeGracePeriod are the properties
+	// of the resume token message holding the token and the number of
+	// seconds the session survives the owner's connection dropping
+	PropertyResumeToken       = "resume_token"
+	PropertyResumeGracePeriod = "grace_period_seconds"
+	// PropertyRelayID identifies the handler relaying the connection the
+	// owner resumed the session from
+	PropertyRelayID = "relay_id"
+
+	paramResumeToken = "resume_token"
+
+	// resumeBufferSize is the maximum number of bytes of terminal output
+	// buffered while the session owner is away, the oldest output is
+	// discarded past the limit
+	resumeBufferSize = 1024 * 1024
+	// resumeReplayChunkSize is the maximum size of the messages replaying
+	// the buffered terminal output
+	resumeReplayChunkSize = 64 * 1024
+)
+
+var (
+	ErrSessionNotResumable = errors.New("the session is no longer available")
+
+	ErrMsgSessionResumed      = "session resumed from another connection"
+	ErrMsgResumeOutputDropped = "\r\n[some output was discarded while disconnected]\r\n"
+
+	// resumeAcceptTimeout is how long the resume request waits for the
+	// handler serving the session to accept the new connection
+	resumeAcceptTimeout = 5 * time.Second
+)
+
+// Resume resumes a terminal session from a new connection of the session
+// owner, e.g. after the owner's connection dropped. The owner authenticates
+// with the resume token received when opening the session. The handler
+// serving the session, on any instance, replays the terminal output
+// buffered while the owner was away and keeps serving the session through
+// the new connection, relayed by this handler.
+func (h ManagementController) Resume(c *gin.Context) {
+	ctx := c.Request.Context()
+	l := log.FromContext(ctx)
+
+	idata := identity.FromContext(ctx)
+	if idata == nil || !idata.IsUser {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": ErrMissingUserAuthentication.Error(),
+		})
+		return
+	}
+	tenantID := idata.Tenant
+	sessionID := c.Param("sessionId")
+
+	session, err := h.app.ResumeUserSession(ctx, sessionID, idata.Subject,
+		c.Query(paramResumeToken))
+	if err == app.ErrSessionNotFound {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": err.Error(),
+		})
+		return
+	} else if err == app.ErrSessionResumeDenied {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": err.Error(),
+		})
+		return
+	} else if err != nil {
+		l.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	relayID := uuid.NewString()
+	relayChan := make(chan *natsio.Msg, channelSize)
+	sub, err := h.nats.ChanSubscribe(session.RelaySubject(tenantID, relayID), relayChan)
+	if err != nil {
+		l.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "failed to establish internal device session",
+		})
+		return
+	}
+	//nolint:errcheck
+	defer sub.Unsubscribe()
+
+	controlChan := make(chan *natsio.Msg, channelSize)
+	subControl, err := h.nats.ChanSubscribe(session.ControlSubject(tenantID), controlChan)
+	if err != nil {
+		l.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "failed to establish internal device session",
+		})
+		return
+	}
+	//nolint:errcheck
+	defer subControl.Unsubscribe()
+
+	msg := ws.ProtoMsg{
+		Header: ws.ProtoHdr{
+			Proto:     ws.ProtoTypeControl,
+			MsgType:   model.SessionControlResume,
+			SessionID: session.ID,
+			Properties: map[string]interface{}{
+				PropertyRelayID: relayID,
+			},
+		},
+	}
+	data, _ := msgpack.Marshal(msg)
+	err = h.nats.Publish(session.ControlSubject(tenantID), data)
+	if err != nil {
+		l.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "failed to publish the session resume request",
+		})
+		return
+	}
+
+	// wait for the handler serving the session to accept the connection
+	select {
+	case msg := <-relayChan:
+		mr := &ws.ProtoMsg{}
+		err = msgpack.Unmarshal(msg.Data, mr)
+		if err == nil && mr.Header.Proto == ws.ProtoTypeControl &&
+			mr.Header.MsgType == ws.MessageTypeAccept {
+			break
+		}
+		l.Errorf("unexpected reply to the session resume request: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "failed to resume the session",
+		})
+		return
+	case <-time.After(resumeAcceptTimeout):
+		c.JSON(http.StatusConflict, gin.H{
+			"error": ErrSessionNotResumable.Error(),
+		})
+		return
+	}
+	l.Infof("resuming the session session_id=%s", session.ID)
+
+	// upgrade get request to websocket protocol
+	conn, err := wsUpgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		err = errors.Wrap(err, "unable to upgrade the request to websocket protocol")
+		l.Error(err)
+		// upgrader.Upgrade has already responded
+		h.publishRelayDetach(session, relayID, model.SessionControlDetach)
+		return
+	}
+	conn.SetReadLimit(int64(newSessionLimits(session).message))
+
+	//nolint:errcheck
+	h.ResumeServeWS(ctx, conn, session, relayID, relayChan, controlChan)
+}
+
+// ResumeServeWS relays the websocket the session owner resumed the session
+// from: the owner's messages are posted on the session resume subject for
+// the handler serving the session, which posts the session output on the
+// subject of the relay. When the connection closes, the relay signals the
+// handler serving the session whether the owner closed the session or the
+// connection dropped, in which case the session can be resumed again.
+func (h ManagementController) ResumeServeWS(
+	ctx context.Context,
+	conn *websocket.Conn,
+	session *model.Session,
+	relayID string,
+	relayChan <-chan *natsio.Msg,
+	controlChan <-chan *natsio.Msg,
+) (err error) {
+	errChan := make(chan error, 1)
+	msgType := model.SessionControlDetach
+	defer func() {
+		h.publishRelayDetach(session, relayID, msgType)
+		if err != nil {
+			select {
+			case errChan <- err:
+
+			case <-time.After(time.Second):
+				log.FromContext(ctx).Warn("Failed to propagate error to client")
+			}
+		}
+		close(errChan)
+	}()
+
+	// relayWriter is responsible for closing the websocket
+	//nolint:errcheck
+	go h.relayWriter(ctx, conn, relayID, relayChan, controlChan, errChan)
+
+	var data []byte
+	for {
+		_, data, err = conn.ReadMessage()
+		if err != nil {
+			if closeErr, ok := err.(*websocket.CloseError); ok {
+				if closeErr.Code == websocket.CloseNormalClosure {
+					msgType = ws.MessageTypeClose
+				}
+				return nil
+			}
+			return err
+		}
+		m := &ws.ProtoMsg{}
+		err = msgpack.Unmarshal(data, m)
+		if err != nil {
+			return err
+		}
+		if m.Header.Properties == nil {
+			m.Header.Properties = make(map[string]interface{})
+		}
+		m.Header.Properties[PropertyRelayID] = relayID
+		data, _ = msgpack.Marshal(m)
+		err = h.nats.Publish(session.ResumeSubject(session.TenantID), data)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// publishRelayDetach signals the handler serving the session that the
+// relayed connection closed (ws.MessageTypeClose) or dropped
+// (model.SessionControlDetach).
+func (h ManagementController) publishRelayDetach(
+	session *model.Session,
+	relayID string,
+	msgType string,
+) {
+	msg := ws.ProtoMsg{
+		Header: ws.ProtoHdr{
+			Proto:     ws.ProtoTypeControl,
+			MsgType:   msgType,
+			SessionID: session.ID,
+			Properties: map[string]interface{}{
+				PropertyRelayID: relayID,
+			},
+		},
+	}
+	data, _ := msgpack.Marshal(msg)
+	_ = h.nats.Publish(session.ResumeSubject(session.TenantID), data)
+}
+
+// relayWriter is the go-routine responsible for the writing end of the
+// relayed websocket. The routine forwards the session output posted on the
+// relay subject and closes the connection when the session closes or when
+// the owner resumes the session from yet another connection.
+func (h ManagementController) relayWriter(
+	ctx context.Context,
+	conn *websocket.Conn,
+	relayID string,
+	relayChan <-chan *natsio.Msg,
+	controlChan <-chan *natsio.Msg,
+	errChan <-chan error,
+) (err error) {
+	l := log.FromContext(ctx)
+	defer writerFinalizer(conn, &err, l)
+
+	// handle the ping-pong connection health check
+	err = conn.SetReadDeadline(time.Now().Add(pongWait))
+	if err != nil {
+		l.Error(err)
+		return err
+	}
+
+	pingPeriod := (pongWait * 9) / 10
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
+	conn.SetPongHandler(func(string) error {
+		ticker.Reset(pingPeriod)
+		return conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+	conn.SetPingHandler(func(msg string) error {
+		ticker.Reset(pingPeriod)
+		err := conn.SetReadDeadline(time.Now().Add(pongWait))
+		if err != nil {
+			return err
+		}
+		return conn.WriteControl(
+			websocket.PongMessage,
+			[]byte(msg),
+			time.Now().Add(writeWait),
+		)
+	})
+
+Loop:
+	for {
+		select {
+		case msg := <-relayChan:
+			mr := &ws.ProtoMsg{}
+			err = msgpack.Unmarshal(msg.Data, mr)
+			if err != nil {
+				return err
+			}
+			if mr.Header.Proto == ws.ProtoTypeControl &&
+				mr.Header.MsgType == ws.MessageTypeClose &&
+				mr.Header.Properties[PropertyRelayID] == relayID {
+				closeSession(conn, msg.Data, websocket.CloseNormalClosure, string(mr.Body))
+				break Loop
+			}
+			err = conn.WriteMessage(websocket.BinaryMessage, msg.Data)
+			if err != nil {
+				l.Error(err)
+				break Loop
+			}
+		case msg := <-controlChan:
+			mr := &ws.ProtoMsg{}
+			err = msgpack.Unmarshal(msg.Data, mr)
+			if err != nil {
+				return err
+			}
+			if mr.Header.Proto == ws.ProtoTypeControl &&
+				mr.Header.MsgType == ws.MessageTypeClose {
+				closeSession(conn, msg.Data, websocket.ClosePolicyViolation, string(mr.Body))
+				break Loop
+			}
+		case <-ctx.Done():
+			break Loop
+		case <-ticker.C:
+			if !websocketPing(conn) {
+				err = errors.New("connection timeout")
+				break Loop
+			}
+		case err := <-errChan:
+			return err
+		}
+	}
+	return err
+}
+
+// prepResumeToken preps the message sending the session owner the token
+// for resuming the session
+func prepResumeToken(session *model.Session) []byte {
+	msg := ws.ProtoMsg{
+		Header: ws.ProtoHdr{
+			Proto:     ws.ProtoTypeControl,
+			MsgType:   MessageTypeResumeToken,
+			SessionID: session.ID,
+			Properties: map[string]interface{}{
+				PropertyResumeToken:       session.ResumeToken,
+				PropertyResumeGracePeriod: int(session.Policy.ResumeGracePeriod.Seconds()),
+			},
+		},
+	}
+	data, _ := msgpack.Marshal(msg)
+	return data
+}
+
+// sessionOutput is the user end of the output of the session written by
+// websocketWriter: the websocket of the session owner or, once the owner
+// resumed the session from a new connection, the relay serving the new
+// connection. While the owner is away, the terminal output is buffered to
+// be replayed when the owner resumes the session.
+type sessionOutput struct {
+	mutex     sync.Mutex
+	nats      nats.Client
+	session   *model.Session
+	conn      *websocket.Conn
+	relayID   string
+	resumable bool
+	buffer    []byte
+	dropped   bool
+	// attach passes the relays the session is resumed from to the
+	// reading end of the session
+	attach chan string
+}
+
+func newSessionOutput(
+	conn *websocket.Conn,
+	session *model.Session,
+	nats nats.Client,
+) *sessionOutput {
+	return &sessionOutput{
+		nats:    nats,
+		session: session,
+		conn:    conn,
+		resumable: session.ResumeToken != "" &&
+			session.Policy != nil && session.Policy.ResumeGracePeriod > 0,
+		attach: make(chan string, 1),
+	}
+}
+
+// Write sends the message to the session owner. If the owner's connection
+// drops and the session is resumable, the terminal output is buffered.
+func (o *sessionOutput) Write(data []byte) error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if o.conn != nil {
+		err := o.conn.WriteMessage(websocket.BinaryMessage, data)
+		if err == nil || !o.resumable {
+			return err
+		}
+		o.conn.Close()
+		o.conn = nil
+	}
+	if o.relayID != "" {
+		return o.nats.Publish(o.session.RelaySubject(o.session.TenantID, o.relayID), data)
+	}
+
+	msg := &ws.ProtoMsg{}
+	err := msgpack.Unmarshal(data, msg)
+	if err != nil || msg.Header.Proto != ws.ProtoTypeShell ||
+		msg.Header.MsgType != shell.MessageTypeShellCommand {
+		return nil
+	}
+	o.buffer = append(o.buffer, msg.Body...)
+	if len(o.buffer) > resumeBufferSize {
+		o.buffer = o.buffer[len(o.buffer)-resumeBufferSize:]
+		o.dropped = true
+	}
+	return nil
+}
+
+// Ping pings the owner's websocket, it returns false if the connection
+// timed out and the session is not resumable.
+func (o *sessionOutput) Ping() bool {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if o.conn == nil || websocketPing(o.conn) {
+		return true
+	} else if !o.resumable {
+		return false
+	}
+	o.conn.Close()
+	o.conn = nil
+	return true
+}
+
+// Close sends the session owner the message closing the session and
+// closes the owner's websocket.
+func (o *sessionOutput) Close(msg []byte, code int, reason string) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if o.conn != nil {
+		closeSession(o.conn, msg, code, reason)
+	} else if o.relayID != "" {
+		// the relay closes the connection on the session close message
+		// posted on the session control subject
+		_ = o.nats.Publish(o.session.RelaySubject(o.session.TenantID, o.relayID), msg)
+	}
+}
+
+// Resume attaches the relay serving the connection the owner resumed the
+// session from: the relay is sent the terminal output buffered while the
+// owner was away, then the session output. The connection or relay the
+// session was served through until then is closed.
+func (o *sessionOutput) Resume(relayID string) error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if !o.resumable || relayID == "" {
+		return nil
+	}
+	relaySubject := o.session.RelaySubject(o.session.TenantID, relayID)
+	msg := ws.ProtoMsg{
+		Header: ws.ProtoHdr{
+			Proto:     ws.ProtoTypeControl,
+			MsgType:   ws.MessageTypeAccept,
+			SessionID: o.session.ID,
+		},
+	}
+	data, _ := msgpack.Marshal(msg)
+	err := o.nats.Publish(relaySubject, data)
+	if err != nil {
+		return errors.Wrap(err, "failed to accept the session resume request")
+	}
+	if o.dropped {
+		o.buffer = append([]byte(ErrMsgResumeOutputDropped), o.buffer...)
+	}
+	msg.Header = ws.ProtoHdr{
+		Proto:     ws.ProtoTypeShell,
+		MsgType:   shell.MessageTypeShellCommand,
+		SessionID: o.session.ID,
+		Properties: map[string]interface{}{
+			"status": shell.NormalMessage,
+		},
+	}
+	for len(o.buffer) > 0 {
+		n := len(o.buffer)
+		if n > resumeReplayChunkSize {
+			n = resumeReplayChunkSize
+		}
+		msg.Body = o.buffer[:n]
+		data, _ = msgpack.Marshal(msg)
+		err = o.nats.Publish(relaySubject, data)
+		if err != nil {
+			return errors.Wrap(err, "failed to replay the session output")
+		}
+		o.buffer = o.buffer[n:]
+	}
+	o.buffer = nil
+	o.dropped = false
+
+	closeMsg := ws.ProtoMsg{
+		Header: ws.ProtoHdr{
+			Proto:     ws.ProtoTypeControl,
+			MsgType:   ws.MessageTypeClose,
+			SessionID: o.session.ID,
+		},
+		Body: []byte(ErrMsgSessionResumed),
+	}
+	if o.relayID != "" {
+		closeMsg.Header.Properties = map[string]interface{}{
+			PropertyRelayID: o.relayID,
+		}
+		data, _ = msgpack.Marshal(closeMsg)
+		_ = o.nats.Publish(o.session.RelaySubject(o.session.TenantID, o.relayID), data)
+	}
+	o.relayID = relayID
+	// signal the reading end before closing the owner's websocket for it
+	// not to mistake the connection closing for the owner leaving
+	select {
+	case <-o.attach:
+	default:
+	}
+	o.attach <- relayID
+	if o.conn != nil {
+		data, _ = msgpack.Marshal(closeMsg)
+		closeSession(o.conn, data, websocket.CloseNormalClosure, ErrMsgSessionResumed)
+		o.conn.Close()
+		o.conn = nil
+	}
+	return nil
+}
+
+// detach detaches the owner's websocket or relay if the session output is
+// still sent through it.
+func (o *sessionOutput) detach(conn *websocket.Conn, relayID string) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if conn != nil && o.conn == conn {
+		o.conn = nil
+	}
+	if relayID != "" && o.relayID == relayID {
+		o.relayID = ""
+	}
+}
+
+// ownerReader reads the messages of the session owner: from the owner's
+// websocket, and after the owner resumes the session, from the relays
+// serving the owner's new connections. When the owner's connection drops
+// while the remote terminal is running, the reader waits for the owner to
+// resume the session for the grace period of the session policy.
+type ownerReader struct {
+	conn       *websocket.Conn
+	relayID    string
+	out        *sessionOutput
+	resumeChan <-chan *natsio.Msg
+	writerDone <-chan struct{}
+	logger     *log.Logger
+	// terminalRunning is true while the remote terminal is running
+	terminalRunning *bool
+}
+
+// ReadMessage returns the next message of the session owner; io.EOF is
+// returned when the owner leaves the session.
+func (r *ownerReader) ReadMessage() ([]byte, error) {
+	for {
+		if r.conn != nil {
+			_, data, err := r.conn.ReadMessage()
+			if err == nil {
+				return data, nil
+			}
+			select {
+			case r.relayID = <-r.out.attach:
+				// the owner resumed the session from another connection
+				r.conn = nil
+				continue
+			default:
+			}
+			if !r.resumable(err) {
+				return nil, err
+			}
+			r.logger.Infof("session_id=%s connection lost, waiting for the "+
+				"user to resume the session: %s", r.out.session.ID, err.Error())
+			r.out.detach(r.conn, "")
+			r.conn = nil
+		} else if r.relayID != "" {
+			data, err := r.readRelay()
+			if data != nil || err != nil {
+				return data, err
+			}
+		} else if err := r.waitResume(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (r *ownerReader) resumable(err error) bool {
+	if !r.out.resumable || !*r.terminalRunning {
+		return false
+	} else if closeErr, ok := err.(*websocket.CloseError); ok &&
+		closeErr.Code == websocket.CloseNormalClosure {
+		return false
+	}
+	select {
+	case <-r.writerDone:
+		return false
+	default:
+	}
+	return true
+}
+
+// readRelay reads the next message of the owner from the relay, it returns
+// no message and no error when the relayed connection drops.
+func (r *ownerReader) readRelay() ([]byte, error) {
+	for {
+		select {
+		case msg := <-r.resumeChan:
+			m := &ws.ProtoMsg{}
+			err := msgpack.Unmarshal(msg.Data, m)
+			if err != nil {
+				return nil, err
+			}
+			if m.Header.Properties[PropertyRelayID] != r.relayID {
+				continue
+			}
+			delete(m.Header.Properties, PropertyRelayID)
+			if m.Header.Proto == ws.ProtoTypeControl {
+				switch m.Header.MsgType {
+				case ws.MessageTypeClose:
+					return nil, io.EOF
+				case model.SessionControlDetach:
+					r.out.detach(nil, r.relayID)
+					r.relayID = ""
+					if !*r.terminalRunning {
+						return nil, io.EOF
+					}
+					r.logger.Infof("session_id=%s connection lost, waiting for "+
+						"the user to resume the session", r.out.session.ID)
+					return nil, nil
+				}
+			}
+			return msgpack.Marshal(m)
+		case r.relayID = <-r.out.attach:
+		case <-r.writerDone:
+			return nil, io.EOF
+		}
+	}
+}
+
+// waitResume waits for the owner to resume the session within the grace
+// period of the session policy.
+func (r *ownerReader) waitResume() error {
+	timer := time.NewTimer(r.out.session.Policy.ResumeGracePeriod)
+	defer timer.Stop()
+	select {
+	case r.relayID = <-r.out.attach:
+		r.logger.Infof("session_id=%s resumed", r.out.session.ID)
+		return nil
+	case <-timer.C:
+		r.logger.Infof("session_id=%s was not resumed within the grace period",
+			r.out.session.ID)
+		return io.EOF
+	case <-r.writerDone:
+		return io.EOF
+	}
+}
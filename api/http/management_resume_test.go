@@ -0,0 +1,563 @@
+// Copyright 2023 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package http
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/mendersoftware/go-lib-micro/identity"
+	"github.com/mendersoftware/go-lib-micro/ws"
+	"github.com/mendersoftware/go-lib-micro/ws/shell"
+	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/vmihailenco/msgpack/v5"
+
+	"github.com/mendersoftware/deviceconnect/app"
+	app_mocks "github.com/mendersoftware/deviceconnect/app/mocks"
+	"github.com/mendersoftware/deviceconnect/model"
+)
+
+func TestManagementResumeFailures(t *testing.T) {
+	prevAcceptTimeout := resumeAcceptTimeout
+	defer func() {
+		resumeAcceptTimeout = prevAcceptTimeout
+	}()
+	resumeAcceptTimeout = time.Millisecond * 100
+
+	owner := identity.Identity{
+		Subject: "00000000-0000-0000-0000-000000000000",
+		Tenant:  "000000000000000000000000",
+		IsUser:  true,
+	}
+	const sessionID = "00000000-0000-0000-0000-000000000001"
+	testCases := []struct {
+		Name string
+
+		Session   *model.Session
+		ResumeErr error
+
+		HTTPStatus int
+	}{
+		{
+			Name: "ko, session not served anymore",
+
+			Session: &model.Session{
+				ID:       sessionID,
+				DeviceID: "1234567890",
+				UserID:   owner.Subject,
+				TenantID: owner.Tenant,
+			},
+
+			HTTPStatus: http.StatusConflict,
+		},
+		{
+			Name: "ko, session not found",
+
+			ResumeErr: app.ErrSessionNotFound,
+
+			HTTPStatus: http.StatusNotFound,
+		},
+		{
+			Name: "ko, invalid resume token",
+
+			ResumeErr: app.ErrSessionResumeDenied,
+
+			HTTPStatus: http.StatusForbidden,
+		},
+		{
+			Name: "ko, internal error",
+
+			ResumeErr: errors.New("internal error"),
+
+			HTTPStatus: http.StatusInternalServerError,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			app := &app_mocks.App{}
+			defer app.AssertExpectations(t)
+			natsClient := NewNATSTestClient(t)
+			router, _ := NewRouter(app, natsClient, nil)
+
+			app.On("ResumeUserSession",
+				mock.MatchedBy(func(_ context.Context) bool {
+					return true
+				}),
+				sessionID,
+				owner.Subject,
+				"token",
+			).Return(tc.Session, tc.ResumeErr)
+
+			s := httptest.NewServer(router)
+			defer s.Close()
+
+			headers := http.Header{}
+			headers.Set(headerAuthorization, "Bearer "+GenerateJWT(owner))
+			url := "ws" + strings.TrimPrefix(s.URL, "http")
+			url = url + strings.Replace(APIURLManagementResume, ":sessionId", sessionID, 1) +
+				"?" + paramResumeToken + "=token"
+
+			_, rsp, err := websocket.DefaultDialer.Dial(url, headers)
+			assert.Error(t, err)
+			if assert.NotNil(t, rsp) {
+				assert.Equal(t, tc.HTTPStatus, rsp.StatusCode)
+			}
+		})
+	}
+}
+
+func TestManagementResume(t *testing.T) {
+	prevWriteWait := writeWait
+	defer func() {
+		writeWait = prevWriteWait
+	}()
+	writeWait = time.Second
+
+	owner := identity.Identity{
+		Subject: "00000000-0000-0000-0000-000000000000",
+		Tenant:  "000000000000000000000000",
+		IsUser:  true,
+	}
+	const (
+		deviceID  = "1234567890"
+		sessionID = "00000000-0000-0000-0000-000000000001"
+		token     = "token"
+	)
+	session := &model.Session{
+		ID:       sessionID,
+		DeviceID: deviceID,
+		UserID:   owner.Subject,
+		TenantID: owner.Tenant,
+		Types:    []string{model.SessionTypeTerminal},
+	}
+
+	appMock := &app_mocks.App{}
+	defer appMock.AssertExpectations(t)
+	natsClient := NewNATSTestClient(t)
+	router, _ := NewRouter(appMock, natsClient, nil)
+	s := httptest.NewServer(router)
+	defer s.Close()
+
+	anyCtx := mock.MatchedBy(func(_ context.Context) bool {
+		return true
+	})
+	appMock.On("PrepareUserSession", anyCtx,
+		mock.MatchedBy(func(sess *model.Session) bool {
+			sess.ID = sessionID
+			sess.Policy = &model.SessionPolicy{
+				ResumeGracePeriod: time.Second * 5,
+			}
+			sess.ResumeToken = token
+			return true
+		}),
+	).Return(nil)
+	appMock.On("LogUserSession", anyCtx, mock.AnythingOfType("*model.Session"),
+		model.SessionTypeTerminal,
+	).Return(nil)
+	freed := make(chan struct{})
+	appMock.On("FreeUserSession", anyCtx, sessionID,
+		mock.AnythingOfType("[]string"),
+	).Return(nil).Run(func(mock.Arguments) {
+		close(freed)
+	})
+	appMock.On("GetControlRecorder", anyCtx, sessionID).Return(ioutil.Discard)
+	appMock.On("SignSessionRecording", anyCtx, sessionID,
+		mock.AnythingOfType("[]model.RecordingStreamHead"),
+	).Return(nil).Maybe()
+	appMock.On("GetRecorder", anyCtx, sessionID).Return(ioutil.Discard)
+	appMock.On("ResumeUserSession", anyCtx, sessionID, owner.Subject, token).
+		Return(session, nil)
+
+	deviceChan := make(chan *nats.Msg, 1)
+	sub, _ := natsClient.ChanSubscribe(
+		model.GetDeviceSubject(owner.Tenant, deviceID),
+		deviceChan,
+	)
+	defer sub.Unsubscribe()
+	readDevice := func(msgType string) *ws.ProtoMsg {
+		select {
+		case natsMsg := <-deviceChan:
+			var rMsg ws.ProtoMsg
+			err := msgpack.Unmarshal(natsMsg.Data, &rMsg)
+			assert.NoError(t, err)
+			assert.Equal(t, msgType, rMsg.Header.MsgType)
+			return &rMsg
+		case <-time.After(time.Second * 5):
+			assert.Fail(t, "timeout waiting for the message to the device")
+		}
+		return nil
+	}
+
+	// the owner opens the session and receives the resume token
+	baseURL := "ws" + strings.TrimPrefix(s.URL, "http")
+	headers := http.Header{}
+	headers.Set(headerAuthorization, "Bearer "+GenerateJWT(owner))
+	conn, _, err := websocket.DefaultDialer.Dial(baseURL+
+		strings.Replace(APIURLManagementDeviceConnect, ":deviceId", deviceID, 1),
+		headers,
+	)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	_, data, err := conn.ReadMessage()
+	if assert.NoError(t, err) {
+		var rsp ws.ProtoMsg
+		_ = msgpack.Unmarshal(data, &rsp)
+		assert.Equal(t, ws.ProtoTypeControl, rsp.Header.Proto)
+		assert.Equal(t, MessageTypeResumeToken, rsp.Header.MsgType)
+		assert.Equal(t, token, rsp.Header.Properties[PropertyResumeToken])
+		assert.EqualValues(t, 5, rsp.Header.Properties[PropertyResumeGracePeriod])
+	}
+
+	msg := ws.ProtoMsg{
+		Header: ws.ProtoHdr{
+			Proto:     ws.ProtoTypeShell,
+			MsgType:   shell.MessageTypeSpawnShell,
+			SessionID: sessionID,
+		},
+	}
+	b, _ := msgpack.Marshal(msg)
+	err = conn.WriteMessage(websocket.BinaryMessage, b)
+	assert.NoError(t, err)
+	readDevice(shell.MessageTypeSpawnShell)
+
+	// the connection drops, the output of the device is buffered
+	conn.UnderlyingConn().Close()
+	time.Sleep(time.Millisecond * 100)
+	msg = ws.ProtoMsg{
+		Header: ws.ProtoHdr{
+			Proto:     ws.ProtoTypeShell,
+			MsgType:   shell.MessageTypeShellCommand,
+			SessionID: sessionID,
+			Properties: map[string]interface{}{
+				"status": shell.NormalMessage,
+			},
+		},
+		Body: []byte("missed output"),
+	}
+	b, _ = msgpack.Marshal(msg)
+	err = natsClient.Publish(session.Subject(owner.Tenant), b)
+	assert.NoError(t, err)
+	time.Sleep(time.Millisecond * 100)
+	select {
+	case <-freed:
+		assert.Fail(t, "session freed when the connection dropped")
+	default:
+	}
+
+	// the owner resumes the session and receives the buffered output
+	conn, _, err = websocket.DefaultDialer.Dial(baseURL+
+		strings.Replace(APIURLManagementResume, ":sessionId", sessionID, 1)+
+		"?"+paramResumeToken+"="+token,
+		headers,
+	)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer conn.Close()
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	_, data, err = conn.ReadMessage()
+	if assert.NoError(t, err) {
+		var rsp ws.ProtoMsg
+		_ = msgpack.Unmarshal(data, &rsp)
+		assert.Equal(t, ws.ProtoTypeShell, rsp.Header.Proto)
+		assert.Equal(t, shell.MessageTypeShellCommand, rsp.Header.MsgType)
+		assert.Equal(t, []byte("missed output"), rsp.Body)
+	}
+
+	// the session goes on through the new connection
+	msg.Body = []byte("live output")
+	b, _ = msgpack.Marshal(msg)
+	err = natsClient.Publish(session.Subject(owner.Tenant), b)
+	assert.NoError(t, err)
+	_, data, err = conn.ReadMessage()
+	if assert.NoError(t, err) {
+		assert.Equal(t, b, data)
+	}
+
+	msg.Body = []byte("ls\n")
+	b, _ = msgpack.Marshal(msg)
+	err = conn.WriteMessage(websocket.BinaryMessage, b)
+	assert.NoError(t, err)
+	if rMsg := readDevice(shell.MessageTypeShellCommand); rMsg != nil {
+		assert.Equal(t, []byte("ls\n"), rMsg.Body)
+		assert.Equal(t, owner.Subject, rMsg.Header.Properties[PropertyUserID])
+		assert.NotContains(t, rMsg.Header.Properties, PropertyRelayID)
+	}
+
+	// the owner closes the session
+	err = conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+		time.Now().Add(time.Second),
+	)
+	assert.NoError(t, err)
+	readDevice(shell.MessageTypeStopShell)
+	select {
+	case <-freed:
+	case <-time.After(time.Second * 5):
+		assert.Fail(t, "session not freed")
+	}
+}
+
+func TestManagementResumeGracePeriod(t *testing.T) {
+	owner := identity.Identity{
+		Subject: "00000000-0000-0000-0000-000000000000",
+		Tenant:  "000000000000000000000000",
+		IsUser:  true,
+	}
+	const (
+		deviceID  = "1234567890"
+		sessionID = "00000000-0000-0000-0000-000000000001"
+	)
+
+	appMock := &app_mocks.App{}
+	defer appMock.AssertExpectations(t)
+	natsClient := NewNATSTestClient(t)
+	router, _ := NewRouter(appMock, natsClient, nil)
+	s := httptest.NewServer(router)
+	defer s.Close()
+
+	anyCtx := mock.MatchedBy(func(_ context.Context) bool {
+		return true
+	})
+	appMock.On("PrepareUserSession", anyCtx,
+		mock.MatchedBy(func(sess *model.Session) bool {
+			sess.ID = sessionID
+			sess.Policy = &model.SessionPolicy{
+				ResumeGracePeriod: time.Millisecond * 500,
+			}
+			sess.ResumeToken = "token"
+			return true
+		}),
+	).Return(nil)
+	appMock.On("LogUserSession", anyCtx, mock.AnythingOfType("*model.Session"),
+		model.SessionTypeTerminal,
+	).Return(nil)
+	freed := make(chan struct{})
+	appMock.On("FreeUserSession", anyCtx, sessionID,
+		mock.AnythingOfType("[]string"),
+	).Return(nil).Run(func(mock.Arguments) {
+		close(freed)
+	})
+	appMock.On("GetControlRecorder", anyCtx, sessionID).Return(ioutil.Discard)
+	appMock.On("SignSessionRecording", anyCtx, sessionID,
+		mock.AnythingOfType("[]model.RecordingStreamHead"),
+	).Return(nil).Maybe()
+	appMock.On("GetRecorder", anyCtx, sessionID).Return(ioutil.Discard)
+
+	deviceChan := make(chan *nats.Msg, 1)
+	sub, _ := natsClient.ChanSubscribe(
+		model.GetDeviceSubject(owner.Tenant, deviceID),
+		deviceChan,
+	)
+	defer sub.Unsubscribe()
+
+	headers := http.Header{}
+	headers.Set(headerAuthorization, "Bearer "+GenerateJWT(owner))
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(s.URL, "http")+
+		strings.Replace(APIURLManagementDeviceConnect, ":deviceId", deviceID, 1),
+		headers,
+	)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	msg := ws.ProtoMsg{
+		Header: ws.ProtoHdr{
+			Proto:     ws.ProtoTypeShell,
+			MsgType:   shell.MessageTypeSpawnShell,
+			SessionID: sessionID,
+		},
+	}
+	b, _ := msgpack.Marshal(msg)
+	err = conn.WriteMessage(websocket.BinaryMessage, b)
+	assert.NoError(t, err)
+	select {
+	case <-deviceChan:
+	case <-time.After(time.Second * 5):
+		assert.Fail(t, "timeout waiting for the message to the device")
+	}
+
+	// the connection drops and the session is not resumed in time
+	droppedAt := time.Now()
+	conn.UnderlyingConn().Close()
+	select {
+	case natsMsg := <-deviceChan:
+		var rMsg ws.ProtoMsg
+		err = msgpack.Unmarshal(natsMsg.Data, &rMsg)
+		assert.NoError(t, err)
+		assert.Equal(t, shell.MessageTypeStopShell, rMsg.Header.MsgType)
+		assert.GreaterOrEqual(t, time.Since(droppedAt), time.Millisecond*500)
+	case <-time.After(time.Second * 5):
+		assert.Fail(t, "the remote terminal was not stopped")
+	}
+	select {
+	case <-freed:
+	case <-time.After(time.Second * 5):
+		assert.Fail(t, "session not freed")
+	}
+}
+
+func TestManagementResumeTakeover(t *testing.T) {
+	prevWriteWait := writeWait
+	defer func() {
+		writeWait = prevWriteWait
+	}()
+	writeWait = time.Second
+
+	owner := identity.Identity{
+		Subject: "00000000-0000-0000-0000-000000000000",
+		Tenant:  "000000000000000000000000",
+		IsUser:  true,
+	}
+	const (
+		deviceID  = "1234567890"
+		sessionID = "00000000-0000-0000-0000-000000000001"
+		token     = "token"
+	)
+	session := &model.Session{
+		ID:       sessionID,
+		DeviceID: deviceID,
+		UserID:   owner.Subject,
+		TenantID: owner.Tenant,
+	}
+
+	appMock := &app_mocks.App{}
+	defer appMock.AssertExpectations(t)
+	natsClient := NewNATSTestClient(t)
+	router, _ := NewRouter(appMock, natsClient, nil)
+	s := httptest.NewServer(router)
+	defer s.Close()
+
+	anyCtx := mock.MatchedBy(func(_ context.Context) bool {
+		return true
+	})
+	appMock.On("PrepareUserSession", anyCtx,
+		mock.MatchedBy(func(sess *model.Session) bool {
+			sess.ID = sessionID
+			sess.Policy = &model.SessionPolicy{
+				ResumeGracePeriod: time.Second * 5,
+			}
+			sess.ResumeToken = token
+			return true
+		}),
+	).Return(nil)
+	appMock.On("LogUserSession", anyCtx, mock.AnythingOfType("*model.Session"),
+		model.SessionTypeTerminal,
+	).Return(nil)
+	freed := make(chan struct{})
+	appMock.On("FreeUserSession", anyCtx, sessionID,
+		mock.AnythingOfType("[]string"),
+	).Return(nil).Run(func(mock.Arguments) {
+		close(freed)
+	})
+	appMock.On("GetControlRecorder", anyCtx, sessionID).Return(ioutil.Discard)
+	appMock.On("SignSessionRecording", anyCtx, sessionID,
+		mock.AnythingOfType("[]model.RecordingStreamHead"),
+	).Return(nil).Maybe()
+	appMock.On("GetRecorder", anyCtx, sessionID).Return(ioutil.Discard)
+	appMock.On("ResumeUserSession", anyCtx, sessionID, owner.Subject, token).
+		Return(session, nil)
+
+	baseURL := "ws" + strings.TrimPrefix(s.URL, "http")
+	headers := http.Header{}
+	headers.Set(headerAuthorization, "Bearer "+GenerateJWT(owner))
+	ownerConn, _, err := websocket.DefaultDialer.Dial(baseURL+
+		strings.Replace(APIURLManagementDeviceConnect, ":deviceId", deviceID, 1),
+		headers,
+	)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer ownerConn.Close()
+	_ = ownerConn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	_, _, err = ownerConn.ReadMessage()
+	assert.NoError(t, err)
+	msg := ws.ProtoMsg{
+		Header: ws.ProtoHdr{
+			Proto:     ws.ProtoTypeShell,
+			MsgType:   shell.MessageTypeSpawnShell,
+			SessionID: sessionID,
+		},
+	}
+	b, _ := msgpack.Marshal(msg)
+	err = ownerConn.WriteMessage(websocket.BinaryMessage, b)
+	assert.NoError(t, err)
+
+	// the owner resumes the session before the connection is found dead:
+	// the previous connection is closed
+	conn, _, err := websocket.DefaultDialer.Dial(baseURL+
+		strings.Replace(APIURLManagementResume, ":sessionId", sessionID, 1)+
+		"?"+paramResumeToken+"="+token,
+		headers,
+	)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer conn.Close()
+	_, data, err := ownerConn.ReadMessage()
+	if assert.NoError(t, err) {
+		var rsp ws.ProtoMsg
+		_ = msgpack.Unmarshal(data, &rsp)
+		assert.Equal(t, ws.ProtoTypeControl, rsp.Header.Proto)
+		assert.Equal(t, ws.MessageTypeClose, rsp.Header.MsgType)
+		assert.Equal(t, ErrMsgSessionResumed, string(rsp.Body))
+	}
+	_, _, err = ownerConn.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseNormalClosure))
+
+	msg = ws.ProtoMsg{
+		Header: ws.ProtoHdr{
+			Proto:     ws.ProtoTypeShell,
+			MsgType:   shell.MessageTypeShellCommand,
+			SessionID: sessionID,
+		},
+		Body: []byte("output"),
+	}
+	b, _ = msgpack.Marshal(msg)
+	err = natsClient.Publish(session.Subject(owner.Tenant), b)
+	assert.NoError(t, err)
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	_, data, err = conn.ReadMessage()
+	if assert.NoError(t, err) {
+		assert.Equal(t, b, data)
+	}
+	select {
+	case <-freed:
+		assert.Fail(t, "session freed when resumed from another connection")
+	default:
+	}
+
+	err = conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+		time.Now().Add(time.Second),
+	)
+	assert.NoError(t, err)
+	select {
+	case <-freed:
+	case <-time.After(time.Second * 5):
+		assert.Fail(t, "session not freed")
+	}
+}
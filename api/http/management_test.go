@@ -15,23 +15,28 @@
 package http
 
 import (
+	"bytes"
 	"context"
 	"crypto/hmac"
 	"crypto/sha256"
 	"crypto/tls"
 	"encoding/base64"
 	"encoding/json"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
 
+	validation "github.com/go-ozzo/ozzo-validation/v4"
 	"github.com/gorilla/websocket"
 	"github.com/mendersoftware/go-lib-micro/identity"
 	"github.com/mendersoftware/go-lib-micro/ws"
+	"github.com/mendersoftware/go-lib-micro/ws/portforward"
 	"github.com/mendersoftware/go-lib-micro/ws/shell"
 	"github.com/nats-io/nats-server/v2/server"
 	"github.com/nats-io/nats.go"
@@ -194,6 +199,843 @@ func TestManagementGetDevice(t *testing.T) {
 	}
 }
 
+func TestManagementListSessions(t *testing.T) {
+	testCases := []struct {
+		Name     string
+		Query    string
+		Identity *identity.Identity
+
+		Filter        *model.SessionFilter
+		Sessions      []model.Session
+		Count         int64
+		ListSessErr   error
+		HTTPStatus    int
+		HdrTotalCount string
+	}{
+		{
+			Name:  "ok",
+			Query: "device_id=1234567890&type=terminal&page=2&per_page=10",
+			Identity: &identity.Identity{
+				Subject: "00000000-0000-0000-0000-000000000000",
+				Tenant:  "000000000000000000000000",
+				IsUser:  true,
+			},
+
+			Filter: &model.SessionFilter{
+				DeviceID: "1234567890",
+				Type:     model.SessionTypeTerminal,
+				Skip:     10,
+				Limit:    10,
+			},
+			Sessions: []model.Session{{
+				ID:       "00000000-0000-0000-0000-000000000001",
+				DeviceID: "1234567890",
+				UserID:   "00000000-0000-0000-0000-000000000000",
+				TenantID: "000000000000000000000000",
+				Types:    []string{model.SessionTypeTerminal},
+			}},
+			Count: 11,
+
+			HTTPStatus:    http.StatusOK,
+			HdrTotalCount: "11",
+		},
+		{
+			Name: "ko, missing auth",
+
+			HTTPStatus: http.StatusUnauthorized,
+		},
+		{
+			Name:  "ko, bad paging parameters",
+			Query: "per_page=foo",
+			Identity: &identity.Identity{
+				Subject: "00000000-0000-0000-0000-000000000000",
+				Tenant:  "000000000000000000000000",
+				IsUser:  true,
+			},
+
+			HTTPStatus: http.StatusBadRequest,
+		},
+		{
+			Name:  "ko, invalid filter",
+			Query: "type=foo",
+			Identity: &identity.Identity{
+				Subject: "00000000-0000-0000-0000-000000000000",
+				Tenant:  "000000000000000000000000",
+				IsUser:  true,
+			},
+
+			Filter: &model.SessionFilter{
+				Type:  "foo",
+				Limit: 20,
+			},
+			ListSessErr: errors.Wrap(validation.Errors{
+				"type": errors.New("must be a valid value"),
+			}, "app: invalid session filter"),
+
+			HTTPStatus: http.StatusBadRequest,
+		},
+		{
+			Name: "ko, internal error",
+			Identity: &identity.Identity{
+				Subject: "00000000-0000-0000-0000-000000000000",
+				Tenant:  "000000000000000000000000",
+				IsUser:  true,
+			},
+
+			Filter: &model.SessionFilter{
+				Limit: 20,
+			},
+			ListSessErr: errors.New("internal error"),
+
+			HTTPStatus: http.StatusInternalServerError,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			app := &app_mocks.App{}
+			defer app.AssertExpectations(t)
+
+			router, _ := NewRouter(app, nil, nil)
+			if tc.Filter != nil {
+				app.On("ListSessions",
+					mock.MatchedBy(func(_ context.Context) bool {
+						return true
+					}),
+					*tc.Filter,
+				).Return(tc.Sessions, tc.Count, tc.ListSessErr)
+			}
+
+			req, _ := http.NewRequest(http.MethodGet,
+				"http://localhost"+APIURLManagementSessions+"?"+tc.Query, nil)
+			if tc.Identity != nil {
+				req.Header.Set(headerAuthorization, "Bearer "+GenerateJWT(*tc.Identity))
+			}
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			assert.Equal(t, tc.HTTPStatus, w.Code)
+
+			if tc.HTTPStatus == http.StatusOK {
+				var sessions []model.Session
+				err := json.Unmarshal(w.Body.Bytes(), &sessions)
+				assert.NoError(t, err)
+				for i := range sessions {
+					sessions[i].StartTS = tc.Sessions[i].StartTS
+				}
+				assert.Equal(t, tc.Sessions, sessions)
+				assert.Equal(t, tc.HdrTotalCount, w.Header().Get(hdrTotalCount))
+				assert.NotEmpty(t, w.Header().Values(hdrLink))
+			}
+		})
+	}
+}
+
+func TestManagementSearchSessions(t *testing.T) {
+	from := time.Date(2023, 5, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2023, 6, 1, 0, 0, 0, 0, time.UTC)
+	userIdentity := &identity.Identity{
+		Subject: "00000000-0000-0000-0000-000000000000",
+		Tenant:  "000000000000000000000000",
+		IsUser:  true,
+	}
+	testCases := []struct {
+		Name     string
+		Query    string
+		Identity *identity.Identity
+
+		Filter    *model.SearchFilter
+		Results   []model.SearchResult
+		SearchErr error
+
+		HTTPStatus int
+	}{{
+		Name: "ok",
+		Query: "q=rm+-rf&device_id=device&user_id=user&page=2&per_page=10" +
+			"&from=2023-05-01T00:00:00Z&to=2023-06-01T00:00:00Z",
+		Identity: userIdentity,
+
+		Filter: &model.SearchFilter{
+			Query:    "rm -rf",
+			DeviceID: "device",
+			UserID:   "user",
+			From:     &from,
+			To:       &to,
+			Skip:     10,
+			Limit:    10,
+		},
+		Results: []model.SearchResult{{
+			SessionID: "session",
+			DeviceID:  "device",
+			UserID:    "user",
+			Matches: []model.SearchMatch{{
+				Offset:    42,
+				Snippet:   "$ rm -rf /tmp",
+				Timestamp: from,
+			}},
+		}},
+
+		HTTPStatus: http.StatusOK,
+	}, {
+		Name:  "ko, not a user",
+		Query: "q=rm+-rf",
+		Identity: &identity.Identity{
+			Subject:  "00000000-0000-0000-0000-000000000000",
+			Tenant:   "000000000000000000000000",
+			IsDevice: true,
+		},
+
+		HTTPStatus: http.StatusBadRequest,
+	}, {
+		Name:     "ko, bad paging parameters",
+		Query:    "q=rm+-rf&per_page=foo",
+		Identity: userIdentity,
+
+		HTTPStatus: http.StatusBadRequest,
+	}, {
+		Name:     "ko, bad time range",
+		Query:    "q=rm+-rf&from=yesterday",
+		Identity: userIdentity,
+
+		HTTPStatus: http.StatusBadRequest,
+	}, {
+		Name:     "ko, invalid filter",
+		Query:    "q=rm",
+		Identity: userIdentity,
+
+		Filter: &model.SearchFilter{
+			Query: "rm",
+			Limit: 20,
+		},
+		SearchErr: errors.Wrap(validation.Errors{
+			"q": errors.New("the length must be between 3 and 256"),
+		}, "app: invalid search filter"),
+
+		HTTPStatus: http.StatusBadRequest,
+	}, {
+		Name:     "ko, internal error",
+		Query:    "q=rm+-rf",
+		Identity: userIdentity,
+
+		Filter: &model.SearchFilter{
+			Query: "rm -rf",
+			Limit: 20,
+		},
+		SearchErr: errors.New("internal error"),
+
+		HTTPStatus: http.StatusInternalServerError,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			app := &app_mocks.App{}
+			defer app.AssertExpectations(t)
+
+			router, _ := NewRouter(app, nil, nil)
+			if tc.Filter != nil {
+				app.On("SearchRecordings",
+					mock.MatchedBy(func(_ context.Context) bool {
+						return true
+					}),
+					*tc.Filter,
+				).Return(tc.Results, tc.SearchErr)
+			}
+
+			req, _ := http.NewRequest(http.MethodGet,
+				"http://localhost"+APIURLManagementSessionsSearch+"?"+tc.Query, nil)
+			req.Header.Set(headerAuthorization, "Bearer "+GenerateJWT(*tc.Identity))
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			assert.Equal(t, tc.HTTPStatus, w.Code)
+
+			if tc.HTTPStatus == http.StatusOK {
+				var results []model.SearchResult
+				err := json.Unmarshal(w.Body.Bytes(), &results)
+				assert.NoError(t, err)
+				assert.Equal(t, tc.Results, results)
+			}
+		})
+	}
+}
+
+func TestManagementTerminateSession(t *testing.T) {
+	prevWriteWait := writeWait
+	defer func() {
+		writeWait = prevWriteWait
+	}()
+	writeWait = time.Second
+	userIdentity := &identity.Identity{
+		Subject: "00000000-0000-0000-0000-000000000000",
+		Tenant:  "000000000000000000000000",
+		IsUser:  true,
+	}
+	testCases := []struct {
+		Name     string
+		Identity *identity.Identity
+
+		Session       *model.Session
+		GetSessionErr error
+		TerminateErr  error
+
+		HTTPStatus int
+	}{
+		{
+			Name:     "ok",
+			Identity: userIdentity,
+
+			Session: &model.Session{
+				ID:       "00000000-0000-0000-0000-000000000001",
+				DeviceID: "1234567890",
+				UserID:   "00000000-0000-0000-0000-000000000002",
+				TenantID: "000000000000000000000000",
+				Types: []string{
+					model.SessionTypeTerminal,
+					model.SessionTypePortForward,
+				},
+			},
+
+			HTTPStatus: http.StatusNoContent,
+		},
+		{
+			Name: "ko, missing auth",
+
+			HTTPStatus: http.StatusUnauthorized,
+		},
+		{
+			Name:     "ko, session not found",
+			Identity: userIdentity,
+
+			GetSessionErr: app.ErrSessionNotFound,
+
+			HTTPStatus: http.StatusNotFound,
+		},
+		{
+			Name:     "ko, get session internal error",
+			Identity: userIdentity,
+
+			GetSessionErr: errors.New("internal error"),
+
+			HTTPStatus: http.StatusInternalServerError,
+		},
+		{
+			Name:     "ko, session already freed",
+			Identity: userIdentity,
+
+			Session: &model.Session{
+				ID:       "00000000-0000-0000-0000-000000000001",
+				DeviceID: "1234567890",
+				TenantID: "000000000000000000000000",
+			},
+			TerminateErr: app.ErrSessionNotFound,
+
+			HTTPStatus: http.StatusNotFound,
+		},
+		{
+			Name:     "ko, terminate internal error",
+			Identity: userIdentity,
+
+			Session: &model.Session{
+				ID:       "00000000-0000-0000-0000-000000000001",
+				DeviceID: "1234567890",
+				TenantID: "000000000000000000000000",
+			},
+			TerminateErr: errors.New("internal error"),
+
+			HTTPStatus: http.StatusInternalServerError,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			app := &app_mocks.App{}
+			defer app.AssertExpectations(t)
+			natsClient := NewNATSTestClient(t)
+
+			router, _ := NewRouter(app, natsClient, nil)
+
+			sessionID := "00000000-0000-0000-0000-000000000001"
+			if tc.Identity != nil {
+				app.On("GetSession",
+					mock.MatchedBy(func(_ context.Context) bool {
+						return true
+					}),
+					sessionID,
+				).Return(tc.Session, tc.GetSessionErr)
+			}
+			if tc.Session != nil {
+				app.On("TerminateUserSession",
+					mock.MatchedBy(func(_ context.Context) bool {
+						return true
+					}),
+					tc.Session,
+					tc.Identity.Subject,
+				).Return(tc.TerminateErr)
+			}
+
+			deviceChan := make(chan *nats.Msg, 2)
+			controlChan := make(chan *nats.Msg, 1)
+			if tc.Session != nil {
+				sub, _ := natsClient.ChanSubscribe(
+					model.GetDeviceSubject(
+						tc.Session.TenantID,
+						tc.Session.DeviceID,
+					), deviceChan,
+				)
+				defer sub.Unsubscribe()
+				sub, _ = natsClient.ChanSubscribe(
+					tc.Session.ControlSubject(tc.Session.TenantID),
+					controlChan,
+				)
+				defer sub.Unsubscribe()
+			}
+
+			url := strings.Replace(APIURLManagementSession, ":sessionId", sessionID, 1)
+			req, _ := http.NewRequest(http.MethodDelete, "http://localhost"+url, nil)
+			if tc.Identity != nil {
+				req.Header.Set(headerAuthorization, "Bearer "+GenerateJWT(*tc.Identity))
+			}
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			assert.Equal(t, tc.HTTPStatus, w.Code)
+
+			if tc.HTTPStatus != http.StatusNoContent {
+				return
+			}
+			for i := 0; i < 2; i++ {
+				select {
+				case msg := <-deviceChan:
+					var stopMsg ws.ProtoMsg
+					err := msgpack.Unmarshal(msg.Data, &stopMsg)
+					if assert.NoError(t, err) {
+						assert.Equal(t, tc.Session.ID, stopMsg.Header.SessionID)
+						assert.Contains(t, []string{
+							shell.MessageTypeStopShell,
+							portforward.MessageTypePortForwardStop,
+						}, stopMsg.Header.MsgType)
+					}
+				case <-time.After(time.Second * 5):
+					assert.Fail(t, "timeout waiting for stop message on nats channel")
+				}
+			}
+			select {
+			case msg := <-controlChan:
+				var closeMsg ws.ProtoMsg
+				err := msgpack.Unmarshal(msg.Data, &closeMsg)
+				if assert.NoError(t, err) {
+					assert.Equal(t, ws.ProtoTypeControl, closeMsg.Header.Proto)
+					assert.Equal(t, ws.MessageTypeClose, closeMsg.Header.MsgType)
+				}
+			case <-time.After(time.Second * 5):
+				assert.Fail(t, "timeout waiting for close message on nats channel")
+			}
+		})
+	}
+}
+
+func TestManagementConnectTerminated(t *testing.T) {
+	prevWriteWait := writeWait
+	defer func() {
+		writeWait = prevWriteWait
+	}()
+	writeWait = time.Second
+	const (
+		deviceID  = "1234567890"
+		sessionID = "session_id"
+	)
+	id := identity.Identity{
+		Subject: "00000000-0000-0000-0000-000000000000",
+		Tenant:  "000000000000000000000000",
+		IsUser:  true,
+	}
+	app := &app_mocks.App{}
+	defer app.AssertExpectations(t)
+	natsClient := NewNATSTestClient(t)
+	router, _ := NewRouter(app, natsClient, nil)
+
+	app.On("PrepareUserSession",
+		mock.MatchedBy(func(_ context.Context) bool {
+			return true
+		}),
+		mock.MatchedBy(func(sess *model.Session) bool {
+			sess.ID = sessionID
+			return true
+		}),
+	).Return(nil)
+	app.On("FreeUserSession",
+		mock.MatchedBy(func(_ context.Context) bool {
+			return true
+		}),
+		sessionID,
+		mock.AnythingOfType("[]string"),
+	).Return(nil)
+	app.On("GetControlRecorder",
+		mock.MatchedBy(func(_ context.Context) bool {
+			return true
+		}),
+		sessionID,
+	).Return(nil)
+	app.On("SignSessionRecording",
+		mock.MatchedBy(func(_ context.Context) bool {
+			return true
+		}),
+		sessionID,
+		mock.AnythingOfType("[]model.RecordingStreamHead"),
+	).Return(nil).Maybe()
+	app.On("GetRecorder",
+		mock.MatchedBy(func(_ context.Context) bool {
+			return true
+		}),
+		sessionID,
+	).Return(nil)
+
+	s := httptest.NewServer(router)
+	defer s.Close()
+
+	headers := http.Header{}
+	headers.Set(headerAuthorization, "Bearer "+GenerateJWT(id))
+	url := "ws" + strings.TrimPrefix(s.URL, "http")
+	url = url + strings.Replace(APIURLManagementDeviceConnect, ":deviceId", deviceID, 1)
+	conn, _, err := websocket.DefaultDialer.Dial(url, headers)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer conn.Close()
+
+	msg := ws.ProtoMsg{
+		Header: ws.ProtoHdr{
+			Proto:     ws.ProtoTypeControl,
+			MsgType:   ws.MessageTypeClose,
+			SessionID: sessionID,
+		},
+		Body: []byte(ErrMsgSessionTerminated),
+	}
+	b, _ := msgpack.Marshal(msg)
+	session := model.Session{ID: sessionID}
+	err = natsClient.Publish(session.ControlSubject(id.Tenant), b)
+	assert.NoError(t, err)
+
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	_, data, err := conn.ReadMessage()
+	if assert.NoError(t, err) {
+		assert.Equal(t, b, data)
+	}
+	_, _, err = conn.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.ClosePolicyViolation))
+}
+
+func TestManagementConnectSessionEnd(t *testing.T) {
+	prevWriteWait := writeWait
+	prevIdleCheckPeriod := idleCheckPeriod
+	defer func() {
+		writeWait = prevWriteWait
+		idleCheckPeriod = prevIdleCheckPeriod
+	}()
+	writeWait = time.Second
+	idleCheckPeriod = 20 * time.Millisecond
+	const (
+		deviceID  = "1234567890"
+		sessionID = "session_id"
+	)
+	testCases := []struct {
+		Name string
+
+		Policy *model.SessionPolicy
+
+		Warning   bool
+		EndReason string
+		Reason    string
+		CloseCode int
+	}{{
+		Name: "idle timeout",
+
+		Policy: &model.SessionPolicy{
+			IdleTimeout: 600 * time.Millisecond,
+			IdleWarning: 300 * time.Millisecond,
+		},
+
+		Warning:   true,
+		EndReason: model.SessionEndReasonIdle,
+		Reason:    ErrMsgSessionIdle,
+		CloseCode: websocket.CloseNormalClosure,
+	}, {
+		Name: "maximum duration",
+
+		Policy: &model.SessionPolicy{
+			IdleTimeout: time.Minute,
+			IdleWarning: time.Second,
+			MaxDuration: 500 * time.Millisecond,
+		},
+
+		EndReason: model.SessionEndReasonMaxDuration,
+		Reason:    ErrMsgSessionExpired,
+		CloseCode: websocket.ClosePolicyViolation,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			id := identity.Identity{
+				Subject: "00000000-0000-0000-0000-000000000000",
+				Tenant:  "000000000000000000000000",
+				IsUser:  true,
+			}
+			app := &app_mocks.App{}
+			defer app.AssertExpectations(t)
+			natsClient := NewNATSTestClient(t)
+			router, _ := NewRouter(app, natsClient, nil)
+
+			app.On("PrepareUserSession",
+				mock.MatchedBy(func(_ context.Context) bool {
+					return true
+				}),
+				mock.MatchedBy(func(sess *model.Session) bool {
+					sess.ID = sessionID
+					sess.Policy = tc.Policy
+					return true
+				}),
+			).Return(nil)
+			app.On("LogUserSession",
+				mock.MatchedBy(func(_ context.Context) bool {
+					return true
+				}),
+				mock.AnythingOfType("*model.Session"),
+				model.SessionTypeTerminal,
+			).Return(nil)
+			app.On("SetSessionEndReason",
+				mock.MatchedBy(func(_ context.Context) bool {
+					return true
+				}),
+				sessionID,
+				tc.EndReason,
+			).Return(nil)
+			app.On("FreeUserSession",
+				mock.MatchedBy(func(_ context.Context) bool {
+					return true
+				}),
+				sessionID,
+				mock.AnythingOfType("[]string"),
+			).Return(nil)
+			app.On("GetControlRecorder",
+				mock.MatchedBy(func(_ context.Context) bool {
+					return true
+				}),
+				sessionID,
+			).Return(nil)
+			app.On("SignSessionRecording",
+				mock.MatchedBy(func(_ context.Context) bool {
+					return true
+				}),
+				sessionID,
+				mock.AnythingOfType("[]model.RecordingStreamHead"),
+			).Return(nil).Maybe()
+			app.On("GetRecorder",
+				mock.MatchedBy(func(_ context.Context) bool {
+					return true
+				}),
+				sessionID,
+			).Return(nil)
+
+			deviceChan := make(chan *nats.Msg, channelSize)
+			sub, err := natsClient.ChanSubscribe(
+				model.GetDeviceSubject(id.Tenant, deviceID), deviceChan)
+			if !assert.NoError(t, err) {
+				t.FailNow()
+			}
+			//nolint:errcheck
+			defer sub.Unsubscribe()
+
+			s := httptest.NewServer(router)
+			defer s.Close()
+
+			headers := http.Header{}
+			headers.Set(headerAuthorization, "Bearer "+GenerateJWT(id))
+			url := "ws" + strings.TrimPrefix(s.URL, "http")
+			url = url + strings.Replace(APIURLManagementDeviceConnect, ":deviceId", deviceID, 1)
+			conn, _, err := websocket.DefaultDialer.Dial(url, headers)
+			if !assert.NoError(t, err) {
+				t.FailNow()
+			}
+			defer conn.Close()
+
+			msg := ws.ProtoMsg{
+				Header: ws.ProtoHdr{
+					Proto:   ws.ProtoTypeShell,
+					MsgType: shell.MessageTypeSpawnShell,
+				},
+			}
+			b, _ := msgpack.Marshal(msg)
+			err = conn.WriteMessage(websocket.BinaryMessage, b)
+			assert.NoError(t, err)
+
+			select {
+			case <-deviceChan:
+			case <-time.After(time.Second * 5):
+				assert.FailNow(t, "timeout waiting for the spawn shell message")
+			}
+
+			_ = conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+			if tc.Warning {
+				_, data, err := conn.ReadMessage()
+				if assert.NoError(t, err) {
+					msg := ws.ProtoMsg{}
+					_ = msgpack.Unmarshal(data, &msg)
+					assert.Equal(t, shell.MessageTypeShellCommand, msg.Header.MsgType)
+					assert.Contains(t, string(msg.Body), "due to inactivity")
+				}
+			}
+			_, data, err := conn.ReadMessage()
+			if assert.NoError(t, err) {
+				msg := ws.ProtoMsg{}
+				_ = msgpack.Unmarshal(data, &msg)
+				assert.Equal(t, shell.MessageTypeStopShell, msg.Header.MsgType)
+				assert.Equal(t, []byte(tc.Reason), msg.Body)
+			}
+			_, _, err = conn.ReadMessage()
+			assert.True(t, websocket.IsCloseError(err, tc.CloseCode))
+
+			select {
+			case natsMsg := <-deviceChan:
+				msg := ws.ProtoMsg{}
+				_ = msgpack.Unmarshal(natsMsg.Data, &msg)
+				assert.Equal(t, shell.MessageTypeStopShell, msg.Header.MsgType)
+				assert.Equal(t, []byte(tc.Reason), msg.Body)
+			case <-time.After(time.Second * 5):
+				assert.Fail(t, "timeout waiting for the stop shell message")
+			}
+		})
+	}
+}
+
+func TestManagementConnectDeviceClose(t *testing.T) {
+	const (
+		deviceID  = "1234567890"
+		sessionID = "session_id"
+	)
+	id := identity.Identity{
+		Subject: "00000000-0000-0000-0000-000000000000",
+		Tenant:  "000000000000000000000000",
+		IsUser:  true,
+	}
+	app := &app_mocks.App{}
+	defer app.AssertExpectations(t)
+	natsClient := NewNATSTestClient(t)
+	router, _ := NewRouter(app, natsClient, nil)
+
+	app.On("PrepareUserSession",
+		mock.MatchedBy(func(_ context.Context) bool {
+			return true
+		}),
+		mock.MatchedBy(func(sess *model.Session) bool {
+			sess.ID = sessionID
+			return true
+		}),
+	).Return(nil)
+	app.On("LogUserSession",
+		mock.MatchedBy(func(_ context.Context) bool {
+			return true
+		}),
+		mock.AnythingOfType("*model.Session"),
+		model.SessionTypeTerminal,
+	).Return(nil)
+	app.On("SetSessionEndReason",
+		mock.MatchedBy(func(_ context.Context) bool {
+			return true
+		}),
+		sessionID,
+		model.SessionEndReasonDeviceClosed,
+	).Return(nil)
+	app.On("FreeUserSession",
+		mock.MatchedBy(func(_ context.Context) bool {
+			return true
+		}),
+		sessionID,
+		mock.AnythingOfType("[]string"),
+	).Return(nil)
+	app.On("GetControlRecorder",
+		mock.MatchedBy(func(_ context.Context) bool {
+			return true
+		}),
+		sessionID,
+	).Return(nil)
+	app.On("SignSessionRecording",
+		mock.MatchedBy(func(_ context.Context) bool {
+			return true
+		}),
+		sessionID,
+		mock.AnythingOfType("[]model.RecordingStreamHead"),
+	).Return(nil).Maybe()
+	app.On("GetRecorder",
+		mock.MatchedBy(func(_ context.Context) bool {
+			return true
+		}),
+		sessionID,
+	).Return(nil)
+
+	deviceChan := make(chan *nats.Msg, channelSize)
+	sub, err := natsClient.ChanSubscribe(
+		model.GetDeviceSubject(id.Tenant, deviceID), deviceChan)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	//nolint:errcheck
+	defer sub.Unsubscribe()
+
+	s := httptest.NewServer(router)
+	defer s.Close()
+
+	headers := http.Header{}
+	headers.Set(headerAuthorization, "Bearer "+GenerateJWT(id))
+	url := "ws" + strings.TrimPrefix(s.URL, "http")
+	url = url + strings.Replace(APIURLManagementDeviceConnect, ":deviceId", deviceID, 1)
+	conn, _, err := websocket.DefaultDialer.Dial(url, headers)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer conn.Close()
+
+	b, _ := msgpack.Marshal(ws.ProtoMsg{
+		Header: ws.ProtoHdr{
+			Proto:   ws.ProtoTypeShell,
+			MsgType: shell.MessageTypeSpawnShell,
+		},
+	})
+	err = conn.WriteMessage(websocket.BinaryMessage, b)
+	assert.NoError(t, err)
+
+	select {
+	case <-deviceChan:
+	case <-time.After(time.Second * 5):
+		assert.FailNow(t, "timeout waiting for the spawn shell message")
+	}
+
+	// the device disconnects: the shell is stopped and the session closed
+	for _, data := range prepDeviceDisconnect(sessionID, &model.ActiveSession{
+		Protocols: map[ws.ProtoType]bool{ws.ProtoTypeShell: true},
+	}) {
+		err = natsClient.Publish(model.GetSessionSubject(id.Tenant, sessionID), data)
+		assert.NoError(t, err)
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	_, data, err := conn.ReadMessage()
+	if assert.NoError(t, err) {
+		msg := ws.ProtoMsg{}
+		_ = msgpack.Unmarshal(data, &msg)
+		assert.Equal(t, shell.MessageTypeStopShell, msg.Header.MsgType)
+		assert.Equal(t, []byte(ErrMsgDeviceDisconnected), msg.Body)
+	}
+	_, data, err = conn.ReadMessage()
+	if assert.NoError(t, err) {
+		msg := ws.ProtoMsg{}
+		_ = msgpack.Unmarshal(data, &msg)
+		assert.Equal(t, ws.ProtoTypeControl, msg.Header.Proto)
+		assert.Equal(t, ws.MessageTypeClose, msg.Header.MsgType)
+	}
+	_, _, err = conn.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseGoingAway))
+}
+
 func TestManagementConnect(t *testing.T) {
 	prevPongWait := pongWait
 	prevWriteWait := writeWait
@@ -266,6 +1108,13 @@ func TestManagementConnect(t *testing.T) {
 				}),
 				tc.SessionID,
 			).Return(nil)
+			app.On("SignSessionRecording",
+				mock.MatchedBy(func(_ context.Context) bool {
+					return true
+				}),
+				tc.SessionID,
+				mock.AnythingOfType("[]model.RecordingStreamHead"),
+			).Return(nil).Maybe()
 			app.On("GetRecorder",
 				mock.MatchedBy(func(_ context.Context) bool {
 					return true
@@ -549,6 +1398,7 @@ func TestManagementPlayback(t *testing.T) {
 		Identity        *identity.Identity
 		SleepIntervalMs string
 		NoUpgrade       bool
+		BadRequest      bool
 	}{
 		{
 			Name:      "ok",
@@ -587,94 +1437,766 @@ func TestManagementPlayback(t *testing.T) {
 			Name:      "bad request no auth",
 			SessionID: "session_id",
 		},
+		{
+			Name:      "bad request invalid sleep interval",
+			SessionID: "session_id",
+			Identity: &identity.Identity{
+				Subject: "00000000-0000-0000-0000-000000000000",
+				Tenant:  "000000000000000000000000",
+				IsUser:  true,
+				Plan:    "professional",
+			},
+			SleepIntervalMs: "fast",
+			BadRequest:      true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			app := &app_mocks.App{}
+			defer app.AssertExpectations(t)
+			natsClient := NewNATSTestClient(t)
+			router, _ := NewRouter(app, natsClient, nil)
+
+			headers := http.Header{}
+			if tc.Identity != nil {
+				headers.Set(headerAuthorization, "Bearer "+GenerateJWT(*tc.Identity))
+			}
+
+			if tc.Identity != nil && !tc.NoUpgrade && !tc.BadRequest {
+				app.On("GetSessionRecording",
+					mock.MatchedBy(func(_ context.Context) bool {
+						return true
+					}),
+					tc.SessionID,
+					mock.AnythingOfType("*app.Playback"),
+				).Return(nil)
+			}
+
+			s := httptest.NewServer(router)
+			defer s.Close()
+
+			if tc.NoUpgrade {
+				url := s.URL + strings.Replace(
+					APIURLManagementPlayback, ":sessionId",
+					tc.SessionID, 1,
+				)
+				req, err := http.NewRequest(http.MethodGet, url, nil)
+				req.Header.Set(headerAuthorization, "Bearer "+GenerateJWT(*tc.Identity))
+				assert.NotNil(t, req)
+				assert.NoError(t, err)
+				tr := &http.Transport{
+					TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+				}
+
+				client := &http.Client{
+					Transport: tr,
+				}
+				ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+				defer cancel()
+				rsp, err := client.Do(req.WithContext(ctx))
+				assert.Equal(t, rsp.StatusCode, http.StatusBadRequest)
+				return
+			}
+
+			url := "ws" + strings.TrimPrefix(s.URL, "http")
+			url = url + strings.Replace(
+				APIURLManagementPlayback, ":sessionId",
+				tc.SessionID, 1,
+			)
+			if len(tc.SleepIntervalMs) > 0 {
+				url += "?" + PlaybackSleepIntervalMsField + "=" + tc.SleepIntervalMs
+			}
+			conn, _, err := websocket.DefaultDialer.Dial(url, headers)
+			if tc.Identity == nil || tc.BadRequest {
+				assert.EqualError(t, err, "websocket: bad handshake")
+				return
+			} else {
+				assert.NoError(t, err)
+			}
+
+			pingReceived := make(chan struct{}, 1)
+			conn.SetPingHandler(func(message string) error {
+				pingReceived <- struct{}{}
+				return conn.WriteControl(
+					websocket.PongMessage,
+					[]byte{},
+					time.Now().Add(writeWait),
+				)
+			})
+			pongReceived := make(chan struct{}, 1)
+			conn.SetPongHandler(func(message string) error {
+				pongReceived <- struct{}{}
+				return nil
+			})
+
+			// close the websocket
+			conn.Close()
+
+			// wait 100ms to let the websocket fully shutdown on the server
+			time.Sleep(100 * time.Millisecond)
+		})
+	}
+}
+
+func TestManagementPlaybackControls(t *testing.T) {
+	const sessionID = "00000000-0000-0000-0000-000000000001"
+	userIdentity := identity.Identity{
+		Subject: "00000000-0000-0000-0000-000000000000",
+		Tenant:  "000000000000000000000000",
+		IsUser:  true,
+	}
+	outputs := []string{"$ ls\r\n", "file\r\n"}
+
+	app := &app_mocks.App{}
+	defer app.AssertExpectations(t)
+	// seeking backwards reads the recording again
+	app.On("GetSessionRecording",
+		mock.MatchedBy(func(_ context.Context) bool {
+			return true
+		}),
+		sessionID,
+		mock.AnythingOfType("*app.Playback"),
+	).Run(func(args mock.Arguments) {
+		w := args.Get(2).(io.Writer)
+		for _, output := range outputs {
+			b, _ := msgpack.Marshal(&ws.ProtoMsg{
+				Header: ws.ProtoHdr{
+					Proto:   ws.ProtoTypeShell,
+					MsgType: shell.MessageTypeShellCommand,
+				},
+				Body: []byte(output),
+			})
+			if _, err := w.Write(b); err != nil {
+				return
+			}
+		}
+	}).Return(nil).Twice()
+
+	router, _ := NewRouter(app, NewNATSTestClient(t), nil)
+	s := httptest.NewServer(router)
+	defer s.Close()
+
+	url := "ws" + strings.TrimPrefix(s.URL, "http") +
+		strings.Replace(APIURLManagementPlayback, ":sessionId", sessionID, 1) +
+		"?" + PlaybackSleepIntervalMsField + "=0"
+	headers := http.Header{}
+	headers.Set(headerAuthorization, "Bearer "+GenerateJWT(userIdentity))
+	conn, _, err := websocket.DefaultDialer.Dial(url, headers)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+
+	played := func(n int) []string {
+		var bodies []string
+		for i := 0; i < n; i++ {
+			_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			_, data, err := conn.ReadMessage()
+			if !assert.NoError(t, err) {
+				break
+			}
+			var msg ws.ProtoMsg
+			assert.NoError(t, msgpack.Unmarshal(data, &msg))
+			bodies = append(bodies, string(msg.Body))
+		}
+		return bodies
+	}
+	sendControl := func(msgType string, props map[string]interface{}) {
+		b, _ := msgpack.Marshal(&ws.ProtoMsg{
+			Header: ws.ProtoHdr{
+				Proto:      ws.ProtoTypeControl,
+				MsgType:    msgType,
+				Properties: props,
+			},
+		})
+		assert.NoError(t, conn.WriteMessage(websocket.BinaryMessage, b))
+	}
+
+	assert.Equal(t, outputs, played(2))
+	// invalid control messages are ignored
+	assert.NoError(t, conn.WriteMessage(websocket.BinaryMessage, []byte("invalid")))
+	sendControl(model.PlaybackMessageSpeed,
+		map[string]interface{}{model.PlaybackSpeedField: 1000})
+	sendControl(model.PlaybackMessageSeek,
+		map[string]interface{}{model.PlaybackSeekOffsetField: 0})
+	assert.Equal(t, append([]string{"\x1bc"}, outputs...), played(3))
+}
+
+func TestManagementExportRecording(t *testing.T) {
+	const sessionID = "00000000-0000-0000-0000-000000000001"
+	userIdentity := &identity.Identity{
+		Subject: "00000000-0000-0000-0000-000000000000",
+		Tenant:  "000000000000000000000000",
+		IsUser:  true,
+	}
+	recording := func(w io.Writer) {
+		for _, msg := range []ws.ProtoMsg{{
+			Header: ws.ProtoHdr{
+				Proto:   ws.ProtoTypeShell,
+				MsgType: shell.MessageTypeResizeShell,
+				Properties: map[string]interface{}{
+					model.ResizeMessageTermWidthField:  uint16(132),
+					model.ResizeMessageTermHeightField: uint16(43),
+				},
+			},
+		}, {
+			Header: ws.ProtoHdr{
+				Proto:   ws.ProtoTypeShell,
+				MsgType: shell.MessageTypeShellCommand,
+			},
+			Body: []byte("$ "),
+		}, {
+			Header: ws.ProtoHdr{
+				Proto:   ws.ProtoTypeShell,
+				MsgType: model.DelayMessageName,
+				Properties: map[string]interface{}{
+					model.DelayMessageValueField: uint16(2000),
+				},
+			},
+		}, {
+			Header: ws.ProtoHdr{
+				Proto:   ws.ProtoTypeShell,
+				MsgType: shell.MessageTypeShellCommand,
+			},
+			Body: []byte("exit\r\n"),
+		}} {
+			b, _ := msgpack.Marshal(&msg)
+			_, _ = w.Write(b)
+		}
+	}
+
+	testCases := []struct {
+		Name     string
+		Query    string
+		Identity *identity.Identity
+
+		Recording       func(w io.Writer)
+		GetRecordingErr error
+		CallApp         bool
+
+		HTTPStatus int
+		Body       string
+	}{{
+		Name:     "ok",
+		Query:    "format=asciicast",
+		Identity: userIdentity,
+
+		Recording: recording,
+		CallApp:   true,
+
+		HTTPStatus: http.StatusOK,
+		Body: `{"version":2,"width":132,"height":43,` +
+			`"title":"session ` + sessionID + `"}` + "\n" +
+			`[0,"o","$ "]` + "\n" +
+			`[2,"o","exit\r\n"]` + "\n",
+	}, {
+		Name:     "ok, default format",
+		Identity: userIdentity,
+
+		Recording: recording,
+		CallApp:   true,
+
+		HTTPStatus: http.StatusOK,
+	}, {
+		Name:     "ko, recording not found",
+		Identity: userIdentity,
+
+		CallApp: true,
+
+		HTTPStatus: http.StatusNotFound,
+	}, {
+		Name:     "ko, recording without events",
+		Identity: userIdentity,
+
+		Recording: func(w io.Writer) {
+			b, _ := msgpack.Marshal(&ws.ProtoMsg{
+				Header: ws.ProtoHdr{
+					Proto:   ws.ProtoTypeShell,
+					MsgType: model.DelayMessageName,
+					Properties: map[string]interface{}{
+						model.DelayMessageValueField: uint16(2000),
+					},
+				},
+			})
+			_, _ = w.Write(b)
+		},
+		CallApp: true,
+
+		HTTPStatus: http.StatusNotFound,
+	}, {
+		Name:     "ko, internal error while streaming",
+		Identity: userIdentity,
+
+		Recording:       recording,
+		GetRecordingErr: errors.New("internal error"),
+		CallApp:         true,
+
+		// the response is under way, the attachment is truncated
+		HTTPStatus: http.StatusOK,
+		Body: `{"version":2,"width":132,"height":43,` +
+			`"title":"session ` + sessionID + `"}` + "\n" +
+			`[0,"o","$ "]` + "\n" +
+			`[2,"o","exit\r\n"]` + "\n",
+	}, {
+		Name:     "ko, unsupported format",
+		Query:    "format=mp4",
+		Identity: userIdentity,
+
+		HTTPStatus: http.StatusBadRequest,
+	}, {
+		Name: "ko, not a user",
+		Identity: &identity.Identity{
+			Subject:  "00000000-0000-0000-0000-000000000000",
+			Tenant:   "000000000000000000000000",
+			IsDevice: true,
+		},
+
+		HTTPStatus: http.StatusBadRequest,
+	}, {
+		Name:     "ko, internal error",
+		Identity: userIdentity,
+
+		GetRecordingErr: errors.New("internal error"),
+		CallApp:         true,
+
+		HTTPStatus: http.StatusInternalServerError,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			app := &app_mocks.App{}
+			defer app.AssertExpectations(t)
+
+			router, _ := NewRouter(app, nil, nil)
+			if tc.CallApp {
+				app.On("GetSessionRecording",
+					mock.MatchedBy(func(_ context.Context) bool {
+						return true
+					}),
+					sessionID,
+					mock.AnythingOfType("*app.AsciicastWriter"),
+				).Run(func(args mock.Arguments) {
+					if tc.Recording != nil {
+						tc.Recording(args.Get(2).(io.Writer))
+					}
+				}).Return(tc.GetRecordingErr)
+			}
+
+			url := "http://localhost" + strings.Replace(
+				APIURLManagementRecording, ":sessionId", sessionID, 1,
+			)
+			if tc.Query != "" {
+				url += "?" + tc.Query
+			}
+			req, _ := http.NewRequest(http.MethodGet, url, nil)
+			req.Header.Set(headerAuthorization, "Bearer "+GenerateJWT(*tc.Identity))
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			assert.Equal(t, tc.HTTPStatus, w.Code)
+			if tc.HTTPStatus == http.StatusOK {
+				assert.Equal(t, "application/x-asciicast",
+					w.Header().Get("Content-Type"))
+				assert.Equal(t,
+					`attachment; filename="`+sessionID+`.cast"`,
+					w.Header().Get("Content-Disposition"))
+				if tc.Body != "" {
+					assert.Equal(t, tc.Body, w.Body.String())
+				}
+			}
+		})
+	}
+}
+
+func TestManagementTranscript(t *testing.T) {
+	const sessionID = "00000000-0000-0000-0000-000000000001"
+	userIdentity := &identity.Identity{
+		Subject: "00000000-0000-0000-0000-000000000000",
+		Tenant:  "000000000000000000000000",
+		IsUser:  true,
+	}
+	recording := func(w io.Writer) {
+		for _, msg := range []ws.ProtoMsg{{
+			Header: ws.ProtoHdr{
+				Proto:   ws.ProtoTypeShell,
+				MsgType: shell.MessageTypeShellCommand,
+			},
+			Body: []byte("\x1b[01;32m$\x1b[00m lss\b \b\r\n"),
+		}, {
+			Header: ws.ProtoHdr{
+				Proto:   ws.ProtoTypeShell,
+				MsgType: model.DelayMessageName,
+				Properties: map[string]interface{}{
+					model.DelayMessageValueField: uint16(2000),
+				},
+			},
+		}, {
+			Header: ws.ProtoHdr{
+				Proto:   ws.ProtoTypeShell,
+				MsgType: shell.MessageTypeShellCommand,
+			},
+			Body: []byte("file\r\n"),
+		}} {
+			b, _ := msgpack.Marshal(&msg)
+			_, _ = w.Write(b)
+		}
+	}
+
+	testCases := []struct {
+		Name     string
+		Query    string
+		Identity *identity.Identity
+
+		Recording       func(w io.Writer)
+		GetRecordingErr error
+		CallApp         bool
+
+		HTTPStatus  int
+		ContentType string
+		Filename    string
+		Body        string
+	}{{
+		Name:     "ok, text",
+		Identity: userIdentity,
+
+		Recording: recording,
+		CallApp:   true,
+
+		HTTPStatus:  http.StatusOK,
+		ContentType: "text/plain; charset=utf-8",
+		Filename:    sessionID + ".txt",
+		Body:        "$ ls\nfile\n",
+	}, {
+		Name:     "ok, JSON lines",
+		Query:    "format=jsonl",
+		Identity: userIdentity,
+
+		Recording: recording,
+		CallApp:   true,
+
+		HTTPStatus:  http.StatusOK,
+		ContentType: "application/x-ndjson",
+		Filename:    sessionID + ".jsonl",
+		Body: `{"time":0,"line":"$ ls"}` + "\n" +
+			`{"time":2,"line":"file"}` + "\n",
+	}, {
+		Name:     "ko, recording not found",
+		Identity: userIdentity,
+
+		CallApp: true,
+
+		HTTPStatus: http.StatusNotFound,
+	}, {
+		Name:     "ko, unsupported format",
+		Query:    "format=asciicast",
+		Identity: userIdentity,
+
+		HTTPStatus: http.StatusBadRequest,
+	}, {
+		Name: "ko, not a user",
+		Identity: &identity.Identity{
+			Subject:  "00000000-0000-0000-0000-000000000000",
+			Tenant:   "000000000000000000000000",
+			IsDevice: true,
+		},
+
+		HTTPStatus: http.StatusBadRequest,
+	}, {
+		Name:     "ko, internal error",
+		Identity: userIdentity,
+
+		GetRecordingErr: errors.New("internal error"),
+		CallApp:         true,
+
+		HTTPStatus: http.StatusInternalServerError,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			app := &app_mocks.App{}
+			defer app.AssertExpectations(t)
+
+			router, _ := NewRouter(app, nil, nil)
+			if tc.CallApp {
+				app.On("GetSessionRecording",
+					mock.MatchedBy(func(_ context.Context) bool {
+						return true
+					}),
+					sessionID,
+					mock.AnythingOfType("*app.TranscriptWriter"),
+				).Run(func(args mock.Arguments) {
+					if tc.Recording != nil {
+						tc.Recording(args.Get(2).(io.Writer))
+					}
+				}).Return(tc.GetRecordingErr)
+			}
+
+			url := "http://localhost" + strings.Replace(
+				APIURLManagementTranscript, ":sessionId", sessionID, 1,
+			)
+			if tc.Query != "" {
+				url += "?" + tc.Query
+			}
+			req, _ := http.NewRequest(http.MethodGet, url, nil)
+			req.Header.Set(headerAuthorization, "Bearer "+GenerateJWT(*tc.Identity))
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			assert.Equal(t, tc.HTTPStatus, w.Code)
+			if tc.HTTPStatus == http.StatusOK {
+				assert.Equal(t, tc.ContentType, w.Header().Get("Content-Type"))
+				assert.Equal(t,
+					`attachment; filename="`+tc.Filename+`"`,
+					w.Header().Get("Content-Disposition"))
+				assert.Equal(t, tc.Body, w.Body.String())
+			}
+		})
 	}
+}
+
+func TestManagementVerifyRecording(t *testing.T) {
+	const sessionID = "00000000-0000-0000-0000-000000000001"
+	userIdentity := &identity.Identity{
+		Subject: "00000000-0000-0000-0000-000000000000",
+		Tenant:  "000000000000000000000000",
+		IsUser:  true,
+	}
+	verification := &model.RecordingVerification{
+		SessionID: sessionID,
+		Valid:     true,
+		Digest:    "00",
+		Signature: model.RecordingSignatureValid,
+		Streams: []model.RecordingStreamVerification{{
+			Stream: model.RecordingStreamOutput,
+			Chunks: 1,
+			Hash:   "00",
+		}},
+	}
+
+	testCases := []struct {
+		Name     string
+		Identity *identity.Identity
+
+		CallApp      bool
+		Verification *model.RecordingVerification
+		VerifyErr    error
+
+		HTTPStatus int
+	}{{
+		Name:     "ok",
+		Identity: userIdentity,
+
+		CallApp:      true,
+		Verification: verification,
+
+		HTTPStatus: http.StatusOK,
+	}, {
+		Name:     "ko, recording not found",
+		Identity: userIdentity,
+
+		CallApp:   true,
+		VerifyErr: app.ErrRecordingNotFound,
+
+		HTTPStatus: http.StatusNotFound,
+	}, {
+		Name:     "ko, internal error",
+		Identity: userIdentity,
+
+		CallApp:   true,
+		VerifyErr: errors.New("internal error"),
+
+		HTTPStatus: http.StatusInternalServerError,
+	}, {
+		Name: "ko, not a user",
+		Identity: &identity.Identity{
+			Subject:  "00000000-0000-0000-0000-000000000000",
+			Tenant:   "000000000000000000000000",
+			IsDevice: true,
+		},
+
+		HTTPStatus: http.StatusBadRequest,
+	}}
 
 	for _, tc := range testCases {
 		t.Run(tc.Name, func(t *testing.T) {
 			app := &app_mocks.App{}
 			defer app.AssertExpectations(t)
-			natsClient := NewNATSTestClient(t)
-			router, _ := NewRouter(app, natsClient, nil)
-
-			headers := http.Header{}
-			if tc.Identity != nil {
-				headers.Set(headerAuthorization, "Bearer "+GenerateJWT(*tc.Identity))
-			}
 
-			if tc.Identity != nil && !tc.NoUpgrade {
-				app.On("GetSessionRecording",
+			router, _ := NewRouter(app, nil, nil)
+			if tc.CallApp {
+				app.On("VerifySessionRecording",
 					mock.MatchedBy(func(_ context.Context) bool {
 						return true
 					}),
-					tc.SessionID,
-					mock.AnythingOfType("*app.Playback"),
-				).Return(nil)
+					sessionID,
+				).Return(tc.Verification, tc.VerifyErr)
 			}
 
-			s := httptest.NewServer(router)
-			defer s.Close()
+			url := "http://localhost" + strings.Replace(
+				APIURLManagementRecordingVerify, ":sessionId", sessionID, 1,
+			)
+			req, _ := http.NewRequest(http.MethodGet, url, nil)
+			req.Header.Set(headerAuthorization, "Bearer "+GenerateJWT(*tc.Identity))
 
-			if tc.NoUpgrade {
-				url := s.URL + strings.Replace(
-					APIURLManagementPlayback, ":sessionId",
-					tc.SessionID, 1,
-				)
-				req, err := http.NewRequest(http.MethodGet, url, nil)
-				req.Header.Set(headerAuthorization, "Bearer "+GenerateJWT(*tc.Identity))
-				assert.NotNil(t, req)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			assert.Equal(t, tc.HTTPStatus, w.Code)
+			if tc.HTTPStatus == http.StatusOK {
+				var body model.RecordingVerification
+				err := json.Unmarshal(w.Body.Bytes(), &body)
 				assert.NoError(t, err)
-				tr := &http.Transport{
-					TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-				}
-
-				client := &http.Client{
-					Transport: tr,
-				}
-				ctx, cancel := context.WithTimeout(context.Background(), time.Second)
-				defer cancel()
-				rsp, err := client.Do(req.WithContext(ctx))
-				assert.Equal(t, rsp.StatusCode, http.StatusBadRequest)
-				return
+				assert.Equal(t, *tc.Verification, body)
 			}
+		})
+	}
+}
 
-			url := "ws" + strings.TrimPrefix(s.URL, "http")
-			url = url + strings.Replace(
-				APIURLManagementPlayback, ":sessionId",
-				tc.SessionID, 1,
-			)
-			if len(tc.SleepIntervalMs) > 0 {
-				url += "?" + PlaybackSleepIntervalMsField + "=" + tc.SleepIntervalMs
+func TestSendResizeMessage(t *testing.T) {
+	testCases := []struct {
+		Name       string
+		Properties map[string]interface{}
+
+		Width  uint16
+		Height uint16
+		Sent   bool
+	}{{
+		Name: "ok, small terminal",
+		Properties: map[string]interface{}{
+			model.ResizeMessageTermWidthField:  uint8(80),
+			model.ResizeMessageTermHeightField: int8(24),
+		},
+
+		Width:  80,
+		Height: 24,
+		Sent:   true,
+	}, {
+		Name: "ok, large terminal",
+		Properties: map[string]interface{}{
+			model.ResizeMessageTermWidthField:  uint16(300),
+			model.ResizeMessageTermHeightField: int64(1000),
+		},
+
+		Width:  300,
+		Height: 1000,
+		Sent:   true,
+	}, {
+		Name: "ko, missing height",
+		Properties: map[string]interface{}{
+			model.ResizeMessageTermWidthField: uint16(300),
+		},
+	}, {
+		Name: "ko, invalid width",
+		Properties: map[string]interface{}{
+			model.ResizeMessageTermWidthField:  "wide",
+			model.ResizeMessageTermHeightField: uint16(24),
+		},
+	}}
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			var buf bytes.Buffer
+			w := newSyncWriter(&buf, 64)
+			sess := &model.Session{
+				BytesRecorded:      42,
+				BytesRecordedMutex: &sync.Mutex{},
 			}
-			conn, _, err := websocket.DefaultDialer.Dial(url, headers)
-			if tc.Identity == nil {
-				assert.EqualError(t, err, "websocket: bad handshake")
+			// round-trip the properties as received from the users
+			b, _ := msgpack.Marshal(&ws.ProtoMsg{
+				Header: ws.ProtoHdr{
+					Proto:      ws.ProtoTypeShell,
+					MsgType:    shell.MessageTypeResizeShell,
+					Properties: tc.Properties,
+				},
+			})
+			var m ws.ProtoMsg
+			_ = msgpack.Unmarshal(b, &m)
+
+			n := sendResizeMessage(&m, sess, w)
+			_ = w.Flush()
+			if !tc.Sent {
+				assert.Zero(t, n)
+				assert.Zero(t, buf.Len())
 				return
-			} else {
-				assert.NoError(t, err)
 			}
+			assert.Equal(t, buf.Len(), n)
+			var control app.Control
+			err := control.UnmarshalBinary(buf.Bytes())
+			assert.NoError(t, err)
+			assert.Equal(t, app.Control{
+				Type:           app.ResizeMessage,
+				Offset:         42,
+				TerminalWidth:  tc.Width,
+				TerminalHeight: tc.Height,
+			}, control)
+		})
+	}
+}
 
-			pingReceived := make(chan struct{}, 1)
-			conn.SetPingHandler(func(message string) error {
-				pingReceived <- struct{}{}
-				return conn.WriteControl(
-					websocket.PongMessage,
-					[]byte{},
-					time.Now().Add(writeWait),
-				)
-			})
-			pongReceived := make(chan struct{}, 1)
-			conn.SetPongHandler(func(message string) error {
-				pongReceived <- struct{}{}
-				return nil
-			})
+func TestInputRecording(t *testing.T) {
+	var buf bytes.Buffer
+	sess := &model.Session{
+		ID:                 "00000000-0000-0000-0000-000000000001",
+		BytesRecorded:      42,
+		BytesRecordedMutex: &sync.Mutex{},
+		Policy: &model.SessionPolicy{
+			RecordInput:   true,
+			MaxInputBytes: 40,
+		},
+	}
+	r := newInputRecording(sess, &buf)
 
-			// close the websocket
-			conn.Close()
+	n := r.Record("user", []byte("whoami\r"))
+	assert.Equal(t, buf.Len(), n)
+	var control app.Control
+	err := control.UnmarshalBinary(buf.Bytes())
+	assert.NoError(t, err)
+	assert.Equal(t, app.InputMessage, control.Type)
+	assert.Equal(t, 42, control.Offset)
+	assert.Equal(t, "user", control.UserID)
+	assert.Equal(t, []byte("whoami\r"), control.Data)
+	assert.WithinDuration(t, time.Now(), control.Timestamp, time.Minute)
+
+	// the input is recorded up to the limit
+	assert.NotZero(t, r.Record("user", []byte("exit\r")))
+	assert.Zero(t, r.Record("user", []byte("ls\r")))
+
+	// nothing is recorded when the policy does not enable the input
+	var nilRecording *inputRecording
+	assert.Zero(t, nilRecording.Record("user", []byte("ls\r")))
+}
 
-			// wait 100ms to let the websocket fully shutdown on the server
-			time.Sleep(100 * time.Millisecond)
-		})
+func TestRecordSession(t *testing.T) {
+	var output, control bytes.Buffer
+	sess := &model.Session{
+		BytesRecordedMutex: &sync.Mutex{},
 	}
+	msg := &ws.ProtoMsg{Body: []byte("output")}
+	recordedBytes := 0
+	var lastTimestampMs int64
+
+	err := recordSession(context.Background(), msg, &output, &control,
+		&recordedBytes, &lastTimestampMs, sess)
+	assert.NoError(t, err)
+	assert.Equal(t, "output", output.String())
+	assert.Equal(t, 6, recordedBytes)
+	assert.Equal(t, 6, sess.BytesRecorded)
+	var timestamp app.Control
+	err = timestamp.UnmarshalBinary(control.Bytes())
+	assert.NoError(t, err)
+	assert.Equal(t, app.TimestampMessage, timestamp.Type)
+	assert.Equal(t, 0, timestamp.Offset)
+	assert.Equal(t, timestamp.Timestamp.UnixMilli(), lastTimestampMs)
+
+	// the timestamp follows the offset of the recorded output
+	control.Reset()
+	lastTimestampMs--
+	err = recordSession(context.Background(), msg, &output, &control,
+		&recordedBytes, &lastTimestampMs, sess)
+	assert.NoError(t, err)
+	assert.Equal(t, 12, recordedBytes)
+	err = timestamp.UnmarshalBinary(control.Bytes())
+	assert.NoError(t, err)
+	assert.Equal(t, 6, timestamp.Offset)
 }
 
 func TestManagementConnectFailures(t *testing.T) {
@@ -737,6 +2259,40 @@ func TestManagementConnectFailures(t *testing.T) {
 			}),
 			HTTPStatus: http.StatusNotFound,
 		},
+		{
+			Name:                  "ko, device session quota exceeded",
+			SessionID:             "1",
+			PrepareUserSessionErr: app.ErrDeviceSessionQuota,
+			Identity: identity.Identity{
+				Subject: "00000000-0000-0000-0000-000000000000",
+				Tenant:  "000000000000000000000000",
+				IsUser:  true,
+			},
+			Authorization: "Bearer " + GenerateJWT(identity.Identity{
+				Subject: "00000000-0000-0000-0000-000000000000",
+				Tenant:  "000000000000000000000000",
+				IsUser:  true,
+			}),
+			HTTPStatus: http.StatusTooManyRequests,
+			HTTPError:  app.ErrDeviceSessionQuota,
+		},
+		{
+			Name:                  "ko, user session quota exceeded",
+			SessionID:             "1",
+			PrepareUserSessionErr: app.ErrUserSessionQuota,
+			Identity: identity.Identity{
+				Subject: "00000000-0000-0000-0000-000000000000",
+				Tenant:  "000000000000000000000000",
+				IsUser:  true,
+			},
+			Authorization: "Bearer " + GenerateJWT(identity.Identity{
+				Subject: "00000000-0000-0000-0000-000000000000",
+				Tenant:  "000000000000000000000000",
+				IsUser:  true,
+			}),
+			HTTPStatus: http.StatusTooManyRequests,
+			HTTPError:  app.ErrUserSessionQuota,
+		},
 		{
 			Name:       "ko, missing authorization header",
 			HTTPStatus: http.StatusUnauthorized,
@@ -836,6 +2392,13 @@ func TestManagementSessionLimit(t *testing.T) {
 			return true
 		}),
 	).Return(nil)
+	mapp.On("SetSessionEndReason",
+		mock.MatchedBy(func(_ context.Context) bool {
+			return true
+		}),
+		sid,
+		model.SessionEndReasonByteLimit,
+	).Return(nil)
 	mapp.On("FreeUserSession",
 		mock.MatchedBy(func(_ context.Context) bool {
 			return true
@@ -855,6 +2418,13 @@ func TestManagementSessionLimit(t *testing.T) {
 		}),
 		sid,
 	).Return(nil)
+	mapp.On("SignSessionRecording",
+		mock.MatchedBy(func(_ context.Context) bool {
+			return true
+		}),
+		sid,
+		mock.AnythingOfType("[]model.RecordingStreamHead"),
+	).Return(nil).Maybe()
 
 	s := httptest.NewServer(router)
 	defer s.Close()
@@ -965,6 +2535,150 @@ func TestManagementSessionLimit(t *testing.T) {
 	}
 }
 
+type countingWriter struct {
+	n int64
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	atomic.AddInt64(&w.n, int64(len(b)))
+	return len(b), nil
+}
+
+func TestManagementSessionLimitStopRecording(t *testing.T) {
+	mapp := &app_mocks.App{}
+	natsClient := NewNATSTestClient(t)
+	router, _ := NewRouter(mapp, natsClient, nil)
+
+	sid := "test_session_id"
+
+	identity := identity.Identity{
+		Subject: "00000000-0000-0000-0000-000000000000",
+		Tenant:  "000000000000000000000000",
+		IsUser:  true,
+		Plan:    "professional",
+	}
+	devid := "1"
+
+	headers := http.Header{}
+	headers.Set(headerAuthorization, "Bearer "+GenerateJWT(identity))
+
+	const (
+		chunkSize   = 8 * 1024
+		chunks      = 16
+		recordLimit = 8 * chunkSize
+	)
+	recorder := &countingWriter{}
+
+	mapp.On("PrepareUserSession",
+		mock.MatchedBy(func(_ context.Context) bool {
+			return true
+		}),
+		mock.MatchedBy(func(sess *model.Session) bool {
+			sess.ID = sid
+			sess.Policy = &model.SessionPolicy{
+				MaxRecordingBytes: recordLimit,
+				LimitAction:       model.SessionLimitActionStopRecording,
+			}
+			return true
+		}),
+	).Return(nil)
+	freed := make(chan struct{})
+	mapp.On("FreeUserSession",
+		mock.MatchedBy(func(_ context.Context) bool {
+			return true
+		}),
+		sid,
+		mock.AnythingOfType("[]string"),
+	).Run(func(mock.Arguments) {
+		close(freed)
+	}).Return(nil)
+	mapp.On("GetRecorder",
+		mock.MatchedBy(func(_ context.Context) bool {
+			return true
+		}),
+		sid,
+	).Return(recorder)
+	mapp.On("GetControlRecorder",
+		mock.MatchedBy(func(_ context.Context) bool {
+			return true
+		}),
+		sid,
+	).Return(ioutil.Discard)
+	mapp.On("SignSessionRecording",
+		mock.MatchedBy(func(_ context.Context) bool {
+			return true
+		}),
+		sid,
+		mock.AnythingOfType("[]model.RecordingStreamHead"),
+	).Return(nil).Maybe()
+
+	s := httptest.NewServer(router)
+	defer s.Close()
+
+	url := "ws" + strings.TrimPrefix(s.URL, "http")
+	url = url + strings.Replace(
+		APIURLManagementDeviceConnect, ":deviceId",
+		devid, 1,
+	)
+	conn, _, err := websocket.DefaultDialer.Dial(url, headers)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	msg := ws.ProtoMsg{
+		Header: ws.ProtoHdr{
+			Proto:     ws.ProtoTypeShell,
+			MsgType:   shell.MessageTypeShellCommand,
+			SessionID: sid,
+			Properties: map[string]interface{}{
+				"status": shell.NormalMessage,
+			},
+		},
+		Body: make([]byte, chunkSize),
+	}
+	b, _ := msgpack.Marshal(msg)
+	for i := 0; i < chunks; i++ {
+		err = natsClient.Publish(
+			model.GetSessionSubject(identity.Tenant, sid),
+			b,
+		)
+		assert.NoError(t, err)
+	}
+
+	// the user keeps receiving the output once the recording stopped,
+	// preceded by a single notice
+	received, notices := 0, 0
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for received < chunks {
+		_, data, err := conn.ReadMessage()
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		var rMsg ws.ProtoMsg
+		err = msgpack.Unmarshal(data, &rMsg)
+		assert.NoError(t, err)
+		assert.Equal(t, ws.ProtoTypeShell, rMsg.Header.Proto)
+		assert.Equal(t, shell.MessageTypeShellCommand, rMsg.Header.MsgType)
+		if rMsg.Header.Properties["status"] == int8(shell.ErrorMessage) {
+			assert.Equal(t, received*chunkSize, recordLimit)
+			assert.Equal(t, ErrMsgRecordingLimit, string(rMsg.Body))
+			notices++
+		} else {
+			received++
+		}
+	}
+	assert.Equal(t, 1, notices)
+
+	conn.Close()
+	select {
+	case <-freed:
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "the session was not freed")
+	}
+	assert.Equal(t, int64(recordLimit), atomic.LoadInt64(&recorder.n))
+	mapp.AssertExpectations(t)
+}
+
 func TestManagementCheckUpdate(t *testing.T) {
 	testCases := []struct {
 		Name     string
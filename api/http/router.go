@@ -18,6 +18,7 @@ import (
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
 
 	"github.com/mendersoftware/go-lib-micro/accesslog"
 	"github.com/mendersoftware/go-lib-micro/identity"
@@ -35,16 +36,21 @@ const (
 
 	APIURLDevicesConnect = APIURLDevices + "/connect"
 
-	APIURLInternalAlive     = APIURLInternal + "/alive"
-	APIURLInternalHealth    = APIURLInternal + "/health"
-	APIURLInternalShutdown  = APIURLInternal + "/shutdown"
-	APIURLInternalDevices   = APIURLInternal + "/tenants/:tenantId/devices"
-	APIURLInternalDevicesID = APIURLInternal +
+	APIURLInternalAlive           = APIURLInternal + "/alive"
+	APIURLInternalHealth          = APIURLInternal + "/health"
+	APIURLInternalShutdown        = APIURLInternal + "/shutdown"
+	APIURLInternalRecordingWriter = APIURLInternal + "/recording-writer"
+	APIURLInternalDevices         = APIURLInternal + "/tenants/:tenantId/devices"
+	APIURLInternalDevicesID       = APIURLInternal +
 		"/tenants/:tenantId/devices/:deviceId"
 	APIURLInternalDevicesIDCheckUpdate = APIURLInternal +
 		"/tenants/:tenantId/devices/:deviceId/check-update"
 	APIURLInternalDevicesIDSendInventory = APIURLInternal +
 		"/tenants/:tenantId/devices/:deviceId/send-inventory"
+	APIURLInternalTenantPolicy = APIURLInternal + "/tenants/:tenantId/policy"
+	APIURLInternalRecording    = APIURLInternal +
+		"/tenants/:tenantId/sessions/:sessionId/recording"
+	APIURLInternalRecordings = APIURLInternal + "/tenants/:tenantId/recordings"
 
 	APIURLManagementDevice              = APIURLManagement + "/devices/:deviceId"
 	APIURLManagementDeviceConnect       = APIURLManagement + "/devices/:deviceId/connect"
@@ -52,13 +58,31 @@ const (
 	APIURLManagementDeviceCheckUpdate   = APIURLManagement + "/devices/:deviceId/check-update"
 	APIURLManagementDeviceSendInventory = APIURLManagement + "/devices/:deviceId/send-inventory"
 	APIURLManagementDeviceUpload        = APIURLManagement + "/devices/:deviceId/upload"
+	APIURLManagementSessions            = APIURLManagement + "/sessions"
+	APIURLManagementSession             = APIURLManagement + "/sessions/:sessionId"
+	APIURLManagementSessionsSearch      = APIURLManagement + "/sessions/search"
 	APIURLManagementPlayback            = APIURLManagement + "/sessions/:sessionId/playback"
+	APIURLManagementRecording           = APIURLManagement + "/sessions/:sessionId/recording"
+	APIURLManagementTranscript          = APIURLManagement + "/sessions/:sessionId/transcript"
+	APIURLManagementObserve             = APIURLManagement + "/sessions/:sessionId/observe"
+	APIURLManagementResume              = APIURLManagement + "/sessions/:sessionId/resume"
+	APIURLManagementRecordingVerify     = APIURLManagement +
+		"/sessions/:sessionId/recording/verify"
+	APIURLManagementSessionWriter = APIURLManagement +
+		"/sessions/:sessionId/writers/:userId"
+	APIURLManagementLegalHold = APIURLManagement +
+		"/sessions/:sessionId/legal-hold"
+	APIURLManagementRecordings = APIURLManagement + "/recordings"
 
 	HdrKeyOrigin = "Origin"
 )
 
 type RouterConfig struct {
 	GracefulShutdownTimeout time.Duration
+	// DeviceViolationPolicy is the policy applied to the device messages
+	// violating the protocol: ViolationPolicyDrop (default) or
+	// ViolationPolicyDisconnect
+	DeviceViolationPolicy string
 }
 
 // NewRouter returns the gin router
@@ -83,16 +107,30 @@ func NewRouter(
 	if config != nil && config.GracefulShutdownTimeout > gracefulShutdownTimeout {
 		gracefulShutdownTimeout = config.GracefulShutdownTimeout
 	}
+	violationPolicy := ViolationPolicyDrop
+	if config != nil && config.DeviceViolationPolicy != "" {
+		violationPolicy = config.DeviceViolationPolicy
+	}
+	if violationPolicy != ViolationPolicyDrop &&
+		violationPolicy != ViolationPolicyDisconnect {
+		return nil, errors.Errorf(
+			"invalid device protocol violation policy: %q", violationPolicy)
+	}
 	status := NewStatusController(app, gracefulShutdownTimeout)
 	router.GET(APIURLInternalAlive, status.Alive)
 	router.GET(APIURLInternalHealth, status.Health)
 	router.GET(APIURLInternalShutdown, status.Shutdown)
+	router.GET(APIURLInternalRecordingWriter, status.RecordingWriter)
 
 	internal := NewInternalController(app, natsClient)
 	router.POST(APIURLInternalDevicesIDCheckUpdate, internal.CheckUpdate)
 	router.POST(APIURLInternalDevicesIDSendInventory, internal.SendInventory)
+	router.GET(APIURLInternalTenantPolicy, internal.GetTenantPolicy)
+	router.PUT(APIURLInternalTenantPolicy, internal.SetTenantPolicy)
+	router.DELETE(APIURLInternalRecording, internal.DeleteRecording)
+	router.DELETE(APIURLInternalRecordings, internal.DeleteRecordings)
 
-	device := NewDeviceController(app, natsClient)
+	device := NewDeviceController(app, natsClient, violationPolicy)
 	router.GET(APIURLDevicesConnect, device.Connect)
 	router.POST(APIURLInternalDevices, device.Provision)
 	router.DELETE(APIURLInternalDevicesID, device.Delete)
@@ -105,7 +143,22 @@ func NewRouter(
 	router.POST(APIURLManagementDeviceCheckUpdate, management.CheckUpdate)
 	router.POST(APIURLManagementDeviceSendInventory, management.SendInventory)
 	router.PUT(APIURLManagementDeviceUpload, management.UploadFile)
+	router.GET(APIURLManagementSessions, management.ListSessions)
+	router.GET(APIURLManagementSessionsSearch, management.SearchSessions)
+	router.DELETE(APIURLManagementSession, management.TerminateSession)
 	router.GET(APIURLManagementPlayback, management.Playback)
+	router.GET(APIURLManagementRecording, management.ExportRecording)
+	router.DELETE(APIURLManagementRecording, management.DeleteRecording)
+	router.DELETE(APIURLManagementRecordings, management.DeleteRecordings)
+	router.GET(APIURLManagementTranscript, management.Transcript)
+	router.GET(APIURLManagementRecordingVerify, management.VerifyRecording)
+	router.GET(APIURLManagementLegalHold, management.GetLegalHold)
+	router.PUT(APIURLManagementLegalHold, management.SetLegalHold)
+	router.DELETE(APIURLManagementLegalHold, management.ReleaseLegalHold)
+	router.GET(APIURLManagementObserve, management.Observe)
+	router.GET(APIURLManagementResume, management.Resume)
+	router.PUT(APIURLManagementSessionWriter, management.GrantSessionWrite)
+	router.DELETE(APIURLManagementSessionWriter, management.RevokeSessionWrite)
 
 	return router, nil
 }
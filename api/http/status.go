@@ -83,3 +83,9 @@ func (h StatusController) Shutdown(c *gin.Context) {
 	time.Sleep(h.gracefulShutdownTimeout)
 	c.Writer.WriteHeader(http.StatusAccepted)
 }
+
+// RecordingWriter responds to GET /recording-writer with the statistics of
+// the asynchronous writer of the session recordings
+func (h StatusController) RecordingWriter(c *gin.Context) {
+	c.JSON(http.StatusOK, h.app.RecordingWriterStats())
+}
@@ -16,6 +16,7 @@ package http
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"net/http"
 	"net/http/httptest"
@@ -25,6 +26,7 @@ import (
 	"github.com/stretchr/testify/mock"
 
 	app_mocks "github.com/mendersoftware/deviceconnect/app/mocks"
+	"github.com/mendersoftware/deviceconnect/model"
 )
 
 func TestAlive(t *testing.T) {
@@ -113,3 +115,28 @@ func TestShutdown(t *testing.T) {
 		})
 	}
 }
+
+func TestRecordingWriter(t *testing.T) {
+	stats := model.RecordingWriterStats{
+		Enabled:       true,
+		FailurePolicy: "block",
+		QueueLength:   2,
+		QueueCapacity: 1024,
+		QueuedChunks:  10,
+		WrittenChunks: 8,
+	}
+	deviceConnectApp := &app_mocks.App{}
+	deviceConnectApp.On("RecordingWriterStats").Return(stats)
+
+	router, _ := NewRouter(deviceConnectApp, nil, nil)
+	req, _ := http.NewRequest("GET", APIURLInternalRecordingWriter, nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	var body model.RecordingWriterStats
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	assert.Equal(t, stats, body)
+
+	deviceConnectApp.AssertExpectations(t)
+}
@@ -16,6 +16,11 @@ package app
 
 import (
 	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
 	"io"
 	"sync"
 	"sync/atomic"
@@ -32,10 +37,24 @@ import (
 
 // App errors
 var (
-	ErrDeviceNotFound     = errors.New("device not found")
-	ErrDeviceNotConnected = errors.New("device not connected")
+	ErrDeviceNotFound      = errors.New("device not found")
+	ErrDeviceNotConnected  = errors.New("device not connected")
+	ErrSessionNotFound     = errors.New("session not found")
+	ErrSessionOwnerWrite   = errors.New("the session owner always has write access")
+	ErrSessionResumeDenied = errors.New(
+		"the session does not exist or cannot be resumed with the given token")
+
+	ErrTenantSessionQuota = errors.New(
+		"the maximum number of concurrent sessions for the tenant has been reached")
+	ErrUserSessionQuota = errors.New(
+		"the maximum number of concurrent sessions for the user has been reached")
+	ErrDeviceSessionQuota = errors.New(
+		"the maximum number of concurrent sessions on the device has been reached")
 )
 
+// resumeTokenSize is the number of random bytes of the session resume tokens
+const resumeTokenSize = 32
+
 // App interface describes app objects
 //
 //nolint:lll
@@ -49,16 +68,51 @@ type App interface {
 	PrepareUserSession(ctx context.Context, sess *model.Session) error
 	LogUserSession(ctx context.Context, sess *model.Session, sessionType string) error
 	FreeUserSession(ctx context.Context, sessionID string, sessionTypes []string) error
+	SetSessionEndReason(ctx context.Context, sessionID, reason string) error
+	GetSession(ctx context.Context, sessionID string) (*model.Session, error)
+	ResumeUserSession(ctx context.Context, sessionID, userID, token string) (*model.Session, error)
+	TerminateUserSession(ctx context.Context, sess *model.Session, userID string) error
+	LogObserverJoin(ctx context.Context, sess *model.Session, observerID string) error
+	GrantSessionWrite(ctx context.Context, sess *model.Session, userID string) error
+	RevokeSessionWrite(ctx context.Context, sess *model.Session, userID string) error
+	LogObserverLeave(ctx context.Context, sess *model.Session, observerID string) error
+	GetTenantPolicy(ctx context.Context, tenantID string) (*model.TenantPolicy, error)
+	SetTenantPolicy(ctx context.Context, tenantID string, policy *model.TenantPolicy) error
+	ListSessions(ctx context.Context, filter model.SessionFilter) ([]model.Session, int64, error)
 	GetSessionRecording(ctx context.Context, id string, w io.Writer) (err error)
+	SearchRecordings(ctx context.Context, filter model.SearchFilter) ([]model.SearchResult, error)
+	SignSessionRecording(
+		ctx context.Context,
+		sessionID string,
+		heads []model.RecordingStreamHead,
+	) error
+	VerifySessionRecording(
+		ctx context.Context,
+		sessionID string,
+	) (*model.RecordingVerification, error)
+	SetLegalHold(ctx context.Context, sessionID, reason string) (*model.LegalHold, error)
+	GetLegalHold(ctx context.Context, sessionID string) (*model.LegalHold, error)
+	ReleaseLegalHold(ctx context.Context, sessionID string) error
+	DeleteSessionRecording(ctx context.Context, sessionID, userID string) error
+	DeleteRecordings(
+		ctx context.Context,
+		filter model.RecordingFilter,
+		userID string,
+	) (*model.RecordingDeletion, error)
 	SaveSessionRecording(ctx context.Context, id string, sessionBytes []byte) error
 	GetRecorder(ctx context.Context, sessionID string) io.Writer
 	GetControlRecorder(ctx context.Context, sessionID string) io.Writer
+	GetInputRecorder(ctx context.Context, sessionID string) io.Writer
 	DownloadFile(ctx context.Context, userID string, deviceID string, path string) error
 	UploadFile(ctx context.Context, userID string, deviceID string, path string) error
 	Shutdown(timeout time.Duration)
 	ShutdownDone()
 	RegisterShutdownCancel(context.CancelFunc) uint32
 	UnregisterShutdownCancel(uint32)
+	KeepLeases(ctx context.Context)
+	ExpireRecordings(ctx context.Context)
+	CloseRecordings(ctx context.Context) error
+	RecordingWriterStats() model.RecordingWriterStats
 }
 
 // app is an app object
@@ -69,11 +123,77 @@ type app struct {
 	shutdownCancels  map[uint32]context.CancelFunc
 	shutdownCancelsM *sync.Mutex
 	shutdownDone     chan struct{}
+	leases           *leases
+	// recordings writes the session recordings asynchronously, nil if
+	// written synchronously
+	recordings *recordingWriter
 	Config
 }
 
 type Config struct {
 	HaveAuditLogs bool
+	// SessionIdleTimeout is the default idle timeout of the sessions,
+	// zero disables the idle timeout
+	SessionIdleTimeout time.Duration
+	// SessionIdleWarning is how long before the idle timeout the users
+	// are warned about the session closing
+	SessionIdleWarning time.Duration
+	// SessionMaxDuration is the default maximum duration of the sessions,
+	// zero disables the limit
+	SessionMaxDuration time.Duration
+	// MaxTenantSessions, MaxUserSessions and MaxDeviceSessions are the
+	// default quotas of concurrent sessions, zero disables the quota
+	MaxTenantSessions int
+	MaxUserSessions   int
+	MaxDeviceSessions int
+	// MaxRecordingBytes, MaxControlBytes and MaxMessageBytes are the default
+	// byte limits of the sessions, zero stands for MessageSizeLimit
+	MaxRecordingBytes int
+	MaxControlBytes   int
+	MaxMessageBytes   int
+	// RecordInput enables recording the terminal input of the sessions,
+	// and MaxInputBytes is the default limit of the recorded input, zero
+	// standing for MessageSizeLimit
+	RecordInput   bool
+	MaxInputBytes int
+	// SessionLimitAction is the default action taken when a session
+	// reaches the recording limits
+	SessionLimitAction string
+	// SessionResumeGracePeriod is the default period the terminal sessions
+	// survive the user's connection dropping, zero disables resuming
+	// the sessions
+	SessionResumeGracePeriod time.Duration
+	// SessionLeaseTTL is the duration of the leases the instance holds on
+	// the sessions and on the device connections it serves, zero disables
+	// the leases
+	SessionLeaseTTL time.Duration
+	// SessionReaperInterval is how often the sessions and the device
+	// connections with an expired lease are reaped
+	SessionReaperInterval time.Duration
+	// RecordingExpiryInterval is how often the expired recordings are
+	// deleted from the recording storages which do not expire them, zero
+	// disables the deletions
+	RecordingExpiryInterval time.Duration
+	// RecordingSearchIndex enables indexing the text of the session
+	// recordings for searching the recordings
+	RecordingSearchIndex bool
+	// RecordingSigner signs the digest of the session recordings at the
+	// end of the sessions; nil disables signing the recordings
+	RecordingSigner crypto.Signer
+	// RecordingVerificationKeys are the public keys verifying the
+	// recordings signed with other keys than RecordingSigner, e.g. before
+	// rotating the signing key
+	RecordingVerificationKeys []crypto.PublicKey
+	// RecordingQueueSize enables writing the session recordings
+	// asynchronously: up to RecordingQueueSize chunks queue for the
+	// writer, written in batches of up to RecordingBatchSize chunks, at
+	// least every RecordingBatchInterval. RecordingFailurePolicy applies to
+	// the chunks not queued or not written. Zero writes the recordings
+	// synchronously.
+	RecordingQueueSize     int
+	RecordingBatchSize     int
+	RecordingBatchInterval time.Duration
+	RecordingFailurePolicy string
 }
 
 // NewApp initialize a new deviceconnect App
@@ -83,8 +203,77 @@ func New(ds store.DataStore, inv inventory.Client, wf workflows.Client, config .
 		if cfgIn.HaveAuditLogs {
 			conf.HaveAuditLogs = true
 		}
+		if cfgIn.SessionIdleTimeout > 0 {
+			conf.SessionIdleTimeout = cfgIn.SessionIdleTimeout
+		}
+		if cfgIn.SessionIdleWarning > 0 {
+			conf.SessionIdleWarning = cfgIn.SessionIdleWarning
+		}
+		if cfgIn.SessionMaxDuration > 0 {
+			conf.SessionMaxDuration = cfgIn.SessionMaxDuration
+		}
+		if cfgIn.MaxTenantSessions > 0 {
+			conf.MaxTenantSessions = cfgIn.MaxTenantSessions
+		}
+		if cfgIn.MaxUserSessions > 0 {
+			conf.MaxUserSessions = cfgIn.MaxUserSessions
+		}
+		if cfgIn.MaxDeviceSessions > 0 {
+			conf.MaxDeviceSessions = cfgIn.MaxDeviceSessions
+		}
+		if cfgIn.MaxRecordingBytes > 0 {
+			conf.MaxRecordingBytes = cfgIn.MaxRecordingBytes
+		}
+		if cfgIn.MaxControlBytes > 0 {
+			conf.MaxControlBytes = cfgIn.MaxControlBytes
+		}
+		if cfgIn.MaxMessageBytes > 0 {
+			conf.MaxMessageBytes = cfgIn.MaxMessageBytes
+		}
+		if cfgIn.RecordInput {
+			conf.RecordInput = true
+		}
+		if cfgIn.MaxInputBytes > 0 {
+			conf.MaxInputBytes = cfgIn.MaxInputBytes
+		}
+		if cfgIn.SessionLimitAction != "" {
+			conf.SessionLimitAction = cfgIn.SessionLimitAction
+		}
+		if cfgIn.SessionResumeGracePeriod > 0 {
+			conf.SessionResumeGracePeriod = cfgIn.SessionResumeGracePeriod
+		}
+		if cfgIn.SessionLeaseTTL > 0 {
+			conf.SessionLeaseTTL = cfgIn.SessionLeaseTTL
+		}
+		if cfgIn.SessionReaperInterval > 0 {
+			conf.SessionReaperInterval = cfgIn.SessionReaperInterval
+		}
+		if cfgIn.RecordingExpiryInterval > 0 {
+			conf.RecordingExpiryInterval = cfgIn.RecordingExpiryInterval
+		}
+		if cfgIn.RecordingSearchIndex {
+			conf.RecordingSearchIndex = true
+		}
+		if cfgIn.RecordingSigner != nil {
+			conf.RecordingSigner = cfgIn.RecordingSigner
+		}
+		if len(cfgIn.RecordingVerificationKeys) > 0 {
+			conf.RecordingVerificationKeys = cfgIn.RecordingVerificationKeys
+		}
+		if cfgIn.RecordingQueueSize > 0 {
+			conf.RecordingQueueSize = cfgIn.RecordingQueueSize
+		}
+		if cfgIn.RecordingBatchSize > 0 {
+			conf.RecordingBatchSize = cfgIn.RecordingBatchSize
+		}
+		if cfgIn.RecordingBatchInterval > 0 {
+			conf.RecordingBatchInterval = cfgIn.RecordingBatchInterval
+		}
+		if cfgIn.RecordingFailurePolicy != "" {
+			conf.RecordingFailurePolicy = cfgIn.RecordingFailurePolicy
+		}
 	}
-	return &app{
+	a := &app{
 		store:            ds,
 		inventory:        inv,
 		workflows:        wf,
@@ -92,7 +281,12 @@ func New(ds store.DataStore, inv inventory.Client, wf workflows.Client, config .
 		shutdownCancels:  make(map[uint32]context.CancelFunc),
 		shutdownCancelsM: &sync.Mutex{},
 		shutdownDone:     make(chan struct{}),
+		leases:           newLeases(),
 	}
+	if conf.RecordingQueueSize > 0 {
+		a.recordings = newRecordingWriter(ds, conf)
+	}
+	return a
 }
 
 // HealthCheck performs a health check and returns an error if it fails
@@ -129,12 +323,23 @@ func (a *app) DeleteDevice(ctx context.Context, tenantID, deviceID string) error
 	return a.store.DeleteDevice(ctx, tenantID, deviceID)
 }
 
-// UpdateDeviceStatus provisions a new tenant
+// UpdateDeviceStatus updates the connection status of the device; the
+// instance holds the lease of the device connection while connected
 func (a *app) UpdateDeviceStatus(
 	ctx context.Context,
 	tenantID, deviceID, status string,
 ) error {
-	return a.store.UpsertDeviceStatus(ctx, tenantID, deviceID, status)
+	if status != model.DeviceStatusConnected {
+		a.leases.removeDevice(deviceID)
+	}
+	err := a.store.UpsertDeviceStatus(ctx, tenantID, deviceID, status)
+	if err != nil || status != model.DeviceStatusConnected ||
+		a.SessionLeaseTTL <= 0 {
+		return err
+	}
+	a.leases.addDevice(deviceID)
+	return a.store.RenewDeviceLeases(ctx,
+		[]string{deviceID}, time.Now().Add(a.SessionLeaseTTL))
 }
 
 // PrepareUserSession prepares a new user session
@@ -165,23 +370,156 @@ func (a *app) PrepareUserSession(
 		return ErrDeviceNotConnected
 	}
 
-	err = a.store.AllocateSession(ctx, sess)
+	tenantPolicy, err := a.store.GetTenantPolicy(ctx, sess.TenantID)
 	if err != nil {
 		return err
 	}
+	sess.Policy = a.sessionPolicy(tenantPolicy)
+	if sess.Policy.ResumeGracePeriod > 0 {
+		token := make([]byte, resumeTokenSize)
+		if _, err := rand.Read(token); err != nil {
+			return errors.Wrap(err, "failed to generate the session resume token")
+		}
+		sess.ResumeToken = hex.EncodeToString(token)
+		sess.ResumeTokenHash = hashResumeToken(sess.ResumeToken)
+	}
+	if a.SessionLeaseTTL > 0 {
+		sess.LeaseExpireTs = time.Now().Add(a.SessionLeaseTTL)
+	}
+
+	err = a.store.AllocateSession(ctx, sess)
+	switch errors.Cause(err) {
+	case nil:
+	case store.ErrTenantSessionQuota:
+		return ErrTenantSessionQuota
+	case store.ErrUserSessionQuota:
+		return ErrUserSessionQuota
+	case store.ErrDeviceSessionQuota:
+		return ErrDeviceSessionQuota
+	default:
+		return err
+	}
+	if err := a.catalogueRecording(ctx, sess); err != nil {
+		if _, e := a.store.DeleteSession(ctx, sess.ID); e != nil {
+			err = errors.Errorf(
+				"%s: failed to clean up session state: %s",
+				err.Error(), e.Error(),
+			)
+		}
+		return err
+	}
+	if a.SessionLeaseTTL > 0 {
+		a.leases.addSession(sess.ID)
+	}
 
 	return nil
 }
 
-// LogUserSession logs a new user session
+// sessionPolicy merges the tenant policy with the global settings
+func (a *app) sessionPolicy(tenantPolicy *model.TenantPolicy) *model.SessionPolicy {
+	policy := &model.SessionPolicy{
+		IdleTimeout: a.SessionIdleTimeout,
+		IdleWarning: a.SessionIdleWarning,
+		MaxDuration: a.SessionMaxDuration,
+
+		MaxTenantSessions: a.MaxTenantSessions,
+		MaxUserSessions:   a.MaxUserSessions,
+		MaxDeviceSessions: a.MaxDeviceSessions,
+
+		MaxRecordingBytes: a.MaxRecordingBytes,
+		MaxControlBytes:   a.MaxControlBytes,
+		MaxMessageBytes:   a.MaxMessageBytes,
+		LimitAction:       a.SessionLimitAction,
+
+		ResumeGracePeriod: a.SessionResumeGracePeriod,
+
+		RecordInput:   a.RecordInput,
+		MaxInputBytes: a.MaxInputBytes,
+	}
+	if tenantPolicy == nil {
+		return policy
+	}
+	if tenantPolicy.IdleTimeout != nil {
+		policy.IdleTimeout = time.Duration(*tenantPolicy.IdleTimeout) * time.Second
+	}
+	if tenantPolicy.MaxDuration != nil {
+		policy.MaxDuration = time.Duration(*tenantPolicy.MaxDuration) * time.Second
+	}
+	if tenantPolicy.MaxTenantSessions != nil {
+		policy.MaxTenantSessions = *tenantPolicy.MaxTenantSessions
+	}
+	if tenantPolicy.MaxUserSessions != nil {
+		policy.MaxUserSessions = *tenantPolicy.MaxUserSessions
+	}
+	if tenantPolicy.MaxDeviceSessions != nil {
+		policy.MaxDeviceSessions = *tenantPolicy.MaxDeviceSessions
+	}
+	if tenantPolicy.MaxRecordingBytes != nil {
+		policy.MaxRecordingBytes = *tenantPolicy.MaxRecordingBytes
+	}
+	if tenantPolicy.MaxControlBytes != nil {
+		policy.MaxControlBytes = *tenantPolicy.MaxControlBytes
+	}
+	if tenantPolicy.MaxMessageBytes != nil {
+		policy.MaxMessageBytes = *tenantPolicy.MaxMessageBytes
+	}
+	if tenantPolicy.LimitAction != nil {
+		policy.LimitAction = *tenantPolicy.LimitAction
+	}
+	if tenantPolicy.ResumeGracePeriod != nil {
+		policy.ResumeGracePeriod = time.Duration(*tenantPolicy.ResumeGracePeriod) *
+			time.Second
+	}
+	if tenantPolicy.RecordInput != nil {
+		policy.RecordInput = *tenantPolicy.RecordInput
+	}
+	if tenantPolicy.MaxInputBytes != nil {
+		policy.MaxInputBytes = *tenantPolicy.MaxInputBytes
+	}
+	if tenantPolicy.DisableRecording != nil {
+		policy.DisableRecording = *tenantPolicy.DisableRecording
+	}
+	return policy
+}
+
+// GetTenantPolicy returns the session policy overrides of the tenant
+func (a *app) GetTenantPolicy(
+	ctx context.Context,
+	tenantID string,
+) (*model.TenantPolicy, error) {
+	policy, err := a.store.GetTenantPolicy(ctx, tenantID)
+	if err != nil {
+		return nil, err
+	} else if policy == nil {
+		policy = &model.TenantPolicy{}
+	}
+	return policy, nil
+}
+
+// SetTenantPolicy replaces the session policy overrides of the tenant; the
+// expiry of the recordings stored follows the retention of the policy.
+func (a *app) SetTenantPolicy(
+	ctx context.Context,
+	tenantID string,
+	policy *model.TenantPolicy,
+) error {
+	previous, err := a.store.GetTenantPolicy(ctx, tenantID)
+	if err != nil {
+		return err
+	}
+	if err := a.store.SetTenantPolicy(ctx, tenantID, policy); err != nil {
+		return err
+	}
+	return a.updateRecordingRetention(ctx, tenantID, previous, policy)
+}
+
+// LogUserSession records the session type for the user session and
+// logs the new session in the audit logs
 func (a *app) LogUserSession(
 	ctx context.Context,
 	sess *model.Session,
 	sessionType string,
 ) error {
-	if !a.HaveAuditLogs {
-		return nil
-	}
 	var change string
 	var action workflows.Action
 	if sessionType == model.SessionTypePortForward {
@@ -193,7 +531,14 @@ func (a *app) LogUserSession(
 	} else {
 		return errors.New("unknown session type: " + sessionType)
 	}
-	err := a.workflows.SubmitAuditLog(ctx, workflows.AuditLog{
+	err := a.store.AddSessionType(ctx, sess.ID, sessionType)
+	if err != nil {
+		return errors.Wrap(err, "failed to update session type")
+	}
+	if !a.HaveAuditLogs {
+		return nil
+	}
+	err = a.workflows.SubmitAuditLog(ctx, workflows.AuditLog{
 		Action: action,
 		Actor: workflows.Actor{
 			ID:   sess.UserID,
@@ -211,6 +556,7 @@ func (a *app) LogUserSession(
 	})
 	if err != nil {
 		err = errors.Wrap(err, "failed to submit audit log")
+		a.leases.removeSession(sess.ID)
 		_, e := a.store.DeleteSession(ctx, sess.ID)
 		if e != nil {
 			err = errors.Errorf(
@@ -223,64 +569,348 @@ func (a *app) LogUserSession(
 	return nil
 }
 
-// FreeUserSession releases the session
+// FreeUserSession releases the session; the audit logs record the reason
+// why the session ended, if any was set with SetSessionEndReason.
 func (a *app) FreeUserSession(
 	ctx context.Context,
 	sessionID string,
 	sessionTypes []string,
 ) error {
+	a.leases.removeSession(sessionID)
 	sess, err := a.store.DeleteSession(ctx, sessionID)
 	if err != nil {
 		return err
 	}
-	if a.HaveAuditLogs {
-		for _, sessionType := range sessionTypes {
-			var action workflows.Action
-			if sessionType == model.SessionTypePortForward {
-				action = workflows.ActionPortForwardClose
-			} else if sessionType == model.SessionTypeTerminal {
-				action = workflows.ActionTerminalClose
-			} else {
-				continue
-			}
-			err = a.workflows.SubmitAuditLog(ctx, workflows.AuditLog{
-				Action: action,
-				Actor: workflows.Actor{
-					ID:   sess.UserID,
-					Type: workflows.ActorUser,
-				},
-				Object: workflows.Object{
-					ID:   sess.DeviceID,
-					Type: workflows.ObjectDevice,
-				},
-				MetaData: map[string][]string{
-					"session_id": {sess.ID},
-				},
-			})
-			if err != nil {
-				return errors.Wrap(err, "failed to submit audit log")
-			}
+	endReason := sess.EndReason
+	if endReason == "" {
+		endReason = model.SessionEndReasonClosed
+	}
+	if !a.HaveAuditLogs {
+		return nil
+	}
+	return a.logSessionClose(ctx, sess, sessionTypes, endReason)
+}
+
+// logSessionClose submits the audit logs for closing the session types
+func (a *app) logSessionClose(
+	ctx context.Context,
+	sess *model.Session,
+	sessionTypes []string,
+	endReason string,
+) error {
+	for _, sessionType := range sessionTypes {
+		var action workflows.Action
+		if sessionType == model.SessionTypePortForward {
+			action = workflows.ActionPortForwardClose
+		} else if sessionType == model.SessionTypeTerminal {
+			action = workflows.ActionTerminalClose
+		} else {
+			continue
+		}
+		err := a.workflows.SubmitAuditLog(ctx, workflows.AuditLog{
+			Action: action,
+			Actor: workflows.Actor{
+				ID:   sess.UserID,
+				Type: workflows.ActorUser,
+			},
+			Object: workflows.Object{
+				ID:   sess.DeviceID,
+				Type: workflows.ObjectDevice,
+			},
+			MetaData: map[string][]string{
+				"session_id": {sess.ID},
+				"end_reason": {endReason},
+			},
+		})
+		if err != nil {
+			return errors.Wrap(err, "failed to submit audit log")
 		}
 	}
 	return nil
 }
 
+// SetSessionEndReason records the reason why the session is ending
+func (a *app) SetSessionEndReason(ctx context.Context, sessionID, reason string) error {
+	err := a.store.SetSessionEndReason(ctx, sessionID, reason)
+	if err == store.ErrSessionNotFound {
+		return ErrSessionNotFound
+	}
+	return err
+}
+
+// GetSession returns an active session
+func (a *app) GetSession(ctx context.Context, sessionID string) (*model.Session, error) {
+	sess, err := a.store.GetSession(ctx, sessionID)
+	if err == store.ErrSessionNotFound {
+		return nil, ErrSessionNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return sess, nil
+}
+
+// ResumeUserSession returns the session the user (userID) resumes with the
+// resume token received when opening the session. Only the session owner
+// holding the token is allowed to resume the session.
+func (a *app) ResumeUserSession(
+	ctx context.Context,
+	sessionID string,
+	userID string,
+	token string,
+) (*model.Session, error) {
+	sess, err := a.GetSession(ctx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	if sess.UserID != userID || sess.ResumeTokenHash == "" ||
+		subtle.ConstantTimeCompare(
+			[]byte(sess.ResumeTokenHash),
+			[]byte(hashResumeToken(token)),
+		) != 1 {
+		return nil, ErrSessionResumeDenied
+	}
+	return sess, nil
+}
+
+func hashResumeToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// TerminateUserSession releases a session on behalf of an administrator
+// (userID) and submits the audit log for the termination.
+func (a *app) TerminateUserSession(
+	ctx context.Context,
+	sess *model.Session,
+	userID string,
+) error {
+	err := a.SetSessionEndReason(ctx, sess.ID, model.SessionEndReasonTerminated)
+	if err != nil {
+		return err
+	}
+	err = a.FreeUserSession(ctx, sess.ID, sess.Types)
+	if errors.Cause(err) == store.ErrSessionNotFound {
+		return ErrSessionNotFound
+	} else if err != nil {
+		return err
+	}
+	if !a.HaveAuditLogs {
+		return nil
+	}
+	err = a.workflows.SubmitAuditLog(ctx, workflows.AuditLog{
+		Action: workflows.ActionSessionTerminate,
+		Actor: workflows.Actor{
+			ID:   userID,
+			Type: workflows.ActorUser,
+		},
+		Object: workflows.Object{
+			ID:   sess.DeviceID,
+			Type: workflows.ObjectDevice,
+		},
+		Change: "User terminated a remote session",
+		MetaData: map[string][]string{
+			"session_id": {sess.ID},
+			"user_id":    {sess.UserID},
+		},
+		EventTS: time.Now(),
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to submit audit log")
+	}
+	return nil
+}
+
+// LogObserverJoin submits the audit log for a user (observerID) joining
+// the session as a read-only observer
+func (a *app) LogObserverJoin(
+	ctx context.Context,
+	sess *model.Session,
+	observerID string,
+) error {
+	return a.logObserver(ctx, sess, observerID, workflows.ActionObserverJoin,
+		"User joined a remote terminal session as observer")
+}
+
+// LogObserverLeave submits the audit log for an observer (observerID)
+// leaving the session
+func (a *app) LogObserverLeave(
+	ctx context.Context,
+	sess *model.Session,
+	observerID string,
+) error {
+	return a.logObserver(ctx, sess, observerID, workflows.ActionObserverLeave,
+		"User left a remote terminal session as observer")
+}
+
+func (a *app) logObserver(
+	ctx context.Context,
+	sess *model.Session,
+	observerID string,
+	action workflows.Action,
+	change string,
+) error {
+	if !a.HaveAuditLogs {
+		return nil
+	}
+	err := a.workflows.SubmitAuditLog(ctx, workflows.AuditLog{
+		Action: action,
+		Actor: workflows.Actor{
+			ID:   observerID,
+			Type: workflows.ActorUser,
+		},
+		Object: workflows.Object{
+			ID:   sess.DeviceID,
+			Type: workflows.ObjectDevice,
+		},
+		Change: change,
+		MetaData: map[string][]string{
+			"session_id": {sess.ID},
+			"user_id":    {sess.UserID},
+		},
+		EventTS: time.Now(),
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to submit audit log")
+	}
+	return nil
+}
+
+// GrantSessionWrite grants the user write access to the session
+func (a *app) GrantSessionWrite(
+	ctx context.Context,
+	sess *model.Session,
+	userID string,
+) error {
+	if userID == sess.UserID {
+		return ErrSessionOwnerWrite
+	}
+	err := a.store.AddSessionWriter(ctx, sess.ID, userID)
+	if err == store.ErrSessionNotFound {
+		return ErrSessionNotFound
+	}
+	return err
+}
+
+// RevokeSessionWrite revokes the write access to the session from the user
+func (a *app) RevokeSessionWrite(
+	ctx context.Context,
+	sess *model.Session,
+	userID string,
+) error {
+	if userID == sess.UserID {
+		return ErrSessionOwnerWrite
+	}
+	err := a.store.RemoveSessionWriter(ctx, sess.ID, userID)
+	if err == store.ErrSessionNotFound {
+		return ErrSessionNotFound
+	}
+	return err
+}
+
+// ListSessions returns the active sessions matching the filter together with
+// the total number of matching sessions
+func (a *app) ListSessions(
+	ctx context.Context,
+	filter model.SessionFilter,
+) ([]model.Session, int64, error) {
+	if err := filter.Validate(); err != nil {
+		return nil, -1, errors.Wrap(err, "app: invalid session filter")
+	}
+	sessions, err := a.store.FindSessions(ctx, filter)
+	if err != nil {
+		return nil, -1, err
+	}
+	count, err := a.store.CountSessions(ctx, filter)
+	if err != nil {
+		return nil, -1, err
+	}
+	return sessions, count, nil
+}
+
 func (a *app) GetSessionRecording(ctx context.Context, id string, w io.Writer) (err error) {
 	err = a.store.WriteSessionRecords(ctx, id, w)
 	return err
 }
 
+// SearchRecordings looks up the session recordings with lines of terminal
+// output matching the filter query; the matching lines are shortened to
+// snippets around the first match.
+func (a *app) SearchRecordings(
+	ctx context.Context,
+	filter model.SearchFilter,
+) ([]model.SearchResult, error) {
+	if err := filter.Validate(); err != nil {
+		return nil, errors.Wrap(err, "app: invalid search filter")
+	}
+	results, err := a.store.SearchRecordings(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	for i := range results {
+		for j := range results[i].Matches {
+			match := &results[i].Matches[j]
+			match.Snippet = searchSnippet(match.Snippet, filter.Query)
+		}
+	}
+	return results, nil
+}
+
+// SaveSessionRecording saves a chunk of a session recording, outside of the
+// chain of the recorded chunks
 func (a *app) SaveSessionRecording(ctx context.Context, id string, sessionBytes []byte) error {
-	err := a.store.InsertSessionRecording(ctx, id, sessionBytes)
+	err := a.store.InsertSessionRecording(ctx, id, sessionBytes, model.ChunkLink{})
 	return err
 }
 
 func (a app) GetRecorder(ctx context.Context, sessionID string) io.Writer {
-	return NewRecorder(ctx, sessionID, a.store)
+	recorder := NewRecorder(ctx, sessionID, a.store)
+	if a.RecordingSearchIndex {
+		recorder.index = &recordingIndex{}
+	}
+	if a.recordings != nil {
+		sink := a.recordings.sink(model.RecordingStreamOutput)
+		recorder.insert = sink.insert
+		recorder.flush = sink.flush
+	}
+	return recorder
 }
 
 func (a app) GetControlRecorder(ctx context.Context, sessionID string) io.Writer {
-	return NewControlRecorder(ctx, sessionID, a.store)
+	recorder := NewControlRecorder(ctx, sessionID, a.store)
+	if a.recordings != nil {
+		sink := a.recordings.sink(model.RecordingStreamControl)
+		recorder.insert = sink.insert
+		recorder.flush = sink.flush
+	}
+	return recorder
+}
+
+func (a app) GetInputRecorder(ctx context.Context, sessionID string) io.Writer {
+	recorder := NewInputRecorder(ctx, sessionID, a.store)
+	if a.recordings != nil {
+		sink := a.recordings.sink(model.RecordingStreamInput)
+		recorder.insert = sink.insert
+		recorder.flush = sink.flush
+	}
+	return recorder
+}
+
+// CloseRecordings stops the asynchronous writer of the session recordings,
+// once the chunks queued are written or the context is done
+func (a *app) CloseRecordings(ctx context.Context) error {
+	if a.recordings == nil {
+		return nil
+	}
+	return a.recordings.close(ctx)
+}
+
+// RecordingWriterStats returns the statistics of the asynchronous writer
+// of the session recordings
+func (a *app) RecordingWriterStats() model.RecordingWriterStats {
+	if a.recordings == nil {
+		return model.RecordingWriterStats{}
+	}
+	return a.recordings.stats()
 }
 
 func (a *app) DownloadFile(ctx context.Context, userID string, deviceID string, path string) error {
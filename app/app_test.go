@@ -25,10 +25,13 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 
+	"github.com/mendersoftware/go-lib-micro/identity"
+
 	inv_mocks "github.com/mendersoftware/deviceconnect/client/inventory/mocks"
 	"github.com/mendersoftware/deviceconnect/client/workflows"
 	wf_mocks "github.com/mendersoftware/deviceconnect/client/workflows/mocks"
 	"github.com/mendersoftware/deviceconnect/model"
+	"github.com/mendersoftware/deviceconnect/store"
 	store_mocks "github.com/mendersoftware/deviceconnect/store/mocks"
 )
 
@@ -189,13 +192,22 @@ func TestPrepareUserSession(t *testing.T) {
 		StoreGetDevice    *model.Device
 		StoreGetDeviceErr error
 
+		StoreGetTenantPolicy    *model.TenantPolicy
+		StoreGetTenantPolicyErr error
+
 		StoreAllocSessErr error
 
+		StoreInsertRecordedErr error
+
 		HaveAuditLogs         bool
+		SessionIdleTimeout    time.Duration
+		MaxUserSessions       int
+		MaxRecordingBytes     int
 		WorkflowsError        error
 		StoreDeleteSessionErr error
 
-		Erre error
+		Policy *model.SessionPolicy
+		Erre   error
 	}{{
 		Name: "ok",
 
@@ -214,6 +226,237 @@ func TestPrepareUserSession(t *testing.T) {
 		StoreAllocSessErr: nil,
 
 		WorkflowsError: nil,
+		Policy:         &model.SessionPolicy{},
+	}, {
+		Name: "ok, tenant policy",
+
+		CTX: context.Background(),
+		Session: &model.Session{
+			DeviceID: "00000000-0000-0000-0000-000000000000",
+			UserID:   "00000000-0000-0000-0000-000000000001",
+			TenantID: "000000000000000000000000",
+			StartTS:  time.Now(),
+		},
+		StoreGetDevice: &model.Device{
+			ID:     "00000000-0000-0000-0000-000000000000",
+			Status: model.DeviceStatusConnected,
+		},
+		StoreGetTenantPolicy: &model.TenantPolicy{
+			IdleTimeout: func() *int { i := 60; return &i }(),
+			MaxDuration: func() *int { i := 3600; return &i }(),
+		},
+		SessionIdleTimeout: time.Hour,
+
+		Policy: &model.SessionPolicy{
+			IdleTimeout: time.Minute,
+			MaxDuration: time.Hour,
+		},
+	}, {
+		Name: "ok, global policy",
+
+		CTX: context.Background(),
+		Session: &model.Session{
+			DeviceID: "00000000-0000-0000-0000-000000000000",
+			UserID:   "00000000-0000-0000-0000-000000000001",
+			TenantID: "000000000000000000000000",
+			StartTS:  time.Now(),
+		},
+		StoreGetDevice: &model.Device{
+			ID:     "00000000-0000-0000-0000-000000000000",
+			Status: model.DeviceStatusConnected,
+		},
+		StoreGetTenantPolicy: &model.TenantPolicy{},
+		SessionIdleTimeout:   time.Hour,
+
+		Policy: &model.SessionPolicy{
+			IdleTimeout: time.Hour,
+		},
+	}, {
+		Name: "ok, tenant session quotas",
+
+		CTX: context.Background(),
+		Session: &model.Session{
+			DeviceID: "00000000-0000-0000-0000-000000000000",
+			UserID:   "00000000-0000-0000-0000-000000000001",
+			TenantID: "000000000000000000000000",
+			StartTS:  time.Now(),
+		},
+		StoreGetDevice: &model.Device{
+			ID:     "00000000-0000-0000-0000-000000000000",
+			Status: model.DeviceStatusConnected,
+		},
+		StoreGetTenantPolicy: &model.TenantPolicy{
+			MaxTenantSessions: func() *int { i := 10; return &i }(),
+			MaxUserSessions:   func() *int { i := 0; return &i }(),
+			MaxDeviceSessions: func() *int { i := 1; return &i }(),
+		},
+		MaxUserSessions: 2,
+
+		Policy: &model.SessionPolicy{
+			MaxTenantSessions: 10,
+			MaxDeviceSessions: 1,
+		},
+	}, {
+		Name: "ok, tenant byte limits",
+
+		CTX: context.Background(),
+		Session: &model.Session{
+			DeviceID: "00000000-0000-0000-0000-000000000000",
+			UserID:   "00000000-0000-0000-0000-000000000001",
+			TenantID: "000000000000000000000000",
+			StartTS:  time.Now(),
+		},
+		StoreGetDevice: &model.Device{
+			ID:     "00000000-0000-0000-0000-000000000000",
+			Status: model.DeviceStatusConnected,
+		},
+		StoreGetTenantPolicy: &model.TenantPolicy{
+			MaxControlBytes: func() *int { i := 1024; return &i }(),
+			LimitAction: func() *string {
+				s := model.SessionLimitActionStopRecording
+				return &s
+			}(),
+		},
+		MaxRecordingBytes: 4096,
+
+		Policy: &model.SessionPolicy{
+			MaxRecordingBytes: 4096,
+			MaxControlBytes:   1024,
+			LimitAction:       model.SessionLimitActionStopRecording,
+		},
+	}, {
+		Name: "ok, resumable session",
+
+		CTX: context.Background(),
+		Session: &model.Session{
+			DeviceID: "00000000-0000-0000-0000-000000000000",
+			UserID:   "00000000-0000-0000-0000-000000000001",
+			TenantID: "000000000000000000000000",
+			StartTS:  time.Now(),
+		},
+		StoreGetDevice: &model.Device{
+			ID:     "00000000-0000-0000-0000-000000000000",
+			Status: model.DeviceStatusConnected,
+		},
+		StoreGetTenantPolicy: &model.TenantPolicy{
+			ResumeGracePeriod: func() *int { i := 120; return &i }(),
+		},
+
+		Policy: &model.SessionPolicy{
+			ResumeGracePeriod: 2 * time.Minute,
+		},
+	}, {
+		Name: "ok, input recording",
+
+		CTX: context.Background(),
+		Session: &model.Session{
+			DeviceID: "00000000-0000-0000-0000-000000000000",
+			UserID:   "00000000-0000-0000-0000-000000000001",
+			TenantID: "000000000000000000000000",
+			StartTS:  time.Now(),
+		},
+		StoreGetDevice: &model.Device{
+			ID:     "00000000-0000-0000-0000-000000000000",
+			Status: model.DeviceStatusConnected,
+		},
+		StoreGetTenantPolicy: &model.TenantPolicy{
+			RecordInput:   func() *bool { b := true; return &b }(),
+			MaxInputBytes: func() *int { i := 2048; return &i }(),
+		},
+
+		Policy: &model.SessionPolicy{
+			RecordInput:   true,
+			MaxInputBytes: 2048,
+		},
+	}, {
+		Name: "ok, recording disabled",
+
+		CTX: context.Background(),
+		Session: &model.Session{
+			DeviceID: "00000000-0000-0000-0000-000000000000",
+			UserID:   "00000000-0000-0000-0000-000000000001",
+			TenantID: "000000000000000000000000",
+			StartTS:  time.Now(),
+		},
+		StoreGetDevice: &model.Device{
+			ID:     "00000000-0000-0000-0000-000000000000",
+			Status: model.DeviceStatusConnected,
+		},
+		StoreGetTenantPolicy: &model.TenantPolicy{
+			DisableRecording: func() *bool { b := true; return &b }(),
+		},
+
+		Policy: &model.SessionPolicy{
+			DisableRecording: true,
+		},
+	}, {
+		Name: "error, device session quota exceeded",
+
+		CTX: context.Background(),
+		Session: &model.Session{
+			DeviceID: "00000000-0000-0000-0000-000000000000",
+			UserID:   "00000000-0000-0000-0000-000000000001",
+			TenantID: "000000000000000000000000",
+			StartTS:  time.Now(),
+		},
+		StoreGetDevice: &model.Device{
+			ID:     "00000000-0000-0000-0000-000000000000",
+			Status: model.DeviceStatusConnected,
+		},
+		StoreAllocSessErr: store.ErrDeviceSessionQuota,
+
+		Erre: ErrDeviceSessionQuota,
+	}, {
+		Name: "error, user session quota exceeded",
+
+		CTX: context.Background(),
+		Session: &model.Session{
+			DeviceID: "00000000-0000-0000-0000-000000000000",
+			UserID:   "00000000-0000-0000-0000-000000000001",
+			TenantID: "000000000000000000000000",
+			StartTS:  time.Now(),
+		},
+		StoreGetDevice: &model.Device{
+			ID:     "00000000-0000-0000-0000-000000000000",
+			Status: model.DeviceStatusConnected,
+		},
+		StoreAllocSessErr: store.ErrUserSessionQuota,
+
+		Erre: ErrUserSessionQuota,
+	}, {
+		Name: "error, tenant session quota exceeded",
+
+		CTX: context.Background(),
+		Session: &model.Session{
+			DeviceID: "00000000-0000-0000-0000-000000000000",
+			UserID:   "00000000-0000-0000-0000-000000000001",
+			TenantID: "000000000000000000000000",
+			StartTS:  time.Now(),
+		},
+		StoreGetDevice: &model.Device{
+			ID:     "00000000-0000-0000-0000-000000000000",
+			Status: model.DeviceStatusConnected,
+		},
+		StoreAllocSessErr: store.ErrTenantSessionQuota,
+
+		Erre: ErrTenantSessionQuota,
+	}, {
+		Name: "error, GetTenantPolicy internal error",
+
+		CTX: context.Background(),
+		Session: &model.Session{
+			DeviceID: "00000000-0000-0000-0000-000000000000",
+			UserID:   "00000000-0000-0000-0000-000000000001",
+			TenantID: "000000000000000000000000",
+			StartTS:  time.Now(),
+		},
+		StoreGetDevice: &model.Device{
+			ID:     "00000000-0000-0000-0000-000000000000",
+			Status: model.DeviceStatusConnected,
+		},
+		StoreGetTenantPolicyErr: errors.New("store: internal error"),
+
+		Erre: errors.New("^store: internal error$"),
 	}, {
 		Name: "error, nil session",
 
@@ -306,6 +549,23 @@ func TestPrepareUserSession(t *testing.T) {
 		},
 		StoreAllocSessErr: errors.New("store: internal error"),
 		Erre:              errors.New("store: internal error"),
+	}, {
+		Name: "error, InsertRecordedSession internal error",
+
+		CTX: context.Background(),
+		Session: &model.Session{
+			DeviceID: "00000000-0000-0000-0000-000000000000",
+			UserID:   "00000000-0000-0000-0000-000000000001",
+			TenantID: "000000000000000000000000",
+			StartTS:  time.Now(),
+		},
+		StoreGetDevice: &model.Device{
+			ID:     "00000000-0000-0000-0000-000000000000",
+			Status: model.DeviceStatusConnected,
+		},
+		StoreInsertRecordedErr: errors.New("store: internal error"),
+		Erre: errors.New(
+			"^failed to catalogue the session recording: store: internal error$"),
 	}}
 
 	for i := range testCases {
@@ -321,7 +581,12 @@ func TestPrepareUserSession(t *testing.T) {
 			defer uuid.SetRand(nil)
 			app := New(
 				ds, inv,
-				wf, Config{HaveAuditLogs: tc.HaveAuditLogs},
+				wf, Config{
+					HaveAuditLogs:      tc.HaveAuditLogs,
+					SessionIdleTimeout: tc.SessionIdleTimeout,
+					MaxUserSessions:    tc.MaxUserSessions,
+					MaxRecordingBytes:  tc.MaxRecordingBytes,
+				},
 			)
 			if tc.BadParameters {
 				goto execTest
@@ -338,11 +603,34 @@ func TestPrepareUserSession(t *testing.T) {
 					model.DeviceStatusConnected {
 				goto execTest
 			}
+			ds.On("GetTenantPolicy", tc.CTX, tc.Session.TenantID).
+				Return(tc.StoreGetTenantPolicy, tc.StoreGetTenantPolicyErr)
+			if tc.StoreGetTenantPolicyErr != nil {
+				goto execTest
+			}
 			ds.On("AllocateSession", tc.CTX, tc.Session).
 				Return(tc.StoreAllocSessErr)
 			if tc.StoreAllocSessErr != nil {
 				goto execTest
 			}
+			if tc.Policy == nil || !tc.Policy.DisableRecording {
+				ds.On("InsertRecordedSession",
+					mock.MatchedBy(func(ctx context.Context) bool {
+						id := identity.FromContext(ctx)
+						return id != nil && id.Tenant == tc.Session.TenantID
+					}),
+					mock.MatchedBy(func(sess *model.RecordedSession) bool {
+						return sess.SessionID == tc.Session.ID &&
+							sess.DeviceID == tc.Session.DeviceID &&
+							sess.UserID == tc.Session.UserID
+					})).
+					Return(tc.StoreInsertRecordedErr)
+			}
+			if tc.StoreInsertRecordedErr != nil {
+				ds.On("DeleteSession", tc.CTX, mock.AnythingOfType("string")).
+					Return(tc.Session, tc.StoreDeleteSessionErr)
+				goto execTest
+			}
 			if !tc.HaveAuditLogs {
 				goto execTest
 			}
@@ -362,6 +650,18 @@ func TestPrepareUserSession(t *testing.T) {
 				}
 			} else {
 				assert.NoError(t, err)
+				if tc.Policy != nil {
+					assert.Equal(t, tc.Policy, tc.Session.Policy)
+				}
+				if tc.Session.Policy.ResumeGracePeriod > 0 {
+					assert.Len(t, tc.Session.ResumeToken, 2*resumeTokenSize)
+					assert.Equal(t,
+						hashResumeToken(tc.Session.ResumeToken),
+						tc.Session.ResumeTokenHash)
+				} else {
+					assert.Empty(t, tc.Session.ResumeToken)
+					assert.Empty(t, tc.Session.ResumeTokenHash)
+				}
 			}
 		})
 	}
@@ -377,6 +677,8 @@ func TestLogUserSession(t *testing.T) {
 		Rand          io.Reader
 		BadParameters bool
 
+		StoreAddSessionTypeErr error
+
 		HaveAuditLogs         bool
 		WorkflowsError        error
 		StoreDeleteSessionErr error
@@ -444,6 +746,33 @@ func TestLogUserSession(t *testing.T) {
 			"failed to submit audit log: http error: failed to clean up " +
 				"session state: store: internal error",
 		),
+	}, {
+		Name: "ok, audit logs disabled",
+
+		CTX: context.Background(),
+		Session: &model.Session{
+			DeviceID: "00000000-0000-0000-0000-000000000000",
+			UserID:   "00000000-0000-0000-0000-000000000001",
+			Types:    []string{model.SessionTypeTerminal},
+			TenantID: "000000000000000000000000",
+			StartTS:  time.Now(),
+		},
+	}, {
+		Name: "error, failed to update session type",
+
+		CTX:           context.Background(),
+		HaveAuditLogs: true,
+		Session: &model.Session{
+			DeviceID: "00000000-0000-0000-0000-000000000000",
+			UserID:   "00000000-0000-0000-0000-000000000001",
+			Types:    []string{model.SessionTypeTerminal},
+			TenantID: "000000000000000000000000",
+			StartTS:  time.Now(),
+		},
+		StoreAddSessionTypeErr: errors.New("store: internal error"),
+		Erre: errors.New(
+			"failed to update session type: store: internal error",
+		),
 	}}
 
 	validateAuditLog := mock.MatchedBy(func(log workflows.AuditLog) bool {
@@ -468,6 +797,14 @@ func TestLogUserSession(t *testing.T) {
 			if tc.BadParameters {
 				goto execTest
 			}
+			ds.On("AddSessionType",
+				tc.CTX,
+				mock.AnythingOfType("string"),
+				tc.Session.Types[0]).
+				Return(tc.StoreAddSessionTypeErr)
+			if tc.StoreAddSessionTypeErr != nil || !tc.HaveAuditLogs {
+				goto execTest
+			}
 			wf.On("SubmitAuditLog",
 				tc.CTX,
 				validateAuditLog).
@@ -509,7 +846,8 @@ func TestFreeUserSession(t *testing.T) {
 		HaveAuditLogs bool
 		WorkflowsErr  error
 
-		Erre error
+		EndReason string
+		Erre      error
 	}{{
 		Name: "ok",
 
@@ -551,6 +889,23 @@ func TestFreeUserSession(t *testing.T) {
 			StartTS:  time.Now().Add(-time.Hour),
 		},
 		HaveAuditLogs: true,
+	}, {
+		Name: "ok, with audit logs and end reason",
+
+		SessionID: "00000000-0000-0000-0000-000000000000",
+
+		StoreDeleteSession: &model.Session{
+			ID:        "00000000-0000-0000-0000-000000000000",
+			DeviceID:  "00000000-0000-0000-0000-000000000001",
+			UserID:    "00000000-0000-0000-0000-000000000002",
+			Types:     []string{model.SessionTypeTerminal},
+			TenantID:  "000000000000000000000000",
+			StartTS:   time.Now().Add(-time.Hour),
+			EndReason: model.SessionEndReasonMaxDuration,
+		},
+		HaveAuditLogs: true,
+
+		EndReason: model.SessionEndReasonMaxDuration,
 	}, {
 		Name: "error, store.DeleteSession internal error",
 
@@ -579,9 +934,13 @@ func TestFreeUserSession(t *testing.T) {
 		Erre: errors.New("http error$"),
 	}}
 
-	workflowsMatcher := func(sess *model.Session) func(workflows.AuditLog) bool {
+	workflowsMatcher := func(endReason string) func(workflows.AuditLog) bool {
+		if endReason == "" {
+			endReason = model.SessionEndReasonClosed
+		}
 		return func(wf workflows.AuditLog) bool {
-			return true
+			reason := wf.MetaData["end_reason"]
+			return len(reason) == 1 && reason[0] == endReason
 		}
 	}
 	for i := range testCases {
@@ -601,7 +960,7 @@ func TestFreeUserSession(t *testing.T) {
 				goto execTest
 			}
 			wf.On("SubmitAuditLog", ctx,
-				mock.MatchedBy(workflowsMatcher(tc.StoreDeleteSession))).
+				mock.MatchedBy(workflowsMatcher(tc.EndReason))).
 				Return(tc.WorkflowsErr)
 
 		execTest:
@@ -624,6 +983,672 @@ func TestFreeUserSession(t *testing.T) {
 	}
 }
 
+func TestGetSession(t *testing.T) {
+	t.Parallel()
+	testCases := []struct {
+		Name string
+
+		SessionID string
+
+		StoreSession    *model.Session
+		StoreSessionErr error
+
+		Erre error
+	}{{
+		Name: "ok",
+
+		SessionID: "00000000-0000-0000-0000-000000000000",
+		StoreSession: &model.Session{
+			ID:       "00000000-0000-0000-0000-000000000000",
+			DeviceID: "00000000-0000-0000-0000-000000000001",
+			UserID:   "00000000-0000-0000-0000-000000000002",
+		},
+	}, {
+		Name: "error, not found",
+
+		SessionID:       "00000000-0000-0000-0000-000000000000",
+		StoreSessionErr: store.ErrSessionNotFound,
+
+		Erre: ErrSessionNotFound,
+	}, {
+		Name: "error, internal error",
+
+		SessionID:       "00000000-0000-0000-0000-000000000000",
+		StoreSessionErr: errors.New("internal error"),
+
+		Erre: errors.New("internal error"),
+	}}
+
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			ctx := context.Background()
+			ds := new(store_mocks.DataStore)
+			defer ds.AssertExpectations(t)
+			ds.On("GetSession", ctx, tc.SessionID).
+				Return(tc.StoreSession, tc.StoreSessionErr)
+
+			app := New(ds, nil, nil)
+			sess, err := app.GetSession(ctx, tc.SessionID)
+			if tc.Erre != nil {
+				if assert.Error(t, err) {
+					assert.EqualError(t, err, tc.Erre.Error())
+				}
+				assert.Nil(t, sess)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, tc.StoreSession, sess)
+			}
+		})
+	}
+}
+
+func TestTerminateUserSession(t *testing.T) {
+	t.Parallel()
+	session := &model.Session{
+		ID:       "00000000-0000-0000-0000-000000000000",
+		DeviceID: "00000000-0000-0000-0000-000000000001",
+		UserID:   "00000000-0000-0000-0000-000000000002",
+		Types:    []string{model.SessionTypeTerminal},
+		TenantID: "000000000000000000000000",
+	}
+	const adminID = "00000000-0000-0000-0000-000000000003"
+	testCases := []struct {
+		Name string
+
+		StoreSetEndReasonErr  error
+		StoreDeleteSessionErr error
+
+		HaveAuditLogs bool
+		WorkflowsErr  error
+
+		Erre error
+	}{{
+		Name: "ok",
+	}, {
+		Name: "ok, with audit logs",
+
+		HaveAuditLogs: true,
+	}, {
+		Name: "error, session not found",
+
+		StoreSetEndReasonErr: store.ErrSessionNotFound,
+
+		Erre: ErrSessionNotFound,
+	}, {
+		Name: "error, store internal error setting the end reason",
+
+		StoreSetEndReasonErr: errors.New("internal error"),
+
+		Erre: errors.New("internal error"),
+	}, {
+		Name: "error, session freed concurrently",
+
+		StoreDeleteSessionErr: store.ErrSessionNotFound,
+		HaveAuditLogs:         true,
+
+		Erre: ErrSessionNotFound,
+	}, {
+		Name: "error, store internal error",
+
+		StoreDeleteSessionErr: errors.New("internal error"),
+
+		Erre: errors.New("internal error"),
+	}, {
+		Name: "error, SubmitAuditLog http error",
+
+		HaveAuditLogs: true,
+		WorkflowsErr:  errors.New("http error"),
+
+		Erre: errors.New("failed to submit audit log: http error"),
+	}}
+
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			ctx := context.Background()
+			ds := new(store_mocks.DataStore)
+			wf := new(wf_mocks.Client)
+			defer ds.AssertExpectations(t)
+			defer wf.AssertExpectations(t)
+
+			ds.On("SetSessionEndReason", ctx,
+				session.ID, model.SessionEndReasonTerminated).
+				Return(tc.StoreSetEndReasonErr)
+			if tc.StoreSetEndReasonErr != nil {
+				goto execTest
+			}
+			if tc.StoreDeleteSessionErr != nil {
+				ds.On("DeleteSession", ctx, session.ID).
+					Return(nil, tc.StoreDeleteSessionErr)
+			} else {
+				deleted := *session
+				deleted.EndReason = model.SessionEndReasonTerminated
+				ds.On("DeleteSession", ctx, session.ID).
+					Return(&deleted, nil)
+			}
+			if tc.HaveAuditLogs && tc.StoreDeleteSessionErr == nil {
+				wf.On("SubmitAuditLog", ctx,
+					mock.MatchedBy(func(log workflows.AuditLog) bool {
+						return log.Action == workflows.ActionTerminalClose &&
+							log.MetaData["end_reason"][0] ==
+								model.SessionEndReasonTerminated
+					})).
+					Return(nil).
+					Once()
+				wf.On("SubmitAuditLog", ctx,
+					mock.MatchedBy(func(log workflows.AuditLog) bool {
+						return log.Action == workflows.ActionSessionTerminate &&
+							log.Actor.ID == adminID &&
+							log.Object.ID == session.DeviceID &&
+							log.MetaData["session_id"][0] == session.ID
+					})).
+					Return(tc.WorkflowsErr).
+					Once()
+			}
+
+		execTest:
+			app := New(ds, nil, wf, Config{HaveAuditLogs: tc.HaveAuditLogs})
+			err := app.TerminateUserSession(ctx, session, adminID)
+			if tc.Erre != nil {
+				if assert.Error(t, err) {
+					assert.EqualError(t, err, tc.Erre.Error())
+				}
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestLogObserver(t *testing.T) {
+	t.Parallel()
+	session := &model.Session{
+		ID:       "00000000-0000-0000-0000-000000000000",
+		DeviceID: "00000000-0000-0000-0000-000000000001",
+		UserID:   "00000000-0000-0000-0000-000000000002",
+		Types:    []string{model.SessionTypeTerminal},
+	}
+	const observerID = "00000000-0000-0000-0000-000000000003"
+	testCases := []struct {
+		Name string
+
+		Join          bool
+		HaveAuditLogs bool
+		WorkflowsErr  error
+
+		Erre error
+	}{{
+		Name: "ok, join without audit logs",
+
+		Join: true,
+	}, {
+		Name: "ok, join",
+
+		Join:          true,
+		HaveAuditLogs: true,
+	}, {
+		Name: "ok, leave",
+
+		HaveAuditLogs: true,
+	}, {
+		Name: "error, SubmitAuditLog http error",
+
+		Join:          true,
+		HaveAuditLogs: true,
+		WorkflowsErr:  errors.New("http error"),
+
+		Erre: errors.New("failed to submit audit log: http error"),
+	}}
+
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			ctx := context.Background()
+			wf := new(wf_mocks.Client)
+			defer wf.AssertExpectations(t)
+
+			action := workflows.ActionObserverLeave
+			if tc.Join {
+				action = workflows.ActionObserverJoin
+			}
+			if tc.HaveAuditLogs {
+				wf.On("SubmitAuditLog", ctx,
+					mock.MatchedBy(func(log workflows.AuditLog) bool {
+						return log.Action == action &&
+							log.Actor.ID == observerID &&
+							log.Object.ID == session.DeviceID &&
+							log.MetaData["session_id"][0] == session.ID
+					})).
+					Return(tc.WorkflowsErr)
+			}
+
+			app := New(nil, nil, wf, Config{HaveAuditLogs: tc.HaveAuditLogs})
+			var err error
+			if tc.Join {
+				err = app.LogObserverJoin(ctx, session, observerID)
+			} else {
+				err = app.LogObserverLeave(ctx, session, observerID)
+			}
+			if tc.Erre != nil {
+				if assert.Error(t, err) {
+					assert.EqualError(t, err, tc.Erre.Error())
+				}
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestSessionWrite(t *testing.T) {
+	t.Parallel()
+	session := &model.Session{
+		ID:       "00000000-0000-0000-0000-000000000000",
+		DeviceID: "00000000-0000-0000-0000-000000000001",
+		UserID:   "00000000-0000-0000-0000-000000000002",
+	}
+	testCases := []struct {
+		Name string
+
+		Grant    bool
+		UserID   string
+		StoreErr error
+
+		Erre error
+	}{{
+		Name: "ok, grant",
+
+		Grant:  true,
+		UserID: "00000000-0000-0000-0000-000000000003",
+	}, {
+		Name: "ok, revoke",
+
+		UserID: "00000000-0000-0000-0000-000000000003",
+	}, {
+		Name: "error, grant to the owner",
+
+		Grant:  true,
+		UserID: session.UserID,
+
+		Erre: ErrSessionOwnerWrite,
+	}, {
+		Name: "error, revoke from the owner",
+
+		UserID: session.UserID,
+
+		Erre: ErrSessionOwnerWrite,
+	}, {
+		Name: "error, session not found",
+
+		Grant:    true,
+		UserID:   "00000000-0000-0000-0000-000000000003",
+		StoreErr: store.ErrSessionNotFound,
+
+		Erre: ErrSessionNotFound,
+	}, {
+		Name: "error, store internal error",
+
+		UserID:   "00000000-0000-0000-0000-000000000003",
+		StoreErr: errors.New("internal error"),
+
+		Erre: errors.New("internal error"),
+	}}
+
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			ctx := context.Background()
+			ds := new(store_mocks.DataStore)
+			defer ds.AssertExpectations(t)
+
+			if tc.UserID != session.UserID {
+				method := "RemoveSessionWriter"
+				if tc.Grant {
+					method = "AddSessionWriter"
+				}
+				ds.On(method, ctx, session.ID, tc.UserID).
+					Return(tc.StoreErr)
+			}
+
+			app := New(ds, nil, nil)
+			var err error
+			if tc.Grant {
+				err = app.GrantSessionWrite(ctx, session, tc.UserID)
+			} else {
+				err = app.RevokeSessionWrite(ctx, session, tc.UserID)
+			}
+			if tc.Erre != nil {
+				if assert.Error(t, err) {
+					assert.EqualError(t, err, tc.Erre.Error())
+				}
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestListSessions(t *testing.T) {
+	t.Parallel()
+	testCases := []struct {
+		Name string
+
+		Filter model.SessionFilter
+
+		StoreSessions    []model.Session
+		StoreFindErr     error
+		StoreCount       int64
+		StoreCountErr    error
+		SkipStoreFind    bool
+		SkipStoreCount   bool
+		ExpectedSessions []model.Session
+		ExpectedCount    int64
+
+		Erre error
+	}{{
+		Name: "ok",
+
+		Filter: model.SessionFilter{
+			DeviceID: "00000000-0000-0000-0000-000000000000",
+			Type:     model.SessionTypeTerminal,
+			Limit:    20,
+		},
+		StoreSessions: []model.Session{{
+			ID:       "00000000-0000-0000-0000-000000000002",
+			DeviceID: "00000000-0000-0000-0000-000000000000",
+			UserID:   "00000000-0000-0000-0000-000000000001",
+			Types:    []string{model.SessionTypeTerminal},
+		}},
+		StoreCount: 1,
+		ExpectedSessions: []model.Session{{
+			ID:       "00000000-0000-0000-0000-000000000002",
+			DeviceID: "00000000-0000-0000-0000-000000000000",
+			UserID:   "00000000-0000-0000-0000-000000000001",
+			Types:    []string{model.SessionTypeTerminal},
+		}},
+		ExpectedCount: 1,
+	}, {
+		Name: "error, invalid filter",
+
+		Filter: model.SessionFilter{
+			Type: "bogus",
+		},
+		SkipStoreFind:  true,
+		SkipStoreCount: true,
+		ExpectedCount:  -1,
+
+		Erre: errors.New("^app: invalid session filter: type: must be a valid value.$"),
+	}, {
+		Name: "error, store find error",
+
+		StoreFindErr:   errors.New("internal error"),
+		SkipStoreCount: true,
+		ExpectedCount:  -1,
+
+		Erre: errors.New("^internal error$"),
+	}, {
+		Name: "error, store count error",
+
+		StoreSessions: []model.Session{},
+		StoreCountErr: errors.New("internal error"),
+		ExpectedCount: -1,
+
+		Erre: errors.New("^internal error$"),
+	}}
+
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			ctx := context.Background()
+			ds := new(store_mocks.DataStore)
+			defer ds.AssertExpectations(t)
+			if !tc.SkipStoreFind {
+				ds.On("FindSessions", ctx, tc.Filter).
+					Return(tc.StoreSessions, tc.StoreFindErr)
+			}
+			if !tc.SkipStoreCount {
+				ds.On("CountSessions", ctx, tc.Filter).
+					Return(tc.StoreCount, tc.StoreCountErr)
+			}
+
+			app := New(ds, nil, nil)
+			sessions, count, err := app.ListSessions(ctx, tc.Filter)
+			if tc.Erre != nil {
+				if assert.Error(t, err) {
+					assert.Regexp(t, tc.Erre.Error(), err.Error())
+				}
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tc.ExpectedSessions, sessions)
+			assert.Equal(t, tc.ExpectedCount, count)
+		})
+	}
+}
+
+func TestGetTenantPolicy(t *testing.T) {
+	t.Parallel()
+	idleTimeout := 300
+	testCases := []struct {
+		Name string
+
+		StorePolicy    *model.TenantPolicy
+		StorePolicyErr error
+
+		Policy *model.TenantPolicy
+		Erre   error
+	}{{
+		Name: "ok",
+
+		StorePolicy: &model.TenantPolicy{IdleTimeout: &idleTimeout},
+		Policy:      &model.TenantPolicy{IdleTimeout: &idleTimeout},
+	}, {
+		Name: "ok, no policy",
+
+		Policy: &model.TenantPolicy{},
+	}, {
+		Name: "error, internal error",
+
+		StorePolicyErr: errors.New("internal error"),
+		Erre:           errors.New("internal error"),
+	}}
+
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			const tenantID = "000000000000000000000000"
+			ctx := context.Background()
+			ds := new(store_mocks.DataStore)
+			defer ds.AssertExpectations(t)
+			ds.On("GetTenantPolicy", ctx, tenantID).
+				Return(tc.StorePolicy, tc.StorePolicyErr)
+
+			app := New(ds, nil, nil)
+			policy, err := app.GetTenantPolicy(ctx, tenantID)
+			if tc.Erre != nil {
+				assert.EqualError(t, err, tc.Erre.Error())
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, tc.Policy, policy)
+			}
+		})
+	}
+}
+
+func TestSetTenantPolicy(t *testing.T) {
+	const tenantID = "000000000000000000000000"
+	week, year := 7*24*3600, 365*24*3600
+	testCases := []struct {
+		Name     string
+		Previous *model.TenantPolicy
+		Policy   *model.TenantPolicy
+
+		SetTenantPolicyError error
+		UpdateExpiry         bool
+		UpdateExpiryError    error
+
+		Error error
+	}{{
+		Name:   "ok, retention unchanged",
+		Policy: &model.TenantPolicy{},
+	}, {
+		Name:         "ok, retention changed",
+		Previous:     &model.TenantPolicy{RecordingRetention: &week},
+		Policy:       &model.TenantPolicy{RecordingRetention: &year},
+		UpdateExpiry: true,
+	}, {
+		Name:         "ok, retention reset",
+		Previous:     &model.TenantPolicy{RecordingRetention: &week},
+		Policy:       &model.TenantPolicy{},
+		UpdateExpiry: true,
+	}, {
+		Name:                 "error, internal error",
+		Policy:               &model.TenantPolicy{},
+		SetTenantPolicyError: errors.New("internal error"),
+		Error:                errors.New("internal error"),
+	}, {
+		Name:              "error, updating the expiry",
+		Policy:            &model.TenantPolicy{RecordingRetention: &year},
+		UpdateExpiry:      true,
+		UpdateExpiryError: errors.New("internal error"),
+		Error: errors.New("failed to update the expiry of the session " +
+			"recordings: internal error"),
+	}}
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			ctx := context.Background()
+			ds := new(store_mocks.DataStore)
+			defer ds.AssertExpectations(t)
+			ds.On("GetTenantPolicy", ctx, tenantID).Return(tc.Previous, nil)
+			ds.On("SetTenantPolicy", ctx, tenantID, tc.Policy).
+				Return(tc.SetTenantPolicyError)
+			if tc.UpdateExpiry {
+				ds.On("UpdateRecordingExpiry",
+					mock.MatchedBy(func(ctx context.Context) bool {
+						id := identity.FromContext(ctx)
+						return id != nil && id.Tenant == tenantID
+					}),
+					"",
+				).Return(tc.UpdateExpiryError)
+			}
+
+			app := New(ds, nil, nil)
+			err := app.SetTenantPolicy(ctx, tenantID, tc.Policy)
+			if tc.Error != nil {
+				assert.EqualError(t, err, tc.Error.Error())
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestResumeUserSession(t *testing.T) {
+	t.Parallel()
+	const (
+		sessionID = "00000000-0000-0000-0000-000000000000"
+		userID    = "00000000-0000-0000-0000-000000000001"
+		token     = "resume-token"
+	)
+	session := &model.Session{
+		ID:              sessionID,
+		UserID:          userID,
+		DeviceID:        "00000000-0000-0000-0000-000000000002",
+		ResumeTokenHash: hashResumeToken(token),
+	}
+	testCases := []struct {
+		Name string
+
+		UserID string
+		Token  string
+
+		StoreSession    *model.Session
+		StoreSessionErr error
+
+		Erre error
+	}{{
+		Name: "ok",
+
+		UserID:       userID,
+		Token:        token,
+		StoreSession: session,
+	}, {
+		Name: "error, invalid token",
+
+		UserID:       userID,
+		Token:        "invalid",
+		StoreSession: session,
+
+		Erre: ErrSessionResumeDenied,
+	}, {
+		Name: "error, not the session owner",
+
+		UserID:       "00000000-0000-0000-0000-000000000003",
+		Token:        token,
+		StoreSession: session,
+
+		Erre: ErrSessionResumeDenied,
+	}, {
+		Name: "error, session not resumable",
+
+		UserID: userID,
+		StoreSession: &model.Session{
+			ID:       sessionID,
+			UserID:   userID,
+			DeviceID: "00000000-0000-0000-0000-000000000002",
+		},
+
+		Erre: ErrSessionResumeDenied,
+	}, {
+		Name: "error, not found",
+
+		UserID:          userID,
+		Token:           token,
+		StoreSessionErr: store.ErrSessionNotFound,
+
+		Erre: ErrSessionNotFound,
+	}, {
+		Name: "error, internal error",
+
+		UserID:          userID,
+		Token:           token,
+		StoreSessionErr: errors.New("internal error"),
+
+		Erre: errors.New("internal error"),
+	}}
+
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			ctx := context.Background()
+			ds := new(store_mocks.DataStore)
+			defer ds.AssertExpectations(t)
+			ds.On("GetSession", ctx, sessionID).
+				Return(tc.StoreSession, tc.StoreSessionErr)
+
+			app := New(ds, nil, nil)
+			sess, err := app.ResumeUserSession(ctx, sessionID, tc.UserID, tc.Token)
+			if tc.Erre != nil {
+				if assert.Error(t, err) {
+					assert.EqualError(t, err, tc.Erre.Error())
+				}
+				assert.Nil(t, sess)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, tc.StoreSession, sess)
+			}
+		})
+	}
+}
+
 func TestGetSessionRecording(t *testing.T) {
 	testCases := []struct {
 		Name                       string
@@ -684,6 +1709,7 @@ func TestSaveSessionRecording(t *testing.T) {
 				}),
 				sessionId,
 				bytes,
+				model.ChunkLink{},
 			).Return(tc.DbGetSessionRecordingError)
 			app := New(store, nil, nil)
 
@@ -0,0 +1,218 @@
+// Copyright 2023 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"unicode/utf8"
+
+	"github.com/mendersoftware/go-lib-micro/ws"
+	"github.com/mendersoftware/go-lib-micro/ws/shell"
+	"github.com/vmihailenco/msgpack/v5"
+
+	"github.com/mendersoftware/deviceconnect/model"
+)
+
+const (
+	// AsciicastVersion is the version of the asciicast file format
+	AsciicastVersion = 2
+	// AsciicastContentType is the media type of the asciicast files
+	AsciicastContentType = "application/x-asciicast"
+
+	// DefaultTerminalWidth and DefaultTerminalHeight are the terminal size
+	// of the recordings lacking the resize control messages
+	DefaultTerminalWidth  = 80
+	DefaultTerminalHeight = 24
+)
+
+const (
+	asciicastEventOutput = "o"
+	asciicastEventInput  = "i"
+	asciicastEventResize = "r"
+)
+
+// AsciicastHeader is the header line of an asciicast v2 file
+type AsciicastHeader struct {
+	Version int    `json:"version"`
+	Width   uint16 `json:"width"`
+	Height  uint16 `json:"height"`
+	Title   string `json:"title,omitempty"`
+}
+
+// AsciicastWriter converts the msgpack-encoded messages of a session
+// recording, as written by GetSessionRecording, to an asciicast v2 file:
+// the terminal output becomes output events, timed after the delay control
+// messages, the recorded terminal input becomes input events, and the
+// resize control messages set the terminal size.
+type AsciicastWriter struct {
+	w      io.Writer
+	header AsciicastHeader
+
+	headerWritten bool
+	elapsedMs     uint64
+	// pending holds the trailing bytes of an incomplete UTF-8 sequence,
+	// completed by the next output chunk
+	pending []byte
+	events  int
+}
+
+// NewAsciicastWriter returns a writer converting the session recording
+// to an asciicast v2 file written to w; title is the optional file title.
+func NewAsciicastWriter(w io.Writer, title string) *AsciicastWriter {
+	return &AsciicastWriter{
+		w: w,
+		header: AsciicastHeader{
+			Version: AsciicastVersion,
+			Title:   title,
+		},
+	}
+}
+
+// Write converts one msgpack-encoded recording message
+func (a *AsciicastWriter) Write(d []byte) (int, error) {
+	var msg ws.ProtoMsg
+	if err := msgpack.Unmarshal(d, &msg); err != nil {
+		return 0, err
+	}
+	if msg.Header.Proto != ws.ProtoTypeShell {
+		return len(d), nil
+	}
+
+	var err error
+	switch msg.Header.MsgType {
+	case shell.MessageTypeShellCommand:
+		err = a.writeOutput(msg.Body)
+	case model.InputMessageName:
+		err = a.writeEvent(asciicastEventInput, string(msg.Body))
+	case model.DelayMessageName:
+		delay, _ := model.PropertyUint16(msg.Header.Properties,
+			model.DelayMessageValueField)
+		a.elapsedMs += uint64(delay)
+	case shell.MessageTypeResizeShell:
+		width, okWidth := model.PropertyUint16(msg.Header.Properties,
+			model.ResizeMessageTermWidthField)
+		height, okHeight := model.PropertyUint16(msg.Header.Properties,
+			model.ResizeMessageTermHeightField)
+		if !okWidth || !okHeight || width == 0 || height == 0 {
+			break
+		}
+		err = a.writeResize(width, height)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return len(d), nil
+}
+
+// Close flushes the pending output and writes the header if the
+// recording has no events; it does not close the underlying writer.
+func (a *AsciicastWriter) Close() error {
+	if len(a.pending) > 0 {
+		pending := a.pending
+		a.pending = nil
+		if err := a.writeEvent(asciicastEventOutput, string(pending)); err != nil {
+			return err
+		}
+	}
+	return a.writeHeader()
+}
+
+// Events returns the number of events written so far
+func (a *AsciicastWriter) Events() int {
+	return a.events
+}
+
+// Empty returns true if the recording has no events
+func (a *AsciicastWriter) Empty() bool {
+	return a.events == 0
+}
+
+func (a *AsciicastWriter) writeOutput(data []byte) error {
+	if len(a.pending) > 0 {
+		data = append(a.pending, data...)
+	}
+	data, a.pending = splitIncompleteRune(data)
+	if len(data) == 0 {
+		return nil
+	}
+	return a.writeEvent(asciicastEventOutput, string(data))
+}
+
+func (a *AsciicastWriter) writeResize(width, height uint16) error {
+	if !a.headerWritten {
+		// the first resize before any output sets the initial size
+		a.header.Width = width
+		a.header.Height = height
+		return nil
+	}
+	return a.writeEvent(asciicastEventResize, fmt.Sprintf("%dx%d", width, height))
+}
+
+func (a *AsciicastWriter) writeHeader() error {
+	if a.headerWritten {
+		return nil
+	}
+	if a.header.Width == 0 || a.header.Height == 0 {
+		a.header.Width = DefaultTerminalWidth
+		a.header.Height = DefaultTerminalHeight
+	}
+	b, err := json.Marshal(a.header)
+	if err != nil {
+		return err
+	}
+	if _, err = a.w.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	a.headerWritten = true
+	return nil
+}
+
+func (a *AsciicastWriter) writeEvent(eventType string, data string) error {
+	if err := a.writeHeader(); err != nil {
+		return err
+	}
+	b, err := json.Marshal([]interface{}{
+		float64(a.elapsedMs) / 1000,
+		eventType,
+		data,
+	})
+	if err != nil {
+		return err
+	}
+	if _, err = a.w.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	a.events++
+	return nil
+}
+
+// splitIncompleteRune splits the data in the complete UTF-8 sequences and
+// the trailing bytes of an incomplete one, to be completed by the next chunk
+// of the recording.
+func splitIncompleteRune(data []byte) (complete []byte, rest []byte) {
+	for i := 1; i < utf8.UTFMax && i <= len(data); i++ {
+		if !utf8.RuneStart(data[len(data)-i]) {
+			continue
+		}
+		if !utf8.FullRune(data[len(data)-i:]) {
+			rest = append([]byte{}, data[len(data)-i:]...)
+			return data[:len(data)-i], rest
+		}
+		break
+	}
+	return data, nil
+}
@@ -0,0 +1,166 @@
+// Copyright 2023 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package app
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/mendersoftware/go-lib-micro/ws"
+	"github.com/mendersoftware/go-lib-micro/ws/shell"
+	"github.com/stretchr/testify/assert"
+	"github.com/vmihailenco/msgpack/v5"
+
+	"github.com/mendersoftware/deviceconnect/model"
+)
+
+func packRecordingMessage(t *testing.T, msgType string,
+	properties map[string]interface{}, body []byte) []byte {
+	b, err := msgpack.Marshal(&ws.ProtoMsg{
+		Header: ws.ProtoHdr{
+			Proto:      ws.ProtoTypeShell,
+			MsgType:    msgType,
+			SessionID:  "session",
+			Properties: properties,
+		},
+		Body: body,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestAsciicastWriter(t *testing.T) {
+	output := func(body string) func(t *testing.T) []byte {
+		return func(t *testing.T) []byte {
+			return packRecordingMessage(t, shell.MessageTypeShellCommand,
+				nil, []byte(body))
+		}
+	}
+	delay := func(ms uint16) func(t *testing.T) []byte {
+		return func(t *testing.T) []byte {
+			return packRecordingMessage(t, model.DelayMessageName,
+				map[string]interface{}{model.DelayMessageValueField: ms}, nil)
+		}
+	}
+	input := func(body string) func(t *testing.T) []byte {
+		return func(t *testing.T) []byte {
+			return packRecordingMessage(t, model.InputMessageName,
+				map[string]interface{}{model.UserMessageIDField: "user"},
+				[]byte(body))
+		}
+	}
+	resize := func(width, height uint16) func(t *testing.T) []byte {
+		return func(t *testing.T) []byte {
+			return packRecordingMessage(t, shell.MessageTypeResizeShell,
+				map[string]interface{}{
+					model.ResizeMessageTermWidthField:  width,
+					model.ResizeMessageTermHeightField: height,
+				}, nil)
+		}
+	}
+
+	testCases := []struct {
+		Name string
+
+		Messages []func(t *testing.T) []byte
+
+		Events int
+		Output string
+	}{{
+		Name: "empty recording",
+
+		Output: `{"version":2,"width":80,"height":24,"title":"title"}` + "\n",
+	}, {
+		Name: "output with delays and resizes",
+
+		Messages: []func(t *testing.T) []byte{
+			resize(120, 40),
+			output("$ "),
+			delay(1500),
+			output("ls\r\n"),
+			delay(65535),
+			resize(100, 30),
+			output("file\r\n"),
+		},
+
+		Events: 4,
+		Output: `{"version":2,"width":120,"height":40,"title":"title"}` + "\n" +
+			`[0,"o","$ "]` + "\n" +
+			`[1.5,"o","ls\r\n"]` + "\n" +
+			`[67.035,"r","100x30"]` + "\n" +
+			`[67.035,"o","file\r\n"]` + "\n",
+	}, {
+		Name: "output with the recorded input",
+
+		Messages: []func(t *testing.T) []byte{
+			output("$ "),
+			delay(500),
+			input("id\r"),
+			output("id\r\nuid=0(root)\r\n"),
+		},
+
+		Events: 3,
+		Output: `{"version":2,"width":80,"height":24,"title":"title"}` + "\n" +
+			`[0,"o","$ "]` + "\n" +
+			`[0.5,"i","id\r"]` + "\n" +
+			`[0.5,"o","id\r\nuid=0(root)\r\n"]` + "\n",
+	}, {
+		Name: "UTF-8 sequence split across chunks",
+
+		Messages: []func(t *testing.T) []byte{
+			output("caf\xc3"),
+			output("\xa9 \xe2\x82"),
+		},
+
+		Events: 3,
+		Output: `{"version":2,"width":80,"height":24,"title":"title"}` + "\n" +
+			`[0,"o","caf"]` + "\n" +
+			`[0,"o","é "]` + "\n" +
+			// the truncated sequence ending the recording is replaced
+			"[0,\"o\",\"\ufffd\ufffd\"]\n",
+	}, {
+		Name: "invalid resize is ignored",
+
+		Messages: []func(t *testing.T) []byte{
+			resize(0, 0),
+			output("x"),
+		},
+
+		Events: 1,
+		Output: `{"version":2,"width":80,"height":24,"title":"title"}` + "\n" +
+			`[0,"o","x"]` + "\n",
+	}}
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			var buf bytes.Buffer
+			w := NewAsciicastWriter(&buf, "title")
+			for _, msg := range tc.Messages {
+				data := msg(t)
+				n, err := w.Write(data)
+				assert.NoError(t, err)
+				assert.Equal(t, len(data), n)
+			}
+			assert.NoError(t, w.Close())
+			assert.Equal(t, tc.Events, w.Events())
+			assert.Equal(t, tc.Output, buf.String())
+		})
+	}
+
+	w := NewAsciicastWriter(&bytes.Buffer{}, "")
+	_, err := w.Write([]byte("not msgpack"))
+	assert.Error(t, err)
+}
@@ -18,11 +18,28 @@ import (
 	"encoding/binary"
 	"errors"
 	"io"
+	"time"
 )
 
 const (
 	ResizeMessage byte = iota + 1
 	DelayMessage
+	// UserMessage marks the user the terminal input following the
+	// offset originates from, in sessions with several writers.
+	UserMessage
+	// TimestampMessage holds the wall-clock time the terminal output
+	// following the offset was recorded at, with millisecond precision.
+	TimestampMessage
+	// InputMessage holds the terminal input a user typed when the output
+	// reached the offset, and the time it was typed at; the input messages
+	// are recorded in their own stream.
+	InputMessage
+)
+
+const (
+	// MaxControlUserIDLength is the maximum length of the user ID
+	// of the UserMessage control message
+	MaxControlUserIDLength = 255
 )
 
 var (
@@ -35,6 +52,9 @@ type Control struct {
 	DelayMs        uint16
 	TerminalWidth  uint16
 	TerminalHeight uint16
+	UserID         string
+	Timestamp      time.Time
+	Data           []byte
 }
 
 func (c Control) MarshalBinary() []byte {
@@ -59,10 +79,84 @@ func (c Control) MarshalBinary() []byte {
 		binary.LittleEndian.PutUint32(b[offset:], uint32(c.Offset))
 		offset += 4
 		binary.LittleEndian.PutUint16(b[offset:], c.DelayMs)
+	case UserMessage:
+		userID := c.UserID
+		if len(userID) > MaxControlUserIDLength {
+			userID = userID[:MaxControlUserIDLength]
+		}
+		b = make([]byte, 1+4+1+len(userID))
+		offset := 0
+		b[offset] = c.Type
+		offset++
+		binary.LittleEndian.PutUint32(b[offset:], uint32(c.Offset))
+		offset += 4
+		b[offset] = byte(len(userID))
+		offset++
+		copy(b[offset:], userID)
+	case TimestampMessage:
+		b = make([]byte, 1+4+8)
+		offset := 0
+		b[offset] = c.Type
+		offset++
+		binary.LittleEndian.PutUint32(b[offset:], uint32(c.Offset))
+		offset += 4
+		binary.LittleEndian.PutUint64(b[offset:], uint64(c.Timestamp.UnixMilli()))
+	case InputMessage:
+		userID := c.UserID
+		if len(userID) > MaxControlUserIDLength {
+			userID = userID[:MaxControlUserIDLength]
+		}
+		b = make([]byte, 1+4+8+1+len(userID)+4+len(c.Data))
+		offset := 0
+		b[offset] = c.Type
+		offset++
+		binary.LittleEndian.PutUint32(b[offset:], uint32(c.Offset))
+		offset += 4
+		binary.LittleEndian.PutUint64(b[offset:], uint64(c.Timestamp.UnixMilli()))
+		offset += 8
+		b[offset] = byte(len(userID))
+		offset++
+		offset += copy(b[offset:], userID)
+		binary.LittleEndian.PutUint32(b[offset:], uint32(len(c.Data)))
+		offset += 4
+		copy(b[offset:], c.Data)
 	}
 	return b
 }
 
+// ControlMessageSize returns the length of the binary representation of
+// the control message starting the buffer, or 0 if the message type is
+// unknown or the buffer is too short to tell.
+func ControlMessageSize(controlMessageBuffer []byte) int {
+	if len(controlMessageBuffer) < 1 {
+		return 0
+	}
+	switch controlMessageBuffer[0] {
+	case DelayMessage:
+		return 7
+	case ResizeMessage:
+		return 9
+	case UserMessage:
+		if len(controlMessageBuffer) < 6 {
+			return 0
+		}
+		return 6 + int(controlMessageBuffer[5])
+	case TimestampMessage:
+		return 13
+	case InputMessage:
+		if len(controlMessageBuffer) < 14 {
+			return 0
+		}
+		userIDEnd := 14 + int(controlMessageBuffer[13])
+		if len(controlMessageBuffer) < userIDEnd+4 {
+			return 0
+		}
+		return userIDEnd + 4 +
+			int(binary.LittleEndian.Uint32(controlMessageBuffer[userIDEnd:]))
+	}
+	return 0
+}
+
 func (c *Control) UnmarshalBinary(controlMessageBuffer []byte) (err error) {
 	var offset = 0
 
@@ -94,6 +188,53 @@ func (c *Control) UnmarshalBinary(controlMessageBuffer []byte) (err error) {
 		c.TerminalWidth = width
 		c.TerminalHeight = height
 		return nil
+	case UserMessage:
+		if len(controlMessageBuffer) < 6 {
+			return io.ErrShortBuffer
+		}
+		offset++
+		recordingOffset := binary.LittleEndian.Uint32(controlMessageBuffer[offset:])
+		offset += 4
+		length := int(controlMessageBuffer[offset])
+		offset++
+		if len(controlMessageBuffer) < offset+length {
+			return io.ErrShortBuffer
+		}
+		c.Type = UserMessage
+		c.Offset = int(recordingOffset)
+		c.UserID = string(controlMessageBuffer[offset : offset+length])
+		return nil
+	case TimestampMessage:
+		if len(controlMessageBuffer) < 13 {
+			return io.ErrShortBuffer
+		}
+		offset++
+		recordingOffset := binary.LittleEndian.Uint32(controlMessageBuffer[offset:])
+		offset += 4
+		timestamp := binary.LittleEndian.Uint64(controlMessageBuffer[offset:])
+		c.Type = TimestampMessage
+		c.Offset = int(recordingOffset)
+		c.Timestamp = time.UnixMilli(int64(timestamp)).UTC()
+		return nil
+	case InputMessage:
+		size := ControlMessageSize(controlMessageBuffer)
+		if size == 0 || len(controlMessageBuffer) < size {
+			return io.ErrShortBuffer
+		}
+		offset++
+		recordingOffset := binary.LittleEndian.Uint32(controlMessageBuffer[offset:])
+		offset += 4
+		timestamp := binary.LittleEndian.Uint64(controlMessageBuffer[offset:])
+		offset += 8
+		length := int(controlMessageBuffer[offset])
+		offset++
+		c.Type = InputMessage
+		c.Offset = int(recordingOffset)
+		c.Timestamp = time.UnixMilli(int64(timestamp)).UTC()
+		c.UserID = string(controlMessageBuffer[offset : offset+length])
+		offset += length + 4
+		c.Data = append([]byte{}, controlMessageBuffer[offset:size]...)
+		return nil
 	}
 	return ErrUnknownMessage
 }
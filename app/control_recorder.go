@@ -15,21 +15,29 @@
 package app
 
 import (
-	"bytes"
-	"compress/gzip"
 	"context"
 	"sync"
 
+	"github.com/mendersoftware/deviceconnect/model"
 	"github.com/mendersoftware/deviceconnect/store"
 )
 
 type ControlRecorder struct {
-	sessionID  string
-	store      store.DataStore
-	ctx        context.Context
-	gzipWriter *gzip.Writer
-	gzipBuffer bytes.Buffer
-	mutex      sync.Mutex
+	sessionID string
+	// name is the name of the recording stream, the control messages or
+	// the terminal input
+	name   string
+	store  store.DataStore
+	ctx    context.Context
+	stream recordingStream
+	mutex  sync.Mutex
+	// insert inserts the compressed chunks in the store, chained by chain
+	insert func(ctx context.Context, sessionID string, data []byte,
+		link model.ChunkLink) error
+	// flush waits for the chunks queued to be written; nil if the chunks
+	// are inserted in the store at once
+	flush func() error
+	chain *model.RecordingChain
 }
 
 const (
@@ -40,17 +48,28 @@ const (
 func NewControlRecorder(ctx context.Context,
 	sessionID string,
 	store store.DataStore) *ControlRecorder {
-	buffer := bytes.Buffer{}
 	return &ControlRecorder{
-		ctx:        ctx,
-		sessionID:  sessionID,
-		store:      store,
-		gzipBuffer: buffer,
-		gzipWriter: gzip.NewWriter(&buffer),
-		mutex:      sync.Mutex{},
+		ctx:       ctx,
+		sessionID: sessionID,
+		name:      model.RecordingStreamControl,
+		store:     store,
+		mutex:     sync.Mutex{},
+		insert:    store.InsertControlRecording,
+		chain:     model.NewRecordingChain(sessionID),
 	}
 }
 
+// NewInputRecorder returns a recorder of the input messages of the session,
+// compressed and stored in chunks like the control messages.
+func NewInputRecorder(ctx context.Context,
+	sessionID string,
+	store store.DataStore) *ControlRecorder {
+	r := NewControlRecorder(ctx, sessionID, store)
+	r.name = model.RecordingStreamInput
+	r.insert = store.InsertInputRecording
+	return r
+}
+
 func (r *ControlRecorder) Write(d []byte) (n int, err error) {
 	//safety precaution, there are two buffered writers using this writer
 	r.mutex.Lock()
@@ -60,26 +79,48 @@ func (r *ControlRecorder) Write(d []byte) (n int, err error) {
 		return 0, nil
 	}
 
-	r.gzipBuffer.Reset()
-	r.gzipWriter.Reset(&r.gzipBuffer)
-	_, err = r.gzipWriter.Write(d)
+	chunk, link, err := r.stream.compress(d)
 	if err != nil {
 		return -1, err
 	}
-
-	r.gzipWriter.Flush()
-	r.gzipWriter.Close()
-	output := r.gzipBuffer.Bytes()
-	n, err = r.gzipBuffer.Read(output)
-	if err != nil {
+	if err = r.insertChunk(chunk, link); err != nil {
 		return -1, err
 	}
+	return len(d), nil
+}
 
-	err = r.store.InsertControlRecording(r.ctx, r.sessionID, output[:n])
+// Close ends the compressed stream of the messages, storing its last chunk
+// and waiting for the chunks queued to be written
+func (r *ControlRecorder) Close() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
 
-	if err != nil {
-		return -1, err
-	} else {
-		return len(d), nil
+	chunk, link, err := r.stream.close()
+	if err == nil && chunk != nil {
+		err = r.insertChunk(chunk, link)
+	}
+	if err == nil && r.flush != nil {
+		if err = r.flush(); err != nil {
+			err = recordingFailed(&r.stream, r.chain, err)
+		}
+	}
+	return err
+}
+
+// Head returns the head of the chain of the chunks recorded
+func (r *ControlRecorder) Head() model.RecordingStreamHead {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return streamHead(r.name, r.chain)
+}
+
+// insertChunk stores the chunk of the stream, chained to the previous chunks
+func (r *ControlRecorder) insertChunk(chunk []byte, link model.ChunkLink) error {
+	chained := r.chain.Next(chunk)
+	link.Sequence, link.Hash = chained.Sequence, chained.Hash
+	if err := r.insert(r.ctx, r.sessionID, chunk, link); err != nil {
+		return recordingFailed(&r.stream, r.chain, err)
 	}
+	r.chain.Advance(chained)
+	return nil
 }
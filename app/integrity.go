@@ -0,0 +1,341 @@
+// Copyright 2023 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package app
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"os"
+
+	"github.com/pkg/errors"
+
+	"github.com/mendersoftware/deviceconnect/model"
+)
+
+var (
+	ErrRecordingNotFound    = errors.New("session recording not found")
+	ErrRecordingChainBroken = errors.New("the chain of the session recording is broken")
+	ErrSigningKeyInvalid    = errors.New("invalid recording signing key")
+)
+
+// LoadRecordingSigningKey loads the PEM-encoded private key signing the
+// session recordings: an Ed25519, ECDSA or RSA key, in PKCS #8 form, or in
+// PKCS #1 or SEC 1 form for the RSA and ECDSA keys.
+func LoadRecordingSigningKey(path string) (crypto.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read the recording signing key")
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.Wrap(ErrSigningKeyInvalid, "no PEM data found")
+	}
+	var key interface{}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, errors.Wrap(ErrSigningKeyInvalid, err.Error())
+	}
+	switch key := key.(type) {
+	case ed25519.PrivateKey:
+		return key, nil
+	case *ecdsa.PrivateKey:
+		return key, nil
+	case *rsa.PrivateKey:
+		return key, nil
+	}
+	return nil, errors.Wrapf(ErrSigningKeyInvalid, "unsupported key type %T", key)
+}
+
+// LoadRecordingVerificationKeys loads the PEM-encoded public keys verifying
+// the signatures of the session recordings, e.g. the keys of the rotated
+// signing keys: Ed25519, ECDSA or RSA keys, in PKIX form, or in PKCS #1 form
+// for the RSA keys.
+func LoadRecordingVerificationKeys(paths []string) ([]crypto.PublicKey, error) {
+	keys := make([]crypto.PublicKey, 0, len(paths))
+	for _, path := range paths {
+		key, err := loadRecordingVerificationKey(path)
+		if err != nil {
+			return nil, errors.Wrap(err, path)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func loadRecordingVerificationKey(path string) (crypto.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read the recording verification key")
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.Wrap(ErrSigningKeyInvalid, "no PEM data found")
+	}
+	var key interface{}
+	if block.Type == "RSA PUBLIC KEY" {
+		key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	} else {
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, errors.Wrap(ErrSigningKeyInvalid, err.Error())
+	}
+	switch key := key.(type) {
+	case ed25519.PublicKey:
+		return key, nil
+	case *ecdsa.PublicKey:
+		return key, nil
+	case *rsa.PublicKey:
+		return key, nil
+	}
+	return nil, errors.Wrapf(ErrSigningKeyInvalid, "unsupported key type %T", key)
+}
+
+// signingKeyID returns the ID of the public key, the hex-encoded SHA-256
+// hash of the key in PKIX form
+func signingKeyID(pub crypto.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// signDigest signs the SHA-256 digest of the recording: the Ed25519 keys
+// sign the digest as the message
+func signDigest(signer crypto.Signer, digest []byte) ([]byte, error) {
+	var opts crypto.SignerOpts = crypto.SHA256
+	if _, ok := signer.Public().(ed25519.PublicKey); ok {
+		opts = crypto.Hash(0)
+	}
+	return signer.Sign(rand.Reader, digest, opts)
+}
+
+// verifyDigest verifies the signature of the SHA-256 digest of the recording
+func verifyDigest(pub crypto.PublicKey, digest, signature []byte) bool {
+	switch pub := pub.(type) {
+	case ed25519.PublicKey:
+		return ed25519.Verify(pub, digest, signature)
+	case *ecdsa.PublicKey:
+		return ecdsa.VerifyASN1(pub, digest, signature)
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest, signature) == nil
+	}
+	return false
+}
+
+// verifyRecordingChains verifies the chains of the streams of the session
+// recording, returning the heads of the chains up to the first broken link
+func (a *app) verifyRecordingChains(ctx context.Context, sessionID string) (
+	[]model.RecordingStreamHead,
+	[]model.RecordingStreamVerification,
+	error,
+) {
+	heads := make([]model.RecordingStreamHead, 0, len(model.RecordingStreams))
+	results := make([]model.RecordingStreamVerification, 0, len(model.RecordingStreams))
+	for _, stream := range model.RecordingStreams {
+		chunks, err := a.store.GetRecordingChunks(ctx, sessionID, stream)
+		if err != nil {
+			return nil, nil, err
+		}
+		result := model.RecordingStreamVerification{
+			Stream: stream,
+			Chunks: len(chunks),
+		}
+		chain := model.NewRecordingChain(sessionID)
+		for i, chunk := range chunks {
+			link := chain.Next(chunk.Data)
+			if chunk.Sequence == 0 {
+				result.Error = fmt.Sprintf("chunk %d is not chained", i+1)
+			} else if chunk.Sequence > link.Sequence {
+				result.Error = fmt.Sprintf("chunk %d is missing", link.Sequence)
+			} else if chunk.Sequence < link.Sequence {
+				result.Error = fmt.Sprintf("chunk %d is duplicated", chunk.Sequence)
+			} else if !bytes.Equal(chunk.Hash, link.Hash) {
+				result.Error = fmt.Sprintf("chunk %d was modified", link.Sequence)
+			}
+			if result.Error != "" {
+				break
+			}
+			chain.Advance(link)
+		}
+		head := chain.Head()
+		if head.Sequence > 0 {
+			result.Hash = hex.EncodeToString(head.Hash)
+		}
+		heads = append(heads, model.RecordingStreamHead{
+			Stream: stream,
+			Chunks: head.Sequence,
+			Hash:   head.Hash,
+		})
+		results = append(results, result)
+	}
+	return heads, results, nil
+}
+
+// SignSessionRecording signs the digest of the session recording, at the
+// end of the session, if a signing key is configured: the heads signed are
+// the heads of the chains built by the recorders, checked against the
+// chunks stored rather than trusting the store.
+func (a *app) SignSessionRecording(
+	ctx context.Context,
+	sessionID string,
+	recorded []model.RecordingStreamHead,
+) error {
+	if a.RecordingSigner == nil {
+		return nil
+	}
+	heads := make([]model.RecordingStreamHead, 0, len(model.RecordingStreams))
+	chunks := 0
+	for _, stream := range model.RecordingStreams {
+		head := model.RecordingStreamHead{Stream: stream}
+		for _, recordedHead := range recorded {
+			if recordedHead.Stream == stream {
+				head = recordedHead
+			}
+		}
+		heads = append(heads, head)
+		chunks += head.Chunks
+	}
+	if chunks == 0 {
+		// nothing recorded, e.g. port forwarding sessions
+		return nil
+	}
+
+	stored, results, err := a.verifyRecordingChains(ctx, sessionID)
+	if err != nil {
+		return err
+	}
+	for i, result := range results {
+		if result.Error != "" {
+			return errors.Wrapf(ErrRecordingChainBroken,
+				"%s: %s", result.Stream, result.Error)
+		} else if stored[i].Chunks != heads[i].Chunks ||
+			!bytes.Equal(stored[i].Hash, heads[i].Hash) {
+			return errors.Wrapf(ErrRecordingChainBroken,
+				"%s: the chunks stored do not match the chunks recorded",
+				result.Stream)
+		}
+	}
+
+	keyID, err := signingKeyID(a.RecordingSigner.Public())
+	if err != nil {
+		return errors.Wrap(err, "failed to sign the session recording")
+	}
+	digest := model.RecordingDigest(sessionID, heads)
+	signature, err := signDigest(a.RecordingSigner, digest)
+	if err != nil {
+		return errors.Wrap(err, "failed to sign the session recording")
+	}
+	return a.store.InsertRecordingSignature(ctx, &model.RecordingSignature{
+		SessionID: sessionID,
+		KeyID:     keyID,
+		Digest:    digest,
+		Signature: signature,
+		Streams:   heads,
+	})
+}
+
+// VerifySessionRecording verifies the chains of the streams of the session
+// recording, and the signature of the recording with the signing key or the
+// verification key which signed it
+func (a *app) VerifySessionRecording(
+	ctx context.Context,
+	sessionID string,
+) (*model.RecordingVerification, error) {
+	heads, results, err := a.verifyRecordingChains(ctx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := a.store.GetRecordingSignature(ctx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	digest := model.RecordingDigest(sessionID, heads)
+	verification := &model.RecordingVerification{
+		SessionID: sessionID,
+		Digest:    hex.EncodeToString(digest),
+		Signature: model.RecordingSignatureMissing,
+		Streams:   results,
+	}
+	chunks := 0
+	chainsValid := true
+	for _, result := range results {
+		chunks += result.Chunks
+		chainsValid = chainsValid && result.Error == ""
+	}
+	if signature == nil && chunks == 0 {
+		return nil, ErrRecordingNotFound
+	} else if signature != nil {
+		signedAt := signature.CreatedTs
+		verification.KeyID = signature.KeyID
+		verification.SignedAt = &signedAt
+		verification.Signature = a.verifyRecordingSignature(signature, digest)
+	}
+	verification.Valid = chainsValid &&
+		verification.Signature == model.RecordingSignatureValid
+	return verification, nil
+}
+
+// verifyRecordingSignature returns the status of the signature of the
+// recording with the given digest
+func (a *app) verifyRecordingSignature(
+	signature *model.RecordingSignature,
+	digest []byte,
+) string {
+	pub := a.recordingVerificationKey(signature.KeyID)
+	if pub == nil {
+		return model.RecordingSignatureUnverified
+	}
+	if !bytes.Equal(signature.Digest, digest) ||
+		!verifyDigest(pub, signature.Digest, signature.Signature) {
+		return model.RecordingSignatureInvalid
+	}
+	return model.RecordingSignatureValid
+}
+
+// recordingVerificationKey returns the public key with the given ID among
+// the signing key and the verification keys, nil if none matches
+func (a *app) recordingVerificationKey(keyID string) crypto.PublicKey {
+	keys := a.RecordingVerificationKeys
+	if a.RecordingSigner != nil {
+		keys = append([]crypto.PublicKey{a.RecordingSigner.Public()}, keys...)
+	}
+	for _, pub := range keys {
+		if id, err := signingKeyID(pub); err == nil && id == keyID {
+			return pub
+		}
+	}
+	return nil
+}
@@ -0,0 +1,465 @@
+// Copyright 2023 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package app
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/mendersoftware/deviceconnect/model"
+	store_mocks "github.com/mendersoftware/deviceconnect/store/mocks"
+)
+
+func TestLoadRecordingSigningKey(t *testing.T) {
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	pkcs8 := func(key interface{}) []byte {
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	}
+	ecDER, _ := x509.MarshalECPrivateKey(ecKey)
+
+	testCases := []struct {
+		Name string
+		PEM  []byte
+
+		Key   crypto.Signer
+		Error error
+	}{{
+		Name: "ok, Ed25519",
+		PEM:  pkcs8(edKey),
+		Key:  edKey,
+	}, {
+		Name: "ok, ECDSA",
+		PEM:  pkcs8(ecKey),
+		Key:  ecKey,
+	}, {
+		Name: "ok, ECDSA SEC 1",
+		PEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: ecDER}),
+		Key:  ecKey,
+	}, {
+		Name: "ok, RSA PKCS #1",
+		PEM: pem.EncodeToMemory(&pem.Block{
+			Type:  "RSA PRIVATE KEY",
+			Bytes: x509.MarshalPKCS1PrivateKey(rsaKey),
+		}),
+		Key: rsaKey,
+	}, {
+		Name:  "error, not PEM",
+		PEM:   []byte("not a key"),
+		Error: ErrSigningKeyInvalid,
+	}, {
+		Name:  "error, not a private key",
+		PEM:   pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: []byte("x")}),
+		Error: ErrSigningKeyInvalid,
+	}}
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "key.pem")
+			err := os.WriteFile(path, tc.PEM, 0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+			key, err := LoadRecordingSigningKey(path)
+			if tc.Error != nil {
+				assert.ErrorIs(t, err, tc.Error)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, tc.Key, key)
+			}
+		})
+	}
+
+	_, err := LoadRecordingSigningKey(filepath.Join(t.TempDir(), "missing.pem"))
+	assert.Error(t, err)
+}
+
+func TestLoadRecordingVerificationKeys(t *testing.T) {
+	edPub, _, _ := ed25519.GenerateKey(rand.Reader)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	pkix := func(key interface{}) []byte {
+		der, err := x509.MarshalPKIXPublicKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	}
+
+	testCases := []struct {
+		Name string
+		PEM  []byte
+
+		Key   crypto.PublicKey
+		Error error
+	}{{
+		Name: "ok, Ed25519",
+		PEM:  pkix(edPub),
+		Key:  edPub,
+	}, {
+		Name: "ok, ECDSA",
+		PEM:  pkix(&ecKey.PublicKey),
+		Key:  &ecKey.PublicKey,
+	}, {
+		Name: "ok, RSA PKCS #1",
+		PEM: pem.EncodeToMemory(&pem.Block{
+			Type:  "RSA PUBLIC KEY",
+			Bytes: x509.MarshalPKCS1PublicKey(&rsaKey.PublicKey),
+		}),
+		Key: &rsaKey.PublicKey,
+	}, {
+		Name:  "error, not PEM",
+		PEM:   []byte("not a key"),
+		Error: ErrSigningKeyInvalid,
+	}, {
+		Name:  "error, not a public key",
+		PEM:   pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: []byte("x")}),
+		Error: ErrSigningKeyInvalid,
+	}}
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "key.pem")
+			err := os.WriteFile(path, tc.PEM, 0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+			keys, err := LoadRecordingVerificationKeys([]string{path})
+			if tc.Error != nil {
+				assert.ErrorIs(t, err, tc.Error)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, []crypto.PublicKey{tc.Key}, keys)
+			}
+		})
+	}
+
+	keys, err := LoadRecordingVerificationKeys(nil)
+	assert.NoError(t, err)
+	assert.Empty(t, keys)
+	_, err = LoadRecordingVerificationKeys(
+		[]string{filepath.Join(t.TempDir(), "missing.pem")})
+	assert.Error(t, err)
+}
+
+func recordingChunks(sessionID string, data ...string) []model.RecordingChunk {
+	chain := model.NewRecordingChain(sessionID)
+	chunks := make([]model.RecordingChunk, 0, len(data))
+	for _, d := range data {
+		link := chain.Next([]byte(d))
+		chain.Advance(link)
+		chunks = append(chunks, model.RecordingChunk{
+			ChunkLink: link,
+			Data:      []byte(d),
+		})
+	}
+	return chunks
+}
+
+// recordedHeads returns the heads of the chains of the chunks, as built by
+// the recorders
+func recordedHeads(
+	sessionID string,
+	chunks map[string][]model.RecordingChunk,
+) []model.RecordingStreamHead {
+	heads := make([]model.RecordingStreamHead, 0, len(chunks))
+	for stream, streamChunks := range chunks {
+		chain := model.NewRecordingChain(sessionID)
+		for _, chunk := range streamChunks {
+			chain.Advance(chain.Next(chunk.Data))
+		}
+		heads = append(heads, streamHead(stream, chain))
+	}
+	return heads
+}
+
+func TestSessionRecordingIntegrity(t *testing.T) {
+	const sessionID = "00000000-0000-0000-0000-000000000001"
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	_, otherKey, _ := ed25519.GenerateKey(rand.Reader)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	testCases := []struct {
+		Name         string
+		Signer       crypto.Signer
+		VerifySigner crypto.Signer
+		VerifyKeys   []crypto.PublicKey
+		Output       []string
+		// Tamper modifies the recorded chunks after the signature
+		Tamper func(chunks map[string][]model.RecordingChunk)
+
+		Signed      bool
+		Valid       bool
+		Signature   string
+		StreamError string
+		Error       error
+	}{{
+		Name:         "ok, Ed25519",
+		Signer:       edKey,
+		VerifySigner: edKey,
+		Output:       []string{"one", "two", "three"},
+
+		Signed:    true,
+		Valid:     true,
+		Signature: model.RecordingSignatureValid,
+	}, {
+		Name:         "ok, ECDSA",
+		Signer:       ecKey,
+		VerifySigner: ecKey,
+		Output:       []string{"one", "two", "three"},
+
+		Signed:    true,
+		Valid:     true,
+		Signature: model.RecordingSignatureValid,
+	}, {
+		Name:         "invalid, chunk modified",
+		Signer:       edKey,
+		VerifySigner: edKey,
+		Output:       []string{"one", "two", "three"},
+		Tamper: func(chunks map[string][]model.RecordingChunk) {
+			chunks[model.RecordingStreamOutput][1].Data = []byte("TWO")
+		},
+
+		Signed:      true,
+		Signature:   model.RecordingSignatureInvalid,
+		StreamError: "chunk 2 was modified",
+	}, {
+		Name:         "invalid, chunk deleted",
+		Signer:       edKey,
+		VerifySigner: edKey,
+		Output:       []string{"one", "two", "three"},
+		Tamper: func(chunks map[string][]model.RecordingChunk) {
+			output := chunks[model.RecordingStreamOutput]
+			chunks[model.RecordingStreamOutput] = append(output[:1], output[2])
+		},
+
+		Signed:      true,
+		Signature:   model.RecordingSignatureInvalid,
+		StreamError: "chunk 2 is missing",
+	}, {
+		Name:         "invalid, chunks truncated",
+		Signer:       edKey,
+		VerifySigner: edKey,
+		Output:       []string{"one", "two", "three"},
+		Tamper: func(chunks map[string][]model.RecordingChunk) {
+			output := chunks[model.RecordingStreamOutput]
+			chunks[model.RecordingStreamOutput] = output[:2]
+		},
+
+		Signed:    true,
+		Signature: model.RecordingSignatureInvalid,
+	}, {
+		Name:         "invalid, chunk appended to the chain",
+		Signer:       edKey,
+		VerifySigner: edKey,
+		Output:       []string{"one", "two"},
+		Tamper: func(chunks map[string][]model.RecordingChunk) {
+			chunks[model.RecordingStreamOutput] = recordingChunks(sessionID,
+				"one", "two", "rm -rf /")
+		},
+
+		Signed:    true,
+		Signature: model.RecordingSignatureInvalid,
+	}, {
+		Name:         "unverified, signed with another key",
+		Signer:       otherKey,
+		VerifySigner: edKey,
+		Output:       []string{"one"},
+
+		Signed:    true,
+		Signature: model.RecordingSignatureUnverified,
+	}, {
+		Name:         "ok, signed with a rotated key",
+		Signer:       otherKey,
+		VerifySigner: edKey,
+		VerifyKeys:   []crypto.PublicKey{ecKey.Public(), otherKey.Public()},
+		Output:       []string{"one"},
+
+		Signed:    true,
+		Valid:     true,
+		Signature: model.RecordingSignatureValid,
+	}, {
+		Name:       "ok, verification key without signing key",
+		Signer:     edKey,
+		VerifyKeys: []crypto.PublicKey{edKey.Public()},
+		Output:     []string{"one"},
+
+		Signed:    true,
+		Valid:     true,
+		Signature: model.RecordingSignatureValid,
+	}, {
+		Name:         "invalid, chunk modified, signed with a rotated key",
+		Signer:       otherKey,
+		VerifySigner: edKey,
+		VerifyKeys:   []crypto.PublicKey{otherKey.Public()},
+		Output:       []string{"one", "two"},
+		Tamper: func(chunks map[string][]model.RecordingChunk) {
+			chunks[model.RecordingStreamOutput][1].Data = []byte("TWO")
+		},
+
+		Signed:      true,
+		Signature:   model.RecordingSignatureInvalid,
+		StreamError: "chunk 2 was modified",
+	}, {
+		Name:   "unverified, no signing key",
+		Signer: edKey,
+		Output: []string{"one"},
+
+		Signed:    true,
+		Signature: model.RecordingSignatureUnverified,
+	}, {
+		Name:         "missing signature",
+		VerifySigner: edKey,
+		Output:       []string{"one"},
+
+		Signature: model.RecordingSignatureMissing,
+	}, {
+		Name:         "not found",
+		Signer:       edKey,
+		VerifySigner: edKey,
+
+		Error: ErrRecordingNotFound,
+	}}
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			ctx := context.Background()
+			chunks := map[string][]model.RecordingChunk{
+				model.RecordingStreamOutput:  recordingChunks(sessionID, tc.Output...),
+				model.RecordingStreamControl: recordingChunks(sessionID, "resize"),
+				model.RecordingStreamInput:   nil,
+			}
+			if len(tc.Output) == 0 {
+				chunks[model.RecordingStreamControl] = nil
+			}
+			ds := &store_mocks.DataStore{}
+			defer ds.AssertExpectations(t)
+			onGetChunks := func() {
+				for stream, streamChunks := range chunks {
+					ds.On("GetRecordingChunks", ctx, sessionID, stream).
+						Return(streamChunks, nil).
+						Once()
+				}
+			}
+
+			var signature *model.RecordingSignature
+			if tc.Signer != nil {
+				if len(tc.Output) > 0 {
+					onGetChunks()
+				}
+				if tc.Signed {
+					ds.On("InsertRecordingSignature", ctx,
+						mock.AnythingOfType("*model.RecordingSignature"),
+					).Run(func(args mock.Arguments) {
+						signature = args.Get(1).(*model.RecordingSignature)
+					}).Return(nil)
+				}
+				app := New(ds, nil, nil, Config{RecordingSigner: tc.Signer})
+				heads := recordedHeads(sessionID, chunks)
+				err := app.SignSessionRecording(ctx, sessionID, heads)
+				assert.NoError(t, err)
+				assert.Equal(t, tc.Signed, signature != nil)
+			}
+			if tc.Tamper != nil {
+				tc.Tamper(chunks)
+			}
+
+			onGetChunks()
+			ds.On("GetRecordingSignature", ctx, sessionID).Return(signature, nil)
+			app := New(ds, nil, nil, Config{
+				RecordingSigner:           tc.VerifySigner,
+				RecordingVerificationKeys: tc.VerifyKeys,
+			})
+			verification, err := app.VerifySessionRecording(ctx, sessionID)
+			if tc.Error != nil {
+				assert.ErrorIs(t, err, tc.Error)
+				return
+			}
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.Equal(t, sessionID, verification.SessionID)
+			assert.Equal(t, tc.Valid, verification.Valid)
+			assert.Equal(t, tc.Signature, verification.Signature)
+			assert.Equal(t, tc.StreamError, verification.Streams[0].Error)
+			if tc.Signed {
+				assert.NotEmpty(t, verification.KeyID)
+				assert.NotNil(t, verification.SignedAt)
+			}
+		})
+	}
+}
+
+func TestSignSessionRecordingChainBroken(t *testing.T) {
+	const sessionID = "00000000-0000-0000-0000-000000000001"
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	heads := recordedHeads(sessionID, map[string][]model.RecordingChunk{
+		model.RecordingStreamOutput: recordingChunks(sessionID, "one", "two"),
+	})
+
+	testCases := []struct {
+		Name   string
+		Output []model.RecordingChunk
+	}{{
+		Name: "chunk not chained",
+		Output: func() []model.RecordingChunk {
+			output := recordingChunks(sessionID, "one", "two")
+			output[0].Hash = nil
+			return output
+		}(),
+	}, {
+		Name:   "chain rewritten in the store",
+		Output: recordingChunks(sessionID, "one", "rm -rf /"),
+	}, {
+		Name:   "chunk missing from the store",
+		Output: recordingChunks(sessionID, "one"),
+	}}
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			ctx := context.Background()
+			ds := &store_mocks.DataStore{}
+			defer ds.AssertExpectations(t)
+			ds.On("GetRecordingChunks", ctx, sessionID, model.RecordingStreamOutput).
+				Return(tc.Output, nil)
+			ds.On("GetRecordingChunks", ctx, sessionID, model.RecordingStreamControl).
+				Return(nil, nil)
+			ds.On("GetRecordingChunks", ctx, sessionID, model.RecordingStreamInput).
+				Return(nil, nil)
+
+			app := New(ds, nil, nil, Config{RecordingSigner: edKey})
+			err := app.SignSessionRecording(ctx, sessionID, heads)
+			assert.ErrorIs(t, err, ErrRecordingChainBroken)
+		})
+	}
+
+	// signing is disabled without a signing key
+	app := New(&store_mocks.DataStore{}, nil, nil)
+	assert.NoError(t, app.SignSessionRecording(context.Background(), sessionID, heads))
+}
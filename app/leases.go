@@ -0,0 +1,162 @@
+// Copyright 2023 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package app
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/mendersoftware/go-lib-micro/identity"
+	"github.com/mendersoftware/go-lib-micro/log"
+
+	"github.com/mendersoftware/deviceconnect/model"
+)
+
+// leases keeps track of the sessions and of the device connections held by
+// the instance, whose leases the instance renews until they are released.
+type leases struct {
+	mutex    sync.Mutex
+	sessions map[string]struct{}
+	devices  map[string]struct{}
+}
+
+func newLeases() *leases {
+	return &leases{
+		sessions: make(map[string]struct{}),
+		devices:  make(map[string]struct{}),
+	}
+}
+
+func (l *leases) addSession(sessionID string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.sessions[sessionID] = struct{}{}
+}
+
+func (l *leases) removeSession(sessionID string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	delete(l.sessions, sessionID)
+}
+
+func (l *leases) addDevice(deviceID string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.devices[deviceID] = struct{}{}
+}
+
+func (l *leases) removeDevice(deviceID string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	delete(l.devices, deviceID)
+}
+
+// held returns the IDs of the sessions and of the devices held by the instance
+func (l *leases) held() (sessionIDs []string, deviceIDs []string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	sessionIDs = make([]string, 0, len(l.sessions))
+	for id := range l.sessions {
+		sessionIDs = append(sessionIDs, id)
+	}
+	deviceIDs = make([]string, 0, len(l.devices))
+	for id := range l.devices {
+		deviceIDs = append(deviceIDs, id)
+	}
+	return sessionIDs, deviceIDs
+}
+
+// KeepLeases renews the leases of the sessions and of the device connections
+// held by the instance, and periodically reaps the sessions and the device
+// connections left behind by the instances which stopped renewing their
+// leases, until the context is canceled. It returns immediately if the
+// leases are disabled.
+func (a *app) KeepLeases(ctx context.Context) {
+	if a.SessionLeaseTTL <= 0 {
+		return
+	}
+	l := log.FromContext(ctx)
+	renewTicker := time.NewTicker(a.SessionLeaseTTL / 3)
+	defer renewTicker.Stop()
+	reapInterval := a.SessionReaperInterval
+	if reapInterval <= 0 {
+		reapInterval = a.SessionLeaseTTL
+	}
+	reapTicker := time.NewTicker(reapInterval)
+	defer reapTicker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-renewTicker.C:
+			if err := a.renewLeases(ctx); err != nil {
+				l.Error(err)
+			}
+		case <-reapTicker.C:
+			if err := a.reapExpiredLeases(ctx); err != nil {
+				l.Error(err)
+			}
+		}
+	}
+}
+
+// renewLeases extends the leases held by the instance by SessionLeaseTTL
+func (a *app) renewLeases(ctx context.Context) error {
+	sessionIDs, deviceIDs := a.leases.held()
+	expire := time.Now().Add(a.SessionLeaseTTL)
+	err := a.store.RenewSessionLeases(ctx, sessionIDs, expire)
+	if err != nil {
+		return err
+	}
+	return a.store.RenewDeviceLeases(ctx, deviceIDs, expire)
+}
+
+// reapExpiredLeases releases the sessions whose lease expired, submitting
+// the audit logs for closing them, and marks the devices whose connection
+// lease expired as disconnected.
+func (a *app) reapExpiredLeases(ctx context.Context) error {
+	l := log.FromContext(ctx)
+	now := time.Now()
+	for {
+		sess, err := a.store.DeleteExpiredSession(ctx, now)
+		if err != nil {
+			return err
+		} else if sess == nil {
+			break
+		}
+		l.Infof("session_id=%s lease expired, releasing the session", sess.ID)
+		if !a.HaveAuditLogs {
+			continue
+		}
+		ctxTenant := identity.WithContext(ctx, &identity.Identity{
+			Tenant: sess.TenantID,
+		})
+		err = a.logSessionClose(ctxTenant, sess, sess.Types,
+			model.SessionEndReasonLeaseExpired)
+		if err != nil {
+			l.Errorf("session_id=%s: %s", sess.ID, err.Error())
+		}
+	}
+	count, err := a.store.DisconnectExpiredDevices(ctx, now)
+	if err != nil {
+		return errors.Wrap(err, "failed to disconnect the expired devices")
+	} else if count > 0 {
+		l.Infof("marked %d devices with expired leases as disconnected", count)
+	}
+	return nil
+}
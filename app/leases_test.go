@@ -0,0 +1,305 @@
+// Copyright 2023 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package app
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/mendersoftware/go-lib-micro/identity"
+
+	"github.com/mendersoftware/deviceconnect/client/workflows"
+	wf_mocks "github.com/mendersoftware/deviceconnect/client/workflows/mocks"
+	"github.com/mendersoftware/deviceconnect/model"
+	store_mocks "github.com/mendersoftware/deviceconnect/store/mocks"
+)
+
+func TestLeases(t *testing.T) {
+	const (
+		tenantID  = "000000000000000000000000"
+		deviceID  = "00000000-0000-0000-0000-000000000001"
+		sessionID = "00000000-0000-0000-0000-000000000002"
+		userID    = "00000000-0000-0000-0000-000000000003"
+		leaseTTL  = time.Minute
+	)
+	ctx := context.Background()
+	store := &store_mocks.DataStore{}
+	defer store.AssertExpectations(t)
+	app := New(store, nil, nil, Config{SessionLeaseTTL: leaseTTL}).(*app)
+
+	inLeaseTTL := mock.MatchedBy(func(expire time.Time) bool {
+		return time.Until(expire) > leaseTTL-time.Second &&
+			time.Until(expire) <= leaseTTL
+	})
+
+	// the device connection lease is taken as the device connects
+	store.On("UpsertDeviceStatus", ctx, tenantID, deviceID, model.DeviceStatusConnected).
+		Return(nil).
+		Once()
+	store.On("RenewDeviceLeases", ctx, []string{deviceID}, inLeaseTTL).
+		Return(nil).
+		Once()
+	err := app.UpdateDeviceStatus(ctx, tenantID, deviceID, model.DeviceStatusConnected)
+	assert.NoError(t, err)
+
+	// the session lease is taken as the session is allocated
+	store.On("GetDevice", ctx, tenantID, deviceID).
+		Return(&model.Device{ID: deviceID, Status: model.DeviceStatusConnected}, nil).
+		Once()
+	store.On("GetTenantPolicy", ctx, tenantID).
+		Return(nil, nil).
+		Once()
+	store.On("AllocateSession", ctx, mock.MatchedBy(func(sess *model.Session) bool {
+		return time.Until(sess.LeaseExpireTs) > leaseTTL-time.Second
+	})).
+		Return(nil).
+		Once()
+	store.On("InsertRecordedSession",
+		mock.AnythingOfType("*context.valueCtx"),
+		mock.AnythingOfType("*model.RecordedSession")).
+		Return(nil).
+		Once()
+	err = app.PrepareUserSession(ctx, &model.Session{
+		ID:       sessionID,
+		TenantID: tenantID,
+		UserID:   userID,
+		DeviceID: deviceID,
+		StartTS:  time.Now(),
+	})
+	assert.NoError(t, err)
+
+	store.On("RenewSessionLeases", ctx, []string{sessionID}, inLeaseTTL).
+		Return(nil).
+		Once()
+	store.On("RenewDeviceLeases", ctx, []string{deviceID}, inLeaseTTL).
+		Return(nil).
+		Once()
+	err = app.renewLeases(ctx)
+	assert.NoError(t, err)
+
+	// the leases are released with the session and the device connection
+	store.On("DeleteSession", ctx, sessionID).
+		Return(&model.Session{ID: sessionID}, nil).
+		Once()
+	err = app.FreeUserSession(ctx, sessionID, nil)
+	assert.NoError(t, err)
+
+	store.On("UpsertDeviceStatus", ctx, tenantID, deviceID, model.DeviceStatusDisconnected).
+		Return(nil).
+		Once()
+	err = app.UpdateDeviceStatus(ctx, tenantID, deviceID, model.DeviceStatusDisconnected)
+	assert.NoError(t, err)
+
+	store.On("RenewSessionLeases", ctx, []string{}, inLeaseTTL).
+		Return(nil).
+		Once()
+	store.On("RenewDeviceLeases", ctx, []string{}, inLeaseTTL).
+		Return(nil).
+		Once()
+	err = app.renewLeases(ctx)
+	assert.NoError(t, err)
+
+	store.On("RenewSessionLeases", ctx, []string{}, inLeaseTTL).
+		Return(errors.New("error")).
+		Once()
+	err = app.renewLeases(ctx)
+	assert.EqualError(t, err, "error")
+}
+
+func TestReapExpiredLeases(t *testing.T) {
+	t.Parallel()
+
+	expiredSession := &model.Session{
+		ID:       "00000000-0000-0000-0000-000000000000",
+		DeviceID: "00000000-0000-0000-0000-000000000001",
+		UserID:   "00000000-0000-0000-0000-000000000002",
+		Types:    []string{model.SessionTypeTerminal, model.SessionTypePortForward},
+		TenantID: "000000000000000000000000",
+		StartTS:  time.Now().Add(-time.Hour),
+	}
+	testCases := []struct {
+		Name string
+
+		StoreDeleteExpiredSession    *model.Session
+		StoreDeleteExpiredSessionErr error
+
+		HaveAuditLogs bool
+		WorkflowsErr  error
+
+		StoreDisconnectExpiredDevicesErr error
+
+		Error error
+	}{{
+		Name: "ok",
+
+		StoreDeleteExpiredSession: expiredSession,
+	}, {
+		Name: "ok, with audit logs",
+
+		StoreDeleteExpiredSession: expiredSession,
+		HaveAuditLogs:             true,
+	}, {
+		Name: "ok, audit logs error",
+
+		StoreDeleteExpiredSession: expiredSession,
+		HaveAuditLogs:             true,
+		WorkflowsErr:              errors.New("error"),
+	}, {
+		Name: "ok, no expired sessions",
+	}, {
+		Name: "error, store.DeleteExpiredSession",
+
+		StoreDeleteExpiredSessionErr: errors.New("error"),
+		Error:                        errors.New("error"),
+	}, {
+		Name: "error, store.DisconnectExpiredDevices",
+
+		StoreDisconnectExpiredDevicesErr: errors.New("error"),
+		Error: errors.New(
+			"failed to disconnect the expired devices: error"),
+	}}
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			ctx := context.Background()
+			store := &store_mocks.DataStore{}
+			defer store.AssertExpectations(t)
+			wf := &wf_mocks.Client{}
+			defer wf.AssertExpectations(t)
+
+			app := New(store, nil, wf, Config{
+				HaveAuditLogs:   tc.HaveAuditLogs,
+				SessionLeaseTTL: time.Minute,
+			}).(*app)
+
+			if tc.StoreDeleteExpiredSession != nil {
+				store.On("DeleteExpiredSession", ctx, mock.AnythingOfType("time.Time")).
+					Return(tc.StoreDeleteExpiredSession, nil).
+					Once()
+			}
+			store.On("DeleteExpiredSession", ctx, mock.AnythingOfType("time.Time")).
+				Return(nil, tc.StoreDeleteExpiredSessionErr).
+				Once()
+			if tc.StoreDeleteExpiredSessionErr == nil {
+				store.On("DisconnectExpiredDevices", ctx,
+					mock.AnythingOfType("time.Time")).
+					Return(int64(1), tc.StoreDisconnectExpiredDevicesErr)
+			}
+			if tc.HaveAuditLogs {
+				sess := tc.StoreDeleteExpiredSession
+				for _, action := range []workflows.Action{
+					workflows.ActionTerminalClose,
+					workflows.ActionPortForwardClose,
+				} {
+					wf.On("SubmitAuditLog",
+						mock.MatchedBy(func(ctx context.Context) bool {
+							id := identity.FromContext(ctx)
+							return id != nil && id.Tenant == sess.TenantID
+						}),
+						workflows.AuditLog{
+							Action: action,
+							Actor: workflows.Actor{
+								ID:   sess.UserID,
+								Type: workflows.ActorUser,
+							},
+							Object: workflows.Object{
+								ID:   sess.DeviceID,
+								Type: workflows.ObjectDevice,
+							},
+							MetaData: map[string][]string{
+								"session_id": {sess.ID},
+								"end_reason": {model.SessionEndReasonLeaseExpired},
+							},
+						}).
+						Return(tc.WorkflowsErr).
+						Once()
+					if tc.WorkflowsErr != nil {
+						break
+					}
+				}
+			}
+
+			err := app.reapExpiredLeases(ctx)
+			if tc.Error != nil {
+				assert.EqualError(t, err, tc.Error.Error())
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestKeepLeases(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	store := &store_mocks.DataStore{}
+	defer store.AssertExpectations(t)
+
+	// the leases are disabled
+	app := New(store, nil, nil)
+	app.KeepLeases(ctx)
+
+	app = New(store, nil, nil, Config{
+		SessionLeaseTTL:       30 * time.Millisecond,
+		SessionReaperInterval: 20 * time.Millisecond,
+	})
+	renewed := make(chan struct{}, 1)
+	reaped := make(chan struct{}, 1)
+	store.On("RenewSessionLeases", ctx, []string{}, mock.AnythingOfType("time.Time")).
+		Return(nil)
+	store.On("RenewDeviceLeases", ctx, []string{}, mock.AnythingOfType("time.Time")).
+		Run(func(mock.Arguments) {
+			select {
+			case renewed <- struct{}{}:
+			default:
+			}
+		}).
+		Return(nil)
+	store.On("DeleteExpiredSession", ctx, mock.AnythingOfType("time.Time")).
+		Return(nil, nil)
+	store.On("DisconnectExpiredDevices", ctx, mock.AnythingOfType("time.Time")).
+		Run(func(mock.Arguments) {
+			select {
+			case reaped <- struct{}{}:
+			default:
+			}
+		}).
+		Return(int64(0), nil)
+
+	done := make(chan struct{})
+	go func() {
+		app.KeepLeases(ctx)
+		close(done)
+	}()
+	for _, c := range []chan struct{}{renewed, reaped} {
+		select {
+		case <-c:
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for the leases to be renewed and reaped")
+		}
+	}
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("KeepLeases did not return after canceling the context")
+	}
+}
@@ -32,6 +32,20 @@ type App struct {
 	mock.Mock
 }
 
+// CloseRecordings provides a mock function with given fields: ctx
+func (_m *App) CloseRecordings(ctx context.Context) error {
+	ret := _m.Called(ctx)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context) error); ok {
+		r0 = rf(ctx)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
 // DeleteDevice provides a mock function with given fields: ctx, tenantID, deviceID
 func (_m *App) DeleteDevice(ctx context.Context, tenantID string, deviceID string) error {
 	ret := _m.Called(ctx, tenantID, deviceID)
@@ -46,6 +60,43 @@ func (_m *App) DeleteDevice(ctx context.Context, tenantID string, deviceID strin
 	return r0
 }
 
+// DeleteRecordings provides a mock function with given fields: ctx, filter, userID
+func (_m *App) DeleteRecordings(ctx context.Context, filter model.RecordingFilter, userID string) (*model.RecordingDeletion, error) {
+	ret := _m.Called(ctx, filter, userID)
+
+	var r0 *model.RecordingDeletion
+	if rf, ok := ret.Get(0).(func(context.Context, model.RecordingFilter, string) *model.RecordingDeletion); ok {
+		r0 = rf(ctx, filter, userID)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*model.RecordingDeletion)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, model.RecordingFilter, string) error); ok {
+		r1 = rf(ctx, filter, userID)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// DeleteSessionRecording provides a mock function with given fields: ctx, sessionID, userID
+func (_m *App) DeleteSessionRecording(ctx context.Context, sessionID string, userID string) error {
+	ret := _m.Called(ctx, sessionID, userID)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, string, string) error); ok {
+		r0 = rf(ctx, sessionID, userID)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
 // DownloadFile provides a mock function with given fields: ctx, userID, deviceID, path
 func (_m *App) DownloadFile(ctx context.Context, userID string, deviceID string, path string) error {
 	ret := _m.Called(ctx, userID, deviceID, path)
@@ -60,6 +111,11 @@ func (_m *App) DownloadFile(ctx context.Context, userID string, deviceID string,
 	return r0
 }
 
+// ExpireRecordings provides a mock function with given fields: ctx
+func (_m *App) ExpireRecordings(ctx context.Context) {
+	_m.Called(ctx)
+}
+
 // FreeUserSession provides a mock function with given fields: ctx, sessionID, sessionTypes
 func (_m *App) FreeUserSession(ctx context.Context, sessionID string, sessionTypes []string) error {
 	ret := _m.Called(ctx, sessionID, sessionTypes)
@@ -113,6 +169,45 @@ func (_m *App) GetDevice(ctx context.Context, tenantID string, deviceID string)
 	return r0, r1
 }
 
+// GetInputRecorder provides a mock function with given fields: ctx, sessionID
+func (_m *App) GetInputRecorder(ctx context.Context, sessionID string) io.Writer {
+	ret := _m.Called(ctx, sessionID)
+
+	var r0 io.Writer
+	if rf, ok := ret.Get(0).(func(context.Context, string) io.Writer); ok {
+		r0 = rf(ctx, sessionID)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(io.Writer)
+		}
+	}
+
+	return r0
+}
+
+// GetLegalHold provides a mock function with given fields: ctx, sessionID
+func (_m *App) GetLegalHold(ctx context.Context, sessionID string) (*model.LegalHold, error) {
+	ret := _m.Called(ctx, sessionID)
+
+	var r0 *model.LegalHold
+	if rf, ok := ret.Get(0).(func(context.Context, string) *model.LegalHold); ok {
+		r0 = rf(ctx, sessionID)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*model.LegalHold)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string) error); ok {
+		r1 = rf(ctx, sessionID)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // GetRecorder provides a mock function with given fields: ctx, sessionID
 func (_m *App) GetRecorder(ctx context.Context, sessionID string) io.Writer {
 	ret := _m.Called(ctx, sessionID)
@@ -129,6 +224,29 @@ func (_m *App) GetRecorder(ctx context.Context, sessionID string) io.Writer {
 	return r0
 }
 
+// GetSession provides a mock function with given fields: ctx, sessionID
+func (_m *App) GetSession(ctx context.Context, sessionID string) (*model.Session, error) {
+	ret := _m.Called(ctx, sessionID)
+
+	var r0 *model.Session
+	if rf, ok := ret.Get(0).(func(context.Context, string) *model.Session); ok {
+		r0 = rf(ctx, sessionID)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*model.Session)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string) error); ok {
+		r1 = rf(ctx, sessionID)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // GetSessionRecording provides a mock function with given fields: ctx, id, w
 func (_m *App) GetSessionRecording(ctx context.Context, id string, w io.Writer) error {
 	ret := _m.Called(ctx, id, w)
@@ -143,6 +261,43 @@ func (_m *App) GetSessionRecording(ctx context.Context, id string, w io.Writer)
 	return r0
 }
 
+// GetTenantPolicy provides a mock function with given fields: ctx, tenantID
+func (_m *App) GetTenantPolicy(ctx context.Context, tenantID string) (*model.TenantPolicy, error) {
+	ret := _m.Called(ctx, tenantID)
+
+	var r0 *model.TenantPolicy
+	if rf, ok := ret.Get(0).(func(context.Context, string) *model.TenantPolicy); ok {
+		r0 = rf(ctx, tenantID)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*model.TenantPolicy)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string) error); ok {
+		r1 = rf(ctx, tenantID)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// GrantSessionWrite provides a mock function with given fields: ctx, sess, userID
+func (_m *App) GrantSessionWrite(ctx context.Context, sess *model.Session, userID string) error {
+	ret := _m.Called(ctx, sess, userID)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, *model.Session, string) error); ok {
+		r0 = rf(ctx, sess, userID)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
 // HealthCheck provides a mock function with given fields: ctx
 func (_m *App) HealthCheck(ctx context.Context) error {
 	ret := _m.Called(ctx)
@@ -157,6 +312,69 @@ func (_m *App) HealthCheck(ctx context.Context) error {
 	return r0
 }
 
+// KeepLeases provides a mock function with given fields: ctx
+func (_m *App) KeepLeases(ctx context.Context) {
+	_m.Called(ctx)
+}
+
+// ListSessions provides a mock function with given fields: ctx, filter
+func (_m *App) ListSessions(ctx context.Context, filter model.SessionFilter) ([]model.Session, int64, error) {
+	ret := _m.Called(ctx, filter)
+
+	var r0 []model.Session
+	if rf, ok := ret.Get(0).(func(context.Context, model.SessionFilter) []model.Session); ok {
+		r0 = rf(ctx, filter)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]model.Session)
+		}
+	}
+
+	var r1 int64
+	if rf, ok := ret.Get(1).(func(context.Context, model.SessionFilter) int64); ok {
+		r1 = rf(ctx, filter)
+	} else {
+		r1 = ret.Get(1).(int64)
+	}
+
+	var r2 error
+	if rf, ok := ret.Get(2).(func(context.Context, model.SessionFilter) error); ok {
+		r2 = rf(ctx, filter)
+	} else {
+		r2 = ret.Error(2)
+	}
+
+	return r0, r1, r2
+}
+
+// LogObserverJoin provides a mock function with given fields: ctx, sess, observerID
+func (_m *App) LogObserverJoin(ctx context.Context, sess *model.Session, observerID string) error {
+	ret := _m.Called(ctx, sess, observerID)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, *model.Session, string) error); ok {
+		r0 = rf(ctx, sess, observerID)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// LogObserverLeave provides a mock function with given fields: ctx, sess, observerID
+func (_m *App) LogObserverLeave(ctx context.Context, sess *model.Session, observerID string) error {
+	ret := _m.Called(ctx, sess, observerID)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, *model.Session, string) error); ok {
+		r0 = rf(ctx, sess, observerID)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
 // LogUserSession provides a mock function with given fields: ctx, sess, sessionType
 func (_m *App) LogUserSession(ctx context.Context, sess *model.Session, sessionType string) error {
 	ret := _m.Called(ctx, sess, sessionType)
@@ -199,6 +417,20 @@ func (_m *App) ProvisionDevice(ctx context.Context, tenantID string, device *mod
 	return r0
 }
 
+// RecordingWriterStats provides a mock function with given fields:
+func (_m *App) RecordingWriterStats() model.RecordingWriterStats {
+	ret := _m.Called()
+
+	var r0 model.RecordingWriterStats
+	if rf, ok := ret.Get(0).(func() model.RecordingWriterStats); ok {
+		r0 = rf()
+	} else {
+		r0 = ret.Get(0).(model.RecordingWriterStats)
+	}
+
+	return r0
+}
+
 // RegisterShutdownCancel provides a mock function with given fields: _a0
 func (_m *App) RegisterShutdownCancel(_a0 context.CancelFunc) uint32 {
 	ret := _m.Called(_a0)
@@ -213,6 +445,57 @@ func (_m *App) RegisterShutdownCancel(_a0 context.CancelFunc) uint32 {
 	return r0
 }
 
+// ReleaseLegalHold provides a mock function with given fields: ctx, sessionID
+func (_m *App) ReleaseLegalHold(ctx context.Context, sessionID string) error {
+	ret := _m.Called(ctx, sessionID)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, string) error); ok {
+		r0 = rf(ctx, sessionID)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// ResumeUserSession provides a mock function with given fields: ctx, sessionID, userID, token
+func (_m *App) ResumeUserSession(ctx context.Context, sessionID string, userID string, token string) (*model.Session, error) {
+	ret := _m.Called(ctx, sessionID, userID, token)
+
+	var r0 *model.Session
+	if rf, ok := ret.Get(0).(func(context.Context, string, string, string) *model.Session); ok {
+		r0 = rf(ctx, sessionID, userID, token)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*model.Session)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string, string, string) error); ok {
+		r1 = rf(ctx, sessionID, userID, token)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// RevokeSessionWrite provides a mock function with given fields: ctx, sess, userID
+func (_m *App) RevokeSessionWrite(ctx context.Context, sess *model.Session, userID string) error {
+	ret := _m.Called(ctx, sess, userID)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, *model.Session, string) error); ok {
+		r0 = rf(ctx, sess, userID)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
 // SaveSessionRecording provides a mock function with given fields: ctx, id, sessionBytes
 func (_m *App) SaveSessionRecording(ctx context.Context, id string, sessionBytes []byte) error {
 	ret := _m.Called(ctx, id, sessionBytes)
@@ -227,6 +510,80 @@ func (_m *App) SaveSessionRecording(ctx context.Context, id string, sessionBytes
 	return r0
 }
 
+// SearchRecordings provides a mock function with given fields: ctx, filter
+func (_m *App) SearchRecordings(ctx context.Context, filter model.SearchFilter) ([]model.SearchResult, error) {
+	ret := _m.Called(ctx, filter)
+
+	var r0 []model.SearchResult
+	if rf, ok := ret.Get(0).(func(context.Context, model.SearchFilter) []model.SearchResult); ok {
+		r0 = rf(ctx, filter)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]model.SearchResult)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, model.SearchFilter) error); ok {
+		r1 = rf(ctx, filter)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// SetLegalHold provides a mock function with given fields: ctx, sessionID, reason
+func (_m *App) SetLegalHold(ctx context.Context, sessionID string, reason string) (*model.LegalHold, error) {
+	ret := _m.Called(ctx, sessionID, reason)
+
+	var r0 *model.LegalHold
+	if rf, ok := ret.Get(0).(func(context.Context, string, string) *model.LegalHold); ok {
+		r0 = rf(ctx, sessionID, reason)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*model.LegalHold)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string, string) error); ok {
+		r1 = rf(ctx, sessionID, reason)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// SetSessionEndReason provides a mock function with given fields: ctx, sessionID, reason
+func (_m *App) SetSessionEndReason(ctx context.Context, sessionID string, reason string) error {
+	ret := _m.Called(ctx, sessionID, reason)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, string, string) error); ok {
+		r0 = rf(ctx, sessionID, reason)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// SetTenantPolicy provides a mock function with given fields: ctx, tenantID, policy
+func (_m *App) SetTenantPolicy(ctx context.Context, tenantID string, policy *model.TenantPolicy) error {
+	ret := _m.Called(ctx, tenantID, policy)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, string, *model.TenantPolicy) error); ok {
+		r0 = rf(ctx, tenantID, policy)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
 // Shutdown provides a mock function with given fields: timeout
 func (_m *App) Shutdown(timeout time.Duration) {
 	_m.Called(timeout)
@@ -237,6 +594,34 @@ func (_m *App) ShutdownDone() {
 	_m.Called()
 }
 
+// SignSessionRecording provides a mock function with given fields: ctx, sessionID, heads
+func (_m *App) SignSessionRecording(ctx context.Context, sessionID string, heads []model.RecordingStreamHead) error {
+	ret := _m.Called(ctx, sessionID, heads)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, string, []model.RecordingStreamHead) error); ok {
+		r0 = rf(ctx, sessionID, heads)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// TerminateUserSession provides a mock function with given fields: ctx, sess, userID
+func (_m *App) TerminateUserSession(ctx context.Context, sess *model.Session, userID string) error {
+	ret := _m.Called(ctx, sess, userID)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, *model.Session, string) error); ok {
+		r0 = rf(ctx, sess, userID)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
 // UnregisterShutdownCancel provides a mock function with given fields: _a0
 func (_m *App) UnregisterShutdownCancel(_a0 uint32) {
 	_m.Called(_a0)
@@ -269,3 +654,26 @@ func (_m *App) UploadFile(ctx context.Context, userID string, deviceID string, p
 
 	return r0
 }
+
+// VerifySessionRecording provides a mock function with given fields: ctx, sessionID
+func (_m *App) VerifySessionRecording(ctx context.Context, sessionID string) (*model.RecordingVerification, error) {
+	ret := _m.Called(ctx, sessionID)
+
+	var r0 *model.RecordingVerification
+	if rf, ok := ret.Get(0).(func(context.Context, string) *model.RecordingVerification); ok {
+		r0 = rf(ctx, sessionID)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*model.RecordingVerification)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string) error); ok {
+		r1 = rf(ctx, sessionID)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
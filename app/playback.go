@@ -15,38 +15,286 @@
 package app
 
 import (
+	"context"
+	"io"
 	"time"
 
+	"github.com/mendersoftware/go-lib-micro/ws"
+	"github.com/mendersoftware/go-lib-micro/ws/shell"
 	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+	"github.com/vmihailenco/msgpack/v5"
+
+	"github.com/mendersoftware/deviceconnect/model"
 )
 
 const (
-	DefaultPlaybackSleepIntervalMs = uint(100)
+	playbackControlsSize = 16
 )
 
+// errPlaybackRewind aborts the playback to read the recording again from
+// the start, seeking backwards
+var errPlaybackRewind = errors.New("playback rewind")
+
+// playbackReset is the terminal output resetting the terminal of the client
+// before playing the recording again
+var playbackReset = []byte("\x1bc")
+
+// PlaybackOptions holds the options of the session playback
+type PlaybackOptions struct {
+	// SleepMs, if set, is a constant interval slept between the playback
+	// writes, replacing the recorded timing: the delay messages are then
+	// forwarded to the client
+	SleepMs *uint
+	// MaxIdleMs, if not zero, caps the recorded delays, compressing the
+	// long idle gaps of the session
+	MaxIdleMs uint
+	// Offset is the offset of the terminal output the playback starts
+	// from; the recording up to the offset is fast-forwarded, without
+	// sleeping nor delays, for the playback to start from e.g. a search
+	// match
+	Offset int
+}
+
 type Playback struct {
-	sessionID         string
-	deviceChan        chan *nats.Msg
-	sleepMilliseconds uint
+	ctx        context.Context
+	sessionID  string
+	deviceChan chan *nats.Msg
+	options    PlaybackOptions
+	// offset and timeMs are the position of the recording the playback
+	// starts from, as offset of the terminal output or as milliseconds
+	// elapsed since the start of the session; played and elapsedMs are
+	// the position played so far
+	offset    int64
+	timeMs    int64
+	played    int64
+	elapsedMs int64
+
+	controls chan *model.PlaybackControl
+	paused   bool
+	speed    float64
 }
 
-func NewPlayback(sessionID string, deviceChan chan *nats.Msg, sleepMilliseconds uint) *Playback {
+// NewPlayback returns a writer playing back the session recording to
+// deviceChan, reproducing the recorded timing unless a constant sleep
+// interval is set. The playback stops when ctx is done.
+func NewPlayback(
+	ctx context.Context,
+	sessionID string,
+	deviceChan chan *nats.Msg,
+	options PlaybackOptions,
+) *Playback {
 	return &Playback{
-		deviceChan:        deviceChan,
-		sessionID:         sessionID,
-		sleepMilliseconds: sleepMilliseconds,
+		ctx:        ctx,
+		deviceChan: deviceChan,
+		sessionID:  sessionID,
+		options:    options,
+		offset:     int64(options.Offset),
+		timeMs:     -1,
+		controls:   make(chan *model.PlaybackControl, playbackControlsSize),
+		speed:      1,
+	}
+}
+
+// Control sends a control message, e.g. pause or seek, to the playback
+func (r *Playback) Control(ctl *model.PlaybackControl) error {
+	select {
+	case r.controls <- ctl:
+		return nil
+	case <-r.ctx.Done():
+		return r.ctx.Err()
+	}
+}
+
+// Play plays back the recording written by read to the playback, and waits
+// for the control messages at the end of the recording until ctx is done:
+// seeking backwards, also after the end, reads the recording again.
+func (r *Playback) Play(read func(w io.Writer) error) error {
+	for {
+		err := read(r)
+		if err == nil {
+			err = r.waitEnd()
+		}
+		if r.ctx.Err() != nil {
+			// the client disconnected
+			return nil
+		} else if errors.Cause(err) != errPlaybackRewind {
+			return err
+		}
+		if err = r.rewind(); err != nil {
+			return err
+		}
 	}
 }
 
 func (r *Playback) Write(d []byte) (n int, err error) {
+	if err := r.applyPending(); err != nil {
+		return 0, err
+	}
+	// the recording preceding the seek position is played at once,
+	// dropping the delays
+	seeking := r.seeking()
+
 	//now playback gets the msgpacked ProtoMsgs
+	var msg ws.ProtoMsg
+	var delay uint16
+	isDelay := false
+	if err := msgpack.Unmarshal(d, &msg); err != nil {
+		if seeking {
+			return 0, err
+		}
+	} else if msg.Header.Proto == ws.ProtoTypeShell {
+		switch msg.Header.MsgType {
+		case model.DelayMessageName:
+			delay, _ = model.PropertyUint16(msg.Header.Properties,
+				model.DelayMessageValueField)
+			r.elapsedMs += int64(delay)
+			isDelay = true
+		case shell.MessageTypeShellCommand:
+			r.played += int64(len(msg.Body))
+		}
+	}
+
+	if seeking {
+		if isDelay {
+			return len(d), nil
+		}
+	} else if r.options.SleepMs != nil {
+		if err := r.wait(*r.options.SleepMs); err != nil {
+			return 0, err
+		}
+	} else if isDelay {
+		// the recorded timing: the delay is slept and not forwarded
+		delayMs := uint(delay)
+		if r.options.MaxIdleMs > 0 && delayMs > r.options.MaxIdleMs {
+			delayMs = r.options.MaxIdleMs
+		}
+		if err := r.wait(delayMs); err != nil {
+			return 0, err
+		}
+		return len(d), nil
+	}
+	if err := r.send(d); err != nil {
+		return 0, err
+	}
+	return len(d), nil
+}
+
+// seeking returns true if the playback has not reached the seek position
+func (r *Playback) seeking() bool {
+	return r.played < r.offset || r.elapsedMs < r.timeMs
+}
+
+// apply applies a control message; seeking backwards returns
+// errPlaybackRewind
+func (r *Playback) apply(ctl *model.PlaybackControl) error {
+	switch ctl.Type {
+	case model.PlaybackMessagePause:
+		r.paused = true
+	case model.PlaybackMessageResume:
+		r.paused = false
+	case model.PlaybackMessageSpeed:
+		r.speed = ctl.Speed
+	case model.PlaybackMessageSeek:
+		r.offset, r.timeMs = ctl.Offset, ctl.TimeMs
+		if (r.offset >= 0 && r.offset < r.played) ||
+			(r.timeMs >= 0 && r.timeMs < r.elapsedMs) {
+			return errPlaybackRewind
+		}
+	}
+	return nil
+}
+
+// applyPending applies the control messages received so far
+func (r *Playback) applyPending() error {
+	for {
+		select {
+		case ctl := <-r.controls:
+			if err := r.apply(ctl); err != nil {
+				return err
+			}
+		default:
+			return nil
+		}
+	}
+}
+
+// wait sleeps for the given number of milliseconds, at the playback speed,
+// and until resumed if the playback is paused, applying the control messages
+// received meanwhile; seeking stops the wait.
+func (r *Playback) wait(sleepMs uint) error {
+	timer := time.NewTimer(time.Duration(float64(sleepMs) *
+		float64(time.Millisecond) / r.speed))
+	defer timer.Stop()
+	for {
+		var expired <-chan time.Time
+		if !r.paused {
+			expired = timer.C
+		}
+		select {
+		case <-expired:
+			return nil
+		case ctl := <-r.controls:
+			if err := r.apply(ctl); err != nil {
+				return err
+			} else if r.seeking() {
+				return nil
+			}
+		case <-r.ctx.Done():
+			return r.ctx.Err()
+		}
+	}
+}
+
+// waitEnd waits for the control messages at the end of the recording,
+// until seeking or ctx is done
+func (r *Playback) waitEnd() error {
+	for {
+		select {
+		case ctl := <-r.controls:
+			if err := r.apply(ctl); err != nil {
+				return err
+			} else if ctl.Type == model.PlaybackMessageSeek {
+				// the recording is read again up to the position,
+				// also when seeking forwards past the end
+				return errPlaybackRewind
+			}
+		case <-r.ctx.Done():
+			return r.ctx.Err()
+		}
+	}
+}
+
+// rewind resets the position and the terminal of the client, to read the
+// recording again
+func (r *Playback) rewind() error {
+	r.played = 0
+	r.elapsedMs = 0
+	data, err := msgpack.Marshal(&ws.ProtoMsg{
+		Header: ws.ProtoHdr{
+			Proto:     ws.ProtoTypeShell,
+			MsgType:   shell.MessageTypeShellCommand,
+			SessionID: r.sessionID,
+		},
+		Body: playbackReset,
+	})
+	if err != nil {
+		return err
+	}
+	return r.send(data)
+}
+
+func (r *Playback) send(d []byte) error {
 	m := nats.Msg{
 		Subject: "playback",
 		Reply:   "no-reply",
 		Data:    d,
 		Sub:     nil,
 	}
-	time.Sleep(time.Duration(r.sleepMilliseconds) * time.Millisecond)
-	r.deviceChan <- &m
-	return len(d), nil
+	select {
+	case r.deviceChan <- &m:
+		return nil
+	case <-r.ctx.Done():
+		return r.ctx.Err()
+	}
 }
@@ -15,22 +15,35 @@
 package app
 
 import (
+	"context"
+	"io"
 	"testing"
 	"time"
 
+	"github.com/mendersoftware/go-lib-micro/ws"
+	"github.com/mendersoftware/go-lib-micro/ws/shell"
 	"github.com/nats-io/nats.go"
 	"github.com/stretchr/testify/assert"
+	"github.com/vmihailenco/msgpack/v5"
+
+	"github.com/mendersoftware/deviceconnect/model"
 )
 
+func sleepMs(ms uint) *uint {
+	return &ms
+}
+
 func TestNewPlayback(t *testing.T) {
 	sessionID := "sessionID"
 	deviceChan := make(chan *nats.Msg, 1)
 	sleepMs := uint(100)
-	r := NewPlayback(sessionID, deviceChan, sleepMs)
+	r := NewPlayback(context.Background(), sessionID, deviceChan, PlaybackOptions{
+		SleepMs: &sleepMs,
+	})
 	assert.NotNil(t, r)
 	assert.Equal(t, r.sessionID, sessionID)
 	assert.Equal(t, r.deviceChan, deviceChan)
-	assert.Equal(t, r.sleepMilliseconds, sleepMs)
+	assert.Equal(t, r.options.SleepMs, &sleepMs)
 }
 
 func TestPlaybackWrite(t *testing.T) {
@@ -55,7 +68,9 @@ func TestPlaybackWrite(t *testing.T) {
 
 	thresholdMs := uint(15)
 	for _, tc := range testCases {
-		r := NewPlayback(sessionID, deviceChan, tc.SleepTime)
+		r := NewPlayback(context.Background(), sessionID, deviceChan, PlaybackOptions{
+			SleepMs: &tc.SleepTime,
+		})
 		assert.NotNil(t, r)
 
 		t0 := float64(time.Now().UTC().UnixNano()) * 0.000001
@@ -71,3 +86,201 @@ func TestPlaybackWrite(t *testing.T) {
 		}
 	}
 }
+
+func TestPlaybackFastForward(t *testing.T) {
+	deviceChan := make(chan *nats.Msg, 10)
+	r := NewPlayback(context.Background(), "sessionID", deviceChan, PlaybackOptions{
+		SleepMs: sleepMs(1000),
+		Offset:  8,
+	})
+
+	output := func(body string) []byte {
+		return packRecordingMessage(t, shell.MessageTypeShellCommand,
+			nil, []byte(body))
+	}
+	delay := packRecordingMessage(t, model.DelayMessageName,
+		map[string]interface{}{model.DelayMessageValueField: uint16(5000)}, nil)
+
+	// the recording preceding the offset is played at once, without delays
+	t0 := time.Now()
+	for _, data := range [][]byte{output("$ ls\r\n"), delay, output("file\r\n")} {
+		n, err := r.Write(data)
+		assert.NoError(t, err)
+		assert.Equal(t, len(data), n)
+	}
+	assert.Less(t, time.Since(t0), 500*time.Millisecond)
+	assert.Len(t, deviceChan, 2)
+
+	// the playback resumes at the offset
+	n, err := r.Write(delay)
+	assert.NoError(t, err)
+	assert.Equal(t, len(delay), n)
+	assert.GreaterOrEqual(t, time.Since(t0), time.Second)
+	assert.Len(t, deviceChan, 3)
+
+	r = NewPlayback(context.Background(), "sessionID", deviceChan, PlaybackOptions{
+		Offset: 8,
+	})
+	_, err = r.Write([]byte("not msgpack"))
+	assert.Error(t, err)
+}
+
+func TestPlaybackControls(t *testing.T) {
+	output := func(body string) []byte {
+		return packRecordingMessage(t, shell.MessageTypeShellCommand,
+			nil, []byte(body))
+	}
+	delay := packRecordingMessage(t, model.DelayMessageName,
+		map[string]interface{}{model.DelayMessageValueField: uint16(1000)}, nil)
+	recording := [][]byte{output("one\n"), delay, output("two\n"), delay, output("three\n")}
+	read := func(w io.Writer) error {
+		for _, data := range recording {
+			if _, err := w.Write(data); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	// played returns the terminal output played back, with the delays as
+	// "+" and the terminal resets as "|"
+	played := func(deviceChan chan *nats.Msg, n int) string {
+		var s string
+		for i := 0; i < n; i++ {
+			select {
+			case m := <-deviceChan:
+				var msg ws.ProtoMsg
+				assert.NoError(t, msgpack.Unmarshal(m.Data, &msg))
+				switch {
+				case msg.Header.MsgType == model.DelayMessageName:
+					s += "+"
+				case string(msg.Body) == string(playbackReset):
+					s += "|"
+				default:
+					s += string(msg.Body)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("timeout waiting for the playback, played %q", s)
+			}
+		}
+		return s
+	}
+	control := func(t *testing.T, r *Playback, ctlType string,
+		props map[string]interface{}) {
+		ctl, err := model.ParsePlaybackControl(&ws.ProtoMsg{
+			Header: ws.ProtoHdr{
+				Proto:      ws.ProtoTypeControl,
+				MsgType:    ctlType,
+				Properties: props,
+			},
+		})
+		if assert.NoError(t, err) {
+			assert.NoError(t, r.Control(ctl))
+		}
+	}
+
+	t.Run("seek backwards after the end", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		deviceChan := make(chan *nats.Msg, 20)
+		r := NewPlayback(ctx, "sessionID", deviceChan, PlaybackOptions{
+			SleepMs: sleepMs(0),
+		})
+		done := make(chan error, 1)
+		go func() { done <- r.Play(read) }()
+
+		assert.Equal(t, "one\n+two\n+three\n", played(deviceChan, 5))
+		control(t, r, model.PlaybackMessageSeek,
+			map[string]interface{}{model.PlaybackSeekOffsetField: 4})
+		assert.Equal(t, "|one\n+two\n+three\n", played(deviceChan, 6))
+
+		cancel()
+		assert.NoError(t, <-done)
+	})
+
+	t.Run("seek forwards in time", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		deviceChan := make(chan *nats.Msg, 20)
+		r := NewPlayback(ctx, "sessionID", deviceChan, PlaybackOptions{
+			SleepMs: sleepMs(0),
+		})
+		control(t, r, model.PlaybackMessageSeek,
+			map[string]interface{}{model.PlaybackSeekTimeField: uint16(1500)})
+		assert.NoError(t, read(r))
+		assert.Equal(t, "one\ntwo\nthree\n", played(deviceChan, 3))
+		assert.Len(t, deviceChan, 0)
+	})
+
+	t.Run("pause and resume", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		deviceChan := make(chan *nats.Msg, 20)
+		r := NewPlayback(ctx, "sessionID", deviceChan, PlaybackOptions{
+			SleepMs: sleepMs(0),
+		})
+		control(t, r, model.PlaybackMessagePause, nil)
+		done := make(chan error, 1)
+		go func() { done <- read(r) }()
+
+		time.Sleep(100 * time.Millisecond)
+		assert.Len(t, deviceChan, 0)
+		control(t, r, model.PlaybackMessageResume, nil)
+		assert.NoError(t, <-done)
+		assert.Equal(t, "one\n+two\n+three\n", played(deviceChan, 5))
+	})
+
+	t.Run("speed", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		deviceChan := make(chan *nats.Msg, 20)
+		r := NewPlayback(ctx, "sessionID", deviceChan, PlaybackOptions{
+			SleepMs: sleepMs(400),
+		})
+		control(t, r, model.PlaybackMessageSpeed,
+			map[string]interface{}{model.PlaybackSpeedField: 8.0})
+		t0 := time.Now()
+		assert.NoError(t, read(r))
+		assert.Less(t, time.Since(t0), time.Second)
+		assert.GreaterOrEqual(t, time.Since(t0), 250*time.Millisecond)
+	})
+
+	t.Run("client disconnected", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		r := NewPlayback(ctx, "sessionID", make(chan *nats.Msg), PlaybackOptions{})
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			cancel()
+		}()
+		_, err := r.Write(output("one\n"))
+		assert.ErrorIs(t, err, context.Canceled)
+		assert.NoError(t, r.Play(read))
+	})
+}
+
+func TestPlaybackRecordedTiming(t *testing.T) {
+	output := func(body string) []byte {
+		return packRecordingMessage(t, shell.MessageTypeShellCommand,
+			nil, []byte(body))
+	}
+	delay := func(ms uint16) []byte {
+		return packRecordingMessage(t, model.DelayMessageName,
+			map[string]interface{}{model.DelayMessageValueField: ms}, nil)
+	}
+	recording := [][]byte{output("$ "), delay(300), output("ls\r\n"),
+		delay(60000), output("file\r\n")}
+
+	deviceChan := make(chan *nats.Msg, 10)
+	r := NewPlayback(context.Background(), "sessionID", deviceChan, PlaybackOptions{
+		MaxIdleMs: 400,
+	})
+	t0 := time.Now()
+	for _, data := range recording {
+		n, err := r.Write(data)
+		assert.NoError(t, err)
+		assert.Equal(t, len(data), n)
+	}
+	// the delays are slept, the long idle gap compressed, and not forwarded
+	assert.GreaterOrEqual(t, time.Since(t0), 700*time.Millisecond)
+	assert.Less(t, time.Since(t0), 2*time.Second)
+	assert.Len(t, deviceChan, 3)
+	assert.Equal(t, int64(60300), r.elapsedMs)
+}
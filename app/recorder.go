@@ -18,34 +18,160 @@ import (
 	"bytes"
 	"compress/gzip"
 	"context"
+	"io"
+	"strings"
+	"unicode/utf8"
 
+	"github.com/pkg/errors"
+
+	"github.com/mendersoftware/go-lib-micro/log"
+
+	"github.com/mendersoftware/deviceconnect/model"
 	"github.com/mendersoftware/deviceconnect/store"
 )
 
+// StreamRecorder records a stream of a session recording, chaining the
+// chunks recorded
+type StreamRecorder interface {
+	io.WriteCloser
+	// Head returns the head of the chain of the chunks recorded, for
+	// signing the recording as recorded rather than as stored
+	Head() model.RecordingStreamHead
+}
+
 type Recorder struct {
-	sessionID  string
-	store      store.DataStore
-	ctx        context.Context
-	gzipWriter *gzip.Writer
-	gzipBuffer bytes.Buffer
+	sessionID string
+	store     store.DataStore
+	ctx       context.Context
+	stream    recordingStream
+	// insert queues the compressed chunks for the asynchronous writer of
+	// the recordings; nil inserts them in the store
+	insert func(ctx context.Context, sessionID string, data []byte,
+		link model.ChunkLink) error
+	// flush waits for the chunks queued to be written; nil if the chunks
+	// are inserted in the store at once
+	flush func() error
+	// chain links the recorded chunks, for verifying the recording
+	chain *model.RecordingChain
+
+	// index decodes the recorded terminal output into lines for the
+	// search index; nil if the recordings are not indexed
+	index *recordingIndex
+}
+
+// recordingIndex holds the state of the terminal output decoded for the
+// search index, and the session the recording belongs to
+type recordingIndex struct {
+	terminal terminalLines
+	session  *model.Session
 }
 
+const (
+	// MaxIndexedLineLength is the maximum number of characters of the
+	// lines of terminal output indexed for searching the recordings
+	MaxIndexedLineLength = 4096
+)
+
 const (
 	//It is used as a length of a memory region in bytes that is used to buffer
 	//the session recording. 4455 comes from the estimated typical terminal size in
 	//bytes (height=135 width=33) multiplied by 4 bytes of of terminal codes to get
 	//an estimate of a typical screen frame size in bytes. So we round to 4kB
 	RecorderBufferSize = 4 * 4096
+
+	// RecordingStreamSize is the size of the data recorded in a continuous
+	// compressed stream: a new stream starts once it is reached, bounding
+	// the data lost with a chunk failing to be stored and the data to
+	// decompress for reading the recording from a stream boundary.
+	RecordingStreamSize = 1024 * 1024
 )
 
+// recordingStream compresses a recording stream into continuous gzip
+// streams, flushed into a chunk at every write so that the chunks stored so
+// far decompress to all the data recorded so far. Compressing the stream
+// as a whole, instead of each chunk on its own, saves the gzip headers and
+// keeps the compression dictionary across the chunks.
+type recordingStream struct {
+	gzipWriter *gzip.Writer
+	gzipBuffer bytes.Buffer
+	started    bool
+	// offset is the offset of the next chunk in the compressed stream
+	offset int64
+	// size is the size of the data written to the stream
+	size int64
+}
+
+// compress compresses the data into the next chunk of the stream, starting
+// a new stream if needed; the link of the chunk holds its position in the
+// compressed stream.
+func (s *recordingStream) compress(d []byte) ([]byte, model.ChunkLink, error) {
+	if !s.started {
+		if s.gzipWriter == nil {
+			s.gzipWriter = gzip.NewWriter(&s.gzipBuffer)
+		} else {
+			s.gzipWriter.Reset(&s.gzipBuffer)
+		}
+		s.started = true
+		s.offset = 0
+		s.size = 0
+	}
+	s.gzipBuffer.Reset()
+	_, err := s.gzipWriter.Write(d)
+	if err == nil {
+		s.size += int64(len(d))
+		if s.size >= RecordingStreamSize {
+			err = s.gzipWriter.Close()
+			s.started = false
+		} else {
+			err = s.gzipWriter.Flush()
+		}
+	}
+	if err != nil {
+		s.started = false
+		return nil, model.ChunkLink{}, err
+	}
+	return s.chunk(), s.link(), nil
+}
+
+// close ends the stream, returning the last chunk of the stream, nil if
+// the stream is not started
+func (s *recordingStream) close() ([]byte, model.ChunkLink, error) {
+	if !s.started {
+		return nil, model.ChunkLink{}, nil
+	}
+	s.started = false
+	s.gzipBuffer.Reset()
+	if err := s.gzipWriter.Close(); err != nil {
+		return nil, model.ChunkLink{}, err
+	}
+	return s.chunk(), s.link(), nil
+}
+
+// restart starts a new stream at the next write, after failing to store a
+// chunk: the chunks following a missing chunk of a stream are unreadable
+func (s *recordingStream) restart() {
+	s.started = false
+}
+
+func (s *recordingStream) chunk() []byte {
+	return append([]byte(nil), s.gzipBuffer.Bytes()...)
+}
+
+func (s *recordingStream) link() model.ChunkLink {
+	link := model.ChunkLink{
+		Format: model.ChunkFormatGzipStream,
+		Offset: s.offset,
+	}
+	s.offset += int64(s.gzipBuffer.Len())
+	return link
+}
+
 func NewRecorder(ctx context.Context, sessionID string, store store.DataStore) *Recorder {
-	buffer := bytes.Buffer{}
 	return &Recorder{
-		ctx:        ctx,
-		sessionID:  sessionID,
-		store:      store,
-		gzipBuffer: buffer,
-		gzipWriter: gzip.NewWriter(&buffer),
+		ctx:       ctx,
+		sessionID: sessionID,
+		store:     store,
+		chain:     model.NewRecordingChain(sessionID),
 	}
 }
 
@@ -54,26 +180,122 @@ func (r *Recorder) Write(d []byte) (n int, err error) {
 		return 0, nil
 	}
 
-	r.gzipBuffer.Reset()
-	r.gzipWriter.Reset(&r.gzipBuffer)
-	_, err = r.gzipWriter.Write(d)
+	chunk, link, err := r.stream.compress(d)
 	if err != nil {
 		return -1, err
 	}
-
-	r.gzipWriter.Flush()
-	r.gzipWriter.Close()
-	output := r.gzipBuffer.Bytes()
-	n, err = r.gzipBuffer.Read(output)
-	if err != nil {
+	if err = r.insertChunk(chunk, link); err != nil {
 		return -1, err
 	}
+	if r.index != nil {
+		// the recording is persisted: failing to index it
+		// does not fail the session
+		if err := r.indexText(d); err != nil {
+			log.FromContext(r.ctx).Warnf(
+				"session_id=%s failed to index the recording: %s",
+				r.sessionID, err.Error())
+		}
+	}
+	return len(d), nil
+}
+
+// Close ends the compressed stream of the recording, storing its last chunk
+// and waiting for the chunks queued to be written
+func (r *Recorder) Close() error {
+	chunk, link, err := r.stream.close()
+	if err == nil && chunk != nil {
+		err = r.insertChunk(chunk, link)
+	}
+	if err == nil && r.flush != nil {
+		if err = r.flush(); err != nil {
+			err = recordingFailed(&r.stream, r.chain, err)
+		}
+	}
+	return err
+}
 
-	err = r.store.InsertSessionRecording(r.ctx, r.sessionID, output[:n])
+// Head returns the head of the chain of the chunks recorded
+func (r *Recorder) Head() model.RecordingStreamHead {
+	return streamHead(model.RecordingStreamOutput, r.chain)
+}
+
+// streamHead returns the head of the chain of a recording stream
+func streamHead(stream string, chain *model.RecordingChain) model.RecordingStreamHead {
+	head := chain.Head()
+	return model.RecordingStreamHead{
+		Stream: stream,
+		Chunks: head.Sequence,
+		Hash:   head.Hash,
+	}
+}
 
+// insertChunk stores the chunk of the stream, chained to the previous chunks
+func (r *Recorder) insertChunk(chunk []byte, link model.ChunkLink) error {
+	chained := r.chain.Next(chunk)
+	link.Sequence, link.Hash = chained.Sequence, chained.Hash
+	insert := r.insert
+	if insert == nil {
+		insert = r.store.InsertSessionRecording
+	}
+	err := insert(r.ctx, r.sessionID, chunk, link)
 	if err != nil {
-		return -1, err
-	} else {
-		return len(d), nil
+		return recordingFailed(&r.stream, r.chain, err)
+	}
+	r.chain.Advance(chained)
+	return nil
+}
+
+// recordingFailed restarts the compressed stream after failing to store a
+// chunk; once chunks queued are lost, the chain goes on from the last chunk
+// written. The recording goes on without the chunks dropped.
+func recordingFailed(
+	stream *recordingStream,
+	chain *model.RecordingChain,
+	err error,
+) error {
+	stream.restart()
+	var lost *recordingLostError
+	if errors.As(err, &lost) {
+		chain.Advance(lost.head)
+	}
+	if errors.Is(err, ErrRecordingDropped) {
+		return nil
+	}
+	return err
+}
+
+// indexText decodes the lines of terminal output completed by the recorded
+// data and inserts them in the search index
+func (r *Recorder) indexText(d []byte) error {
+	var lines []model.RecordingTextLine
+	_ = r.index.terminal.write(d, func(line string, offset int) error {
+		if strings.TrimSpace(line) == "" {
+			return nil
+		}
+		if utf8.RuneCountInString(line) > MaxIndexedLineLength {
+			line = string([]rune(line)[:MaxIndexedLineLength])
+		}
+		lines = append(lines, model.RecordingTextLine{
+			Offset: offset,
+			Text:   line,
+		})
+		return nil
+	})
+	if len(lines) == 0 {
+		return nil
+	}
+	if r.index.session == nil {
+		// the session is looked up once, while it is active
+		session, err := r.store.GetSession(r.ctx, r.sessionID)
+		if err != nil {
+			return errors.Wrap(err, "failed to look up the session")
+		}
+		r.index.session = session
 	}
+	return r.store.InsertRecordingText(r.ctx, &model.RecordingText{
+		SessionID: r.sessionID,
+		DeviceID:  r.index.session.DeviceID,
+		UserID:    r.index.session.UserID,
+		Lines:     lines,
+	})
 }
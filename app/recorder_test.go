@@ -15,13 +15,19 @@
 package app
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/sha256"
 	"errors"
+	"fmt"
+	"io"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 
+	"github.com/mendersoftware/deviceconnect/model"
 	store_mocks "github.com/mendersoftware/deviceconnect/store/mocks"
 )
 
@@ -62,6 +68,9 @@ func TestRecorderWrite(t *testing.T) {
 			}),
 			sessionID,
 			mock.AnythingOfType("[]uint8"),
+			mock.MatchedBy(func(link model.ChunkLink) bool {
+				return link.Sequence == 1 && len(link.Hash) == sha256.Size
+			}),
 		).Return(tc.DbGetSessionRecordingError)
 
 		r := NewRecorder(ctx, sessionID, store)
@@ -78,3 +87,152 @@ func TestRecorderWrite(t *testing.T) {
 		}
 	}
 }
+
+func TestRecorderStream(t *testing.T) {
+	ctx := context.Background()
+	sessionID := "00000000-0000-0000-0000-000000000000"
+	store := &store_mocks.DataStore{}
+	defer store.AssertExpectations(t)
+
+	var (
+		chunks [][]byte
+		links  []model.ChunkLink
+	)
+	record := func(args mock.Arguments) {
+		chunks = append(chunks, args.Get(2).([]byte))
+		links = append(links, args.Get(3).(model.ChunkLink))
+	}
+	store.On("InsertSessionRecording", ctx, sessionID,
+		mock.AnythingOfType("[]uint8"), mock.AnythingOfType("model.ChunkLink")).
+		Run(record).
+		Return(nil).
+		Times(3)
+	store.On("InsertSessionRecording", ctx, sessionID,
+		mock.AnythingOfType("[]uint8"), mock.AnythingOfType("model.ChunkLink")).
+		Return(errors.New("error")).
+		Once()
+	store.On("InsertSessionRecording", ctx, sessionID,
+		mock.AnythingOfType("[]uint8"), mock.AnythingOfType("model.ChunkLink")).
+		Run(record).
+		Return(nil)
+
+	r := NewRecorder(ctx, sessionID, store)
+	var listing []byte
+	for i := 0; i < 32; i++ {
+		listing = append(listing, fmt.Sprintf(
+			"-rw-r--r-- 1 root root %5d Jan  1 00:00 file-%02d.txt\r\n",
+			i*37, i)...)
+	}
+	for i := 0; i < 2; i++ {
+		n, err := r.Write(listing)
+		assert.NoError(t, err)
+		assert.Equal(t, len(listing), n)
+	}
+	assert.NoError(t, r.Close())
+	assert.NoError(t, r.Close())
+
+	// the head of the chain is the last chunk stored
+	if assert.Len(t, links, 3) {
+		assert.Equal(t, model.RecordingStreamHead{
+			Stream: model.RecordingStreamOutput,
+			Chunks: 3,
+			Hash:   links[2].Hash,
+		}, r.Head())
+	}
+
+	// the chunks are the fragments of one gzip stream, the dictionary is
+	// kept across the chunks
+	if !assert.Len(t, chunks, 3) {
+		return
+	}
+	var offset int64
+	for i, link := range links {
+		assert.Equal(t, i+1, link.Sequence)
+		assert.Equal(t, model.ChunkFormatGzipStream, link.Format)
+		assert.Equal(t, offset, link.Offset)
+		offset += int64(len(chunks[i]))
+	}
+	assert.Less(t, len(chunks[1]), len(chunks[0])/4)
+	zr, err := gzip.NewReader(bytes.NewReader(bytes.Join(chunks, nil)))
+	if assert.NoError(t, err) {
+		data, err := io.ReadAll(zr)
+		assert.NoError(t, err)
+		assert.Equal(t, bytes.Repeat(listing, 2), data)
+	}
+
+	line := []byte("$ ls\r\n")
+
+	// a new stream starts after failing to store a chunk
+	_, err = r.Write(line)
+	assert.Error(t, err)
+	_, err = r.Write(line)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), links[3].Offset)
+	assert.Equal(t, 4, links[3].Sequence)
+
+	// and once the size of the stream is reached
+	_, err = r.Write(bytes.Repeat(line, RecordingStreamSize/len(line)+1))
+	assert.NoError(t, err)
+	_, err = r.Write(line)
+	assert.NoError(t, err)
+	assert.NotZero(t, links[4].Offset)
+	assert.Equal(t, int64(0), links[5].Offset)
+}
+
+func TestRecorderIndex(t *testing.T) {
+	ctx := context.Background()
+	sessionID := "00000000-0000-0000-0000-000000000000"
+	store := &store_mocks.DataStore{}
+	defer store.AssertExpectations(t)
+	app := New(store, nil, nil, Config{RecordingSearchIndex: true})
+	r := app.GetRecorder(ctx, sessionID)
+
+	store.On("InsertSessionRecording", ctx, sessionID, mock.AnythingOfType("[]uint8"),
+		mock.AnythingOfType("model.ChunkLink")).
+		Return(nil)
+
+	// the lines are indexed once complete, blank lines are skipped
+	store.On("GetSession", ctx, sessionID).
+		Return(nil, errors.New("error")).
+		Once()
+	n, err := r.Write([]byte("$ ls\r\n\r\n$ cat /etc/sha"))
+	assert.NoError(t, err)
+	assert.Equal(t, 22, n)
+
+	store.On("GetSession", ctx, sessionID).
+		Return(&model.Session{
+			ID:       sessionID,
+			DeviceID: "device",
+			UserID:   "user",
+		}, nil).
+		Once()
+	store.On("InsertRecordingText", ctx, &model.RecordingText{
+		SessionID: sessionID,
+		DeviceID:  "device",
+		UserID:    "user",
+		Lines: []model.RecordingTextLine{{
+			Offset: 8,
+			Text:   "$ cat /etc/shadow",
+		}},
+	}).Return(nil).Once()
+	_, err = r.Write([]byte("dow\r\n$ "))
+	assert.NoError(t, err)
+
+	// the session is looked up once
+	store.On("InsertRecordingText", ctx, &model.RecordingText{
+		SessionID: sessionID,
+		DeviceID:  "device",
+		UserID:    "user",
+		Lines: []model.RecordingTextLine{{
+			Offset: 27,
+			Text:   "$ exit",
+		}},
+	}).Return(errors.New("error")).Once()
+	_, err = r.Write([]byte("exit\r\n"))
+	assert.NoError(t, err)
+
+	// the recordings are not indexed by default
+	r = New(store, nil, nil).GetRecorder(ctx, sessionID)
+	_, err = r.Write([]byte("$ ls\r\n"))
+	assert.NoError(t, err)
+}
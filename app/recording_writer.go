@@ -0,0 +1,489 @@
+// Copyright 2023 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package app
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/mendersoftware/go-lib-micro/identity"
+	"github.com/mendersoftware/go-lib-micro/log"
+
+	"github.com/mendersoftware/deviceconnect/model"
+	"github.com/mendersoftware/deviceconnect/store"
+)
+
+// The failure policies of the asynchronous recording writer, applied to the
+// chunks it cannot queue, the queue being full, or write to the store
+const (
+	// RecordingFailureDrop drops the chunks: the recording of the session
+	// goes on, missing the chunks dropped
+	RecordingFailureDrop = "drop"
+	// RecordingFailureBlock blocks the sessions while the queue is full,
+	// and retries writing the chunks until written
+	RecordingFailureBlock = "block"
+	// RecordingFailureTerminate terminates the sessions whose chunks are
+	// not queued or written
+	RecordingFailureTerminate = "terminate"
+)
+
+var (
+	// ErrRecordingDropped is returned recording the chunks dropped by the
+	// drop failure policy
+	ErrRecordingDropped = errors.New("the session recording chunk was dropped")
+	// ErrRecordingFailed is returned recording the chunks of the sessions
+	// to terminate by the terminate failure policy
+	ErrRecordingFailed = errors.New("failed to record the session")
+
+	// errRecordingWriterClosed is returned queueing the chunks past
+	// closing the writer, written at once instead
+	errRecordingWriterClosed = errors.New("the session recording writer is closed")
+)
+
+// recordingLostError is returned queueing the chunks of a stream once
+// chunks queued before were lost: the recorder restarts the compressed
+// stream, and the chain from the last chunk written.
+type recordingLostError struct {
+	err  error
+	head model.ChunkLink
+}
+
+func (e *recordingLostError) Error() string {
+	return e.err.Error()
+}
+
+func (e *recordingLostError) Unwrap() error {
+	return e.err
+}
+
+const (
+	// DefaultRecordingBatchSize and DefaultRecordingBatchInterval are the
+	// default maximum size of the batches of chunks written at once, and
+	// the default maximum time the chunks wait in the queue
+	DefaultRecordingBatchSize     = 64
+	DefaultRecordingBatchInterval = time.Second
+
+	// recordingRetryInterval is the interval of retrying to write the
+	// batches with the block failure policy, doubling up to
+	// maxRecordingRetryInterval
+	recordingRetryInterval    = 100 * time.Millisecond
+	maxRecordingRetryInterval = 5 * time.Second
+)
+
+// recordingWriter writes the chunks of the session recordings to the store
+// asynchronously: the recorders queue the chunks, written in batches by
+// the writer, so that the sessions do not wait for the store.
+type recordingWriter struct {
+	// the statistics, first for the alignment of the 64-bit atomics
+	queued      uint64
+	written     uint64
+	batches     uint64
+	failed      uint64
+	dropped     uint64
+	full        uint64
+	blockedTime int64
+
+	store         store.DataStore
+	policy        string
+	batchSize     int
+	batchInterval time.Duration
+	queue         chan *queuedChunk
+
+	// closed stops queueing the chunks: the recorders queueing a chunk
+	// are tracked by senders, and the queue is closed once they are done
+	mutex   sync.Mutex
+	closed  bool
+	closing chan struct{}
+	senders sync.WaitGroup
+	// abort stops retrying to write the chunks, done is closed once the
+	// chunks queued are written
+	abort chan struct{}
+	done  chan struct{}
+}
+
+// queuedChunk is a chunk queued by the recorder of a recording stream
+type queuedChunk struct {
+	tenant     string
+	chunk      model.StoredChunk
+	sink       *recordingSink
+	generation int
+}
+
+// recordingSink queues the chunks of a recording stream of a session
+type recordingSink struct {
+	writer *recordingWriter
+	stream string
+	// pending tracks the chunks queued, until written or dropped
+	pending sync.WaitGroup
+
+	mutex sync.Mutex
+	// written is the link of the last chunk written
+	written model.ChunkLink
+	// generation counts the chunks lost: the chunks queued before are
+	// chained to the lost chunks, and are dropped
+	generation int
+	// lost is set once chunks of the stream are lost, until reported to
+	// the recorder
+	lost bool
+}
+
+func newRecordingWriter(ds store.DataStore, config Config) *recordingWriter {
+	w := &recordingWriter{
+		store:         ds,
+		policy:        config.RecordingFailurePolicy,
+		batchSize:     config.RecordingBatchSize,
+		batchInterval: config.RecordingBatchInterval,
+		queue:         make(chan *queuedChunk, config.RecordingQueueSize),
+		closing:       make(chan struct{}),
+		abort:         make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+	if w.policy == "" {
+		w.policy = RecordingFailureBlock
+	}
+	if w.batchSize <= 0 {
+		w.batchSize = DefaultRecordingBatchSize
+	}
+	if w.batchInterval <= 0 {
+		w.batchInterval = DefaultRecordingBatchInterval
+	}
+	go w.run()
+	return w
+}
+
+// sink returns the sink of the chunks of a recording stream
+func (w *recordingWriter) sink(stream string) *recordingSink {
+	return &recordingSink{writer: w, stream: stream}
+}
+
+// insert queues a chunk of the recording stream; the signature matches the
+// Insert*Recording methods of the store.
+func (s *recordingSink) insert(
+	ctx context.Context,
+	sessionID string,
+	data []byte,
+	link model.ChunkLink,
+) error {
+	w := s.writer
+	if err := s.dropLost(); err != nil {
+		return err
+	}
+	item := &queuedChunk{
+		sink: s,
+		chunk: model.StoredChunk{
+			SessionID: sessionID,
+			Stream:    s.stream,
+			ChunkLink: link,
+			Data:      data,
+			CreatedTs: time.Now().UTC(),
+		},
+	}
+	if id := identity.FromContext(ctx); id != nil {
+		item.tenant = id.Tenant
+	}
+	s.mutex.Lock()
+	item.generation = s.generation
+	s.mutex.Unlock()
+
+	s.pending.Add(1)
+	err := w.enqueue(item)
+	if err == nil {
+		return nil
+	}
+	s.pending.Done()
+	if err == errRecordingWriterClosed {
+		// the writer is shut down, the late chunks are written at once,
+		// following the chunks queued
+		s.pending.Wait()
+		if err = s.dropLost(); err != nil {
+			return err
+		}
+		if err = w.writeNow(item); err == nil {
+			s.done(item, nil)
+		}
+	}
+	return err
+}
+
+// lostError returns the error reporting the chunks lost to the recorder:
+// the chunks following a missing chunk of the compressed stream are
+// unreadable, so the chunk recorded is dropped and the stream restarts,
+// unless the session terminates.
+func (s *recordingSink) lostError() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.lost {
+		return nil
+	}
+	err := &recordingLostError{
+		err:  ErrRecordingDropped,
+		head: s.written,
+	}
+	if s.writer.policy == RecordingFailureTerminate {
+		err.err = ErrRecordingFailed
+	} else {
+		s.lost = false
+	}
+	return err
+}
+
+// dropLost returns the error reporting the chunks lost, dropping the chunk
+// recorded
+func (s *recordingSink) dropLost() error {
+	err := s.lostError()
+	if errors.Is(err, ErrRecordingDropped) {
+		atomic.AddUint64(&s.writer.dropped, 1)
+	}
+	return err
+}
+
+// done records the outcome of writing a chunk of the stream
+func (s *recordingSink) done(item *queuedChunk, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err == nil {
+		s.written = model.ChunkLink{
+			Sequence: item.chunk.Sequence,
+			Hash:     item.chunk.Hash,
+		}
+	} else if item.generation == s.generation {
+		s.generation++
+		s.lost = true
+	}
+}
+
+// stale reports if the chunk queued follows chunks lost since queueing it
+func (s *recordingSink) stale(item *queuedChunk) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return item.generation != s.generation
+}
+
+// flush waits for the chunks queued to be written, returning the error
+// reporting the chunks lost meanwhile
+func (s *recordingSink) flush() error {
+	s.pending.Wait()
+	return s.lostError()
+}
+
+func (w *recordingWriter) enqueue(item *queuedChunk) error {
+	w.mutex.Lock()
+	if w.closed {
+		w.mutex.Unlock()
+		return errRecordingWriterClosed
+	}
+	w.senders.Add(1)
+	w.mutex.Unlock()
+	defer w.senders.Done()
+
+	select {
+	case w.queue <- item:
+		atomic.AddUint64(&w.queued, 1)
+		return nil
+	default:
+	}
+	atomic.AddUint64(&w.full, 1)
+	switch w.policy {
+	case RecordingFailureBlock:
+		start := time.Now()
+		defer func() {
+			atomic.AddInt64(&w.blockedTime, int64(time.Since(start)))
+		}()
+		select {
+		case w.queue <- item:
+			atomic.AddUint64(&w.queued, 1)
+			return nil
+		case <-w.closing:
+			return errRecordingWriterClosed
+		}
+	case RecordingFailureTerminate:
+		return ErrRecordingFailed
+	default:
+		atomic.AddUint64(&w.dropped, 1)
+		return ErrRecordingDropped
+	}
+}
+
+// writeNow writes a chunk synchronously
+func (w *recordingWriter) writeNow(item *queuedChunk) error {
+	ctx := tenantContext(item.tenant)
+	err := w.store.InsertRecordingChunks(ctx, []model.StoredChunk{item.chunk})
+	if err != nil {
+		return err
+	}
+	atomic.AddUint64(&w.written, 1)
+	return nil
+}
+
+func tenantContext(tenant string) context.Context {
+	return identity.WithContext(context.Background(), &identity.Identity{
+		Tenant: tenant,
+	})
+}
+
+// run writes the chunks queued in batches, once the batch is full or after
+// the batch interval, until the queue is closed
+func (w *recordingWriter) run() {
+	defer close(w.done)
+	timer := time.NewTimer(w.batchInterval)
+	defer timer.Stop()
+	batch := make([]*queuedChunk, 0, w.batchSize)
+	for {
+		select {
+		case item, ok := <-w.queue:
+			if !ok {
+				w.write(batch)
+				return
+			}
+			batch = append(batch, item)
+			if len(batch) < w.batchSize {
+				continue
+			}
+		case <-timer.C:
+		}
+		w.write(batch)
+		batch = batch[:0]
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(w.batchInterval)
+	}
+}
+
+// write writes a batch of chunks, the chunks of each tenant at once; the
+// chunks following the chunks lost of their stream are dropped
+func (w *recordingWriter) write(batch []*queuedChunk) {
+	queued := batch[:0:0]
+	for _, item := range batch {
+		if item.sink.stale(item) {
+			atomic.AddUint64(&w.dropped, 1)
+			item.sink.pending.Done()
+			continue
+		}
+		queued = append(queued, item)
+	}
+	batch = queued
+	for len(batch) > 0 {
+		tenant := batch[0].tenant
+		var (
+			chunks []model.StoredChunk
+			items  []*queuedChunk
+			rest   = batch[:0:0]
+		)
+		for _, item := range batch {
+			if item.tenant == tenant {
+				chunks = append(chunks, item.chunk)
+				items = append(items, item)
+			} else {
+				rest = append(rest, item)
+			}
+		}
+		w.writeChunks(tenant, chunks, items)
+		batch = rest
+	}
+}
+
+func (w *recordingWriter) writeChunks(
+	tenant string,
+	chunks []model.StoredChunk,
+	items []*queuedChunk,
+) {
+	ctx := tenantContext(tenant)
+	l := log.FromContext(ctx)
+	retry := recordingRetryInterval
+	for {
+		err := w.store.InsertRecordingChunks(ctx, chunks)
+		if err == nil {
+			atomic.AddUint64(&w.batches, 1)
+			atomic.AddUint64(&w.written, uint64(len(chunks)))
+			for _, item := range items {
+				item.sink.done(item, nil)
+				item.sink.pending.Done()
+			}
+			return
+		}
+		atomic.AddUint64(&w.failed, 1)
+		if w.policy == RecordingFailureBlock {
+			l.Errorf("failed to write %d session recording chunks, "+
+				"retrying in %s: %s", len(chunks), retry, err.Error())
+			select {
+			case <-time.After(retry):
+				retry *= 2
+				if retry > maxRecordingRetryInterval {
+					retry = maxRecordingRetryInterval
+				}
+				continue
+			case <-w.abort:
+			}
+		}
+		l.Errorf("failed to write %d session recording chunks: %s",
+			len(chunks), err.Error())
+		atomic.AddUint64(&w.dropped, uint64(len(chunks)))
+		for _, item := range items {
+			item.sink.done(item, err)
+			item.sink.pending.Done()
+		}
+		return
+	}
+}
+
+// close stops queueing the chunks and waits for the chunks queued to be
+// written; the chunks recorded past closing the writer are written
+// synchronously. Past the deadline of the context, the writer stops
+// retrying to write the chunks.
+func (w *recordingWriter) close(ctx context.Context) error {
+	w.mutex.Lock()
+	if w.closed {
+		w.mutex.Unlock()
+		return nil
+	}
+	w.closed = true
+	close(w.closing)
+	w.mutex.Unlock()
+
+	w.senders.Wait()
+	close(w.queue)
+	select {
+	case <-w.done:
+		return nil
+	case <-ctx.Done():
+		close(w.abort)
+		<-w.done
+		return ctx.Err()
+	}
+}
+
+func (w *recordingWriter) stats() model.RecordingWriterStats {
+	return model.RecordingWriterStats{
+		Enabled:        true,
+		FailurePolicy:  w.policy,
+		QueueLength:    len(w.queue),
+		QueueCapacity:  cap(w.queue),
+		QueuedChunks:   atomic.LoadUint64(&w.queued),
+		WrittenChunks:  atomic.LoadUint64(&w.written),
+		WrittenBatches: atomic.LoadUint64(&w.batches),
+		FailedBatches:  atomic.LoadUint64(&w.failed),
+		DroppedChunks:  atomic.LoadUint64(&w.dropped),
+		QueueFull:      atomic.LoadUint64(&w.full),
+		BlockedSeconds: time.Duration(atomic.LoadInt64(&w.blockedTime)).Seconds(),
+	}
+}
@@ -0,0 +1,381 @@
+// Copyright 2023 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package app
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/mendersoftware/go-lib-micro/identity"
+
+	"github.com/mendersoftware/deviceconnect/model"
+	store_mocks "github.com/mendersoftware/deviceconnect/store/mocks"
+)
+
+func chunkSequences(chunks []model.StoredChunk) []int {
+	sequences := make([]int, len(chunks))
+	for i, chunk := range chunks {
+		sequences[i] = chunk.Sequence
+	}
+	return sequences
+}
+
+func TestRecordingWriterBatches(t *testing.T) {
+	testCases := []struct {
+		Name          string
+		BatchSize     int
+		BatchInterval time.Duration
+		Chunks        int
+
+		Batches [][]int
+	}{{
+		Name:          "ok, full batches",
+		BatchSize:     2,
+		BatchInterval: time.Hour,
+		Chunks:        5,
+		// the last chunk is written closing the writer
+		Batches: [][]int{{1, 2}, {3, 4}, {5}},
+	}, {
+		Name:          "ok, batch interval",
+		BatchSize:     64,
+		BatchInterval: 10 * time.Millisecond,
+		Chunks:        3,
+		Batches:       [][]int{{1, 2, 3}},
+	}}
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			ctx := identity.WithContext(context.Background(), &identity.Identity{
+				Tenant: "tenant",
+			})
+			batches := make(chan []int, len(tc.Batches))
+			ds := &store_mocks.DataStore{}
+			ds.On("InsertRecordingChunks",
+				mock.MatchedBy(func(ctx context.Context) bool {
+					id := identity.FromContext(ctx)
+					return id != nil && id.Tenant == "tenant"
+				}),
+				mock.AnythingOfType("[]model.StoredChunk"),
+			).Run(func(args mock.Arguments) {
+				batches <- chunkSequences(args.Get(1).([]model.StoredChunk))
+			}).Return(nil)
+			defer ds.AssertExpectations(t)
+
+			w := newRecordingWriter(ds, Config{
+				RecordingQueueSize:     16,
+				RecordingBatchSize:     tc.BatchSize,
+				RecordingBatchInterval: tc.BatchInterval,
+			})
+			sink := w.sink(model.RecordingStreamOutput)
+			for i := 1; i <= tc.Chunks; i++ {
+				err := sink.insert(ctx, "session", []byte("data"),
+					model.ChunkLink{Sequence: i})
+				assert.NoError(t, err)
+			}
+			if tc.BatchInterval < time.Second {
+				assert.Equal(t, tc.Batches[0], <-batches)
+			}
+			assert.NoError(t, w.close(context.Background()))
+			close(batches)
+
+			var written [][]int
+			if tc.BatchInterval < time.Second {
+				written = append(written, tc.Batches[0])
+			}
+			for batch := range batches {
+				written = append(written, batch)
+			}
+			assert.Equal(t, tc.Batches, written)
+
+			stats := w.stats()
+			assert.True(t, stats.Enabled)
+			assert.Equal(t, RecordingFailureBlock, stats.FailurePolicy)
+			assert.Equal(t, uint64(tc.Chunks), stats.QueuedChunks)
+			assert.Equal(t, uint64(tc.Chunks), stats.WrittenChunks)
+			assert.Equal(t, uint64(len(tc.Batches)), stats.WrittenBatches)
+		})
+	}
+}
+
+func TestRecordingWriterFailurePolicy(t *testing.T) {
+	testCases := []struct {
+		Name   string
+		Policy string
+
+		Error error
+		Stats model.RecordingWriterStats
+	}{{
+		Name:   "block, retried until written",
+		Policy: RecordingFailureBlock,
+		Stats: model.RecordingWriterStats{
+			QueuedChunks:   1,
+			WrittenChunks:  2,
+			WrittenBatches: 1,
+			FailedBatches:  1,
+		},
+	}, {
+		Name:   "drop",
+		Policy: RecordingFailureDrop,
+
+		Error: ErrRecordingDropped,
+		Stats: model.RecordingWriterStats{
+			QueuedChunks:  1,
+			WrittenChunks: 1,
+			DroppedChunks: 2,
+			FailedBatches: 1,
+		},
+	}, {
+		Name:   "terminate",
+		Policy: RecordingFailureTerminate,
+
+		Error: ErrRecordingFailed,
+		Stats: model.RecordingWriterStats{
+			QueuedChunks:  1,
+			DroppedChunks: 1,
+			FailedBatches: 1,
+		},
+	}}
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			ds := &store_mocks.DataStore{}
+			ds.On("InsertRecordingChunks",
+				mock.Anything,
+				mock.AnythingOfType("[]model.StoredChunk"),
+			).Return(errors.New("connection lost")).Once()
+			ds.On("InsertRecordingChunks",
+				mock.Anything,
+				mock.AnythingOfType("[]model.StoredChunk"),
+			).Return(nil)
+
+			w := newRecordingWriter(ds, Config{
+				RecordingQueueSize:     16,
+				RecordingBatchSize:     1,
+				RecordingBatchInterval: time.Hour,
+				RecordingFailurePolicy: tc.Policy,
+			})
+			sink := w.sink(model.RecordingStreamOutput)
+			ctx := context.Background()
+			err := sink.insert(ctx, "session", []byte("data"), model.ChunkLink{Sequence: 1})
+			assert.NoError(t, err)
+			assert.NoError(t, w.close(ctx))
+
+			// the chunks recorded past closing are written at once
+			err = sink.insert(ctx, "session", []byte("data"), model.ChunkLink{Sequence: 2})
+			if tc.Error != nil {
+				assert.ErrorIs(t, err, tc.Error)
+			} else {
+				assert.NoError(t, err)
+			}
+			if tc.Policy == RecordingFailureDrop {
+				// dropping the chunk restarts the stream
+				err = sink.insert(ctx, "session", []byte("data"),
+					model.ChunkLink{Sequence: 1})
+				assert.NoError(t, err)
+			}
+
+			stats := w.stats()
+			assert.Equal(t, tc.Stats.QueuedChunks, stats.QueuedChunks)
+			assert.Equal(t, tc.Stats.WrittenChunks, stats.WrittenChunks)
+			assert.Equal(t, tc.Stats.WrittenBatches, stats.WrittenBatches)
+			assert.Equal(t, tc.Stats.FailedBatches, stats.FailedBatches)
+			assert.Equal(t, tc.Stats.DroppedChunks, stats.DroppedChunks)
+		})
+	}
+}
+
+func TestRecordingWriterBatchFailed(t *testing.T) {
+	const sessionID = "00000000-0000-0000-0000-000000000001"
+	ds := &store_mocks.DataStore{}
+	defer ds.AssertExpectations(t)
+	var stored []model.StoredChunk
+	record := func(args mock.Arguments) {
+		stored = append(stored, args.Get(1).([]model.StoredChunk)...)
+	}
+	release := make(chan struct{})
+	ds.On("InsertRecordingChunks",
+		mock.Anything,
+		mock.AnythingOfType("[]model.StoredChunk"),
+	).Run(record).Return(nil).Once()
+	ds.On("InsertRecordingChunks",
+		mock.Anything,
+		mock.AnythingOfType("[]model.StoredChunk"),
+	).Run(func(mock.Arguments) {
+		<-release
+	}).Return(errors.New("connection lost")).Once()
+	ds.On("InsertRecordingChunks",
+		mock.Anything,
+		mock.AnythingOfType("[]model.StoredChunk"),
+	).Run(record).Return(nil).Once()
+
+	w := newRecordingWriter(ds, Config{
+		RecordingQueueSize:     16,
+		RecordingBatchSize:     2,
+		RecordingBatchInterval: time.Hour,
+		RecordingFailurePolicy: RecordingFailureDrop,
+	})
+	defer w.close(context.Background())
+	sink := w.sink(model.RecordingStreamOutput)
+	r := NewRecorder(context.Background(), sessionID, ds)
+	r.insert = sink.insert
+	r.flush = sink.flush
+
+	// the second batch fails while the third one is queued: the chunks
+	// queued past the failed batch are dropped, not written past the gap
+	for _, data := range []string{"one", "two", "three", "four", "five", "six"} {
+		_, err := r.Write([]byte(data))
+		assert.NoError(t, err)
+	}
+	close(release)
+	assert.Eventually(t, func() bool {
+		return w.stats().DroppedChunks == 4
+	}, time.Second, 10*time.Millisecond)
+
+	// the recording goes on from the last chunk written, in a new stream
+	_, err := r.Write([]byte("seven"))
+	assert.NoError(t, err)
+	_, err = r.Write([]byte("eight"))
+	assert.NoError(t, err)
+	assert.NoError(t, r.Close())
+	assert.Equal(t, uint64(5), w.stats().DroppedChunks)
+
+	if !assert.Equal(t, []int{1, 2, 3, 4}, chunkSequences(stored)) {
+		return
+	}
+	chain := model.NewRecordingChain(sessionID)
+	for _, chunk := range stored {
+		link := chain.Next(chunk.Data)
+		assert.Equal(t, link.Hash, chunk.Hash)
+		chain.Advance(link)
+	}
+	assert.Equal(t, model.RecordingStreamHead{
+		Stream: model.RecordingStreamOutput,
+		Chunks: 4,
+		Hash:   stored[3].Hash,
+	}, r.Head())
+	assert.Equal(t, int64(0), stored[2].Offset)
+	zr, err := gzip.NewReader(bytes.NewReader(
+		append(append([]byte(nil), stored[2].Data...), stored[3].Data...)))
+	if assert.NoError(t, err) {
+		data, err := io.ReadAll(zr)
+		assert.NoError(t, err)
+		assert.Equal(t, "eight", string(data))
+	}
+}
+
+func TestRecordingWriterQueueFull(t *testing.T) {
+	testCases := []struct {
+		Name   string
+		Policy string
+
+		Error error
+	}{{
+		Name:   "block",
+		Policy: RecordingFailureBlock,
+	}, {
+		Name:   "drop",
+		Policy: RecordingFailureDrop,
+		Error:  ErrRecordingDropped,
+	}, {
+		Name:   "terminate",
+		Policy: RecordingFailureTerminate,
+		Error:  ErrRecordingFailed,
+	}}
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			started := make(chan struct{}, 4)
+			release := make(chan struct{})
+			ds := &store_mocks.DataStore{}
+			ds.On("InsertRecordingChunks",
+				mock.Anything,
+				mock.AnythingOfType("[]model.StoredChunk"),
+			).Run(func(mock.Arguments) {
+				started <- struct{}{}
+				<-release
+			}).Return(nil)
+
+			w := newRecordingWriter(ds, Config{
+				RecordingQueueSize:     1,
+				RecordingBatchSize:     1,
+				RecordingBatchInterval: time.Hour,
+				RecordingFailurePolicy: tc.Policy,
+			})
+			sink := w.sink(model.RecordingStreamOutput)
+			ctx := context.Background()
+
+			// the writer waits for the store with the first chunk, the
+			// second one fills the queue
+			assert.NoError(t, sink.insert(ctx, "session", nil, model.ChunkLink{}))
+			<-started
+			assert.NoError(t, sink.insert(ctx, "session", nil, model.ChunkLink{}))
+
+			if tc.Error != nil {
+				err := sink.insert(ctx, "session", nil, model.ChunkLink{})
+				assert.ErrorIs(t, err, tc.Error)
+				close(release)
+			} else {
+				errs := make(chan error, 1)
+				go func() {
+					errs <- sink.insert(ctx, "session", nil, model.ChunkLink{})
+				}()
+				select {
+				case err := <-errs:
+					t.Fatalf("the chunk was not blocked: %v", err)
+				case <-time.After(50 * time.Millisecond):
+				}
+				close(release)
+				assert.NoError(t, <-errs)
+			}
+			assert.NoError(t, w.close(ctx))
+
+			stats := w.stats()
+			assert.Equal(t, uint64(1), stats.QueueFull)
+			if tc.Error == nil {
+				assert.Equal(t, uint64(3), stats.WrittenChunks)
+				assert.Greater(t, stats.BlockedSeconds, 0.0)
+			} else {
+				assert.Equal(t, uint64(2), stats.WrittenChunks)
+			}
+		})
+	}
+}
+
+func TestRecordingWriterCloseTimeout(t *testing.T) {
+	ds := &store_mocks.DataStore{}
+	ds.On("InsertRecordingChunks",
+		mock.Anything,
+		mock.AnythingOfType("[]model.StoredChunk"),
+	).Return(errors.New("connection lost"))
+
+	w := newRecordingWriter(ds, Config{
+		RecordingQueueSize:     16,
+		RecordingBatchInterval: time.Hour,
+	})
+	sink := w.sink(model.RecordingStreamOutput)
+	assert.NoError(t, sink.insert(context.Background(), "session", nil, model.ChunkLink{}))
+
+	// the block policy retries writing the chunk until the deadline
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, w.close(ctx), context.DeadlineExceeded)
+	assert.Equal(t, uint64(1), w.stats().DroppedChunks)
+	assert.NoError(t, w.close(ctx))
+}
@@ -0,0 +1,320 @@
+// Copyright 2023 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package app
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/mendersoftware/go-lib-micro/identity"
+	"github.com/mendersoftware/go-lib-micro/log"
+
+	"github.com/mendersoftware/deviceconnect/client/workflows"
+	"github.com/mendersoftware/deviceconnect/model"
+	"github.com/mendersoftware/deviceconnect/store"
+)
+
+var (
+	// ErrLegalHoldNotFound is returned for the sessions not on legal hold
+	ErrLegalHoldNotFound = errors.New("the session is not on legal hold")
+	// ErrRecordingOnLegalHold is returned deleting the recording of a
+	// session on legal hold
+	ErrRecordingOnLegalHold = errors.New("the session recording is on legal hold")
+	// ErrRecordingSessionActive is returned deleting the recording of a
+	// session still open
+	ErrRecordingSessionActive = errors.New("the recorded session is still open")
+)
+
+// SetLegalHold places the recording of the session on legal hold: the
+// recording does not expire until the hold is released. The placing of the
+// hold is audited.
+func (a *app) SetLegalHold(
+	ctx context.Context,
+	sessionID string,
+	reason string,
+) (*model.LegalHold, error) {
+	sess, err := a.store.GetRecordedSession(ctx, sessionID)
+	if err != nil {
+		return nil, err
+	} else if sess == nil {
+		return nil, ErrRecordingNotFound
+	}
+	hold := &model.LegalHold{
+		SessionID: sessionID,
+		Reason:    reason,
+		CreatedTs: time.Now().UTC(),
+	}
+	if id := identity.FromContext(ctx); id != nil {
+		hold.UserID = id.Subject
+	}
+	if err := a.store.SetLegalHold(ctx, hold); err != nil {
+		return nil, err
+	}
+	err = a.auditRecording(ctx, *sess, hold.UserID,
+		workflows.ActionRecordingHold,
+		"User placed a session recording on legal hold")
+	if err != nil {
+		return nil, err
+	}
+	return hold, nil
+}
+
+// GetLegalHold returns the legal hold of the session recording
+func (a *app) GetLegalHold(ctx context.Context, sessionID string) (*model.LegalHold, error) {
+	hold, err := a.store.GetLegalHold(ctx, sessionID)
+	if err != nil {
+		return nil, err
+	} else if hold == nil {
+		return nil, ErrLegalHoldNotFound
+	}
+	return hold, nil
+}
+
+// ReleaseLegalHold releases the legal hold of the session recording, which
+// expires again after the retention of the tenant from its creation. The
+// release of the hold is audited.
+func (a *app) ReleaseLegalHold(ctx context.Context, sessionID string) error {
+	err := a.store.DeleteLegalHold(ctx, sessionID)
+	if err == store.ErrLegalHoldNotFound {
+		return ErrLegalHoldNotFound
+	} else if err != nil {
+		return err
+	}
+	var userID string
+	if id := identity.FromContext(ctx); id != nil {
+		userID = id.Subject
+	}
+	sess, err := a.store.GetRecordedSession(ctx, sessionID)
+	if err != nil {
+		return err
+	} else if sess == nil {
+		sess = &model.RecordedSession{SessionID: sessionID}
+	}
+	return a.auditRecording(ctx, *sess, userID,
+		workflows.ActionRecordingRelease,
+		"User released a session recording from legal hold")
+}
+
+// DeleteSessionRecording permanently deletes the recording of the session
+// on behalf of the user (userID) and submits the audit log of the deletion;
+// the recordings of the sessions on legal hold or still open are kept. The
+// recordings not catalogued are deleted by the session ID.
+func (a *app) DeleteSessionRecording(ctx context.Context, sessionID, userID string) error {
+	sess, err := a.store.GetRecordedSession(ctx, sessionID)
+	if err != nil {
+		return err
+	} else if sess == nil {
+		found, err := a.store.HasSessionRecording(ctx, sessionID)
+		if err != nil {
+			return err
+		} else if !found {
+			return ErrRecordingNotFound
+		}
+		sess = &model.RecordedSession{SessionID: sessionID}
+	}
+	deletion, err := a.deleteRecordings(ctx, []model.RecordedSession{*sess}, userID)
+	if err != nil {
+		return err
+	} else if len(deletion.Held) > 0 {
+		return ErrRecordingOnLegalHold
+	} else if len(deletion.Active) > 0 {
+		return ErrRecordingSessionActive
+	}
+	return nil
+}
+
+// DeleteRecordings permanently deletes the recordings of the user or of the
+// device in the filter on behalf of the user (userID), submitting the audit
+// log of each deletion; the recordings of the sessions on legal hold or
+// still open are kept. The recordings whose user and device are unknown
+// never match the filter: they are reported, to be deleted by session ID.
+// On failure, the deletion returned holds the recordings deleted until then.
+func (a *app) DeleteRecordings(
+	ctx context.Context,
+	filter model.RecordingFilter,
+	userID string,
+) (*model.RecordingDeletion, error) {
+	if err := filter.Validate(); err != nil {
+		return nil, errors.Wrap(err, "app: invalid recording filter")
+	}
+	sessions, err := a.store.FindRecordedSessions(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	unattributed, err := a.store.FindUnattributedRecordedSessions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	deletion, err := a.deleteRecordings(ctx, sessions, userID)
+	for _, sess := range unattributed {
+		deletion.Unmatched = append(deletion.Unmatched, sess.SessionID)
+	}
+	return deletion, err
+}
+
+// deleteRecordings deletes the recordings of the sessions, submitting the
+// audit log of each deletion before deleting the recording; on failure, the
+// deletion returned holds the recordings deleted until then.
+func (a *app) deleteRecordings(
+	ctx context.Context,
+	sessions []model.RecordedSession,
+	userID string,
+) (*model.RecordingDeletion, error) {
+	deletion := &model.RecordingDeletion{Deleted: []string{}}
+	for _, sess := range sessions {
+		hold, err := a.store.GetLegalHold(ctx, sess.SessionID)
+		if err != nil {
+			return deletion, err
+		} else if hold != nil {
+			deletion.Held = append(deletion.Held, sess.SessionID)
+			continue
+		}
+		_, err = a.store.GetSession(ctx, sess.SessionID)
+		if err == nil {
+			deletion.Active = append(deletion.Active, sess.SessionID)
+			continue
+		} else if err != store.ErrSessionNotFound {
+			return deletion, err
+		}
+
+		err = a.auditRecording(ctx, sess, userID,
+			workflows.ActionRecordingDelete,
+			"User deleted a session recording")
+		if err != nil {
+			return deletion, err
+		}
+		err = a.store.DeleteSessionRecordings(ctx, []string{sess.SessionID})
+		if err != nil {
+			return deletion, err
+		}
+		deletion.Deleted = append(deletion.Deleted, sess.SessionID)
+	}
+	return deletion, nil
+}
+
+// auditRecording submits the audit log of the action of the user (userID)
+// on the recording of the session
+func (a *app) auditRecording(
+	ctx context.Context,
+	sess model.RecordedSession,
+	userID string,
+	action workflows.Action,
+	change string,
+) error {
+	if !a.HaveAuditLogs {
+		return nil
+	}
+	object := workflows.Object{
+		ID:   sess.DeviceID,
+		Type: workflows.ObjectDevice,
+	}
+	if sess.DeviceID == "" {
+		// the device of the recordings made before the catalogue is
+		// unknown
+		object = workflows.Object{
+			ID:   userID,
+			Type: workflows.ObjectUser,
+		}
+	}
+	err := a.workflows.SubmitAuditLog(ctx, workflows.AuditLog{
+		Action: action,
+		Actor: workflows.Actor{
+			ID:   userID,
+			Type: workflows.ActorUser,
+		},
+		Object: object,
+		Change: change,
+		MetaData: map[string][]string{
+			"session_id": {sess.SessionID},
+			"user_id":    {sess.UserID},
+		},
+		EventTS: time.Now(),
+	})
+	return errors.Wrap(err, "failed to submit audit log")
+}
+
+// updateRecordingRetention updates the expiry of the recordings of the
+// tenant if the policy changes the retention of the recordings
+func (a *app) updateRecordingRetention(
+	ctx context.Context,
+	tenantID string,
+	previous, policy *model.TenantPolicy,
+) error {
+	var before, after *int
+	if previous != nil {
+		before = previous.RecordingRetention
+	}
+	if policy != nil {
+		after = policy.RecordingRetention
+	}
+	if (before == nil && after == nil) ||
+		(before != nil && after != nil && *before == *after) {
+		return nil
+	}
+	ctx = identity.WithContext(ctx, &identity.Identity{Tenant: tenantID})
+	return errors.Wrap(a.store.UpdateRecordingExpiry(ctx, ""),
+		"failed to update the expiry of the session recordings")
+}
+
+// catalogueRecording catalogues the user and the device of the session, if
+// recorded, for deleting the recordings of the users and of the devices
+func (a *app) catalogueRecording(ctx context.Context, sess *model.Session) error {
+	if sess.Policy != nil && sess.Policy.DisableRecording {
+		return nil
+	}
+	ctx = identity.WithContext(ctx, &identity.Identity{Tenant: sess.TenantID})
+	err := a.store.InsertRecordedSession(ctx, &model.RecordedSession{
+		SessionID: sess.ID,
+		DeviceID:  sess.DeviceID,
+		UserID:    sess.UserID,
+		CreatedTs: sess.StartTS.UTC(),
+	})
+	return errors.Wrap(err, "failed to catalogue the session recording")
+}
+
+// ExpireRecordings periodically deletes the expired recordings from the
+// recording storages which do not expire them, until the context is
+// canceled. It returns immediately if the deletions are disabled.
+func (a *app) ExpireRecordings(ctx context.Context) {
+	if a.RecordingExpiryInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(a.RecordingExpiryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := a.deleteExpiredRecordings(ctx); err != nil {
+				log.FromContext(ctx).Error(err)
+			}
+		}
+	}
+}
+
+// deleteExpiredRecordings deletes the expired recordings from the recording
+// storages which do not expire them
+func (a *app) deleteExpiredRecordings(ctx context.Context) error {
+	count, err := a.store.DeleteExpiredRecordings(ctx, time.Now())
+	if err != nil {
+		return errors.Wrap(err, "failed to delete the expired recordings")
+	} else if count > 0 {
+		log.FromContext(ctx).Infof("deleted %d expired recording chunks", count)
+	}
+	return nil
+}
@@ -0,0 +1,470 @@
+// Copyright 2023 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package app
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/mendersoftware/go-lib-micro/identity"
+
+	"github.com/mendersoftware/deviceconnect/client/workflows"
+	wf_mocks "github.com/mendersoftware/deviceconnect/client/workflows/mocks"
+	"github.com/mendersoftware/deviceconnect/model"
+	"github.com/mendersoftware/deviceconnect/store"
+	store_mocks "github.com/mendersoftware/deviceconnect/store/mocks"
+)
+
+func TestSetLegalHold(t *testing.T) {
+	const (
+		sessionID = "00000000-0000-0000-0000-000000000001"
+		userID    = "00000000-0000-0000-0000-000000000002"
+	)
+	recorded := &model.RecordedSession{
+		SessionID: sessionID,
+		DeviceID:  "00000000-0000-0000-0000-000000000003",
+		UserID:    "00000000-0000-0000-0000-000000000004",
+	}
+
+	testCases := []struct {
+		Name string
+
+		RecordedSession *model.RecordedSession
+		SetErr          error
+
+		HaveAuditLogs bool
+		AuditLogErr   error
+
+		Error error
+	}{{
+		Name:            "ok",
+		RecordedSession: recorded,
+	}, {
+		Name:            "ok, audit logs",
+		RecordedSession: recorded,
+		HaveAuditLogs:   true,
+	}, {
+		Name:  "error, recording not found",
+		Error: ErrRecordingNotFound,
+	}, {
+		Name:            "error, internal error",
+		RecordedSession: recorded,
+		SetErr:          errors.New("internal error"),
+		Error:           errors.New("internal error"),
+	}, {
+		Name:            "error, audit log",
+		RecordedSession: recorded,
+		HaveAuditLogs:   true,
+		AuditLogErr:     errors.New("internal error"),
+		Error:           errors.New("failed to submit audit log: internal error"),
+	}}
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			ctx := identity.WithContext(context.Background(), &identity.Identity{
+				Subject: userID,
+				Tenant:  "000000000000000000000000",
+				IsUser:  true,
+			})
+			ds := &store_mocks.DataStore{}
+			defer ds.AssertExpectations(t)
+			wf := &wf_mocks.Client{}
+			defer wf.AssertExpectations(t)
+
+			ds.On("GetRecordedSession", ctx, sessionID).Return(tc.RecordedSession, nil)
+			if tc.RecordedSession != nil {
+				ds.On("SetLegalHold", ctx, mock.MatchedBy(func(hold *model.LegalHold) bool {
+					return hold.SessionID == sessionID &&
+						hold.Reason == "case 42" &&
+						hold.UserID == userID &&
+						time.Since(hold.CreatedTs) < time.Minute
+				})).Return(tc.SetErr)
+			}
+			if tc.HaveAuditLogs {
+				wf.On("SubmitAuditLog", ctx, mock.MatchedBy(func(log workflows.AuditLog) bool {
+					return log.Action == workflows.ActionRecordingHold &&
+						log.Actor.ID == userID &&
+						log.Object.ID == recorded.DeviceID &&
+						log.Object.Type == workflows.ObjectDevice &&
+						log.MetaData["session_id"][0] == sessionID &&
+						log.MetaData["user_id"][0] == recorded.UserID
+				})).Return(tc.AuditLogErr)
+			}
+
+			app := New(ds, nil, wf, Config{HaveAuditLogs: tc.HaveAuditLogs})
+			hold, err := app.SetLegalHold(ctx, sessionID, "case 42")
+			if tc.Error != nil {
+				assert.EqualError(t, err, tc.Error.Error())
+				assert.Nil(t, hold)
+			} else if assert.NoError(t, err) {
+				assert.Equal(t, sessionID, hold.SessionID)
+			}
+		})
+	}
+}
+
+func TestGetLegalHold(t *testing.T) {
+	const sessionID = "00000000-0000-0000-0000-000000000001"
+	ctx := context.Background()
+	hold := &model.LegalHold{SessionID: sessionID}
+
+	ds := &store_mocks.DataStore{}
+	defer ds.AssertExpectations(t)
+	ds.On("GetLegalHold", ctx, sessionID).Return(hold, nil).Once()
+	ds.On("GetLegalHold", ctx, sessionID).Return(nil, nil).Once()
+	ds.On("GetLegalHold", ctx, sessionID).
+		Return(nil, errors.New("internal error")).Once()
+
+	app := New(ds, nil, nil)
+	res, err := app.GetLegalHold(ctx, sessionID)
+	assert.NoError(t, err)
+	assert.Equal(t, hold, res)
+
+	_, err = app.GetLegalHold(ctx, sessionID)
+	assert.Equal(t, ErrLegalHoldNotFound, err)
+
+	_, err = app.GetLegalHold(ctx, sessionID)
+	assert.EqualError(t, err, "internal error")
+}
+
+func TestReleaseLegalHold(t *testing.T) {
+	const (
+		sessionID = "00000000-0000-0000-0000-000000000001"
+		userID    = "00000000-0000-0000-0000-000000000002"
+	)
+	recorded := &model.RecordedSession{
+		SessionID: sessionID,
+		DeviceID:  "00000000-0000-0000-0000-000000000003",
+		UserID:    "00000000-0000-0000-0000-000000000004",
+	}
+
+	testCases := []struct {
+		Name string
+
+		DeleteErr       error
+		RecordedSession *model.RecordedSession
+
+		HaveAuditLogs bool
+		AuditLogErr   error
+
+		Error error
+	}{{
+		Name:            "ok",
+		RecordedSession: recorded,
+	}, {
+		Name:            "ok, audit logs",
+		RecordedSession: recorded,
+		HaveAuditLogs:   true,
+	}, {
+		Name:          "ok, audit logs, recording deleted",
+		HaveAuditLogs: true,
+	}, {
+		Name:      "error, not on legal hold",
+		DeleteErr: store.ErrLegalHoldNotFound,
+		Error:     ErrLegalHoldNotFound,
+	}, {
+		Name:      "error, internal error",
+		DeleteErr: errors.New("internal error"),
+		Error:     errors.New("internal error"),
+	}, {
+		Name:            "error, audit log",
+		RecordedSession: recorded,
+		HaveAuditLogs:   true,
+		AuditLogErr:     errors.New("internal error"),
+		Error:           errors.New("failed to submit audit log: internal error"),
+	}}
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			ctx := identity.WithContext(context.Background(), &identity.Identity{
+				Subject: userID,
+				Tenant:  "000000000000000000000000",
+				IsUser:  true,
+			})
+			ds := &store_mocks.DataStore{}
+			defer ds.AssertExpectations(t)
+			wf := &wf_mocks.Client{}
+			defer wf.AssertExpectations(t)
+
+			ds.On("DeleteLegalHold", ctx, sessionID).Return(tc.DeleteErr)
+			if tc.DeleteErr == nil {
+				ds.On("GetRecordedSession", ctx, sessionID).
+					Return(tc.RecordedSession, nil)
+			}
+			if tc.HaveAuditLogs {
+				// the object of the recordings deleted since is the user
+				// releasing them, their device unknown
+				object := workflows.Object{ID: userID, Type: workflows.ObjectUser}
+				if tc.RecordedSession != nil {
+					object = workflows.Object{
+						ID:   tc.RecordedSession.DeviceID,
+						Type: workflows.ObjectDevice,
+					}
+				}
+				wf.On("SubmitAuditLog", ctx, mock.MatchedBy(func(log workflows.AuditLog) bool {
+					return log.Action == workflows.ActionRecordingRelease &&
+						log.Actor.ID == userID &&
+						log.Object == object &&
+						log.MetaData["session_id"][0] == sessionID
+				})).Return(tc.AuditLogErr)
+			}
+
+			app := New(ds, nil, wf, Config{HaveAuditLogs: tc.HaveAuditLogs})
+			err := app.ReleaseLegalHold(ctx, sessionID)
+			if tc.Error != nil {
+				assert.EqualError(t, err, tc.Error.Error())
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestDeleteSessionRecording(t *testing.T) {
+	const (
+		sessionID = "00000000-0000-0000-0000-000000000001"
+		userID    = "00000000-0000-0000-0000-000000000002"
+	)
+	recorded := &model.RecordedSession{
+		SessionID: sessionID,
+		DeviceID:  "00000000-0000-0000-0000-000000000003",
+		UserID:    "00000000-0000-0000-0000-000000000004",
+	}
+
+	testCases := []struct {
+		Name string
+
+		RecordedSession *model.RecordedSession
+		Recorded        bool
+		LegalHold       *model.LegalHold
+		SessionErr      error
+		DeleteErr       error
+
+		HaveAuditLogs bool
+		AuditLogErr   error
+
+		Error error
+	}{{
+		Name:            "ok",
+		RecordedSession: recorded,
+		SessionErr:      store.ErrSessionNotFound,
+	}, {
+		Name:            "ok, audit logs",
+		RecordedSession: recorded,
+		SessionErr:      store.ErrSessionNotFound,
+		HaveAuditLogs:   true,
+	}, {
+		Name:          "ok, not catalogued",
+		Recorded:      true,
+		SessionErr:    store.ErrSessionNotFound,
+		HaveAuditLogs: true,
+	}, {
+		Name:  "error, recording not found",
+		Error: ErrRecordingNotFound,
+	}, {
+		Name:            "error, legal hold",
+		RecordedSession: recorded,
+		LegalHold:       &model.LegalHold{SessionID: sessionID},
+		Error:           ErrRecordingOnLegalHold,
+	}, {
+		Name:            "error, session active",
+		RecordedSession: recorded,
+		Error:           ErrRecordingSessionActive,
+	}, {
+		Name:            "error, delete internal error",
+		RecordedSession: recorded,
+		SessionErr:      store.ErrSessionNotFound,
+		DeleteErr:       errors.New("internal error"),
+		Error:           errors.New("internal error"),
+	}, {
+		Name:            "error, audit log",
+		RecordedSession: recorded,
+		SessionErr:      store.ErrSessionNotFound,
+		HaveAuditLogs:   true,
+		AuditLogErr:     errors.New("internal error"),
+		Error:           errors.New("failed to submit audit log: internal error"),
+	}}
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			ctx := context.Background()
+			ds := &store_mocks.DataStore{}
+			defer ds.AssertExpectations(t)
+			wf := &wf_mocks.Client{}
+			defer wf.AssertExpectations(t)
+
+			ds.On("GetRecordedSession", ctx, sessionID).Return(tc.RecordedSession, nil)
+			if tc.RecordedSession == nil {
+				ds.On("HasSessionRecording", ctx, sessionID).Return(tc.Recorded, nil)
+			}
+			recorded := tc.RecordedSession != nil || tc.Recorded
+			if recorded {
+				ds.On("GetLegalHold", ctx, sessionID).Return(tc.LegalHold, nil)
+			}
+			if recorded && tc.LegalHold == nil {
+				ds.On("GetSession", ctx, sessionID).
+					Return(&model.Session{ID: sessionID}, tc.SessionErr)
+			}
+			if tc.SessionErr != nil && tc.AuditLogErr == nil {
+				// the recording is deleted once the deletion is audited
+				ds.On("DeleteSessionRecordings", ctx, []string{sessionID}).
+					Return(tc.DeleteErr)
+			}
+			if tc.HaveAuditLogs {
+				// the object of the recordings not catalogued is the
+				// user deleting them, their device unknown
+				object := workflows.Object{ID: userID, Type: workflows.ObjectUser}
+				sess := model.RecordedSession{SessionID: sessionID}
+				if tc.RecordedSession != nil {
+					object = workflows.Object{
+						ID:   tc.RecordedSession.DeviceID,
+						Type: workflows.ObjectDevice,
+					}
+					sess = *tc.RecordedSession
+				}
+				wf.On("SubmitAuditLog", ctx, mock.MatchedBy(func(log workflows.AuditLog) bool {
+					return log.Action == workflows.ActionRecordingDelete &&
+						log.Actor.ID == userID &&
+						log.Object == object &&
+						log.MetaData["session_id"][0] == sessionID &&
+						log.MetaData["user_id"][0] == sess.UserID
+				})).Return(tc.AuditLogErr)
+			}
+
+			app := New(ds, nil, wf, Config{HaveAuditLogs: tc.HaveAuditLogs})
+			err := app.DeleteSessionRecording(ctx, sessionID, userID)
+			if tc.Error != nil {
+				assert.EqualError(t, err, tc.Error.Error())
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestDeleteRecordings(t *testing.T) {
+	const userID = "00000000-0000-0000-0000-000000000001"
+	ctx := context.Background()
+	filter := model.RecordingFilter{UserID: "00000000-0000-0000-0000-000000000002"}
+	sessions := []model.RecordedSession{
+		{SessionID: "deleted", DeviceID: "device", UserID: filter.UserID},
+		{SessionID: "held", DeviceID: "device", UserID: filter.UserID},
+		{SessionID: "active", DeviceID: "device", UserID: filter.UserID},
+	}
+
+	ds := &store_mocks.DataStore{}
+	defer ds.AssertExpectations(t)
+	ds.On("FindRecordedSessions", ctx, filter).Return(sessions, nil)
+	ds.On("FindUnattributedRecordedSessions", ctx).
+		Return([]model.RecordedSession{{SessionID: "legacy"}}, nil)
+	ds.On("GetLegalHold", ctx, "deleted").Return(nil, nil)
+	ds.On("GetLegalHold", ctx, "held").Return(&model.LegalHold{SessionID: "held"}, nil)
+	ds.On("GetLegalHold", ctx, "active").Return(nil, nil)
+	ds.On("GetSession", ctx, "deleted").Return(nil, store.ErrSessionNotFound)
+	ds.On("GetSession", ctx, "active").Return(&model.Session{ID: "active"}, nil)
+	ds.On("DeleteSessionRecordings", ctx, []string{"deleted"}).Return(nil)
+	wf := &wf_mocks.Client{}
+	defer wf.AssertExpectations(t)
+	wf.On("SubmitAuditLog", ctx, mock.MatchedBy(func(log workflows.AuditLog) bool {
+		return log.Action == workflows.ActionRecordingDelete &&
+			log.MetaData["session_id"][0] == "deleted"
+	})).Return(nil).Once()
+
+	app := New(ds, nil, wf, Config{HaveAuditLogs: true})
+	deletion, err := app.DeleteRecordings(ctx, filter, userID)
+	assert.NoError(t, err)
+	assert.Equal(t, &model.RecordingDeletion{
+		Deleted:   []string{"deleted"},
+		Held:      []string{"held"},
+		Active:    []string{"active"},
+		Unmatched: []string{"legacy"},
+	}, deletion)
+
+	// the recordings deleted before failing are returned with the error
+	failing := model.RecordingFilter{DeviceID: "device"}
+	ds.On("FindRecordedSessions", ctx, failing).Return([]model.RecordedSession{
+		{SessionID: "deleted", DeviceID: "device", UserID: filter.UserID},
+		{SessionID: "failed", DeviceID: "device", UserID: filter.UserID},
+	}, nil)
+	ds.On("GetLegalHold", ctx, "failed").Return(nil, nil)
+	ds.On("GetSession", ctx, "failed").Return(nil, store.ErrSessionNotFound)
+	wf.On("SubmitAuditLog", ctx, mock.MatchedBy(func(log workflows.AuditLog) bool {
+		return log.Action == workflows.ActionRecordingDelete &&
+			log.MetaData["session_id"][0] == "deleted"
+	})).Return(nil).Once()
+	wf.On("SubmitAuditLog", ctx, mock.MatchedBy(func(log workflows.AuditLog) bool {
+		return log.Action == workflows.ActionRecordingDelete &&
+			log.MetaData["session_id"][0] == "failed"
+	})).Return(nil).Once()
+	ds.On("DeleteSessionRecordings", ctx, []string{"failed"}).
+		Return(errors.New("internal error"))
+	deletion, err = app.DeleteRecordings(ctx, failing, userID)
+	assert.EqualError(t, err, "internal error")
+	assert.Equal(t, &model.RecordingDeletion{
+		Deleted:   []string{"deleted"},
+		Unmatched: []string{"legacy"},
+	}, deletion)
+
+	// the filter selects the recordings of a user or of a device
+	_, err = app.DeleteRecordings(ctx, model.RecordingFilter{}, userID)
+	assert.EqualError(t, err, "app: invalid recording filter: "+
+		"device_id: either device_id or user_id is required.")
+}
+
+func TestExpireRecordings(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds := &store_mocks.DataStore{}
+	defer ds.AssertExpectations(t)
+
+	// the deletions are disabled
+	app := New(ds, nil, nil)
+	app.ExpireRecordings(ctx)
+
+	// the expired recordings are deleted whether the leases are enabled
+	// or not
+	app = New(ds, nil, nil, Config{RecordingExpiryInterval: 10 * time.Millisecond})
+	deleted := make(chan struct{}, 1)
+	ds.On("DeleteExpiredRecordings", ctx, mock.AnythingOfType("time.Time")).
+		Return(0, errors.New("internal error")).
+		Once()
+	ds.On("DeleteExpiredRecordings", ctx, mock.AnythingOfType("time.Time")).
+		Run(func(mock.Arguments) {
+			select {
+			case deleted <- struct{}{}:
+			default:
+			}
+		}).
+		Return(1, nil)
+
+	done := make(chan struct{})
+	go func() {
+		app.ExpireRecordings(ctx)
+		close(done)
+	}()
+	select {
+	case <-deleted:
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for the expired recordings to be deleted")
+	}
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("ExpireRecordings did not return after canceling the context")
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright 2023 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package app
+
+import (
+	"unicode"
+)
+
+const (
+	// searchSnippetContext is the number of characters kept around the
+	// match in the search snippets
+	searchSnippetContext  = 60
+	searchSnippetEllipsis = "…"
+)
+
+// searchSnippet shortens the line to the first case-insensitive match of
+// the query and its context
+func searchSnippet(line, query string) string {
+	runes := []rune(line)
+	lower := toLowerRunes(line)
+	needle := toLowerRunes(query)
+
+	index := -1
+	for i := 0; i+len(needle) <= len(lower); i++ {
+		if string(lower[i:i+len(needle)]) == string(needle) {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		index = 0
+	}
+	start := index - searchSnippetContext
+	end := index + len(needle) + searchSnippetContext
+	snippet := ""
+	if start > 0 {
+		snippet = searchSnippetEllipsis
+	} else {
+		start = 0
+	}
+	if end >= len(runes) {
+		return snippet + string(runes[start:])
+	}
+	return snippet + string(runes[start:end]) + searchSnippetEllipsis
+}
+
+func toLowerRunes(s string) []rune {
+	runes := []rune(s)
+	for i, r := range runes {
+		runes[i] = unicode.ToLower(r)
+	}
+	return runes
+}
@@ -0,0 +1,136 @@
+// Copyright 2023 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package app
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mendersoftware/deviceconnect/model"
+	store_mocks "github.com/mendersoftware/deviceconnect/store/mocks"
+)
+
+func TestSearchSnippet(t *testing.T) {
+	long := strings.Repeat("x", 100)
+	testCases := []struct {
+		Name  string
+		Line  string
+		Query string
+
+		Snippet string
+	}{{
+		Name:  "short line",
+		Line:  "$ sudo rm -rf /var/cache",
+		Query: "RM -RF",
+
+		Snippet: "$ sudo rm -rf /var/cache",
+	}, {
+		Name:  "long line",
+		Line:  long + "cat /etc/shadow" + long,
+		Query: "/etc/shadow",
+
+		Snippet: "…" + strings.Repeat("x", 56) + "cat /etc/shadow" +
+			strings.Repeat("x", 60) + "…",
+	}, {
+		Name:  "multi-byte characters",
+		Line:  "échec: rm -rf " + long,
+		Query: "ÉCHEC",
+
+		Snippet: "échec: rm -rf " + strings.Repeat("x", 51) + "…",
+	}}
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			assert.Equal(t, tc.Snippet, searchSnippet(tc.Line, tc.Query))
+		})
+	}
+}
+
+func TestSearchRecordings(t *testing.T) {
+	testCases := []struct {
+		Name string
+
+		Filter model.SearchFilter
+
+		StoreResults []model.SearchResult
+		StoreErr     error
+
+		Results []model.SearchResult
+		Error   error
+	}{{
+		Name: "ok",
+
+		Filter: model.SearchFilter{Query: "rm -rf", Limit: 20},
+		StoreResults: []model.SearchResult{{
+			SessionID: "session",
+			DeviceID:  "device",
+			UserID:    "user",
+			Matches: []model.SearchMatch{{
+				Offset:  42,
+				Snippet: strings.Repeat("x", 70) + "$ rm -rf /tmp",
+			}},
+		}},
+
+		Results: []model.SearchResult{{
+			SessionID: "session",
+			DeviceID:  "device",
+			UserID:    "user",
+			Matches: []model.SearchMatch{{
+				Offset:  42,
+				Snippet: "…" + strings.Repeat("x", 58) + "$ rm -rf /tmp",
+			}},
+		}},
+	}, {
+		Name: "ko, invalid filter",
+
+		Filter: model.SearchFilter{Query: "rm"},
+
+		Error: errors.New("app: invalid search filter: q: the length " +
+			"must be between 3 and 256."),
+	}, {
+		Name: "ko, store error",
+
+		Filter:   model.SearchFilter{Query: "rm -rf"},
+		StoreErr: errors.New("error"),
+
+		Error: errors.New("error"),
+	}}
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			ctx := context.Background()
+			store := &store_mocks.DataStore{}
+			defer store.AssertExpectations(t)
+			if err := tc.Filter.Validate(); err == nil {
+				store.On("SearchRecordings", ctx, tc.Filter).
+					Return(tc.StoreResults, tc.StoreErr)
+			} else {
+				_, ok := err.(validation.Errors)
+				assert.True(t, ok)
+			}
+			app := New(store, nil, nil)
+			results, err := app.SearchRecordings(ctx, tc.Filter)
+			if tc.Error != nil {
+				assert.EqualError(t, err, tc.Error.Error())
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, tc.Results, results)
+			}
+		})
+	}
+}
@@ -0,0 +1,256 @@
+// Copyright 2023 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package app
+
+import (
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const terminalTabWidth = 8
+
+type escapeState int
+
+const (
+	escapeNone escapeState = iota
+	// escapeStart follows ESC
+	escapeStart
+	// escapeCSI follows ESC [, until the final byte
+	escapeCSI
+	// escapeString follows ESC ], ESC P, ESC X, ESC ^ and ESC _, until
+	// the string terminator (BEL or ESC \)
+	escapeString
+	// escapeStringEnd follows ESC within an escapeString
+	escapeStringEnd
+	// escapeCharset follows ESC (, ESC ) and the like, selecting a
+	// character set with the next character
+	escapeCharset
+)
+
+// lineFunc receives the lines reconstructed by terminalLines, with the
+// offset in the terminal output of the first character of the line
+type lineFunc func(line string, offset int) error
+
+// terminalLines reconstructs the lines displayed on a terminal from its
+// output: the ANSI escape and control sequences are stripped, and the
+// carriage returns, backspaces and line editing sequences are applied to
+// the line being output.
+type terminalLines struct {
+	// offset is the number of bytes of terminal output consumed, and
+	// pending the trailing bytes of an incomplete UTF-8 sequence
+	offset  int
+	pending []byte
+
+	// line is the terminal line being output, col the cursor column and
+	// start the offset of the first character of the line
+	line  []rune
+	col   int
+	start int
+	dirty bool
+
+	escape escapeState
+	params []byte
+}
+
+// write processes the terminal output, calling emit for each line completed
+func (t *terminalLines) write(data []byte, emit lineFunc) error {
+	offset := t.offset - len(t.pending)
+	t.offset += len(data)
+	if len(t.pending) > 0 {
+		data = append(t.pending, data...)
+	}
+	data, t.pending = splitIncompleteRune(data)
+	return t.process(data, offset, emit)
+}
+
+// flush completes the line being output
+func (t *terminalLines) flush(emit lineFunc) error {
+	if len(t.pending) > 0 {
+		pending := t.pending
+		t.pending = nil
+		if err := t.process(pending, t.offset-len(pending), emit); err != nil {
+			return err
+		}
+	}
+	if t.dirty {
+		return t.emitLine(emit, t.offset)
+	}
+	return nil
+}
+
+func (t *terminalLines) process(data []byte, offset int, emit lineFunc) error {
+	for i := 0; i < len(data); {
+		r, size := utf8.DecodeRune(data[i:])
+		pos := offset + i
+		i += size
+		if t.escape != escapeNone {
+			t.handleEscape(r)
+			continue
+		}
+		switch r {
+		case '\n':
+			if err := t.emitLine(emit, pos); err != nil {
+				return err
+			}
+		case '\r':
+			t.col = 0
+		case '\b':
+			if t.col > 0 {
+				t.col--
+			}
+		case '\t':
+			t.markDirty(pos)
+			t.col += terminalTabWidth - t.col%terminalTabWidth
+		case '\x1b':
+			t.escape = escapeStart
+		default:
+			if r < 0x20 || r == 0x7f || (r >= 0x80 && r < 0xa0) {
+				// other C0 and C1 control characters are not displayed
+				continue
+			}
+			t.put(r, pos)
+		}
+	}
+	return nil
+}
+
+func (t *terminalLines) handleEscape(r rune) {
+	switch t.escape {
+	case escapeStart:
+		switch r {
+		case '[':
+			t.escape = escapeCSI
+			t.params = t.params[:0]
+		case ']', 'P', 'X', '^', '_':
+			t.escape = escapeString
+		case '(', ')', '*', '+', '#', '%':
+			t.escape = escapeCharset
+		default:
+			t.escape = escapeNone
+		}
+	case escapeCSI:
+		if r >= 0x40 && r <= 0x7e {
+			t.escape = escapeNone
+			t.applyCSI(r)
+		} else if r < utf8.RuneSelf {
+			t.params = append(t.params, byte(r))
+		}
+	case escapeString:
+		switch r {
+		case '\a':
+			t.escape = escapeNone
+		case '\x1b':
+			t.escape = escapeStringEnd
+		}
+	case escapeStringEnd:
+		if r == '\\' {
+			t.escape = escapeNone
+		} else {
+			t.escape = escapeString
+		}
+	case escapeCharset:
+		t.escape = escapeNone
+	}
+}
+
+// applyCSI applies the control sequences editing the line; the others,
+// e.g. colors and cursor movements across the lines, are dropped.
+func (t *terminalLines) applyCSI(final rune) {
+	params := string(t.params)
+	if strings.ContainsAny(params, "?<=>") {
+		// private sequences, e.g. the terminal modes
+		return
+	}
+	n, err := strconv.Atoi(strings.SplitN(params, ";", 2)[0])
+	if err != nil {
+		n = 0
+	}
+	count := n
+	if count < 1 {
+		count = 1
+	}
+	switch final {
+	case 'C': // cursor forward
+		t.col += count
+	case 'D': // cursor backward
+		t.col -= count
+		if t.col < 0 {
+			t.col = 0
+		}
+	case 'G': // cursor horizontal absolute
+		t.col = count - 1
+	case 'K': // erase in line
+		switch n {
+		case 0:
+			if t.col < len(t.line) {
+				t.line = t.line[:t.col]
+			}
+		case 1:
+			for i := 0; i <= t.col && i < len(t.line); i++ {
+				t.line[i] = ' '
+			}
+		case 2:
+			t.line = t.line[:0]
+		}
+	case 'P': // delete characters
+		if t.col < len(t.line) {
+			end := t.col + count
+			if end > len(t.line) {
+				end = len(t.line)
+			}
+			t.line = append(t.line[:t.col], t.line[end:]...)
+		}
+	case '@': // insert blank characters
+		if t.col < len(t.line) {
+			blanks := []rune(strings.Repeat(" ", count))
+			t.line = append(t.line[:t.col],
+				append(blanks, t.line[t.col:]...)...)
+		}
+	}
+}
+
+func (t *terminalLines) markDirty(offset int) {
+	if !t.dirty {
+		t.dirty = true
+		t.start = offset
+	}
+}
+
+func (t *terminalLines) put(r rune, offset int) {
+	t.markDirty(offset)
+	for len(t.line) < t.col {
+		t.line = append(t.line, ' ')
+	}
+	if t.col < len(t.line) {
+		t.line[t.col] = r
+	} else {
+		t.line = append(t.line, r)
+	}
+	t.col++
+}
+
+// emitLine completes the line being output at the given offset
+func (t *terminalLines) emitLine(emit lineFunc, offset int) error {
+	line := strings.TrimRight(string(t.line), " ")
+	start := t.start
+	if !t.dirty {
+		start = offset
+	}
+	t.line = t.line[:0]
+	t.col = 0
+	t.dirty = false
+	return emit(line, start)
+}
@@ -0,0 +1,187 @@
+// Copyright 2023 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package app
+
+import (
+	"encoding/json"
+	"io"
+
+	"github.com/mendersoftware/go-lib-micro/ws"
+	"github.com/mendersoftware/go-lib-micro/ws/shell"
+	"github.com/vmihailenco/msgpack/v5"
+
+	"github.com/mendersoftware/deviceconnect/model"
+)
+
+const (
+	// TranscriptFormatText is the plain text transcript, one terminal
+	// line per line
+	TranscriptFormatText = "text"
+	// TranscriptFormatJSONLines is the JSON lines transcript, one
+	// TranscriptLine object per terminal line, and one TranscriptInput
+	// object per recorded terminal input
+	TranscriptFormatJSONLines = "jsonl"
+
+	TranscriptTextContentType      = "text/plain; charset=utf-8"
+	TranscriptJSONLinesContentType = "application/x-ndjson"
+)
+
+// TranscriptLine is a line of the JSON lines transcript
+type TranscriptLine struct {
+	// Time is the approximate number of seconds elapsed since the start
+	// of the session when the line started to be output
+	Time float64 `json:"time"`
+	Line string  `json:"line"`
+}
+
+// TranscriptInput is the terminal input typed by a user, in the JSON lines
+// transcript of the sessions recording the input
+type TranscriptInput struct {
+	// Time is the number of seconds elapsed since the start of the
+	// session when the input was typed
+	Time   float64 `json:"time"`
+	UserID string  `json:"user_id"`
+	Input  string  `json:"input"`
+}
+
+// transcriptCheckpoint maps an offset of the terminal output to the time
+// elapsed since the start of the session
+type transcriptCheckpoint struct {
+	offset    int
+	elapsedMs uint64
+}
+
+// TranscriptWriter converts the msgpack-encoded messages of a session
+// recording, as written by GetSessionRecording, to a readable transcript:
+// the ANSI escape and control sequences are stripped, and the carriage
+// returns, backspaces and line editing sequences are applied to the
+// line being output, so that each line reads as displayed on the terminal.
+// The recorded terminal input is part of the JSON lines transcript only,
+// written when typed: the plain text transcript shows the input as echoed
+// by the terminal.
+type TranscriptWriter struct {
+	w      io.Writer
+	format string
+
+	terminal terminalLines
+	lines    int
+
+	// checkpoints are the offsets of the output following the delays,
+	// for timing the lines
+	elapsedMs   uint64
+	checkpoints []transcriptCheckpoint
+	lineMs      uint64
+}
+
+// NewTranscriptWriter returns a writer converting the session recording
+// to a transcript in the given format written to w.
+func NewTranscriptWriter(w io.Writer, format string) *TranscriptWriter {
+	return &TranscriptWriter{
+		w:      w,
+		format: format,
+	}
+}
+
+// Write converts one msgpack-encoded recording message
+func (t *TranscriptWriter) Write(d []byte) (int, error) {
+	var msg ws.ProtoMsg
+	if err := msgpack.Unmarshal(d, &msg); err != nil {
+		return 0, err
+	}
+	if msg.Header.Proto != ws.ProtoTypeShell {
+		return len(d), nil
+	}
+
+	switch msg.Header.MsgType {
+	case shell.MessageTypeShellCommand:
+		if err := t.terminal.write(msg.Body, t.writeLine); err != nil {
+			return 0, err
+		}
+	case model.InputMessageName:
+		if err := t.writeInput(&msg); err != nil {
+			return 0, err
+		}
+	case model.DelayMessageName:
+		delay, _ := model.PropertyUint16(msg.Header.Properties,
+			model.DelayMessageValueField)
+		t.elapsedMs += uint64(delay)
+		t.checkpoints = append(t.checkpoints, transcriptCheckpoint{
+			offset:    t.terminal.offset,
+			elapsedMs: t.elapsedMs,
+		})
+	}
+	return len(d), nil
+}
+
+// Close flushes the line being output; it does not close the underlying
+// writer.
+func (t *TranscriptWriter) Close() error {
+	return t.terminal.flush(t.writeLine)
+}
+
+// Lines returns the number of lines written so far
+func (t *TranscriptWriter) Lines() int {
+	return t.lines
+}
+
+// Empty returns true if the transcript has no lines
+func (t *TranscriptWriter) Empty() bool {
+	return t.lines == 0
+}
+
+func (t *TranscriptWriter) writeInput(msg *ws.ProtoMsg) error {
+	if t.format != TranscriptFormatJSONLines {
+		return nil
+	}
+	userID, _ := msg.Header.Properties[model.UserMessageIDField].(string)
+	b, err := json.Marshal(TranscriptInput{
+		Time:   float64(t.elapsedMs) / 1000,
+		UserID: userID,
+		Input:  string(msg.Body),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = t.w.Write(append(b, '\n'))
+	return err
+}
+
+func (t *TranscriptWriter) writeLine(line string, offset int) error {
+	// the lines are completed in order: drop the checkpoints preceding
+	// the start of the line
+	for len(t.checkpoints) > 0 && t.checkpoints[0].offset <= offset {
+		t.lineMs = t.checkpoints[0].elapsedMs
+		t.checkpoints = t.checkpoints[1:]
+	}
+
+	var b []byte
+	if t.format == TranscriptFormatJSONLines {
+		var err error
+		b, err = json.Marshal(TranscriptLine{
+			Time: float64(t.lineMs) / 1000,
+			Line: line,
+		})
+		if err != nil {
+			return err
+		}
+	} else {
+		b = []byte(line)
+	}
+	if _, err := t.w.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	t.lines++
+	return nil
+}
@@ -0,0 +1,171 @@
+// Copyright 2023 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package app
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/mendersoftware/go-lib-micro/ws/shell"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mendersoftware/deviceconnect/model"
+)
+
+func TestTranscriptWriter(t *testing.T) {
+	testCases := []struct {
+		Name string
+
+		Format string
+		Output []string
+		// Delays are the delays, in milliseconds, preceding the outputs,
+		// and Input the recorded input following the delays
+		Delays []uint16
+		Input  []string
+
+		Transcript string
+		Lines      int
+	}{{
+		Name: "empty recording",
+	}, {
+		Name: "colors and terminal modes are stripped",
+
+		Output: []string{
+			"\x1b[?2004h\x1b]0;root@device: ~\a\x1b[01;32mroot@device\x1b[00m:~# ",
+			"ls\r\n\x1b[0m\x1b[01;34mdir\x1b[0m  file\r\n",
+		},
+
+		Transcript: "root@device:~# ls\ndir  file\n",
+		Lines:      2,
+	}, {
+		Name: "backspaces and line editing",
+
+		Output: []string{
+			"$ lss\b \b",
+			"\b\bcat\x1b[K /etc/hostname\r\n",
+			"$ echo world\x1b[5D\x1b[6@hello \x1b[5C\r\n",
+			"$ rm -rf\x1b[3D\x1b[3P\r\n",
+		},
+
+		Transcript: "$ cat /etc/hostname\n$ echo hello world\n$ rm\n",
+		Lines:      3,
+	}, {
+		Name: "carriage returns overwrite the line",
+
+		Output: []string{
+			"progress 10%\rprogress 100%\r\n",
+			"abcdef\rxy\r\n",
+			"a\tb\r\n",
+		},
+
+		Transcript: "progress 100%\nxycdef\na       b\n",
+		Lines:      3,
+	}, {
+		Name: "split escape and UTF-8 sequences",
+
+		Output: []string{
+			"caf\xc3",
+			"\xa9 \x1b[",
+			"31mrouge\x1b",
+			"[0m\x1bPq#0\x1b\\ok\x1b(Bend",
+		},
+
+		Transcript: "café rougeokend\n",
+		Lines:      1,
+	}, {
+		Name:   "JSON lines with timestamps",
+		Format: TranscriptFormatJSONLines,
+
+		Output: []string{
+			"$ ",
+			"ls\r\n",
+			"file\r\n",
+			"$ ",
+		},
+		Delays: []uint16{0, 1500, 250, 3000},
+
+		Transcript: `{"time":0,"line":"$ ls"}` + "\n" +
+			`{"time":1.75,"line":"file"}` + "\n" +
+			`{"time":4.75,"line":"$"}` + "\n",
+		Lines: 3,
+	}, {
+		Name:   "JSON lines with the recorded input",
+		Format: TranscriptFormatJSONLines,
+
+		Output: []string{
+			"$ ",
+			"\r\nPassword: ",
+			"\r\nok\r\n",
+		},
+		Delays: []uint16{0, 2000, 1000},
+		Input:  []string{"", "sudo -s\r", "secret\r"},
+
+		Transcript: `{"time":2,"user_id":"user","input":"sudo -s\r"}` + "\n" +
+			`{"time":0,"line":"$"}` + "\n" +
+			`{"time":3,"user_id":"user","input":"secret\r"}` + "\n" +
+			`{"time":2,"line":"Password:"}` + "\n" +
+			`{"time":3,"line":"ok"}` + "\n",
+		Lines: 3,
+	}, {
+		Name: "text without the recorded input",
+
+		Output: []string{"$ ", "\r\nPassword: ", "\r\nok\r\n"},
+		Input:  []string{"", "sudo -s\r", "secret\r"},
+
+		Transcript: "$\nPassword:\nok\n",
+		Lines:      3,
+	}}
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			var buf bytes.Buffer
+			format := tc.Format
+			if format == "" {
+				format = TranscriptFormatText
+			}
+			w := NewTranscriptWriter(&buf, format)
+			for i, output := range tc.Output {
+				if i < len(tc.Delays) && tc.Delays[i] > 0 {
+					_, err := w.Write(packRecordingMessage(t,
+						model.DelayMessageName,
+						map[string]interface{}{
+							model.DelayMessageValueField: tc.Delays[i],
+						}, nil))
+					assert.NoError(t, err)
+				}
+				if i < len(tc.Input) && tc.Input[i] != "" {
+					_, err := w.Write(packRecordingMessage(t,
+						model.InputMessageName,
+						map[string]interface{}{
+							model.UserMessageIDField: "user",
+						}, []byte(tc.Input[i])))
+					assert.NoError(t, err)
+				}
+				data := packRecordingMessage(t, shell.MessageTypeShellCommand,
+					nil, []byte(output))
+				n, err := w.Write(data)
+				assert.NoError(t, err)
+				assert.Equal(t, len(data), n)
+			}
+			assert.NoError(t, w.Close())
+			assert.Equal(t, tc.Transcript, buf.String())
+			assert.Equal(t, tc.Lines, w.Lines())
+			assert.Equal(t, tc.Lines == 0, w.Empty())
+		})
+	}
+
+	w := NewTranscriptWriter(&bytes.Buffer{}, TranscriptFormatText)
+	_, err := w.Write([]byte("not msgpack"))
+	assert.Error(t, err)
+}
@@ -36,6 +36,12 @@ const (
 	ActionPortForwardClose Action = "close_portforward"
 	ActionDownloadFile     Action = "download_file"
 	ActionUploadFile       Action = "upload_file"
+	ActionSessionTerminate Action = "terminate_session"
+	ActionObserverJoin     Action = "join_terminal_observer"
+	ActionObserverLeave    Action = "leave_terminal_observer"
+	ActionRecordingDelete  Action = "delete_recording"
+	ActionRecordingHold    Action = "hold_recording"
+	ActionRecordingRelease Action = "release_recording"
 )
 
 type ActorType string
@@ -75,7 +81,10 @@ func (a Actor) Validate() error {
 
 type ObjectType string
 
-const ObjectDevice ObjectType = "device"
+const (
+	ObjectDevice ObjectType = "device"
+	ObjectUser   ObjectType = "user"
+)
 
 type Object struct {
 	ID   string     `json:"id"`
@@ -87,7 +96,7 @@ func (o Object) Validate() error {
 		validation.Field(&o.ID, validation.Required),
 		validation.Field(&o.Type,
 			validation.Required,
-			validation.In(ObjectDevice),
+			validation.In(ObjectDevice, ObjectUser),
 		),
 	)
 	return err
@@ -109,6 +118,9 @@ func (l AuditLog) Validate() error {
 			ActionTerminalOpen, ActionTerminalClose,
 			ActionPortForwardOpen, ActionPortForwardClose,
 			ActionDownloadFile, ActionUploadFile,
+			ActionSessionTerminate,
+			ActionObserverJoin, ActionObserverLeave,
+			ActionRecordingDelete, ActionRecordingHold, ActionRecordingRelease,
 		), validation.Required),
 		validation.Field(&l.Object, validation.Required),
 		validation.Field(&l.EventTS, validation.Required),
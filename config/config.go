@@ -90,6 +90,181 @@ const (
 	SettingWSAllowedOrigins        = "ws.allowed_origins"
 	SettingWSAllowedOriginsDefault = ""
 
+	// SettingSessionIdleTimeout is the config key for the number of seconds
+	// without user input nor device output after which a session is closed;
+	// zero disables the idle timeout. Tenants can override it.
+	SettingSessionIdleTimeout        = "session_idle_timeout_seconds"
+	SettingSessionIdleTimeoutDefault = 0
+
+	// SettingSessionIdleWarning is the config key for how many seconds
+	// before the idle timeout the user is warned about the session closing.
+	SettingSessionIdleWarning        = "session_idle_warning_seconds"
+	SettingSessionIdleWarningDefault = 60
+
+	// SettingSessionMaxDuration is the config key for the maximum number of
+	// seconds a session can last; zero disables the limit. Tenants can
+	// override it.
+	SettingSessionMaxDuration        = "session_max_duration_seconds"
+	SettingSessionMaxDurationDefault = 0
+
+	// SettingSessionQuotaTenant, SettingSessionQuotaUser and
+	// SettingSessionQuotaDevice are the config keys for the maximum number of
+	// concurrent sessions of a tenant, of a user and on a device; zero
+	// disables the quota. Tenants can override them.
+	SettingSessionQuotaTenant        = "session_quota.tenant"
+	SettingSessionQuotaTenantDefault = 0
+	SettingSessionQuotaUser          = "session_quota.user"
+	SettingSessionQuotaUserDefault   = 0
+	SettingSessionQuotaDevice        = "session_quota.device"
+	SettingSessionQuotaDeviceDefault = 0
+
+	// SettingSessionLimitRecording, SettingSessionLimitControl and
+	// SettingSessionLimitMessage are the config keys for the maximum number
+	// of bytes of terminal output and of control data recorded for a
+	// session, and for the maximum size of the users' websocket messages.
+	// Tenants can override them.
+	SettingSessionLimitRecording        = "session_limits.recording_bytes"
+	SettingSessionLimitRecordingDefault = 8 * 1024 * 1024
+	SettingSessionLimitControl          = "session_limits.control_bytes"
+	SettingSessionLimitControlDefault   = 8 * 1024 * 1024
+	SettingSessionLimitMessage          = "session_limits.message_bytes"
+	SettingSessionLimitMessageDefault   = 8 * 1024 * 1024
+
+	// SettingSessionLimitInput is the config key for the maximum number of
+	// bytes of terminal input recorded for a session. Tenants can override
+	// it.
+	SettingSessionLimitInput        = "session_limits.input_bytes"
+	SettingSessionLimitInputDefault = 8 * 1024 * 1024
+
+	// SettingSessionLimitAction is the config key for the action taken when
+	// a session reaches the recording limits: "terminate" the session or
+	// "stop_recording" and keep the session alive. Tenants can override it.
+	SettingSessionLimitAction        = "session_limits.action"
+	SettingSessionLimitActionDefault = "terminate"
+
+	// SettingSessionResumeGracePeriod is the config key for the number of
+	// seconds a terminal session is kept alive after the user's connection
+	// drops, for the user to resume it; zero disables resuming the sessions.
+	// Tenants can override it.
+	SettingSessionResumeGracePeriod        = "session_resume_grace_period_seconds"
+	SettingSessionResumeGracePeriodDefault = 0
+
+	// SettingSessionLeaseTTL is the config key for the number of seconds of
+	// the leases the instances hold on the sessions and on the device
+	// connections they serve; zero disables the leases.
+	SettingSessionLeaseTTL        = "session_lease_seconds"
+	SettingSessionLeaseTTLDefault = 60
+
+	// SettingSessionReaperInterval is the config key for the number of
+	// seconds between the runs of the reaper releasing the sessions and
+	// the device connections whose lease expired.
+	SettingSessionReaperInterval        = "session_reaper_interval_seconds"
+	SettingSessionReaperIntervalDefault = 30
+
+	// SettingDeviceViolationPolicy is the config key for the policy applied
+	// to the device messages violating the protocol, e.g. addressing the
+	// sessions of other devices: "drop" the messages or "disconnect" the
+	// device.
+	SettingDeviceViolationPolicy        = "device_protocol_violation_policy"
+	SettingDeviceViolationPolicyDefault = "drop"
+
+	// SettingRecordingSearchIndex is the config key for enabling the
+	// indexing of the text of the session recordings, for searching them.
+	SettingRecordingSearchIndex        = "recording_search_index"
+	SettingRecordingSearchIndexDefault = true
+
+	// SettingRecordInput is the config key for enabling the recording of
+	// the terminal input of the users, alongside the terminal output.
+	// Tenants can override it.
+	SettingRecordInput        = "record_input"
+	SettingRecordInputDefault = false
+
+	// SettingRecordingSigningKey is the config key for the path of the
+	// PEM-encoded private key signing the session recordings.
+	SettingRecordingSigningKey        = "recording_signing_key"
+	SettingRecordingSigningKeyDefault = ""
+
+	// SettingRecordingVerificationKeys is the config key for the list of
+	// paths of the PEM-encoded public keys verifying the session recordings
+	// signed with other keys than the signing key, e.g. the rotated keys.
+	SettingRecordingVerificationKeys        = "recording_verification_keys"
+	SettingRecordingVerificationKeysDefault = ""
+
+	// SettingRecordingMasterKey and SettingRecordingMasterKeyFile are the
+	// config keys for the base64-encoded 256-bit master key wrapping the
+	// data keys which encrypt the session recordings at rest, or the path of
+	// the file holding it; no master key disables the encryption.
+	SettingRecordingMasterKey            = "recording_encryption.master_key"
+	SettingRecordingMasterKeyDefault     = ""
+	SettingRecordingMasterKeyFile        = "recording_encryption.master_key_file"
+	SettingRecordingMasterKeyFileDefault = ""
+
+	// SettingRecordingPreviousMasterKey and
+	// SettingRecordingPreviousMasterKeyFile are the config keys for the
+	// master key being rotated, unwrapping the data keys until they are
+	// re-wrapped with the master key.
+	SettingRecordingPreviousMasterKey            = "recording_encryption.previous_master_key"
+	SettingRecordingPreviousMasterKeyDefault     = ""
+	SettingRecordingPreviousMasterKeyFile        = "recording_encryption.previous_master_key_file"
+	SettingRecordingPreviousMasterKeyFileDefault = ""
+
+	// SettingRecordingStorageBackend is the config key for the storage of
+	// the session recordings: "mongo", "filesystem" or "s3".
+	SettingRecordingStorageBackend        = "recording_storage.backend"
+	SettingRecordingStorageBackendDefault = "mongo"
+
+	// SettingRecordingStoragePath is the config key for the directory of
+	// the session recordings with the filesystem storage.
+	SettingRecordingStoragePath        = "recording_storage.filesystem.path"
+	SettingRecordingStoragePathDefault = "/var/lib/deviceconnect/recordings"
+
+	// SettingRecordingStorageS3Endpoint, SettingRecordingStorageS3Region,
+	// SettingRecordingStorageS3Bucket, SettingRecordingStorageS3AccessKeyID,
+	// SettingRecordingStorageS3SecretAccessKey and
+	// SettingRecordingStorageS3PathStyle are the config keys for the
+	// S3-compatible object storage of the session recordings.
+	SettingRecordingStorageS3Endpoint               = "recording_storage.s3.endpoint"
+	SettingRecordingStorageS3EndpointDefault        = ""
+	SettingRecordingStorageS3Region                 = "recording_storage.s3.region"
+	SettingRecordingStorageS3RegionDefault          = "us-east-1"
+	SettingRecordingStorageS3Bucket                 = "recording_storage.s3.bucket"
+	SettingRecordingStorageS3BucketDefault          = ""
+	SettingRecordingStorageS3AccessKeyID            = "recording_storage.s3.access_key_id"
+	SettingRecordingStorageS3AccessKeyIDDefault     = ""
+	SettingRecordingStorageS3SecretAccessKey        = "recording_storage.s3.secret_access_key"
+	SettingRecordingStorageS3SecretAccessKeyDefault = ""
+	SettingRecordingStorageS3PathStyle              = "recording_storage.s3.path_style"
+	SettingRecordingStorageS3PathStyleDefault       = false
+
+	// SettingRecordingStorageExpiryInterval is the config key for the
+	// number of seconds between the deletions of the expired recordings
+	// from the storages which do not expire them, the filesystem and the
+	// S3 storages; zero disables the deletions.
+	SettingRecordingStorageExpiryInterval        = "recording_storage.expiry_interval_seconds"
+	SettingRecordingStorageExpiryIntervalDefault = 30
+
+	// SettingRecordingWriterQueueSize is the config key for the number of
+	// chunks of the session recordings queued for the asynchronous writer;
+	// zero writes the recordings synchronously.
+	SettingRecordingWriterQueueSize        = "recording_writer.queue_size"
+	SettingRecordingWriterQueueSizeDefault = 1024
+
+	// SettingRecordingWriterBatchSize is the config key for the maximum
+	// number of chunks written at once by the asynchronous writer.
+	SettingRecordingWriterBatchSize        = "recording_writer.batch_size"
+	SettingRecordingWriterBatchSizeDefault = 64
+
+	// SettingRecordingWriterBatchInterval is the config key for the
+	// maximum time the chunks wait in the queue of the writer.
+	SettingRecordingWriterBatchInterval        = "recording_writer.batch_interval"
+	SettingRecordingWriterBatchIntervalDefault = "1s"
+
+	// SettingRecordingWriterFailurePolicy is the config key for the policy
+	// applied to the chunks the writer cannot queue or write: "block",
+	// "drop" or "terminate".
+	SettingRecordingWriterFailurePolicy        = "recording_writer.failure_policy"
+	SettingRecordingWriterFailurePolicyDefault = "block"
+
 	// SettingGracefulShutdownTimeout is the config key for the
 	// graceful shutdown timeout.
 	SettingGracefulShutdownTimeout        = "graceful_shutdown_timeout"
@@ -113,5 +288,50 @@ var (
 		{Key: SettingRecordingExpireSec, Value: SettingRecordingExpireDefault},
 		{Key: SettingWSAllowedOrigins, Value: SettingWSAllowedOriginsDefault},
 		{Key: SettingGracefulShutdownTimeout, Value: SettingGracefulShutdownTimeoutDefault},
+		{Key: SettingSessionIdleTimeout, Value: SettingSessionIdleTimeoutDefault},
+		{Key: SettingSessionIdleWarning, Value: SettingSessionIdleWarningDefault},
+		{Key: SettingSessionMaxDuration, Value: SettingSessionMaxDurationDefault},
+		{Key: SettingSessionQuotaTenant, Value: SettingSessionQuotaTenantDefault},
+		{Key: SettingSessionQuotaUser, Value: SettingSessionQuotaUserDefault},
+		{Key: SettingSessionQuotaDevice, Value: SettingSessionQuotaDeviceDefault},
+		{Key: SettingSessionLimitRecording, Value: SettingSessionLimitRecordingDefault},
+		{Key: SettingSessionLimitControl, Value: SettingSessionLimitControlDefault},
+		{Key: SettingSessionLimitMessage, Value: SettingSessionLimitMessageDefault},
+		{Key: SettingSessionLimitInput, Value: SettingSessionLimitInputDefault},
+		{Key: SettingSessionLimitAction, Value: SettingSessionLimitActionDefault},
+		{Key: SettingSessionResumeGracePeriod, Value: SettingSessionResumeGracePeriodDefault},
+		{Key: SettingSessionLeaseTTL, Value: SettingSessionLeaseTTLDefault},
+		{Key: SettingSessionReaperInterval, Value: SettingSessionReaperIntervalDefault},
+		{Key: SettingDeviceViolationPolicy, Value: SettingDeviceViolationPolicyDefault},
+		{Key: SettingRecordingSearchIndex, Value: SettingRecordingSearchIndexDefault},
+		{Key: SettingRecordInput, Value: SettingRecordInputDefault},
+		{Key: SettingRecordingSigningKey, Value: SettingRecordingSigningKeyDefault},
+		{Key: SettingRecordingVerificationKeys,
+			Value: SettingRecordingVerificationKeysDefault},
+		{Key: SettingRecordingMasterKey, Value: SettingRecordingMasterKeyDefault},
+		{Key: SettingRecordingMasterKeyFile, Value: SettingRecordingMasterKeyFileDefault},
+		{Key: SettingRecordingPreviousMasterKey,
+			Value: SettingRecordingPreviousMasterKeyDefault},
+		{Key: SettingRecordingPreviousMasterKeyFile,
+			Value: SettingRecordingPreviousMasterKeyFileDefault},
+		{Key: SettingRecordingStorageBackend, Value: SettingRecordingStorageBackendDefault},
+		{Key: SettingRecordingStoragePath, Value: SettingRecordingStoragePathDefault},
+		{Key: SettingRecordingStorageS3Endpoint, Value: SettingRecordingStorageS3EndpointDefault},
+		{Key: SettingRecordingStorageS3Region, Value: SettingRecordingStorageS3RegionDefault},
+		{Key: SettingRecordingStorageS3Bucket, Value: SettingRecordingStorageS3BucketDefault},
+		{Key: SettingRecordingStorageS3AccessKeyID,
+			Value: SettingRecordingStorageS3AccessKeyIDDefault},
+		{Key: SettingRecordingStorageS3SecretAccessKey,
+			Value: SettingRecordingStorageS3SecretAccessKeyDefault},
+		{Key: SettingRecordingStorageS3PathStyle,
+			Value: SettingRecordingStorageS3PathStyleDefault},
+		{Key: SettingRecordingStorageExpiryInterval,
+			Value: SettingRecordingStorageExpiryIntervalDefault},
+		{Key: SettingRecordingWriterQueueSize, Value: SettingRecordingWriterQueueSizeDefault},
+		{Key: SettingRecordingWriterBatchSize, Value: SettingRecordingWriterBatchSizeDefault},
+		{Key: SettingRecordingWriterBatchInterval,
+			Value: SettingRecordingWriterBatchIntervalDefault},
+		{Key: SettingRecordingWriterFailurePolicy,
+			Value: SettingRecordingWriterFailurePolicyDefault},
 	}
 )
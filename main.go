@@ -15,14 +15,19 @@
 package main
 
 import (
+	"context"
+	"crypto"
+	"encoding/json"
 	"fmt"
 	"log"
 	"os"
 	"strings"
 
 	"github.com/mendersoftware/go-lib-micro/config"
+	"github.com/mendersoftware/go-lib-micro/identity"
 	"github.com/urfave/cli"
 
+	"github.com/mendersoftware/deviceconnect/app"
 	dconfig "github.com/mendersoftware/deviceconnect/config"
 	"github.com/mendersoftware/deviceconnect/server"
 	store "github.com/mendersoftware/deviceconnect/store/mongo"
@@ -62,6 +67,30 @@ func doMain(args []string) {
 				Usage:  "Run the migrations",
 				Action: cmdMigrate,
 			},
+			{
+				Name: "verify-recording",
+				Usage: "Verify the integrity of a session recording, " +
+					"exiting with a non-zero status if it is not valid",
+				Action: cmdVerifyRecording,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "session-id",
+						Usage:    "ID of the session to verify.",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:  "tenant-id",
+						Usage: "ID of the tenant of the session.",
+					},
+				},
+			},
+			{
+				Name: "rotate-recording-keys",
+				Usage: "Re-wrap the data keys encrypting the session " +
+					"recordings with the master key, after setting the " +
+					"master key being rotated as the previous master key",
+				Action: cmdRotateRecordingKeys,
+			},
 		},
 	}
 	app.Usage = "Device Connect"
@@ -106,3 +135,65 @@ func cmdMigrate(args *cli.Context) error {
 	}
 	return nil
 }
+
+func cmdVerifyRecording(args *cli.Context) error {
+	dataStore, err := store.SetupDataStore(false)
+	if err != nil {
+		return err
+	}
+	defer dataStore.Close()
+
+	var recordingSigner crypto.Signer
+	keyPath := config.Config.GetString(dconfig.SettingRecordingSigningKey)
+	if keyPath != "" {
+		recordingSigner, err = app.LoadRecordingSigningKey(keyPath)
+		if err != nil {
+			return err
+		}
+	}
+	recordingVerificationKeys, err := app.LoadRecordingVerificationKeys(
+		config.Config.GetStringSlice(dconfig.SettingRecordingVerificationKeys))
+	if err != nil {
+		return err
+	}
+	deviceConnectApp := app.New(dataStore, nil, nil, app.Config{
+		RecordingSigner:           recordingSigner,
+		RecordingVerificationKeys: recordingVerificationKeys,
+	})
+
+	ctx := context.Background()
+	if tenantID := args.String("tenant-id"); tenantID != "" {
+		ctx = identity.WithContext(ctx, &identity.Identity{
+			Tenant: tenantID,
+		})
+	}
+	verification, err := deviceConnectApp.VerifySessionRecording(ctx,
+		args.String("session-id"))
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(verification); err != nil {
+		return err
+	}
+	if !verification.Valid {
+		return cli.NewExitError("the session recording is not valid", 2)
+	}
+	return nil
+}
+
+func cmdRotateRecordingKeys(args *cli.Context) error {
+	dataStore, err := store.SetupDataStore(false)
+	if err != nil {
+		return err
+	}
+	defer dataStore.Close()
+
+	rotated, err := dataStore.RotateRecordingKeys(context.Background())
+	if err != nil {
+		return err
+	}
+	fmt.Printf("rotated %d recording data keys\n", rotated)
+	return nil
+}
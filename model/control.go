@@ -24,6 +24,22 @@ type ControlData struct {
 	ID        uuid.UUID `json:"-" bson:"_id"`
 	SessionID string    `json:"session_id" bson:"session_id"`
 	Control   []byte    `json:"control" bson:"control"`
+	ChunkLink `bson:",inline"`
+	// KeyID is the ID of the data key encrypting the chunk, if encrypted
+	KeyID     string    `json:"-" bson:"key_id,omitempty"`
 	CreatedTs time.Time `json:"created_ts" bson:"created_ts"`
-	ExpireTs  time.Time `json:"expire_ts" bson:"expire_ts"`
+	ExpireTs  time.Time `json:"expire_ts" bson:"expire_ts,omitempty"`
+}
+
+// InputData holds a chunk of the input recording of a session, the terminal
+// input of the users, recorded alongside the terminal output.
+type InputData struct {
+	ID        uuid.UUID `json:"-" bson:"_id"`
+	SessionID string    `json:"session_id" bson:"session_id"`
+	Input     []byte    `json:"input" bson:"input"`
+	ChunkLink `bson:",inline"`
+	// KeyID is the ID of the data key encrypting the chunk, if encrypted
+	KeyID     string    `json:"-" bson:"key_id,omitempty"`
+	CreatedTs time.Time `json:"created_ts" bson:"created_ts"`
+	ExpireTs  time.Time `json:"expire_ts" bson:"expire_ts,omitempty"`
 }
@@ -29,4 +29,7 @@ type Device struct {
 	Status    string    `json:"status" bson:"status"`
 	CreatedTs time.Time `json:"created_ts" bson:"created_ts,omitempty"`
 	UpdatedTs time.Time `json:"updated_ts" bson:"updated_ts,omitempty"`
+	// LeaseExpireTs is the expiration time of the lease of the instance
+	// holding the device connection
+	LeaseExpireTs time.Time `json:"-" bson:"lease_expire_ts,omitempty"`
 }
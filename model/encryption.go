@@ -0,0 +1,28 @@
+// Copyright 2023 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package model
+
+import "time"
+
+// RecordingKey is the data key encrypting the session recordings of a
+// tenant, stored wrapped (encrypted) by the master key
+type RecordingKey struct {
+	ID         string `json:"id" bson:"_id"`
+	WrappedKey []byte `json:"-" bson:"wrapped_key"`
+	// MasterKeyID identifies the master key wrapping the data key
+	MasterKeyID string    `json:"master_key_id" bson:"master_key_id"`
+	CreatedTs   time.Time `json:"created_ts" bson:"created_ts"`
+	UpdatedTs   time.Time `json:"updated_ts" bson:"updated_ts"`
+}
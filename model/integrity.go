@@ -0,0 +1,162 @@
+// Copyright 2023 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package model
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"time"
+)
+
+// The streams of a session recording, each stored in its own collection
+// and hash-chained separately
+const (
+	RecordingStreamOutput  = "output"
+	RecordingStreamControl = "control"
+	RecordingStreamInput   = "input"
+)
+
+// RecordingStreams are the streams of a session recording, in the order
+// they are digested
+var RecordingStreams = []string{
+	RecordingStreamOutput,
+	RecordingStreamControl,
+	RecordingStreamInput,
+}
+
+// The statuses of the signature of a session recording
+const (
+	RecordingSignatureValid   = "valid"
+	RecordingSignatureInvalid = "invalid"
+	RecordingSignatureMissing = "missing"
+	// RecordingSignatureUnverified is the status of the recordings signed
+	// with another key than the signing and verification keys configured
+	RecordingSignatureUnverified = "unverified"
+)
+
+// ChunkLink chains a chunk of a recording stream to the previous chunks:
+// Sequence is the position of the chunk in the stream, starting at 1, and
+// Hash the hash of the previous chunk's hash, the session ID and the chunk.
+// The chunks recorded without a chain have a zero ChunkLink.
+// Format is the compression format of the chunk and, for the fragments of
+// the continuous compressed streams, Offset is the position of the chunk
+// in its compressed stream.
+type ChunkLink struct {
+	Sequence int    `json:"-" bson:"seq,omitempty"`
+	Hash     []byte `json:"-" bson:"hash,omitempty"`
+	Format   string `json:"-" bson:"format,omitempty"`
+	Offset   int64  `json:"-" bson:"offset,omitempty"`
+}
+
+// RecordingChain computes the links of the chunks of a recording stream
+type RecordingChain struct {
+	sessionID string
+	head      ChunkLink
+}
+
+// NewRecordingChain returns the chain of a recording stream of the session
+func NewRecordingChain(sessionID string) *RecordingChain {
+	return &RecordingChain{sessionID: sessionID}
+}
+
+// Next returns the link of the chunk following the head of the chain; the
+// chain advances only once the chunk is stored, with Advance.
+func (c *RecordingChain) Next(chunk []byte) ChunkLink {
+	h := sha256.New()
+	_, _ = h.Write(c.head.Hash)
+	_, _ = h.Write([]byte(c.sessionID))
+	_, _ = h.Write(chunk)
+	return ChunkLink{
+		Sequence: c.head.Sequence + 1,
+		Hash:     h.Sum(nil),
+	}
+}
+
+// Advance moves the head of the chain to the link
+func (c *RecordingChain) Advance(link ChunkLink) {
+	c.head = link
+}
+
+// Head returns the link of the last chunk of the chain
+func (c *RecordingChain) Head() ChunkLink {
+	return c.head
+}
+
+// RecordingChunk is a chunk of a recording stream, as stored
+type RecordingChunk struct {
+	ChunkLink
+	Data []byte
+}
+
+// RecordingStreamHead is the head of the chain of a recording stream
+type RecordingStreamHead struct {
+	Stream string `json:"stream" bson:"stream"`
+	Chunks int    `json:"chunks" bson:"chunks"`
+	Hash   []byte `json:"hash" bson:"hash"`
+}
+
+// RecordingDigest returns the digest of the session recording, the hash of
+// the session ID and of the heads of the chains of its streams
+func RecordingDigest(sessionID string, heads []RecordingStreamHead) []byte {
+	h := sha256.New()
+	_, _ = h.Write([]byte(sessionID))
+	for _, head := range heads {
+		var chunks [8]byte
+		binary.BigEndian.PutUint64(chunks[:], uint64(head.Chunks))
+		_, _ = h.Write([]byte(head.Stream))
+		_, _ = h.Write(chunks[:])
+		_, _ = h.Write(head.Hash)
+	}
+	return h.Sum(nil)
+}
+
+// RecordingSignature is the signature of the digest of a session recording,
+// made at the end of the session
+type RecordingSignature struct {
+	SessionID string `json:"session_id" bson:"_id"`
+	// KeyID identifies the signing key, as the SHA-256 hash of its public
+	// key in PKIX form
+	KeyID     string                `json:"key_id" bson:"key_id"`
+	Digest    []byte                `json:"digest" bson:"digest"`
+	Signature []byte                `json:"signature" bson:"signature"`
+	Streams   []RecordingStreamHead `json:"streams" bson:"streams"`
+	CreatedTs time.Time             `json:"created_ts" bson:"created_ts"`
+	ExpireTs  time.Time             `json:"expire_ts" bson:"expire_ts,omitempty"`
+}
+
+// RecordingVerification is the result of verifying the integrity of a
+// session recording
+type RecordingVerification struct {
+	SessionID string `json:"session_id"`
+	// Valid is true if the chains of the streams are intact and the
+	// signature of the recording is valid
+	Valid bool `json:"valid"`
+	// Digest is the hex-encoded digest of the recording as stored
+	Digest    string                        `json:"digest"`
+	Signature string                        `json:"signature"`
+	KeyID     string                        `json:"key_id,omitempty"`
+	SignedAt  *time.Time                    `json:"signed_at,omitempty"`
+	Streams   []RecordingStreamVerification `json:"streams"`
+}
+
+// RecordingStreamVerification is the result of verifying the chain of a
+// recording stream
+type RecordingStreamVerification struct {
+	Stream string `json:"stream"`
+	Chunks int    `json:"chunks"`
+	// Hash is the hex-encoded hash of the last chunk of the stream
+	Hash  string `json:"hash,omitempty"`
+	Error string `json:"error,omitempty"`
+}
@@ -0,0 +1,73 @@
+// Copyright 2023 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package model
+
+import (
+	"crypto/sha256"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecordingChain(t *testing.T) {
+	const sessionID = "00000000-0000-0000-0000-000000000001"
+	chain := NewRecordingChain(sessionID)
+	assert.Equal(t, ChunkLink{}, chain.Head())
+
+	first := chain.Next([]byte("one"))
+	assert.Equal(t, 1, first.Sequence)
+	assert.Len(t, first.Hash, sha256.Size)
+	// the chain advances once the chunk is stored
+	assert.Equal(t, first, chain.Next([]byte("one")))
+	assert.NotEqual(t, first.Hash, chain.Next([]byte("two")).Hash)
+	chain.Advance(first)
+	assert.Equal(t, first, chain.Head())
+
+	second := chain.Next([]byte("two"))
+	assert.Equal(t, 2, second.Sequence)
+	chain.Advance(second)
+
+	// the links depend on the session and on the previous chunks
+	other := NewRecordingChain("00000000-0000-0000-0000-000000000002")
+	assert.NotEqual(t, first.Hash, other.Next([]byte("one")).Hash)
+	reordered := NewRecordingChain(sessionID)
+	reordered.Advance(reordered.Next([]byte("two")))
+	assert.NotEqual(t, second.Hash, reordered.Next([]byte("one")).Hash)
+}
+
+func TestRecordingDigest(t *testing.T) {
+	const sessionID = "00000000-0000-0000-0000-000000000001"
+	heads := []RecordingStreamHead{{
+		Stream: RecordingStreamOutput,
+		Chunks: 2,
+		Hash:   []byte("output"),
+	}, {
+		Stream: RecordingStreamControl,
+	}}
+	digest := RecordingDigest(sessionID, heads)
+	assert.Len(t, digest, sha256.Size)
+	assert.Equal(t, digest, RecordingDigest(sessionID, heads))
+
+	truncated := []RecordingStreamHead{{
+		Stream: RecordingStreamOutput,
+		Chunks: 1,
+		Hash:   []byte("output"),
+	}, {
+		Stream: RecordingStreamControl,
+	}}
+	assert.NotEqual(t, digest, RecordingDigest(sessionID, truncated))
+	assert.NotEqual(t, digest,
+		RecordingDigest("00000000-0000-0000-0000-000000000002", heads))
+}
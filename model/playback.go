@@ -0,0 +1,94 @@
+// Copyright 2023 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package model
+
+import (
+	"github.com/mendersoftware/go-lib-micro/ws"
+	"github.com/pkg/errors"
+)
+
+// The playback control messages are sent by the client on the playback
+// websocket, as control protocol messages
+const (
+	PlaybackMessagePause  = "pause"
+	PlaybackMessageResume = "resume"
+	// PlaybackMessageSeek moves the playback to the offset of the terminal
+	// output, e.g. of a search match, or to the number of milliseconds
+	// elapsed since the start of the session
+	PlaybackMessageSeek = "seek"
+	// PlaybackMessageSpeed sets the speed multiplier of the playback
+	PlaybackMessageSpeed = "speed"
+
+	PlaybackSeekOffsetField = "offset"
+	PlaybackSeekTimeField   = "time_ms"
+	PlaybackSpeedField      = "speed"
+
+	PlaybackSpeedMin = 0.25
+	PlaybackSpeedMax = 16
+)
+
+var (
+	ErrPlaybackControlType   = errors.New("unknown playback control message")
+	ErrPlaybackSeekPosition  = errors.New("seek requires either the offset or the time")
+	ErrPlaybackSpeedOutRange = errors.New("speed out of range")
+)
+
+// PlaybackControl is a playback control message sent by the client
+type PlaybackControl struct {
+	Type string
+	// Offset and TimeMs are the seek position, only one is set (>= 0)
+	Offset int64
+	TimeMs int64
+	Speed  float64
+}
+
+// ParsePlaybackControl parses and validates a playback control message
+func ParsePlaybackControl(msg *ws.ProtoMsg) (*PlaybackControl, error) {
+	if msg.Header.Proto != ws.ProtoTypeControl {
+		return nil, ErrPlaybackControlType
+	}
+	props := msg.Header.Properties
+	ctl := &PlaybackControl{
+		Type:   msg.Header.MsgType,
+		Offset: -1,
+		TimeMs: -1,
+	}
+	switch ctl.Type {
+	case PlaybackMessagePause, PlaybackMessageResume:
+	case PlaybackMessageSeek:
+		offset, okOffset := PropertyInt64(props, PlaybackSeekOffsetField)
+		timeMs, okTime := PropertyInt64(props, PlaybackSeekTimeField)
+		if okOffset == okTime {
+			return nil, ErrPlaybackSeekPosition
+		} else if okOffset && offset >= 0 {
+			ctl.Offset = offset
+		} else if okTime && timeMs >= 0 {
+			ctl.TimeMs = timeMs
+		} else {
+			return nil, ErrPlaybackSeekPosition
+		}
+	case PlaybackMessageSpeed:
+		speed, ok := PropertyFloat64(props, PlaybackSpeedField)
+		if !ok || speed < PlaybackSpeedMin || speed > PlaybackSpeedMax {
+			return nil, errors.Wrapf(ErrPlaybackSpeedOutRange,
+				"the speed must be between %g and %g",
+				float64(PlaybackSpeedMin), float64(PlaybackSpeedMax))
+		}
+		ctl.Speed = speed
+	default:
+		return nil, errors.Wrapf(ErrPlaybackControlType, "%q", ctl.Type)
+	}
+	return ctl, nil
+}
@@ -0,0 +1,123 @@
+// Copyright 2023 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package model
+
+import (
+	"testing"
+
+	"github.com/mendersoftware/go-lib-micro/ws"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePlaybackControl(t *testing.T) {
+	testCases := []struct {
+		Name       string
+		Proto      ws.ProtoType
+		MsgType    string
+		Properties map[string]interface{}
+
+		Control *PlaybackControl
+		Error   error
+	}{{
+		Name:    "pause",
+		MsgType: PlaybackMessagePause,
+
+		Control: &PlaybackControl{Type: PlaybackMessagePause, Offset: -1, TimeMs: -1},
+	}, {
+		Name:       "seek to offset",
+		MsgType:    PlaybackMessageSeek,
+		Properties: map[string]interface{}{PlaybackSeekOffsetField: uint32(1024)},
+
+		Control: &PlaybackControl{Type: PlaybackMessageSeek, Offset: 1024, TimeMs: -1},
+	}, {
+		Name:       "seek to time",
+		MsgType:    PlaybackMessageSeek,
+		Properties: map[string]interface{}{PlaybackSeekTimeField: int64(90000)},
+
+		Control: &PlaybackControl{Type: PlaybackMessageSeek, Offset: -1, TimeMs: 90000},
+	}, {
+		Name:    "error, seek without position",
+		MsgType: PlaybackMessageSeek,
+
+		Error: ErrPlaybackSeekPosition,
+	}, {
+		Name:    "error, seek to both offset and time",
+		MsgType: PlaybackMessageSeek,
+		Properties: map[string]interface{}{
+			PlaybackSeekOffsetField: 10,
+			PlaybackSeekTimeField:   10,
+		},
+
+		Error: ErrPlaybackSeekPosition,
+	}, {
+		Name:       "error, seek to negative offset",
+		MsgType:    PlaybackMessageSeek,
+		Properties: map[string]interface{}{PlaybackSeekOffsetField: -1},
+
+		Error: ErrPlaybackSeekPosition,
+	}, {
+		Name:       "speed",
+		MsgType:    PlaybackMessageSpeed,
+		Properties: map[string]interface{}{PlaybackSpeedField: float32(2.5)},
+
+		Control: &PlaybackControl{Type: PlaybackMessageSpeed, Offset: -1, TimeMs: -1,
+			Speed: 2.5},
+	}, {
+		Name:       "speed, integer",
+		MsgType:    PlaybackMessageSpeed,
+		Properties: map[string]interface{}{PlaybackSpeedField: uint8(4)},
+
+		Control: &PlaybackControl{Type: PlaybackMessageSpeed, Offset: -1, TimeMs: -1,
+			Speed: 4},
+	}, {
+		Name:       "error, speed out of range",
+		MsgType:    PlaybackMessageSpeed,
+		Properties: map[string]interface{}{PlaybackSpeedField: 100.0},
+
+		Error: ErrPlaybackSpeedOutRange,
+	}, {
+		Name:    "error, unknown message",
+		MsgType: "rewind",
+
+		Error: ErrPlaybackControlType,
+	}, {
+		Name:    "error, not a control message",
+		Proto:   ws.ProtoTypeShell,
+		MsgType: PlaybackMessagePause,
+
+		Error: ErrPlaybackControlType,
+	}}
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			proto := tc.Proto
+			if proto == 0 {
+				proto = ws.ProtoTypeControl
+			}
+			ctl, err := ParsePlaybackControl(&ws.ProtoMsg{
+				Header: ws.ProtoHdr{
+					Proto:      proto,
+					MsgType:    tc.MsgType,
+					Properties: tc.Properties,
+				},
+			})
+			if tc.Error != nil {
+				assert.ErrorIs(t, err, tc.Error)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, tc.Control, ctl)
+			}
+		})
+	}
+}
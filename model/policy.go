@@ -0,0 +1,126 @@
+// Copyright 2023 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package model
+
+import (
+	"time"
+
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+)
+
+// Actions taken when a session reaches a byte limit
+const (
+	// SessionLimitActionTerminate terminates the session
+	SessionLimitActionTerminate = "terminate"
+	// SessionLimitActionStopRecording keeps the session alive and
+	// stops recording it
+	SessionLimitActionStopRecording = "stop_recording"
+)
+
+// TenantPolicy holds the per-tenant overrides of the session policies
+// configured globally; unset attributes fall back to the global settings.
+//
+//nolint:lll
+type TenantPolicy struct {
+	// IdleTimeout is the number of seconds without user input nor device
+	// output after which a session is closed; zero disables the timeout.
+	IdleTimeout *int `json:"idle_timeout_seconds,omitempty" bson:"idle_timeout_seconds,omitempty"`
+	// MaxDuration is the maximum number of seconds a session can last;
+	// zero disables the limit.
+	MaxDuration *int `json:"max_duration_seconds,omitempty" bson:"max_duration_seconds,omitempty"`
+	// MaxTenantSessions, MaxUserSessions and MaxDeviceSessions are the
+	// maximum numbers of concurrent sessions of the tenant, of each user
+	// and on each device; zero disables the quota.
+	MaxTenantSessions *int `json:"max_tenant_sessions,omitempty" bson:"max_tenant_sessions,omitempty"`
+	MaxUserSessions   *int `json:"max_user_sessions,omitempty" bson:"max_user_sessions,omitempty"`
+	MaxDeviceSessions *int `json:"max_device_sessions,omitempty" bson:"max_device_sessions,omitempty"`
+	// MaxRecordingBytes and MaxControlBytes are the maximum numbers of bytes
+	// of terminal output and of control data recorded for a session, not
+	// counting the output timestamps, and LimitAction is the action taken
+	// when a session reaches them.
+	MaxRecordingBytes *int    `json:"max_recording_bytes,omitempty" bson:"max_recording_bytes,omitempty"`
+	MaxControlBytes   *int    `json:"max_control_bytes,omitempty" bson:"max_control_bytes,omitempty"`
+	LimitAction       *string `json:"limit_action,omitempty" bson:"limit_action,omitempty"`
+	// MaxMessageBytes is the maximum size of the websocket messages
+	// sent by the users.
+	MaxMessageBytes *int `json:"max_message_bytes,omitempty" bson:"max_message_bytes,omitempty"`
+	// ResumeGracePeriod is the number of seconds a terminal session is kept
+	// alive after the user's connection drops, for the user to resume it;
+	// zero disables resuming the sessions.
+	ResumeGracePeriod *int `json:"resume_grace_period_seconds,omitempty" bson:"resume_grace_period_seconds,omitempty"`
+	// RecordInput enables recording the terminal input of the users, and
+	// MaxInputBytes is the maximum number of bytes of input recorded for
+	// a session.
+	RecordInput   *bool `json:"record_input,omitempty" bson:"record_input,omitempty"`
+	MaxInputBytes *int  `json:"max_input_bytes,omitempty" bson:"max_input_bytes,omitempty"`
+	// RecordingRetention is the number of seconds the session recordings
+	// are kept; changing it updates the expiry of the recordings stored.
+	RecordingRetention *int `json:"recording_retention_seconds,omitempty" bson:"recording_retention_seconds,omitempty"`
+	// DisableRecording disables recording the sessions of the tenant.
+	DisableRecording *bool `json:"disable_recording,omitempty" bson:"disable_recording,omitempty"`
+}
+
+// Validate validates the tenant policy
+func (p TenantPolicy) Validate() error {
+	return validation.ValidateStruct(&p,
+		validation.Field(&p.IdleTimeout, validation.Min(0)),
+		validation.Field(&p.MaxDuration, validation.Min(0)),
+		validation.Field(&p.MaxTenantSessions, validation.Min(0)),
+		validation.Field(&p.MaxUserSessions, validation.Min(0)),
+		validation.Field(&p.MaxDeviceSessions, validation.Min(0)),
+		validation.Field(&p.MaxRecordingBytes, validation.Min(1)),
+		validation.Field(&p.MaxControlBytes, validation.Min(1)),
+		validation.Field(&p.MaxMessageBytes, validation.Min(1)),
+		validation.Field(&p.LimitAction, validation.In(
+			SessionLimitActionTerminate,
+			SessionLimitActionStopRecording,
+		)),
+		validation.Field(&p.ResumeGracePeriod, validation.Min(0)),
+		validation.Field(&p.MaxInputBytes, validation.Min(1)),
+		validation.Field(&p.RecordingRetention, validation.Min(1)),
+	)
+}
+
+// SessionPolicy is the effective policy applied to a session, obtained by
+// merging the tenant policy with the global settings.
+type SessionPolicy struct {
+	// IdleTimeout is the maximum period of inactivity of the session
+	IdleTimeout time.Duration
+	// IdleWarning is how long before the idle timeout the user is warned
+	IdleWarning time.Duration
+	// MaxDuration is the maximum duration of the session
+	MaxDuration time.Duration
+	// MaxTenantSessions, MaxUserSessions and MaxDeviceSessions are the
+	// quotas of concurrent sessions enforced when allocating the session
+	MaxTenantSessions int
+	MaxUserSessions   int
+	MaxDeviceSessions int
+	// MaxRecordingBytes, MaxControlBytes and MaxMessageBytes are the byte
+	// limits of the session, zero stands for the service default
+	MaxRecordingBytes int
+	MaxControlBytes   int
+	MaxMessageBytes   int
+	// LimitAction is the action taken when reaching the recording limits
+	LimitAction string
+	// ResumeGracePeriod is how long the session survives the user's
+	// connection dropping, waiting for the user to resume it
+	ResumeGracePeriod time.Duration
+	// RecordInput enables recording the terminal input, up to
+	// MaxInputBytes, zero standing for the service default
+	RecordInput   bool
+	MaxInputBytes int
+	// DisableRecording disables recording the session
+	DisableRecording bool
+}
@@ -15,6 +15,7 @@
 package model
 
 import (
+	"math"
 	"time"
 
 	"github.com/google/uuid"
@@ -26,12 +27,133 @@ const (
 
 	DelayMessageValueField = "delay_value"
 	DelayMessageName       = "delay"
+
+	UserMessageIDField = "user_id"
+	UserMessageName    = "user"
+
+	// InputMessageName is the message of the terminal input typed by the
+	// user in UserMessageIDField, at the Unix time in milliseconds in
+	// InputMessageTimestampField
+	InputMessageName           = "input"
+	InputMessageTimestampField = "timestamp"
+)
+
+// The compression formats of the chunks of the recording streams
+const (
+	// ChunkFormatGzip chunks are complete gzip streams, one per write
+	ChunkFormatGzip = ""
+	// ChunkFormatGzipStream chunks are the consecutive fragments of a
+	// continuous gzip stream, each ending at a flush of the stream so that
+	// the fragments stored so far decompress to all the data recorded so
+	// far; a stream starts at the fragment at offset 0.
+	ChunkFormatGzipStream = "gzip-stream"
 )
 
 type Recording struct {
 	ID        uuid.UUID `json:"-" bson:"_id"`
 	SessionID string    `json:"session_id" bson:"session_id"`
 	Recording []byte    `json:"recording" bson:"recording"`
+	ChunkLink `bson:",inline"`
+	// KeyID is the ID of the data key encrypting the chunk, if encrypted
+	KeyID     string    `json:"-" bson:"key_id,omitempty"`
 	CreatedTs time.Time `json:"created_ts" bson:"created_ts"`
-	ExpireTs  time.Time `json:"expire_ts" bson:"expire_ts"`
+	ExpireTs  time.Time `json:"expire_ts" bson:"expire_ts,omitempty"`
+}
+
+// StoredChunk is a chunk of a recording stream of a session, as stored by
+// the recording storage
+type StoredChunk struct {
+	SessionID string
+	Stream    string
+	ChunkLink
+	// KeyID is the ID of the data key encrypting the chunk, if encrypted
+	KeyID     string
+	Data      []byte
+	CreatedTs time.Time
+	ExpireTs  time.Time
+}
+
+// RecordingWriterStats are the statistics of the asynchronous writer of the
+// session recordings, for monitoring its backpressure
+type RecordingWriterStats struct {
+	// Enabled is false if the recordings are written synchronously
+	Enabled       bool   `json:"enabled"`
+	FailurePolicy string `json:"failure_policy,omitempty"`
+	// QueueLength is the number of chunks waiting in the queue, out of
+	// QueueCapacity
+	QueueLength   int `json:"queue_length"`
+	QueueCapacity int `json:"queue_capacity"`
+	// QueuedChunks, WrittenChunks and DroppedChunks are the number of
+	// chunks queued, written and dropped since the start
+	QueuedChunks  uint64 `json:"queued_chunks"`
+	WrittenChunks uint64 `json:"written_chunks"`
+	DroppedChunks uint64 `json:"dropped_chunks"`
+	// WrittenBatches and FailedBatches are the number of batches written
+	// and of the attempts to write a batch which failed
+	WrittenBatches uint64 `json:"written_batches"`
+	FailedBatches  uint64 `json:"failed_batches"`
+	// QueueFull is the number of chunks recorded while the queue was full,
+	// and BlockedSeconds the time the sessions waited for the queue
+	QueueFull      uint64  `json:"queue_full"`
+	BlockedSeconds float64 `json:"blocked_seconds"`
+}
+
+// PropertyUint16 returns the integer value of a message header property,
+// whichever integer type msgpack decoded it to; ok is false if the property
+// is missing, is not an integer or does not fit in an uint16.
+func PropertyUint16(properties map[string]interface{}, key string) (v uint16, ok bool) {
+	n, ok := PropertyInt64(properties, key)
+	if !ok || n < 0 || n > math.MaxUint16 {
+		return 0, false
+	}
+	return uint16(n), true
+}
+
+// PropertyInt64 returns the integer value of a message header property,
+// whichever integer type msgpack decoded it to; ok is false if the property
+// is missing, is not an integer or does not fit in an int64.
+func PropertyInt64(properties map[string]interface{}, key string) (v int64, ok bool) {
+	switch value := properties[key].(type) {
+	case int8:
+		return int64(value), true
+	case int16:
+		return int64(value), true
+	case int32:
+		return int64(value), true
+	case int64:
+		return value, true
+	case int:
+		return int64(value), true
+	case uint8:
+		return int64(value), true
+	case uint16:
+		return int64(value), true
+	case uint32:
+		return int64(value), true
+	case uint64:
+		if value > math.MaxInt64 {
+			return 0, false
+		}
+		return int64(value), true
+	case uint:
+		if uint64(value) > math.MaxInt64 {
+			return 0, false
+		}
+		return int64(value), true
+	}
+	return 0, false
+}
+
+// PropertyFloat64 returns the numeric value of a message header property,
+// either a float or an integer; ok is false if the property is missing or
+// is not a number.
+func PropertyFloat64(properties map[string]interface{}, key string) (v float64, ok bool) {
+	switch value := properties[key].(type) {
+	case float32:
+		return float64(value), true
+	case float64:
+		return value, true
+	}
+	n, ok := PropertyInt64(properties, key)
+	return float64(n), ok
 }
@@ -0,0 +1,91 @@
+// Copyright 2023 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package model
+
+import (
+	"time"
+
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+)
+
+// LegalHoldReasonMaxLength is the maximum length of the reason of a legal
+// hold
+const LegalHoldReasonMaxLength = 1024
+
+// LegalHold keeps the recording of a session from expiring until the hold
+// is released
+type LegalHold struct {
+	SessionID string `json:"session_id" bson:"_id"`
+	// Reason describes the hold, e.g. the reference of the litigation
+	Reason string `json:"reason,omitempty" bson:"reason,omitempty"`
+	// UserID is the ID of the user who placed the hold
+	UserID    string    `json:"user_id" bson:"user_id"`
+	CreatedTs time.Time `json:"created_ts" bson:"created_ts"`
+}
+
+// LegalHoldRequest is the request body placing a legal hold on a session
+type LegalHoldRequest struct {
+	Reason string `json:"reason"`
+}
+
+// Validate validates the legal hold request
+func (r LegalHoldRequest) Validate() error {
+	return validation.ValidateStruct(&r,
+		validation.Field(&r.Reason, validation.Length(0, LegalHoldReasonMaxLength)),
+	)
+}
+
+// RecordedSession catalogues the user and the device of a recorded session,
+// for deleting the recordings of the users or of the devices; it expires
+// with the recording.
+type RecordedSession struct {
+	SessionID string    `json:"session_id" bson:"_id"`
+	DeviceID  string    `json:"device_id" bson:"device_id"`
+	UserID    string    `json:"user_id" bson:"user_id"`
+	CreatedTs time.Time `json:"created_ts" bson:"created_ts"`
+	ExpireTs  time.Time `json:"-" bson:"expire_ts,omitempty"`
+}
+
+// RecordingFilter selects the session recordings of a user or of a device
+type RecordingFilter struct {
+	DeviceID string `json:"device_id"`
+	UserID   string `json:"user_id"`
+}
+
+// Validate validates the recording filter: the filter selects the
+// recordings of a user or of a device, never all the recordings
+func (f RecordingFilter) Validate() error {
+	return validation.ValidateStruct(&f,
+		validation.Field(&f.DeviceID, validation.Required.When(f.UserID == "").
+			Error("either device_id or user_id is required")),
+	)
+}
+
+// RecordingDeletion is the outcome of deleting session recordings
+type RecordingDeletion struct {
+	// Deleted are the sessions whose recording is deleted
+	Deleted []string `json:"deleted"`
+	// Held are the sessions on legal hold, whose recording is kept
+	Held []string `json:"held,omitempty"`
+	// Active are the sessions still open, whose recording is kept
+	Active []string `json:"active,omitempty"`
+	// Unmatched are the sessions recorded before the recordings were
+	// catalogued, whose user and device are unknown: the filters never
+	// match them, their recordings are deleted by session ID
+	Unmatched []string `json:"unmatched,omitempty"`
+	// Error describes the failure stopping the deletion, the recordings
+	// not listed above being kept
+	Error string `json:"error,omitempty"`
+}
@@ -0,0 +1,86 @@
+// Copyright 2023 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package model
+
+import (
+	"time"
+
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/google/uuid"
+)
+
+const (
+	// SearchQueryMinLength and SearchQueryMaxLength bound the length of
+	// the text searched in the session recordings
+	SearchQueryMinLength = 3
+	SearchQueryMaxLength = 256
+)
+
+// RecordingText holds the lines of the terminal output decoded from a chunk
+// of a session recording, indexed for searching the recordings
+type RecordingText struct {
+	ID        uuid.UUID           `json:"-" bson:"_id"`
+	SessionID string              `json:"session_id" bson:"session_id"`
+	DeviceID  string              `json:"device_id" bson:"device_id"`
+	UserID    string              `json:"user_id" bson:"user_id"`
+	Lines     []RecordingTextLine `json:"lines" bson:"lines"`
+	CreatedTs time.Time           `json:"created_ts" bson:"created_ts"`
+	ExpireTs  time.Time           `json:"expire_ts" bson:"expire_ts,omitempty"`
+}
+
+// RecordingTextLine is a line of the terminal output, with the offset of
+// the line in the session recording
+type RecordingTextLine struct {
+	Offset int    `json:"offset" bson:"offset"`
+	Text   string `json:"text" bson:"text"`
+}
+
+// SearchFilter holds the parameters for searching the session recordings
+type SearchFilter struct {
+	// Query is the text to search, matched case-insensitively
+	Query    string     `json:"q"`
+	DeviceID string     `json:"device_id"`
+	UserID   string     `json:"user_id"`
+	From     *time.Time `json:"from"`
+	To       *time.Time `json:"to"`
+
+	Skip  int64 `json:"-"`
+	Limit int64 `json:"-"`
+}
+
+func (f SearchFilter) Validate() error {
+	return validation.ValidateStruct(&f,
+		validation.Field(&f.Query, validation.Required,
+			validation.RuneLength(SearchQueryMinLength, SearchQueryMaxLength)),
+		validation.Field(&f.Skip, validation.Min(int64(0))),
+		validation.Field(&f.Limit, validation.Min(int64(0))),
+	)
+}
+
+// SearchResult is a session whose recording matches the search
+type SearchResult struct {
+	SessionID string        `json:"session_id" bson:"_id"`
+	DeviceID  string        `json:"device_id" bson:"device_id"`
+	UserID    string        `json:"user_id" bson:"user_id"`
+	Matches   []SearchMatch `json:"matches" bson:"matches"`
+}
+
+// SearchMatch is a line of a session recording matching the search, with
+// its offset in the recording for playing back the session from the match
+type SearchMatch struct {
+	Offset    int       `json:"offset" bson:"offset"`
+	Snippet   string    `json:"snippet" bson:"snippet"`
+	Timestamp time.Time `json:"timestamp" bson:"timestamp"`
+}
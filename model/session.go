@@ -20,6 +20,7 @@ import (
 	"time"
 
 	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/mendersoftware/go-lib-micro/ws"
 )
 
 // Values for the session status attribute
@@ -34,6 +35,33 @@ const (
 	SessionTypePortForward = "portforward"
 )
 
+// Values for the session end reason attribute
+const (
+	SessionEndReasonClosed       = "closed"
+	SessionEndReasonTerminated   = "terminated"
+	SessionEndReasonIdle         = "idle_timeout"
+	SessionEndReasonMaxDuration  = "max_duration"
+	SessionEndReasonByteLimit    = "byte_limit"
+	SessionEndReasonLeaseExpired = "lease_expired"
+	SessionEndReasonDeviceClosed = "device_closed"
+)
+
+// Message types published on the session control subject, besides
+// ws.MessageTypeClose, for granting and revoking write access to
+// the session participants
+const (
+	SessionControlGrantWrite  = "grant_write"
+	SessionControlRevokeWrite = "revoke_write"
+)
+
+// Message types published on the session control subject for resuming the
+// session from a new connection of the session owner, and by the handler
+// relaying the new connection when the connection drops
+const (
+	SessionControlResume = "resume"
+	SessionControlDetach = "detach"
+)
+
 func GetSessionSubject(tenantID, sessionID string) string {
 	if tenantID == "" {
 		return strings.Join([]string{
@@ -47,6 +75,72 @@ func GetSessionSubject(tenantID, sessionID string) string {
 	}, ".")
 }
 
+// GetSessionControlSubject returns the subject used for signaling the
+// server-side handlers of a session, e.g. for terminating the session.
+// The subject uses a dedicated prefix so that devices, which publish on
+// the session subject, are not able to inject control messages.
+func GetSessionControlSubject(tenantID, sessionID string) string {
+	if tenantID == "" {
+		return strings.Join([]string{
+			"session-control", sessionID,
+		}, ".")
+	}
+	return strings.Join([]string{
+		"session-control",
+		tenantID,
+		sessionID,
+	}, ".")
+}
+
+// GetSessionInputSubject returns the subject used by the session
+// participants with write access to send input to the handler serving
+// the session owner, which forwards it to the device.
+func GetSessionInputSubject(tenantID, sessionID string) string {
+	if tenantID == "" {
+		return strings.Join([]string{
+			"session-input", sessionID,
+		}, ".")
+	}
+	return strings.Join([]string{
+		"session-input",
+		tenantID,
+		sessionID,
+	}, ".")
+}
+
+// GetSessionResumeSubject returns the subject used by the handler relaying
+// the connection the session owner resumed the session from to send the
+// owner's messages to the handler serving the session.
+func GetSessionResumeSubject(tenantID, sessionID string) string {
+	if tenantID == "" {
+		return strings.Join([]string{
+			"session-resume", sessionID,
+		}, ".")
+	}
+	return strings.Join([]string{
+		"session-resume",
+		tenantID,
+		sessionID,
+	}, ".")
+}
+
+// GetSessionRelaySubject returns the subject used by the handler serving
+// the session to send the session output to the handler relaying the
+// connection the session owner resumed the session from.
+func GetSessionRelaySubject(tenantID, sessionID, relayID string) string {
+	if tenantID == "" {
+		return strings.Join([]string{
+			"session-relay", sessionID, relayID,
+		}, ".")
+	}
+	return strings.Join([]string{
+		"session-relay",
+		tenantID,
+		sessionID,
+		relayID,
+	}, ".")
+}
+
 func GetDeviceSubject(tenantID, deviceID string) string {
 	if tenantID == "" {
 		return strings.Join([]string{
@@ -63,20 +157,66 @@ func GetDeviceSubject(tenantID, deviceID string) string {
 
 // Session represents a session from a user to a device and its attributes
 type Session struct {
-	ID                 string      `json:"id" bson:"_id"`
-	UserID             string      `json:"user_id" bson:"user_id"`
-	DeviceID           string      `json:"device_id" bson:"device_id"`
-	Types              []string    `json:"-" bson:"-"`
-	StartTS            time.Time   `json:"start_ts" bson:"start_ts"`
-	TenantID           string      `json:"tenant_id" bson:"tenant_id"`
-	BytesRecordedMutex *sync.Mutex `json:"-" bson:"-"`
-	BytesRecorded      int         `json:"bytes_transferred" bson:"bytes_transferred"`
+	ID                 string         `json:"id" bson:"_id"`
+	UserID             string         `json:"user_id" bson:"user_id"`
+	DeviceID           string         `json:"device_id" bson:"device_id"`
+	Types              []string       `json:"types" bson:"types,omitempty"`
+	StartTS            time.Time      `json:"start_ts" bson:"start_ts"`
+	TenantID           string         `json:"tenant_id" bson:"tenant_id"`
+	BytesRecordedMutex *sync.Mutex    `json:"-" bson:"-"`
+	BytesRecorded      int            `json:"bytes_transferred" bson:"bytes_transferred"`
+	Writers            []string       `json:"writers,omitempty" bson:"writers,omitempty"`
+	EndReason          string         `json:"end_reason,omitempty" bson:"end_reason,omitempty"`
+	Policy             *SessionPolicy `json:"-" bson:"-"`
+	ResumeToken        string         `json:"-" bson:"-"`
+	ResumeTokenHash    string         `json:"-" bson:"resume_token_hash,omitempty"`
+	LeaseExpireTs      time.Time      `json:"-" bson:"lease_expire_ts,omitempty"`
 }
 
 func (sess Session) Subject(tenantID string) string {
 	return GetSessionSubject(tenantID, sess.ID)
 }
 
+func (sess Session) ControlSubject(tenantID string) string {
+	return GetSessionControlSubject(tenantID, sess.ID)
+}
+
+func (sess Session) InputSubject(tenantID string) string {
+	return GetSessionInputSubject(tenantID, sess.ID)
+}
+
+func (sess Session) ResumeSubject(tenantID string) string {
+	return GetSessionResumeSubject(tenantID, sess.ID)
+}
+
+func (sess Session) RelaySubject(tenantID, relayID string) string {
+	return GetSessionRelaySubject(tenantID, sess.ID, relayID)
+}
+
+// HasType returns true if the session type is among the session's types
+func (sess Session) HasType(sessionType string) bool {
+	for _, t := range sess.Types {
+		if t == sessionType {
+			return true
+		}
+	}
+	return false
+}
+
+// CanWrite returns true if the user is the session owner or has been
+// granted write access to the session
+func (sess Session) CanWrite(userID string) bool {
+	if userID == sess.UserID {
+		return true
+	}
+	for _, w := range sess.Writers {
+		if w == userID {
+			return true
+		}
+	}
+	return false
+}
+
 func (sess Session) Validate() error {
 	return validation.ValidateStruct(&sess,
 		validation.Field(&sess.ID, validation.Required),
@@ -86,7 +226,36 @@ func (sess Session) Validate() error {
 	)
 }
 
+// SessionFilter holds the parameters for looking up active sessions
+type SessionFilter struct {
+	DeviceID string `json:"device_id"`
+	UserID   string `json:"user_id"`
+	Type     string `json:"type"`
+
+	Skip  int64 `json:"-"`
+	Limit int64 `json:"-"`
+}
+
+func (f SessionFilter) Validate() error {
+	return validation.ValidateStruct(&f,
+		validation.Field(&f.Type, validation.In(
+			SessionTypeTerminal,
+			SessionTypePortForward,
+		)),
+		validation.Field(&f.Skip, validation.Min(int64(0))),
+		validation.Field(&f.Limit, validation.Min(int64(0))),
+	)
+}
+
 // ActiveSession stores the data about an active session in memory
 type ActiveSession struct {
-	RemoteTerminal bool
+	// Protocols holds the protocols the device is using in the session
+	Protocols map[ws.ProtoType]bool
+}
+
+// NewActiveSession returns a new ActiveSession without protocols in use
+func NewActiveSession() *ActiveSession {
+	return &ActiveSession{
+		Protocols: make(map[ws.ProtoType]bool),
+	}
 }
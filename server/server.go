@@ -16,6 +16,7 @@ package server
 
 import (
 	"context"
+	"crypto"
 	"net/http"
 	"os"
 	"os/signal"
@@ -23,6 +24,7 @@ import (
 
 	"github.com/mendersoftware/go-lib-micro/config"
 	"github.com/mendersoftware/go-lib-micro/log"
+	"github.com/pkg/errors"
 	"golang.org/x/sys/unix"
 
 	api "github.com/mendersoftware/deviceconnect/api/http"
@@ -31,6 +33,7 @@ import (
 	"github.com/mendersoftware/deviceconnect/client/nats"
 	"github.com/mendersoftware/deviceconnect/client/workflows"
 	dconfig "github.com/mendersoftware/deviceconnect/config"
+	"github.com/mendersoftware/deviceconnect/model"
 	"github.com/mendersoftware/deviceconnect/store"
 )
 
@@ -59,16 +62,92 @@ func InitAndRun(conf config.Reader, dataStore store.DataStore) error {
 	wflows := workflows.NewClient(
 		config.Config.GetString(dconfig.SettingWorkflowsURL),
 	)
+	var recordingSigner crypto.Signer
+	if keyPath := conf.GetString(dconfig.SettingRecordingSigningKey); keyPath != "" {
+		recordingSigner, err = app.LoadRecordingSigningKey(keyPath)
+		if err != nil {
+			return err
+		}
+	}
+	recordingVerificationKeys, err := app.LoadRecordingVerificationKeys(
+		conf.GetStringSlice(dconfig.SettingRecordingVerificationKeys))
+	if err != nil {
+		return err
+	}
+	recordingSearchIndex := conf.GetBool(dconfig.SettingRecordingSearchIndex)
+	if recordingSearchIndex &&
+		(conf.GetString(dconfig.SettingRecordingMasterKey) != "" ||
+			conf.GetString(dconfig.SettingRecordingMasterKeyFile) != "") {
+		// the search index holds the text of the recordings in clear
+		l.Warn("the recording search index is disabled by the " +
+			"encryption of the recordings")
+		recordingSearchIndex = false
+	}
+	recordingFailurePolicy := conf.GetString(dconfig.SettingRecordingWriterFailurePolicy)
+	switch recordingFailurePolicy {
+	case app.RecordingFailureBlock, app.RecordingFailureDrop,
+		app.RecordingFailureTerminate:
+	default:
+		return errors.Errorf("invalid recording writer failure policy: %q",
+			recordingFailurePolicy)
+	}
+	sessionLimitAction := conf.GetString(dconfig.SettingSessionLimitAction)
+	switch sessionLimitAction {
+	case model.SessionLimitActionTerminate, model.SessionLimitActionStopRecording:
+	default:
+		return errors.Errorf("invalid session limit action: %q",
+			sessionLimitAction)
+	}
 	deviceConnectApp := app.New(
 		dataStore, inventory,
 		wflows, app.Config{
 			HaveAuditLogs: conf.GetBool(dconfig.SettingEnableAuditLogs),
+			SessionIdleTimeout: time.Duration(
+				conf.GetInt(dconfig.SettingSessionIdleTimeout)) * time.Second,
+			SessionIdleWarning: time.Duration(
+				conf.GetInt(dconfig.SettingSessionIdleWarning)) * time.Second,
+			SessionMaxDuration: time.Duration(
+				conf.GetInt(dconfig.SettingSessionMaxDuration)) * time.Second,
+			MaxTenantSessions:  conf.GetInt(dconfig.SettingSessionQuotaTenant),
+			MaxUserSessions:    conf.GetInt(dconfig.SettingSessionQuotaUser),
+			MaxDeviceSessions:  conf.GetInt(dconfig.SettingSessionQuotaDevice),
+			MaxRecordingBytes:  conf.GetInt(dconfig.SettingSessionLimitRecording),
+			MaxControlBytes:    conf.GetInt(dconfig.SettingSessionLimitControl),
+			MaxMessageBytes:    conf.GetInt(dconfig.SettingSessionLimitMessage),
+			MaxInputBytes:      conf.GetInt(dconfig.SettingSessionLimitInput),
+			SessionLimitAction: sessionLimitAction,
+			SessionResumeGracePeriod: time.Duration(
+				conf.GetInt(dconfig.SettingSessionResumeGracePeriod)) * time.Second,
+			SessionLeaseTTL: time.Duration(
+				conf.GetInt(dconfig.SettingSessionLeaseTTL)) * time.Second,
+			SessionReaperInterval: time.Duration(
+				conf.GetInt(dconfig.SettingSessionReaperInterval)) * time.Second,
+			RecordingExpiryInterval: time.Duration(
+				conf.GetInt(dconfig.SettingRecordingStorageExpiryInterval)) * time.Second,
+			RecordingSearchIndex:      recordingSearchIndex,
+			RecordInput:               conf.GetBool(dconfig.SettingRecordInput),
+			RecordingSigner:           recordingSigner,
+			RecordingVerificationKeys: recordingVerificationKeys,
+			RecordingQueueSize: conf.GetInt(
+				dconfig.SettingRecordingWriterQueueSize),
+			RecordingBatchSize: conf.GetInt(
+				dconfig.SettingRecordingWriterBatchSize),
+			RecordingBatchInterval: conf.GetDuration(
+				dconfig.SettingRecordingWriterBatchInterval),
+			RecordingFailurePolicy: recordingFailurePolicy,
 		},
 	)
 
+	ctxLeases, cancelLeases := context.WithCancel(ctx)
+	defer cancelLeases()
+	go deviceConnectApp.KeepLeases(ctxLeases)
+	go deviceConnectApp.ExpireRecordings(ctxLeases)
+
 	gracefulShutdownTimeout := conf.GetDuration(dconfig.SettingGracefulShutdownTimeout)
 	router, err := api.NewRouter(deviceConnectApp, natsClient, &api.RouterConfig{
 		GracefulShutdownTimeout: gracefulShutdownTimeout,
+		DeviceViolationPolicy: conf.GetString(
+			dconfig.SettingDeviceViolationPolicy),
 	})
 	if err != nil {
 		l.Fatal(err)
@@ -111,5 +190,12 @@ func InitAndRun(conf config.Reader, dataStore store.DataStore) error {
 		l.Info("graceful shutdown completed")
 	}
 
+	// the recordings queued are written before exiting
+	ctxRecordings, cancelRecordings := context.WithTimeout(ctx, gracefulShutdownTimeout)
+	defer cancelRecordings()
+	if err := deviceConnectApp.CloseRecordings(ctxRecordings); err != nil {
+		l.Errorf("failed to write the queued session recordings: %s", err.Error())
+	}
+
 	return nil
 }
@@ -18,6 +18,7 @@ import (
 	"context"
 	"errors"
 	"io"
+	"time"
 
 	"github.com/mendersoftware/deviceconnect/model"
 )
@@ -34,13 +35,71 @@ type DataStore interface {
 	UpsertDeviceStatus(ctx context.Context, tenantID, deviceID, status string) error
 	AllocateSession(ctx context.Context, sess *model.Session) error
 	GetSession(ctx context.Context, sessionID string) (*model.Session, error)
+	FindSessions(ctx context.Context, filter model.SessionFilter) ([]model.Session, error)
+	CountSessions(ctx context.Context, filter model.SessionFilter) (int64, error)
+	AddSessionType(ctx context.Context, sessionID, sessionType string) error
+	AddSessionWriter(ctx context.Context, sessionID, userID string) error
+	RemoveSessionWriter(ctx context.Context, sessionID, userID string) error
+	SetSessionEndReason(ctx context.Context, sessionID, reason string) error
 	WriteSessionRecords(ctx context.Context, sessionID string, w io.Writer) error
-	InsertSessionRecording(ctx context.Context, sessionID string, sessionBytes []byte) error
-	InsertControlRecording(ctx context.Context, sessionID string, sessionBytes []byte) error
+	InsertSessionRecording(
+		ctx context.Context,
+		sessionID string,
+		sessionBytes []byte,
+		link model.ChunkLink,
+	) error
+	InsertControlRecording(
+		ctx context.Context,
+		sessionID string,
+		sessionBytes []byte,
+		link model.ChunkLink,
+	) error
+	InsertInputRecording(
+		ctx context.Context,
+		sessionID string,
+		inputBytes []byte,
+		link model.ChunkLink,
+	) error
+	InsertRecordingChunks(ctx context.Context, chunks []model.StoredChunk) error
+	GetRecordingChunks(
+		ctx context.Context,
+		sessionID, stream string,
+	) ([]model.RecordingChunk, error)
+	InsertRecordingSignature(ctx context.Context, signature *model.RecordingSignature) error
+	GetRecordingSignature(ctx context.Context, sessionID string) (*model.RecordingSignature, error)
+	RotateRecordingKeys(ctx context.Context) (int, error)
+	DeleteExpiredRecordings(ctx context.Context, before time.Time) (int, error)
+	UpdateRecordingExpiry(ctx context.Context, sessionID string) error
+	SetLegalHold(ctx context.Context, hold *model.LegalHold) error
+	GetLegalHold(ctx context.Context, sessionID string) (*model.LegalHold, error)
+	DeleteLegalHold(ctx context.Context, sessionID string) error
+	InsertRecordedSession(ctx context.Context, sess *model.RecordedSession) error
+	GetRecordedSession(ctx context.Context, sessionID string) (*model.RecordedSession, error)
+	FindRecordedSessions(
+		ctx context.Context,
+		filter model.RecordingFilter,
+	) ([]model.RecordedSession, error)
+	FindUnattributedRecordedSessions(ctx context.Context) ([]model.RecordedSession, error)
+	HasSessionRecording(ctx context.Context, sessionID string) (bool, error)
+	DeleteSessionRecordings(ctx context.Context, sessionIDs []string) error
+	InsertRecordingText(ctx context.Context, text *model.RecordingText) error
+	SearchRecordings(ctx context.Context, filter model.SearchFilter) ([]model.SearchResult, error)
 	DeleteSession(ctx context.Context, sessionID string) (*model.Session, error)
+	RenewSessionLeases(ctx context.Context, sessionIDs []string, expire time.Time) error
+	RenewDeviceLeases(ctx context.Context, deviceIDs []string, expire time.Time) error
+	DeleteExpiredSession(ctx context.Context, before time.Time) (*model.Session, error)
+	DisconnectExpiredDevices(ctx context.Context, before time.Time) (int64, error)
+	GetTenantPolicy(ctx context.Context, tenantID string) (*model.TenantPolicy, error)
+	SetTenantPolicy(ctx context.Context, tenantID string, policy *model.TenantPolicy) error
 	Close() error
 }
 
 var (
-	ErrSessionNotFound = errors.New("store: session not found")
+	ErrSessionNotFound   = errors.New("store: session not found")
+	ErrRecordingSigned   = errors.New("store: the session recording is already signed")
+	ErrLegalHoldNotFound = errors.New("store: legal hold not found")
+
+	ErrTenantSessionQuota = errors.New("store: tenant concurrent session quota exceeded")
+	ErrUserSessionQuota   = errors.New("store: user concurrent session quota exceeded")
+	ErrDeviceSessionQuota = errors.New("store: device concurrent session quota exceeded")
 )
@@ -19,6 +19,7 @@ package mocks
 import (
 	context "context"
 	io "io"
+	time "time"
 
 	mock "github.com/stretchr/testify/mock"
 
@@ -30,6 +31,34 @@ type DataStore struct {
 	mock.Mock
 }
 
+// AddSessionType provides a mock function with given fields: ctx, sessionID, sessionType
+func (_m *DataStore) AddSessionType(ctx context.Context, sessionID string, sessionType string) error {
+	ret := _m.Called(ctx, sessionID, sessionType)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, string, string) error); ok {
+		r0 = rf(ctx, sessionID, sessionType)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// AddSessionWriter provides a mock function with given fields: ctx, sessionID, userID
+func (_m *DataStore) AddSessionWriter(ctx context.Context, sessionID string, userID string) error {
+	ret := _m.Called(ctx, sessionID, userID)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, string, string) error); ok {
+		r0 = rf(ctx, sessionID, userID)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
 // AllocateSession provides a mock function with given fields: ctx, sess
 func (_m *DataStore) AllocateSession(ctx context.Context, sess *model.Session) error {
 	ret := _m.Called(ctx, sess)
@@ -58,6 +87,27 @@ func (_m *DataStore) Close() error {
 	return r0
 }
 
+// CountSessions provides a mock function with given fields: ctx, filter
+func (_m *DataStore) CountSessions(ctx context.Context, filter model.SessionFilter) (int64, error) {
+	ret := _m.Called(ctx, filter)
+
+	var r0 int64
+	if rf, ok := ret.Get(0).(func(context.Context, model.SessionFilter) int64); ok {
+		r0 = rf(ctx, filter)
+	} else {
+		r0 = ret.Get(0).(int64)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, model.SessionFilter) error); ok {
+		r1 = rf(ctx, filter)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // DeleteDevice provides a mock function with given fields: ctx, tenantID, deviceID
 func (_m *DataStore) DeleteDevice(ctx context.Context, tenantID string, deviceID string) error {
 	ret := _m.Called(ctx, tenantID, deviceID)
@@ -72,6 +122,64 @@ func (_m *DataStore) DeleteDevice(ctx context.Context, tenantID string, deviceID
 	return r0
 }
 
+// DeleteExpiredRecordings provides a mock function with given fields: ctx, before
+func (_m *DataStore) DeleteExpiredRecordings(ctx context.Context, before time.Time) (int, error) {
+	ret := _m.Called(ctx, before)
+
+	var r0 int
+	if rf, ok := ret.Get(0).(func(context.Context, time.Time) int); ok {
+		r0 = rf(ctx, before)
+	} else {
+		r0 = ret.Get(0).(int)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, time.Time) error); ok {
+		r1 = rf(ctx, before)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// DeleteExpiredSession provides a mock function with given fields: ctx, before
+func (_m *DataStore) DeleteExpiredSession(ctx context.Context, before time.Time) (*model.Session, error) {
+	ret := _m.Called(ctx, before)
+
+	var r0 *model.Session
+	if rf, ok := ret.Get(0).(func(context.Context, time.Time) *model.Session); ok {
+		r0 = rf(ctx, before)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*model.Session)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, time.Time) error); ok {
+		r1 = rf(ctx, before)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// DeleteLegalHold provides a mock function with given fields: ctx, sessionID
+func (_m *DataStore) DeleteLegalHold(ctx context.Context, sessionID string) error {
+	ret := _m.Called(ctx, sessionID)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, string) error); ok {
+		r0 = rf(ctx, sessionID)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
 // DeleteSession provides a mock function with given fields: ctx, sessionID
 func (_m *DataStore) DeleteSession(ctx context.Context, sessionID string) (*model.Session, error) {
 	ret := _m.Called(ctx, sessionID)
@@ -95,6 +203,110 @@ func (_m *DataStore) DeleteSession(ctx context.Context, sessionID string) (*mode
 	return r0, r1
 }
 
+// DeleteSessionRecordings provides a mock function with given fields: ctx, sessionIDs
+func (_m *DataStore) DeleteSessionRecordings(ctx context.Context, sessionIDs []string) error {
+	ret := _m.Called(ctx, sessionIDs)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, []string) error); ok {
+		r0 = rf(ctx, sessionIDs)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// DisconnectExpiredDevices provides a mock function with given fields: ctx, before
+func (_m *DataStore) DisconnectExpiredDevices(ctx context.Context, before time.Time) (int64, error) {
+	ret := _m.Called(ctx, before)
+
+	var r0 int64
+	if rf, ok := ret.Get(0).(func(context.Context, time.Time) int64); ok {
+		r0 = rf(ctx, before)
+	} else {
+		r0 = ret.Get(0).(int64)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, time.Time) error); ok {
+		r1 = rf(ctx, before)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// FindRecordedSessions provides a mock function with given fields: ctx, filter
+func (_m *DataStore) FindRecordedSessions(ctx context.Context, filter model.RecordingFilter) ([]model.RecordedSession, error) {
+	ret := _m.Called(ctx, filter)
+
+	var r0 []model.RecordedSession
+	if rf, ok := ret.Get(0).(func(context.Context, model.RecordingFilter) []model.RecordedSession); ok {
+		r0 = rf(ctx, filter)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]model.RecordedSession)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, model.RecordingFilter) error); ok {
+		r1 = rf(ctx, filter)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// FindSessions provides a mock function with given fields: ctx, filter
+func (_m *DataStore) FindSessions(ctx context.Context, filter model.SessionFilter) ([]model.Session, error) {
+	ret := _m.Called(ctx, filter)
+
+	var r0 []model.Session
+	if rf, ok := ret.Get(0).(func(context.Context, model.SessionFilter) []model.Session); ok {
+		r0 = rf(ctx, filter)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]model.Session)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, model.SessionFilter) error); ok {
+		r1 = rf(ctx, filter)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// FindUnattributedRecordedSessions provides a mock function with given fields: ctx
+func (_m *DataStore) FindUnattributedRecordedSessions(ctx context.Context) ([]model.RecordedSession, error) {
+	ret := _m.Called(ctx)
+
+	var r0 []model.RecordedSession
+	if rf, ok := ret.Get(0).(func(context.Context) []model.RecordedSession); ok {
+		r0 = rf(ctx)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]model.RecordedSession)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context) error); ok {
+		r1 = rf(ctx)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // GetDevice provides a mock function with given fields: ctx, tenantID, deviceID
 func (_m *DataStore) GetDevice(ctx context.Context, tenantID string, deviceID string) (*model.Device, error) {
 	ret := _m.Called(ctx, tenantID, deviceID)
@@ -118,6 +330,98 @@ func (_m *DataStore) GetDevice(ctx context.Context, tenantID string, deviceID st
 	return r0, r1
 }
 
+// GetLegalHold provides a mock function with given fields: ctx, sessionID
+func (_m *DataStore) GetLegalHold(ctx context.Context, sessionID string) (*model.LegalHold, error) {
+	ret := _m.Called(ctx, sessionID)
+
+	var r0 *model.LegalHold
+	if rf, ok := ret.Get(0).(func(context.Context, string) *model.LegalHold); ok {
+		r0 = rf(ctx, sessionID)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*model.LegalHold)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string) error); ok {
+		r1 = rf(ctx, sessionID)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// GetRecordedSession provides a mock function with given fields: ctx, sessionID
+func (_m *DataStore) GetRecordedSession(ctx context.Context, sessionID string) (*model.RecordedSession, error) {
+	ret := _m.Called(ctx, sessionID)
+
+	var r0 *model.RecordedSession
+	if rf, ok := ret.Get(0).(func(context.Context, string) *model.RecordedSession); ok {
+		r0 = rf(ctx, sessionID)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*model.RecordedSession)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string) error); ok {
+		r1 = rf(ctx, sessionID)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// GetRecordingChunks provides a mock function with given fields: ctx, sessionID, stream
+func (_m *DataStore) GetRecordingChunks(ctx context.Context, sessionID string, stream string) ([]model.RecordingChunk, error) {
+	ret := _m.Called(ctx, sessionID, stream)
+
+	var r0 []model.RecordingChunk
+	if rf, ok := ret.Get(0).(func(context.Context, string, string) []model.RecordingChunk); ok {
+		r0 = rf(ctx, sessionID, stream)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]model.RecordingChunk)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string, string) error); ok {
+		r1 = rf(ctx, sessionID, stream)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// GetRecordingSignature provides a mock function with given fields: ctx, sessionID
+func (_m *DataStore) GetRecordingSignature(ctx context.Context, sessionID string) (*model.RecordingSignature, error) {
+	ret := _m.Called(ctx, sessionID)
+
+	var r0 *model.RecordingSignature
+	if rf, ok := ret.Get(0).(func(context.Context, string) *model.RecordingSignature); ok {
+		r0 = rf(ctx, sessionID)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*model.RecordingSignature)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string) error); ok {
+		r1 = rf(ctx, sessionID)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // GetSession provides a mock function with given fields: ctx, sessionID
 func (_m *DataStore) GetSession(ctx context.Context, sessionID string) (*model.Session, error) {
 	ret := _m.Called(ctx, sessionID)
@@ -141,13 +445,57 @@ func (_m *DataStore) GetSession(ctx context.Context, sessionID string) (*model.S
 	return r0, r1
 }
 
-// GetSessionRecording provides a mock function with given fields: ctx, sessionID, w
-func (_m *DataStore) WriteSessionRecords(ctx context.Context, sessionID string, w io.Writer) error {
-	ret := _m.Called(ctx, sessionID, w)
+// GetTenantPolicy provides a mock function with given fields: ctx, tenantID
+func (_m *DataStore) GetTenantPolicy(ctx context.Context, tenantID string) (*model.TenantPolicy, error) {
+	ret := _m.Called(ctx, tenantID)
+
+	var r0 *model.TenantPolicy
+	if rf, ok := ret.Get(0).(func(context.Context, string) *model.TenantPolicy); ok {
+		r0 = rf(ctx, tenantID)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*model.TenantPolicy)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string) error); ok {
+		r1 = rf(ctx, tenantID)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// HasSessionRecording provides a mock function with given fields: ctx, sessionID
+func (_m *DataStore) HasSessionRecording(ctx context.Context, sessionID string) (bool, error) {
+	ret := _m.Called(ctx, sessionID)
+
+	var r0 bool
+	if rf, ok := ret.Get(0).(func(context.Context, string) bool); ok {
+		r0 = rf(ctx, sessionID)
+	} else {
+		r0 = ret.Get(0).(bool)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string) error); ok {
+		r1 = rf(ctx, sessionID)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// InsertControlRecording provides a mock function with given fields: ctx, sessionID, sessionBytes, link
+func (_m *DataStore) InsertControlRecording(ctx context.Context, sessionID string, sessionBytes []byte, link model.ChunkLink) error {
+	ret := _m.Called(ctx, sessionID, sessionBytes, link)
 
 	var r0 error
-	if rf, ok := ret.Get(0).(func(context.Context, string, io.Writer) error); ok {
-		r0 = rf(ctx, sessionID, w)
+	if rf, ok := ret.Get(0).(func(context.Context, string, []byte, model.ChunkLink) error); ok {
+		r0 = rf(ctx, sessionID, sessionBytes, link)
 	} else {
 		r0 = ret.Error(0)
 	}
@@ -155,13 +503,13 @@ func (_m *DataStore) WriteSessionRecords(ctx context.Context, sessionID string,
 	return r0
 }
 
-// InsertControlRecording provides a mock function with given fields: ctx, sessionID, sessionBytes
-func (_m *DataStore) InsertControlRecording(ctx context.Context, sessionID string, sessionBytes []byte) error {
-	ret := _m.Called(ctx, sessionID, sessionBytes)
+// InsertInputRecording provides a mock function with given fields: ctx, sessionID, inputBytes, link
+func (_m *DataStore) InsertInputRecording(ctx context.Context, sessionID string, inputBytes []byte, link model.ChunkLink) error {
+	ret := _m.Called(ctx, sessionID, inputBytes, link)
 
 	var r0 error
-	if rf, ok := ret.Get(0).(func(context.Context, string, []byte) error); ok {
-		r0 = rf(ctx, sessionID, sessionBytes)
+	if rf, ok := ret.Get(0).(func(context.Context, string, []byte, model.ChunkLink) error); ok {
+		r0 = rf(ctx, sessionID, inputBytes, link)
 	} else {
 		r0 = ret.Error(0)
 	}
@@ -169,13 +517,69 @@ func (_m *DataStore) InsertControlRecording(ctx context.Context, sessionID strin
 	return r0
 }
 
-// InsertSessionRecording provides a mock function with given fields: ctx, sessionID, sessionBytes
-func (_m *DataStore) InsertSessionRecording(ctx context.Context, sessionID string, sessionBytes []byte) error {
-	ret := _m.Called(ctx, sessionID, sessionBytes)
+// InsertRecordedSession provides a mock function with given fields: ctx, sess
+func (_m *DataStore) InsertRecordedSession(ctx context.Context, sess *model.RecordedSession) error {
+	ret := _m.Called(ctx, sess)
 
 	var r0 error
-	if rf, ok := ret.Get(0).(func(context.Context, string, []byte) error); ok {
-		r0 = rf(ctx, sessionID, sessionBytes)
+	if rf, ok := ret.Get(0).(func(context.Context, *model.RecordedSession) error); ok {
+		r0 = rf(ctx, sess)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// InsertRecordingChunks provides a mock function with given fields: ctx, chunks
+func (_m *DataStore) InsertRecordingChunks(ctx context.Context, chunks []model.StoredChunk) error {
+	ret := _m.Called(ctx, chunks)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, []model.StoredChunk) error); ok {
+		r0 = rf(ctx, chunks)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// InsertRecordingSignature provides a mock function with given fields: ctx, signature
+func (_m *DataStore) InsertRecordingSignature(ctx context.Context, signature *model.RecordingSignature) error {
+	ret := _m.Called(ctx, signature)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, *model.RecordingSignature) error); ok {
+		r0 = rf(ctx, signature)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// InsertRecordingText provides a mock function with given fields: ctx, text
+func (_m *DataStore) InsertRecordingText(ctx context.Context, text *model.RecordingText) error {
+	ret := _m.Called(ctx, text)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, *model.RecordingText) error); ok {
+		r0 = rf(ctx, text)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// InsertSessionRecording provides a mock function with given fields: ctx, sessionID, sessionBytes, link
+func (_m *DataStore) InsertSessionRecording(ctx context.Context, sessionID string, sessionBytes []byte, link model.ChunkLink) error {
+	ret := _m.Called(ctx, sessionID, sessionBytes, link)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, string, []byte, model.ChunkLink) error); ok {
+		r0 = rf(ctx, sessionID, sessionBytes, link)
 	} else {
 		r0 = ret.Error(0)
 	}
@@ -211,6 +615,148 @@ func (_m *DataStore) ProvisionDevice(ctx context.Context, tenantID string, devic
 	return r0
 }
 
+// RemoveSessionWriter provides a mock function with given fields: ctx, sessionID, userID
+func (_m *DataStore) RemoveSessionWriter(ctx context.Context, sessionID string, userID string) error {
+	ret := _m.Called(ctx, sessionID, userID)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, string, string) error); ok {
+		r0 = rf(ctx, sessionID, userID)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// RenewDeviceLeases provides a mock function with given fields: ctx, deviceIDs, expire
+func (_m *DataStore) RenewDeviceLeases(ctx context.Context, deviceIDs []string, expire time.Time) error {
+	ret := _m.Called(ctx, deviceIDs, expire)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, []string, time.Time) error); ok {
+		r0 = rf(ctx, deviceIDs, expire)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// RenewSessionLeases provides a mock function with given fields: ctx, sessionIDs, expire
+func (_m *DataStore) RenewSessionLeases(ctx context.Context, sessionIDs []string, expire time.Time) error {
+	ret := _m.Called(ctx, sessionIDs, expire)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, []string, time.Time) error); ok {
+		r0 = rf(ctx, sessionIDs, expire)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// RotateRecordingKeys provides a mock function with given fields: ctx
+func (_m *DataStore) RotateRecordingKeys(ctx context.Context) (int, error) {
+	ret := _m.Called(ctx)
+
+	var r0 int
+	if rf, ok := ret.Get(0).(func(context.Context) int); ok {
+		r0 = rf(ctx)
+	} else {
+		r0 = ret.Get(0).(int)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context) error); ok {
+		r1 = rf(ctx)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// SearchRecordings provides a mock function with given fields: ctx, filter
+func (_m *DataStore) SearchRecordings(ctx context.Context, filter model.SearchFilter) ([]model.SearchResult, error) {
+	ret := _m.Called(ctx, filter)
+
+	var r0 []model.SearchResult
+	if rf, ok := ret.Get(0).(func(context.Context, model.SearchFilter) []model.SearchResult); ok {
+		r0 = rf(ctx, filter)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]model.SearchResult)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, model.SearchFilter) error); ok {
+		r1 = rf(ctx, filter)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// SetLegalHold provides a mock function with given fields: ctx, hold
+func (_m *DataStore) SetLegalHold(ctx context.Context, hold *model.LegalHold) error {
+	ret := _m.Called(ctx, hold)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, *model.LegalHold) error); ok {
+		r0 = rf(ctx, hold)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// SetSessionEndReason provides a mock function with given fields: ctx, sessionID, reason
+func (_m *DataStore) SetSessionEndReason(ctx context.Context, sessionID string, reason string) error {
+	ret := _m.Called(ctx, sessionID, reason)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, string, string) error); ok {
+		r0 = rf(ctx, sessionID, reason)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// SetTenantPolicy provides a mock function with given fields: ctx, tenantID, policy
+func (_m *DataStore) SetTenantPolicy(ctx context.Context, tenantID string, policy *model.TenantPolicy) error {
+	ret := _m.Called(ctx, tenantID, policy)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, string, *model.TenantPolicy) error); ok {
+		r0 = rf(ctx, tenantID, policy)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// UpdateRecordingExpiry provides a mock function with given fields: ctx, sessionID
+func (_m *DataStore) UpdateRecordingExpiry(ctx context.Context, sessionID string) error {
+	ret := _m.Called(ctx, sessionID)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, string) error); ok {
+		r0 = rf(ctx, sessionID)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
 // UpsertDeviceStatus provides a mock function with given fields: ctx, tenantID, deviceID, status
 func (_m *DataStore) UpsertDeviceStatus(ctx context.Context, tenantID string, deviceID string, status string) error {
 	ret := _m.Called(ctx, tenantID, deviceID, status)
@@ -224,3 +770,17 @@ func (_m *DataStore) UpsertDeviceStatus(ctx context.Context, tenantID string, de
 
 	return r0
 }
+
+// WriteSessionRecords provides a mock function with given fields: ctx, sessionID, w
+func (_m *DataStore) WriteSessionRecords(ctx context.Context, sessionID string, w io.Writer) error {
+	ret := _m.Called(ctx, sessionID, w)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, string, io.Writer) error); ok {
+		r0 = rf(ctx, sessionID, w)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
@@ -0,0 +1,159 @@
+// Copyright 2023 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package mongo
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+
+	"github.com/mendersoftware/deviceconnect/model"
+	"github.com/mendersoftware/deviceconnect/store"
+)
+
+// chunkReader decompresses the chunks of a recording stream, in order, into
+// the recorded data. It reads both the chunks compressed one by one into
+// complete gzip streams, as recorded by the former versions, and the
+// fragments of the continuous gzip streams. A continuous stream ends at its
+// last fragment: the streams not closed at the end of the session, or
+// missing a fragment which failed to be stored, are read up to there, and
+// the fragments following a missing one are skipped up to the next stream.
+type chunkReader struct {
+	ctx context.Context
+	c   store.ChunkIterator
+	// open decrypts the chunks encrypted with the data key with the ID
+	open func(keyID string, data []byte) ([]byte, error)
+
+	gzipReader *gzip.Reader
+	// fragments reads the compressed data of the current continuous
+	// stream, nil if reading a complete chunk
+	fragments *fragmentReader
+	// next is the chunk read ahead of the end of the current stream
+	next *model.StoredChunk
+	err  error
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for r.err == nil {
+		if r.gzipReader != nil {
+			n, err := r.gzipReader.Read(p)
+			if err == io.ErrUnexpectedEOF && r.fragments != nil {
+				// the continuous stream ends without trailer
+				err = io.EOF
+			}
+			if err == io.EOF {
+				r.gzipReader.Close()
+				r.gzipReader = nil
+				r.fragments = nil
+				err = nil
+			}
+			if err != nil {
+				r.err = err
+			}
+			if n > 0 || len(p) == 0 {
+				return n, nil
+			}
+			continue
+		}
+
+		var chunk *model.StoredChunk
+		chunk, r.err = r.nextChunk()
+		if r.err != nil {
+			break
+		}
+		var compressed io.Reader
+		switch chunk.Format {
+		case model.ChunkFormatGzipStream:
+			if chunk.Offset != 0 {
+				// the start of the stream is missing
+				continue
+			}
+			r.fragments = &fragmentReader{r: r}
+			r.fragments.push(chunk)
+			compressed = r.fragments
+		default:
+			compressed = bytes.NewReader(chunk.Data)
+		}
+		r.gzipReader, r.err = gzip.NewReader(compressed)
+		if r.err == nil {
+			r.gzipReader.Multistream(false)
+		}
+	}
+	return 0, r.err
+}
+
+// nextChunk returns the next chunk of the stream, decrypted, or io.EOF
+func (r *chunkReader) nextChunk() (*model.StoredChunk, error) {
+	if r.next != nil {
+		chunk := r.next
+		r.next = nil
+		return chunk, nil
+	}
+	if r.c == nil || !r.c.Next(r.ctx) {
+		if r.c != nil && r.c.Err() != nil {
+			return nil, r.c.Err()
+		}
+		return nil, io.EOF
+	}
+	chunk := *r.c.Chunk()
+	if r.open != nil {
+		data, err := r.open(chunk.KeyID, chunk.Data)
+		if err != nil {
+			return nil, err
+		}
+		chunk.Data = data
+	}
+	return &chunk, nil
+}
+
+// fragmentReader reads the compressed data of a continuous stream from its
+// consecutive fragments
+type fragmentReader struct {
+	r      *chunkReader
+	data   []byte
+	offset int64
+	done   bool
+}
+
+func (f *fragmentReader) push(chunk *model.StoredChunk) {
+	f.data = chunk.Data
+	f.offset = chunk.Offset + int64(len(chunk.Data))
+}
+
+func (f *fragmentReader) Read(p []byte) (int, error) {
+	for len(f.data) == 0 {
+		if f.done {
+			return 0, io.EOF
+		}
+		chunk, err := f.r.nextChunk()
+		if err == io.EOF {
+			f.done = true
+			continue
+		} else if err != nil {
+			return 0, err
+		}
+		if chunk.Format != model.ChunkFormatGzipStream || chunk.Offset != f.offset {
+			// the chunk does not follow the stream: it is read next
+			f.r.next = chunk
+			f.done = true
+			continue
+		}
+		f.push(chunk)
+	}
+	n := copy(p, f.data)
+	f.data = f.data[n:]
+	return n, nil
+}
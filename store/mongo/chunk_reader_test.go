@@ -0,0 +1,225 @@
+// Copyright 2023 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package mongo
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/mendersoftware/deviceconnect/app"
+	"github.com/mendersoftware/deviceconnect/model"
+)
+
+// gzipChunk compresses the data into a complete gzip stream, as recorded
+// by the former versions
+func gzipChunk(data string) model.Recording {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	_, _ = w.Write([]byte(data))
+	w.Close()
+	return model.Recording{
+		ID:        uuid.New(),
+		Recording: buf.Bytes(),
+	}
+}
+
+// gzipStream compresses the data into the fragments of a continuous gzip
+// stream, one per write, closing the stream if close is true
+func gzipStream(close bool, data ...string) []model.Recording {
+	var (
+		buf    bytes.Buffer
+		chunks []model.Recording
+		offset int64
+	)
+	w := gzip.NewWriter(&buf)
+	fragment := func() {
+		chunks = append(chunks, model.Recording{
+			ID:        uuid.New(),
+			Recording: append([]byte(nil), buf.Bytes()...),
+			ChunkLink: model.ChunkLink{
+				Format: model.ChunkFormatGzipStream,
+				Offset: offset,
+			},
+		})
+		offset += int64(buf.Len())
+		buf.Reset()
+	}
+	for _, d := range data {
+		_, _ = w.Write([]byte(d))
+		_ = w.Flush()
+		fragment()
+	}
+	if close {
+		_ = w.Close()
+		fragment()
+	}
+	return chunks
+}
+
+func TestReadRecordingChunks(t *testing.T) {
+	testCases := []struct {
+		Name   string
+		Chunks [][]model.Recording
+
+		Output string
+	}{{
+		Name: "ok, complete chunks",
+		Chunks: [][]model.Recording{
+			{gzipChunk("hello ")},
+			{gzipChunk("world")},
+		},
+		Output: "hello world",
+	}, {
+		Name: "ok, continuous stream",
+		Chunks: [][]model.Recording{
+			gzipStream(true, "$ ls\r\n", "bin  etc  usr\r\n", "$ exit\r\n"),
+		},
+		Output: "$ ls\r\nbin  etc  usr\r\n$ exit\r\n",
+	}, {
+		Name: "ok, streams not closed",
+		Chunks: [][]model.Recording{
+			gzipStream(false, "$ ls\r\n", "bin  etc  usr\r\n"),
+			gzipStream(false, "$ exit\r\n"),
+		},
+		Output: "$ ls\r\nbin  etc  usr\r\n$ exit\r\n",
+	}, {
+		Name: "ok, complete chunks followed by streams",
+		Chunks: [][]model.Recording{
+			{gzipChunk("$ ls\r\n")},
+			gzipStream(true, "bin  etc  usr\r\n"),
+			{gzipChunk("$ exit\r\n")},
+		},
+		Output: "$ ls\r\nbin  etc  usr\r\n$ exit\r\n",
+	}, {
+		Name: "ok, stream missing a fragment",
+		Chunks: func() [][]model.Recording {
+			chunks := gzipStream(true, "$ ls\r\n", "bin  etc  usr\r\n", "$ id\r\n")
+			return [][]model.Recording{
+				{chunks[0], chunks[2], chunks[3]},
+				gzipStream(true, "$ exit\r\n"),
+			}
+		}(),
+		Output: "$ ls\r\n$ exit\r\n",
+	}, {
+		Name: "ok, stream missing its start",
+		Chunks: [][]model.Recording{
+			gzipStream(true, "$ ls\r\n", "bin  etc  usr\r\n")[1:],
+			gzipStream(true, "$ exit\r\n"),
+		},
+		Output: "$ exit\r\n",
+	}}
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			var documents []interface{}
+			for _, chunks := range tc.Chunks {
+				for _, chunk := range chunks {
+					documents = append(documents, chunk)
+				}
+			}
+			for _, size := range []int{1, 4, recordingReadBufferSize} {
+				c, err := mongo.NewCursorFromDocuments(documents, nil, nil)
+				if !assert.NoError(t, err) {
+					return
+				}
+				r := NewRecordingReader(context.Background(),
+					newChunkCursor(c, model.RecordingStreamOutput))
+				output, err := io.ReadAll(io.LimitReader(
+					readerFunc(func(p []byte) (int, error) {
+						if len(p) > size {
+							p = p[:size]
+						}
+						return r.Read(p)
+					}), 1<<20))
+				assert.NoError(t, err)
+				assert.Equal(t, tc.Output, string(output))
+			}
+		})
+	}
+}
+
+func TestReadRecordingChunksError(t *testing.T) {
+	documents := []interface{}{
+		gzipChunk("hello"),
+		model.Recording{ID: uuid.New(), Recording: []byte("this is not gzip data")},
+	}
+	c, err := mongo.NewCursorFromDocuments(documents, nil, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	r := NewRecordingReader(context.Background(),
+		newChunkCursor(c, model.RecordingStreamOutput))
+	output, err := io.ReadAll(r)
+	assert.Equal(t, "hello", string(output))
+	assert.ErrorIs(t, err, gzip.ErrHeader)
+}
+
+func TestPopControlMessageStream(t *testing.T) {
+	// the control messages span the fragments of the stream
+	var (
+		messages []*app.Control
+		data     []string
+	)
+	for i := 0; i < 100; i++ {
+		m := &app.Control{
+			Type:      app.TimestampMessage,
+			Offset:    i * 10,
+			Timestamp: time.UnixMilli(1680223340544 + int64(i)*100).UTC(),
+		}
+		if i%10 == 0 {
+			m = &app.Control{
+				Type:   app.UserMessage,
+				Offset: i * 10,
+				UserID: fmt.Sprintf("user-%d", i),
+			}
+		}
+		messages = append(messages, m)
+		b := m.MarshalBinary()
+		data = append(data, string(b[:3]), string(b[3:]))
+	}
+	var documents []interface{}
+	for _, chunk := range gzipStream(true, data...) {
+		documents = append(documents, model.ControlData{
+			ID:        uuid.New(),
+			Control:   chunk.Recording,
+			ChunkLink: chunk.ChunkLink,
+		})
+	}
+	c, err := mongo.NewCursorFromDocuments(documents, nil, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	r := NewControlMessageReader(context.Background(),
+		newChunkCursor(c, model.RecordingStreamControl))
+	for _, m := range messages {
+		assert.Equal(t, m, r.Pop())
+	}
+	assert.Nil(t, r.Pop())
+}
+
+type readerFunc func(p []byte) (int, error)
+
+func (f readerFunc) Read(p []byte) (int, error) {
+	return f(p)
+}
@@ -15,125 +15,130 @@
 package mongo
 
 import (
-	"bytes"
-	"compress/gzip"
 	"context"
-	"io"
-
-	"go.mongodb.org/mongo-driver/mongo"
 
 	"github.com/mendersoftware/deviceconnect/app"
-	"github.com/mendersoftware/deviceconnect/model"
+	"github.com/mendersoftware/deviceconnect/store"
 )
 
 const (
 	controlReadBufferSize = 4096
 )
 
-var (
-	noopReader = &ControlMessageReader{}
-)
-
+// ControlMessageReader reads the control messages of a session, or the
+// input messages of the input stream, from the chunks of the stream.
 type ControlMessageReader struct {
+	chunkReader
 	currentOffset int
 	output        []byte
 	outputLength  int
-	buffer        bytes.Buffer
-	c             *mongo.Cursor
-	gzipReader    *gzip.Reader
 }
 
-func NewControlMessageReader(ctx context.Context, c *mongo.Cursor) *ControlMessageReader {
-	reader := &ControlMessageReader{
-		currentOffset: 0,
-		output:        make([]byte, controlReadBufferSize),
-		buffer:        bytes.Buffer{},
-		c:             c,
-		outputLength:  0,
-	}
-
-	hasNext := c.Next(ctx)
-	if !hasNext {
-		return noopReader
-	}
-
-	var r model.ControlData
-	err := c.Decode(&r)
-	if err != nil {
-		return noopReader
-	}
-
-	reader.buffer.Reset()
-	reader.buffer.Write(r.Control)
-	gzipReader, e := gzip.NewReader(&reader.buffer)
-	if e != nil {
-		return noopReader
+func NewControlMessageReader(ctx context.Context, c store.ChunkIterator) *ControlMessageReader {
+	return &ControlMessageReader{
+		chunkReader: chunkReader{
+			ctx: ctx,
+			c:   c,
+		},
+		output: make([]byte, controlReadBufferSize),
 	}
-
-	n, e := gzipReader.Read(reader.output)
-	reader.gzipReader = gzipReader
-	reader.outputLength = n
-	if e != nil && e != io.EOF {
-		return noopReader
-	}
-
-	return reader
 }
 
+// Pop returns the next control message, reading the chunks in order; the
+// messages may span the chunks and the read buffer.
 func (r *ControlMessageReader) Pop() *app.Control {
 	if r.c == nil {
 		return nil
 	}
 
-	if r.outputLength < 3 { // at least we have to have type: 1 byte, and two bytes of offset
-		n, e := r.gzipReader.Read(r.output[r.outputLength:])
-		if e != nil && e != io.EOF {
-			return nil
-		}
-		r.outputLength += n
-	}
-
-	if r.outputLength < 3 { // at least we have to have type: 1 byte, and two bytes of offset
-		return nil
-	}
-	m := &app.Control{}
-	offset := r.currentOffset
-	//now here we can start deserializing the control messages
-	//output[:n] contains the uncompressed buffer
-	// +---------+----------+---------+
-	// | type: 1 | offset:4 | data: l |
-	// +---------+----------+---------+
-	// where l is type-dependent
-	controlMessageBuffer := r.output[:r.outputLength]
-	switch controlMessageBuffer[offset] {
-	case app.DelayMessage:
-		if offset+7 > r.outputLength {
+	for {
+		//here we can start deserializing the control messages
+		//output[currentOffset:outputLength] contains the uncompressed buffer
+		// +---------+----------+---------+
+		// | type: 1 | offset:4 | data: l |
+		// +---------+----------+---------+
+		// where l is type-dependent
+		controlMessageBuffer := r.output[r.currentOffset:r.outputLength]
+		size := app.ControlMessageSize(controlMessageBuffer)
+		if size > 0 && size <= len(controlMessageBuffer) {
+			m := &app.Control{}
+			if e := m.UnmarshalBinary(controlMessageBuffer[:size]); e != nil {
+				return nil
+			}
+			r.currentOffset += size
+			return m
+		} else if len(controlMessageBuffer) > 0 &&
+			(&app.Control{}).UnmarshalBinary(controlMessageBuffer) ==
+				app.ErrUnknownMessage {
+			// the data is inconsistent
 			return nil
 		}
 
-		e := m.UnmarshalBinary(controlMessageBuffer[offset:])
-		if e != nil {
-			return nil
+		// the message is incomplete: move it to the start of the
+		// buffer, growing the buffer for the large messages, and
+		// read more
+		if size > len(r.output) {
+			output := make([]byte, size)
+			copy(output, controlMessageBuffer)
+			r.output = output
+		} else {
+			copy(r.output, controlMessageBuffer)
 		}
-		offset += 7
-	case app.ResizeMessage:
-		if offset+9 > r.outputLength {
+		r.outputLength = len(controlMessageBuffer)
+		r.currentOffset = 0
+		if !r.read() {
 			return nil
 		}
+	}
+}
 
-		e := m.UnmarshalBinary(controlMessageBuffer[offset:])
-		if e != nil {
-			return nil
+// read reads more uncompressed data to the buffer, moving to the next
+// chunk at the end of the current one
+func (r *ControlMessageReader) read() bool {
+	for r.outputLength < len(r.output) {
+		n, err := r.chunkReader.Read(r.output[r.outputLength:])
+		r.outputLength += n
+		if n > 0 {
+			return true
+		} else if err != nil {
+			return false
 		}
-		offset += 9
-	default:
-		return nil
 	}
+	return false
+}
 
-	r.currentOffset = offset
-	if r.currentOffset >= r.outputLength {
-		r.outputLength = 0
-		r.currentOffset = 0
+// mergedMessageReader merges the control messages and the input messages
+// in the order of their offsets; at the same offset, the input precedes the
+// timestamp of the output echoing it.
+type mergedMessageReader struct {
+	control   *ControlMessageReader
+	input     *ControlMessageReader
+	started   bool
+	nextCtrl  *app.Control
+	nextInput *app.Control
+}
+
+func newMergedMessageReader(control, input *ControlMessageReader) *mergedMessageReader {
+	return &mergedMessageReader{
+		control: control,
+		input:   input,
+	}
+}
+
+// Pop returns the next control or input message
+func (r *mergedMessageReader) Pop() (m *app.Control) {
+	if !r.started {
+		r.nextCtrl = r.control.Pop()
+		r.nextInput = r.input.Pop()
+		r.started = true
+	}
+	if r.nextInput != nil && (r.nextCtrl == nil ||
+		r.nextInput.Offset < r.nextCtrl.Offset ||
+		(r.nextInput.Offset == r.nextCtrl.Offset &&
+			r.nextCtrl.Type == app.TimestampMessage)) {
+		m, r.nextInput = r.nextInput, r.input.Pop()
+	} else if r.nextCtrl != nil {
+		m, r.nextCtrl = r.nextCtrl, r.control.Pop()
 	}
 	return m
 }
@@ -15,18 +15,23 @@
 package mongo
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
 	"encoding/base64"
 	"errors"
+	"fmt"
 	"testing"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
 
 	"github.com/mendersoftware/deviceconnect/app"
 	"github.com/mendersoftware/deviceconnect/model"
+	"github.com/mendersoftware/deviceconnect/store"
 	"github.com/mendersoftware/go-lib-micro/identity"
 	mstore "github.com/mendersoftware/go-lib-micro/store"
 )
@@ -89,6 +94,48 @@ func TestPopControlMessage(t *testing.T) {
 				},
 			},
 		},
+		{
+			Name: "ok user message",
+
+			Ctx: identity.WithContext(
+				context.Background(),
+				&identity.Identity{
+					Tenant: "000000000000000000000000",
+				},
+			),
+			SessionID: "00000000-0000-0000-0000-000000000000",
+			//            0    1   2   3   4   5   6-9
+			//echo -n -e '\x03\x20\x00\x00\x00\x04abcd' | gzip - | base64
+			ControlData: "H4sIAAAAAAAAA2NWYGBgYElMSk4BABvlCrMKAAAA",
+			Messages: []*app.Control{
+				{
+					Type:   app.UserMessage, // offset 0 \x03
+					Offset: 32,              // offset 1-4 \x20\x00
+					UserID: "abcd",          // offset 5 length, 6-9 user ID
+				},
+			},
+		},
+		{
+			Name: "ok timestamp message",
+
+			Ctx: identity.WithContext(
+				context.Background(),
+				&identity.Identity{
+					Tenant: "000000000000000000000000",
+				},
+			),
+			SessionID: "00000000-0000-0000-0000-000000000000",
+			//            0    1   2   3   4   5-12
+			//echo -n -e '\x04\x20\x00\x00\x00\x00\x88\x1d\x35\x87\x01\x00\x00' | gzip -n - | base64
+			ControlData: "H4sIAAAAAAAAA2NRYACCDlnTdkYGBgB/kcDLDQAAAA==",
+			Messages: []*app.Control{
+				{
+					Type:      app.TimestampMessage, // offset 0 \x04
+					Offset:    32,                   // offset 1-4 \x20\x00
+					Timestamp: time.UnixMilli(1680223340544).UTC(),
+				},
+			},
+		},
 		{
 			Name: "ok more than one",
 
@@ -250,7 +297,8 @@ func TestPopControlMessage(t *testing.T) {
 			ctx, cancel := context.WithTimeout(context.TODO(), time.Second*10)
 			defer cancel()
 
-			r := NewControlMessageReader(ctx, c)
+			r := NewControlMessageReader(ctx,
+				newChunkCursor(c, model.RecordingStreamControl))
 			assert.NotNil(t, r)
 
 			if len(tc.Messages) == 0 {
@@ -272,3 +320,99 @@ func TestPopControlMessage(t *testing.T) {
 		})
 	}
 }
+
+func TestPopControlMessageDocuments(t *testing.T) {
+	// the control messages span the read buffer and the documents
+	var messages []*app.Control
+	var data []byte
+	for i := 0; i < 1000; i++ {
+		m := &app.Control{
+			Type:      app.TimestampMessage,
+			Offset:    i * 10,
+			Timestamp: time.UnixMilli(1680223340544 + int64(i)*100).UTC(),
+		}
+		if i%100 == 0 {
+			m = &app.Control{
+				Type:   app.UserMessage,
+				Offset: i * 10,
+				UserID: fmt.Sprintf("user-%d", i),
+			}
+		}
+		messages = append(messages, m)
+		data = append(data, m.MarshalBinary()...)
+	}
+	var documents []interface{}
+	for _, chunk := range [][]byte{data[:5000], data[5000:5001], data[5001:]} {
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		_, _ = w.Write(chunk)
+		w.Close()
+		documents = append(documents, model.ControlData{
+			ID:      uuid.New(),
+			Control: buf.Bytes(),
+		})
+	}
+	c, err := mongo.NewCursorFromDocuments(documents, nil, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	r := NewControlMessageReader(context.Background(),
+		newChunkCursor(c, model.RecordingStreamControl))
+	for _, m := range messages {
+		assert.Equal(t, m, r.Pop())
+	}
+	assert.Nil(t, r.Pop())
+}
+
+func TestMergedMessageReader(t *testing.T) {
+	cursor := func(stream string, document func(data []byte) interface{},
+		messages ...*app.Control) store.ChunkIterator {
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		for _, m := range messages {
+			_, _ = w.Write(m.MarshalBinary())
+		}
+		w.Close()
+		c, err := mongo.NewCursorFromDocuments(
+			[]interface{}{document(buf.Bytes())}, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return newChunkCursor(c, stream)
+	}
+	ts := time.UnixMilli(1680223340544).UTC()
+	control := []*app.Control{
+		{Type: app.TimestampMessage, Offset: 0, Timestamp: ts},
+		{Type: app.TimestampMessage, Offset: 2, Timestamp: ts.Add(time.Second)},
+		{Type: app.ResizeMessage, Offset: 4, TerminalWidth: 80, TerminalHeight: 24},
+		{Type: app.TimestampMessage, Offset: 4, Timestamp: ts.Add(2 * time.Second)},
+	}
+	input := []*app.Control{
+		{Type: app.InputMessage, Offset: 2, Timestamp: ts.Add(500 * time.Millisecond),
+			UserID: "user", Data: []byte("l")},
+		{Type: app.InputMessage, Offset: 3, Timestamp: ts.Add(1500 * time.Millisecond),
+			UserID: "user", Data: []byte("s")},
+		{Type: app.InputMessage, Offset: 6, Timestamp: ts.Add(3 * time.Second),
+			UserID: "user", Data: []byte("\r")},
+	}
+
+	r := newMergedMessageReader(
+		NewControlMessageReader(context.Background(),
+			cursor(model.RecordingStreamControl, func(data []byte) interface{} {
+				return model.ControlData{ID: uuid.New(), Control: data}
+			}, control...)),
+		NewControlMessageReader(context.Background(),
+			cursor(model.RecordingStreamInput, func(data []byte) interface{} {
+				return model.InputData{ID: uuid.New(), Input: data}
+			}, input...)),
+	)
+	// the input precedes the timestamp of the output at the same offset
+	expected := []*app.Control{
+		control[0], input[0], control[1], input[1], control[2], control[3], input[2],
+	}
+	for _, m := range expected {
+		assert.Equal(t, m, r.Pop())
+	}
+	assert.Nil(t, r.Pop())
+}
@@ -19,6 +19,8 @@ import (
 	"crypto/tls"
 	"fmt"
 	"io"
+	"math"
+	"regexp"
 	"strings"
 	"time"
 
@@ -26,6 +28,7 @@ import (
 	"github.com/pkg/errors"
 	"github.com/vmihailenco/msgpack/v5"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	mopts "go.mongodb.org/mongo-driver/mongo/options"
 	"go.mongodb.org/mongo-driver/mongo/writeconcern"
@@ -51,6 +54,7 @@ var (
 	recordingReadBufferSize                  = 1024
 	ErrUnknownControlMessageType             = errors.New("unknown control message type")
 	ErrRecordingDataInconsistent             = errors.New("recording data corrupt")
+	ErrUnknownRecordingStream                = errors.New("unknown recording stream")
 )
 
 const (
@@ -66,14 +70,58 @@ const (
 	// ControlCollectionName name of the collection of session control data
 	ControlCollectionName = "control"
 
+	// InputCollectionName name of the collection of the session input
+	// recordings
+	InputCollectionName = "input_recordings"
+
+	// RecordingSignaturesCollectionName name of the collection of the
+	// signatures of the session recordings
+	RecordingSignaturesCollectionName = "recording_signatures"
+
+	// RecordingKeysCollectionName name of the collection of the wrapped
+	// data keys encrypting the session recordings
+	RecordingKeysCollectionName = "recording_keys"
+
+	// TenantPoliciesCollectionName name of the collection of tenant policies
+	TenantPoliciesCollectionName = "tenant_policies"
+
+	// RecordingTextCollectionName name of the collection of the decoded
+	// text of the session recordings, for searching the recordings
+	RecordingTextCollectionName = "recording_text"
+
+	// LegalHoldsCollectionName name of the collection of the legal holds
+	// of the session recordings
+	LegalHoldsCollectionName = "legal_holds"
+
+	// RecordedSessionsCollectionName name of the collection cataloguing
+	// the user and the device of the recorded sessions
+	RecordedSessionsCollectionName = "recorded_sessions"
+
 	dbFieldID        = "_id"
 	dbFieldSessionID = "session_id"
 	dbFieldDeviceID  = "device_id"
+	dbFieldUserID    = "user_id"
+	dbFieldTypes     = "types"
+	dbFieldWriters   = "writers"
+	dbFieldEndReason = "end_reason"
+	dbFieldStartTs   = "start_ts"
 	dbFieldStatus    = "status"
 	dbFieldCreatedTs = "created_ts"
 	dbFieldUpdatedTs = "updated_ts"
+	dbFieldLeaseTs   = "lease_expire_ts"
+	dbFieldLines     = "lines"
+	dbFieldExpireTs  = "expire_ts"
+	dbFieldSequence  = "seq"
+	dbFieldHash      = "hash"
+	dbFieldKeyID     = "key_id"
+	dbFieldFormat    = "format"
+	dbFieldOffset    = "offset"
 )
 
+// maxSearchMatches is the maximum number of matching lines returned for
+// each session searching the recordings
+const maxSearchMatches = 10
+
 // SetupDataStore returns the mongo data store and optionally runs migrations
 func SetupDataStore(automigrate bool) (store.DataStore, error) {
 	ctx := context.Background()
@@ -85,8 +133,22 @@ func SetupDataStore(automigrate bool) (store.DataStore, error) {
 	if err != nil {
 		return nil, err
 	}
-	dataStore := NewDataStoreWithClient(dbClient,
-		time.Second*time.Duration(config.Config.GetInt(dconfig.SettingRecordingExpireSec)))
+	encryption, err := setupRecordingEncryption(config.Config)
+	if err != nil {
+		return nil, err
+	}
+	recordings, err := setupRecordingStorage(config.Config, dbClient)
+	if err != nil {
+		return nil, err
+	}
+	dataStore := &DataStoreMongo{
+		client: dbClient,
+		recordingExpire: time.Second *
+			time.Duration(config.Config.GetInt(dconfig.SettingRecordingExpireSec)),
+		encryption: encryption,
+		recordings: recordings,
+		policies:   newRecordingPolicies(recordingPolicyTTL),
+	}
 	return dataStore, nil
 }
 
@@ -175,6 +237,14 @@ type DataStoreMongo struct {
 	// mongodb server.
 	client          *mongo.Client
 	recordingExpire time.Duration
+	// encryption encrypts the recordings at rest, if a master key is
+	// configured
+	encryption *RecordingEncryption
+	// recordings stores the recording streams, in the database if nil
+	recordings store.RecordingStorage
+	// policies caches the retention and the legal hold of the sessions
+	// storing their recordings, if not nil
+	policies *recordingPolicies
 }
 
 // NewDataStoreWithClient initializes a DataStore object
@@ -182,6 +252,7 @@ func NewDataStoreWithClient(client *mongo.Client, expire time.Duration) store.Da
 	return &DataStoreMongo{
 		client:          client,
 		recordingExpire: expire,
+		policies:        newRecordingPolicies(recordingPolicyTTL),
 	}
 }
 
@@ -264,6 +335,11 @@ func (db *DataStoreMongo) UpsertDeviceStatus(
 				dbFieldStatus:    status,
 				dbFieldUpdatedTs: &now,
 			},
+			// the lease of the previous connection, if any, must not
+			// expire the new one before the owning instance renews it
+			"$unset": bson.M{
+				dbFieldLeaseTs: "",
+			},
 			"$setOnInsert": bson.M{
 				dbFieldCreatedTs:     &now,
 				mstore.FieldTenantID: tenantID,
@@ -275,7 +351,11 @@ func (db *DataStoreMongo) UpsertDeviceStatus(
 	return err
 }
 
-// AllocateSession allocates a new session.
+// AllocateSession allocates a new session, enforcing the quotas of
+// concurrent sessions set in the session policy.
+// The session is inserted before counting the sessions, so that concurrent
+// allocations always account for each other: when racing for the last slot
+// of a quota, all of them may be rejected but never exceed the quota.
 func (db *DataStoreMongo) AllocateSession(ctx context.Context, sess *model.Session) error {
 
 	if err := sess.Validate(); err != nil {
@@ -288,6 +368,57 @@ func (db *DataStoreMongo) AllocateSession(ctx context.Context, sess *model.Sessi
 	if err != nil {
 		return errors.Wrap(err, "store: failed to allocate session")
 	}
+	if sess.Policy == nil {
+		return nil
+	}
+
+	quotas := []struct {
+		limit  int
+		filter bson.D
+		err    error
+	}{{
+		limit:  sess.Policy.MaxTenantSessions,
+		filter: bson.D{tenantElem},
+		err:    store.ErrTenantSessionQuota,
+	}, {
+		limit: sess.Policy.MaxUserSessions,
+		filter: bson.D{
+			tenantElem,
+			{Key: dbFieldUserID, Value: sess.UserID},
+		},
+		err: store.ErrUserSessionQuota,
+	}, {
+		limit: sess.Policy.MaxDeviceSessions,
+		filter: bson.D{
+			tenantElem,
+			{Key: dbFieldDeviceID, Value: sess.DeviceID},
+		},
+		err: store.ErrDeviceSessionQuota,
+	}}
+	for _, quota := range quotas {
+		if quota.limit <= 0 {
+			continue
+		}
+		count, err := coll.CountDocuments(ctx, quota.filter)
+		if err == nil && count <= int64(quota.limit) {
+			continue
+		} else if err == nil {
+			err = quota.err
+		} else {
+			err = errors.Wrap(err, "store: failed to count sessions")
+		}
+		_, errDelete := coll.DeleteOne(ctx, bson.D{
+			{Key: dbFieldID, Value: sess.ID},
+			tenantElem,
+		})
+		if errDelete != nil {
+			err = errors.Wrapf(err,
+				"store: failed to release the session: %s",
+				errDelete.Error(),
+			)
+		}
+		return err
+	}
 
 	return nil
 }
@@ -343,6 +474,187 @@ func (db *DataStoreMongo) GetSession(
 	return session, nil
 }
 
+func sessionFilterToQuery(ctx context.Context, filter model.SessionFilter) bson.D {
+	query := bson.D{}
+	if filter.DeviceID != "" {
+		query = append(query, bson.E{Key: dbFieldDeviceID, Value: filter.DeviceID})
+	}
+	if filter.UserID != "" {
+		query = append(query, bson.E{Key: dbFieldUserID, Value: filter.UserID})
+	}
+	if filter.Type != "" {
+		query = append(query, bson.E{Key: dbFieldTypes, Value: filter.Type})
+	}
+	return mstore.WithTenantID(ctx, query)
+}
+
+// FindSessions returns the active sessions matching the filter, sorted
+// by starting time (most recent first).
+func (db *DataStoreMongo) FindSessions(
+	ctx context.Context,
+	filter model.SessionFilter,
+) ([]model.Session, error) {
+	collSess := db.client.
+		Database(DbName).
+		Collection(SessionsCollectionName)
+
+	findOpts := mopts.Find().
+		SetSort(bson.D{
+			{Key: dbFieldStartTs, Value: -1},
+			{Key: dbFieldID, Value: 1},
+		})
+	if filter.Skip > 0 {
+		findOpts.SetSkip(filter.Skip)
+	}
+	if filter.Limit > 0 {
+		findOpts.SetLimit(filter.Limit)
+	}
+	cur, err := collSess.Find(ctx, sessionFilterToQuery(ctx, filter), findOpts)
+	if err != nil {
+		return nil, errors.Wrap(err, "store: failed to query sessions")
+	}
+	sessions := []model.Session{}
+	if err = cur.All(ctx, &sessions); err != nil {
+		return nil, errors.Wrap(err, "store: failed to decode sessions")
+	}
+	return sessions, nil
+}
+
+// CountSessions returns the number of active sessions matching the filter
+func (db *DataStoreMongo) CountSessions(
+	ctx context.Context,
+	filter model.SessionFilter,
+) (int64, error) {
+	collSess := db.client.
+		Database(DbName).
+		Collection(SessionsCollectionName)
+
+	count, err := collSess.CountDocuments(ctx, sessionFilterToQuery(ctx, filter))
+	if err != nil {
+		return -1, errors.Wrap(err, "store: failed to count sessions")
+	}
+	return count, nil
+}
+
+// AddSessionType adds a session type (terminal, port forward) to the
+// session's list of types
+func (db *DataStoreMongo) AddSessionType(
+	ctx context.Context,
+	sessionID, sessionType string,
+) error {
+	collSess := db.client.
+		Database(DbName).
+		Collection(SessionsCollectionName)
+
+	res, err := collSess.UpdateOne(ctx,
+		mstore.WithTenantID(ctx, bson.D{{Key: dbFieldID, Value: sessionID}}),
+		bson.D{{Key: "$addToSet", Value: bson.D{
+			{Key: dbFieldTypes, Value: sessionType},
+		}}},
+	)
+	if err != nil {
+		return errors.Wrap(err, "store: failed to update session")
+	} else if res.MatchedCount == 0 {
+		return store.ErrSessionNotFound
+	}
+	return nil
+}
+
+// AddSessionWriter grants the user write access to the session
+func (db *DataStoreMongo) AddSessionWriter(
+	ctx context.Context,
+	sessionID, userID string,
+) error {
+	return db.updateSessionWriters(ctx, sessionID, "$addToSet", userID)
+}
+
+// RemoveSessionWriter revokes the write access to the session from the user
+func (db *DataStoreMongo) RemoveSessionWriter(
+	ctx context.Context,
+	sessionID, userID string,
+) error {
+	return db.updateSessionWriters(ctx, sessionID, "$pull", userID)
+}
+
+// SetSessionEndReason records the reason why the session ended
+func (db *DataStoreMongo) SetSessionEndReason(
+	ctx context.Context,
+	sessionID, reason string,
+) error {
+	collSess := db.client.
+		Database(DbName).
+		Collection(SessionsCollectionName)
+
+	res, err := collSess.UpdateOne(ctx,
+		mstore.WithTenantID(ctx, bson.D{{Key: dbFieldID, Value: sessionID}}),
+		bson.D{{Key: "$set", Value: bson.D{
+			{Key: dbFieldEndReason, Value: reason},
+		}}},
+	)
+	if err != nil {
+		return errors.Wrap(err, "store: failed to update session")
+	} else if res.MatchedCount == 0 {
+		return store.ErrSessionNotFound
+	}
+	return nil
+}
+
+func (db *DataStoreMongo) updateSessionWriters(
+	ctx context.Context,
+	sessionID, operator, userID string,
+) error {
+	collSess := db.client.
+		Database(DbName).
+		Collection(SessionsCollectionName)
+
+	res, err := collSess.UpdateOne(ctx,
+		mstore.WithTenantID(ctx, bson.D{{Key: dbFieldID, Value: sessionID}}),
+		bson.D{{Key: operator, Value: bson.D{
+			{Key: dbFieldWriters, Value: userID},
+		}}},
+	)
+	if err != nil {
+		return errors.Wrap(err, "store: failed to update session")
+	} else if res.MatchedCount == 0 {
+		return store.ErrSessionNotFound
+	}
+	return nil
+}
+
+// sendTimestampMessage sends the time elapsed since the previous timestamp
+// or input control message as delay messages, of at most math.MaxUint16
+// milliseconds each, reproducing the timing of the recorded output and input.
+func sendTimestampMessage(
+	control app.Control,
+	lastTimestamp *time.Time,
+	sessionID string,
+	w io.Writer,
+) (n int, err error) {
+	var elapsed time.Duration
+	if !lastTimestamp.IsZero() {
+		elapsed = control.Timestamp.Sub(*lastTimestamp)
+	}
+	if control.Timestamp.After(*lastTimestamp) {
+		*lastTimestamp = control.Timestamp
+	}
+	for ms := elapsed.Milliseconds(); ms > 0; ms -= math.MaxUint16 {
+		delayMs := ms
+		if delayMs > math.MaxUint16 {
+			delayMs = math.MaxUint16
+		}
+		sent, err := sendControlMessage(app.Control{
+			Type:    app.DelayMessage,
+			Offset:  control.Offset,
+			DelayMs: uint16(delayMs),
+		}, sessionID, w)
+		n += sent
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
 func sendControlMessage(control app.Control, sessionID string, w io.Writer) (int, error) {
 	messageType := ""
 	var data []byte
@@ -356,6 +668,14 @@ func sendControlMessage(control app.Control, sessionID string, w io.Writer) (int
 		messageType = shell.MessageTypeResizeShell
 		properties[model.ResizeMessageTermHeightField] = control.TerminalHeight
 		properties[model.ResizeMessageTermWidthField] = control.TerminalWidth
+	case app.UserMessage:
+		messageType = model.UserMessageName
+		properties[model.UserMessageIDField] = control.UserID
+	case app.InputMessage:
+		messageType = model.InputMessageName
+		properties[model.UserMessageIDField] = control.UserID
+		properties[model.InputMessageTimestampField] = control.Timestamp.UnixMilli()
+		data = control.Data
 	default:
 		return 0, ErrUnknownControlMessageType
 	}
@@ -382,56 +702,60 @@ func (db *DataStoreMongo) WriteSessionRecords(ctx context.Context,
 	sessionID string,
 	w io.Writer) error {
 	l := log.FromContext(ctx)
-	collRecording := db.client.Database(DbName).
-		Collection(RecordingsCollectionName)
-	collControl := db.client.Database(DbName).
-		Collection(ControlCollectionName)
-
-	findOptions := mopts.Find()
-	sortField := bson.M{
-		"created_ts": 1,
-	}
-	findOptions.SetSort(sortField)
-	recordingsCursor, err := collRecording.Find(ctx,
-		mstore.WithTenantID(ctx, bson.M{
-			dbFieldSessionID: sessionID,
-		}),
-		findOptions,
-	)
+	storage := db.recordingStorage()
+	recordingChunks, err := storage.GetChunks(ctx, sessionID,
+		model.RecordingStreamOutput)
 	if err != nil {
 		return err
 	}
-	defer recordingsCursor.Close(ctx)
+	defer recordingChunks.Close(ctx)
 
-	controlCursor, err := collControl.Find(ctx,
-		mstore.WithTenantID(ctx, bson.M{
-			dbFieldSessionID: sessionID,
-		}),
-		findOptions,
-	)
+	controlChunks, err := storage.GetChunks(ctx, sessionID,
+		model.RecordingStreamControl)
 	if err != nil {
 		return err
 	}
-	defer controlCursor.Close(ctx)
+	defer controlChunks.Close(ctx)
 
-	controlReader := NewControlMessageReader(ctx, controlCursor)
-	recordingReader := NewRecordingReader(ctx, recordingsCursor)
+	inputChunks, err := storage.GetChunks(ctx, sessionID,
+		model.RecordingStreamInput)
+	if err != nil {
+		return err
+	}
+	defer inputChunks.Close(ctx)
+
+	// the input is interleaved with the output, as control messages
+	controlMessageReader := NewControlMessageReader(ctx, controlChunks)
+	controlMessageReader.open = db.chunkOpener(ctx, sessionID,
+		model.RecordingStreamControl)
+	inputMessageReader := NewControlMessageReader(ctx, inputChunks)
+	inputMessageReader.open = db.chunkOpener(ctx, sessionID,
+		model.RecordingStreamInput)
+	controlReader := newMergedMessageReader(controlMessageReader, inputMessageReader)
+	recordingReader := NewRecordingReader(ctx, recordingChunks)
+	recordingReader.open = db.chunkOpener(ctx, sessionID,
+		model.RecordingStreamOutput)
 
 	recordingWriter := NewRecordingWriter(sessionID, w)
 	recordingBuffer := make([]byte, recordingReadBufferSize)
 	recordingBytesSent := 0
+	var lastTimestamp time.Time
 	for {
 		control := controlReader.Pop()
 		if control == nil {
 			l.Debug("WriteSessionRecords: no more control " +
 				"messages, flushing the recording upstream.")
 			//no more control messages, we send the whole recording
-			n, err := io.Copy(recordingWriter, recordingReader)
+			var n int64
+			n, err = io.Copy(recordingWriter, recordingReader)
 			if err != nil && err != io.ErrShortWrite && n < 1 {
 				l.Errorf("WriteSessionRecords: "+
 					"error writing recording data, err: %+v n:%d",
 					err, n)
 			}
+			if err == io.ErrShortWrite {
+				err = nil
+			}
 			if n == 0 {
 				l.Errorf("WriteSessionRecords: "+
 					"failed to write any recording data, err: %+v",
@@ -511,7 +835,14 @@ func (db *DataStoreMongo) WriteSessionRecords(ctx context.Context,
 				recordingBytesSent += n
 			}
 			l.Debugf("WriteSessionRecords: sending %+v.", *control)
-			_, err = sendControlMessage(*control, sessionID, w)
+			if control.Type == app.TimestampMessage ||
+				control.Type == app.InputMessage {
+				_, err = sendTimestampMessage(*control, &lastTimestamp,
+					sessionID, w)
+			}
+			if err == nil && control.Type != app.TimestampMessage {
+				_, err = sendControlMessage(*control, sessionID, w)
+			}
 			if err != nil {
 				l.Errorf("error sending recording data: %s",
 					err.Error())
@@ -527,44 +858,420 @@ func (db *DataStoreMongo) WriteSessionRecords(ctx context.Context,
 // SetSession saves a session recording
 func (db *DataStoreMongo) InsertSessionRecording(ctx context.Context,
 	sessionID string,
-	sessionBytes []byte) error {
-	coll := db.client.Database(DbName).Collection(RecordingsCollectionName)
+	sessionBytes []byte,
+	link model.ChunkLink) error {
+	return db.insertRecordingChunk(ctx, sessionID,
+		model.RecordingStreamOutput, sessionBytes, link)
+}
 
-	now := clock.Now().UTC()
-	recording := model.Recording{
-		ID:        uuid.New(),
+// Inserts control data recording
+func (db *DataStoreMongo) InsertControlRecording(ctx context.Context,
+	sessionID string,
+	sessionBytes []byte,
+	link model.ChunkLink) error {
+	return db.insertRecordingChunk(ctx, sessionID,
+		model.RecordingStreamControl, sessionBytes, link)
+}
+
+// InsertInputRecording inserts a chunk of the input recording of a session
+func (db *DataStoreMongo) InsertInputRecording(ctx context.Context,
+	sessionID string,
+	inputBytes []byte,
+	link model.ChunkLink) error {
+	return db.insertRecordingChunk(ctx, sessionID,
+		model.RecordingStreamInput, inputBytes, link)
+}
+
+// recordingStorage returns the storage of the recording streams, the
+// collections of the database by default
+func (db *DataStoreMongo) recordingStorage() store.RecordingStorage {
+	if db.recordings != nil {
+		return db.recordings
+	}
+	return NewRecordingStorage(db.client)
+}
+
+// insertRecordingChunk encrypts, if enabled, and stores a chunk of a
+// recording stream
+func (db *DataStoreMongo) insertRecordingChunk(ctx context.Context,
+	sessionID, stream string,
+	data []byte,
+	link model.ChunkLink) error {
+	return db.InsertRecordingChunks(ctx, []model.StoredChunk{{
 		SessionID: sessionID,
-		Recording: sessionBytes,
-		CreatedTs: now,
-		ExpireTs:  now.Add(db.recordingExpire),
+		Stream:    stream,
+		ChunkLink: link,
+		Data:      data,
+	}})
+}
+
+// InsertRecordingChunks encrypts, if enabled, and stores chunks of the
+// recording streams at once; the chunks without creation time are created
+// now, and all expire after the retention of the tenant from their creation
+// but the chunks of the sessions on legal hold.
+func (db *DataStoreMongo) InsertRecordingChunks(
+	ctx context.Context,
+	chunks []model.StoredChunk,
+) error {
+	policies := make(map[string]recordingPolicy, 1)
+	for i := range chunks {
+		sessionID := chunks[i].SessionID
+		if _, ok := policies[sessionID]; ok {
+			continue
+		}
+		policy, err := db.recordingPolicy(ctx, sessionID)
+		if err != nil {
+			return err
+		}
+		policies[sessionID] = policy
+	}
+	now := clock.Now().UTC()
+	stored := make([]*model.StoredChunk, len(chunks))
+	for i := range chunks {
+		var err error
+		chunk := chunks[i]
+		chunk.Data, chunk.KeyID, err = db.sealRecordingChunk(ctx,
+			chunk.SessionID, chunk.Stream, chunk.Data)
+		if err != nil {
+			return err
+		}
+		if chunk.CreatedTs.IsZero() {
+			chunk.CreatedTs = now
+		}
+		chunk.ExpireTs = policies[chunk.SessionID].expireTs(chunk.CreatedTs)
+		stored[i] = &chunk
+	}
+	return db.recordingStorage().PutChunks(ctx, stored)
+}
+
+// GetRecordingChunks returns the chunks of a recording stream of a session,
+// in the order of the chain
+func (db *DataStoreMongo) GetRecordingChunks(ctx context.Context,
+	sessionID, stream string) ([]model.RecordingChunk, error) {
+	it, err := db.recordingStorage().GetChunks(ctx, sessionID, stream)
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close(ctx)
+
+	var chunks []model.RecordingChunk
+	for it.Next(ctx) {
+		stored := it.Chunk()
+		data, err := db.openRecordingChunk(ctx, sessionID, stream,
+			stored.KeyID, stored.Data)
+		if err != nil {
+			return nil, err
+		}
+		chunks = append(chunks, model.RecordingChunk{
+			ChunkLink: stored.ChunkLink,
+			Data:      data,
+		})
+	}
+	if err := it.Err(); err != nil {
+		return nil, errors.Wrap(err, "store: failed to get the recording chunks")
 	}
-	_, err := coll.InsertOne(ctx,
-		mstore.WithTenantID(ctx, &recording),
+	return chunks, nil
+}
+
+// DeleteExpiredRecordings deletes the chunks of the recordings which
+// expired before the time, if the recording storage does not expire them
+func (db *DataStoreMongo) DeleteExpiredRecordings(ctx context.Context,
+	before time.Time) (int, error) {
+	return db.recordingStorage().DeleteExpiredChunks(ctx, before)
+}
+
+// InsertRecordingSignature stores the signature of a session recording,
+// expiring with the recording
+func (db *DataStoreMongo) InsertRecordingSignature(ctx context.Context,
+	signature *model.RecordingSignature) error {
+	coll := db.client.Database(DbName).
+		Collection(RecordingSignaturesCollectionName)
+
+	now := clock.Now().UTC()
+	expire, err := db.recordingExpireTs(ctx, signature.SessionID, now)
+	if err != nil {
+		return err
+	}
+	signature.CreatedTs = now
+	signature.ExpireTs = expire
+	_, err = coll.InsertOne(ctx,
+		mstore.WithTenantID(ctx, signature),
 	)
-	return err
+	if mongo.IsDuplicateKeyError(err) {
+		return store.ErrRecordingSigned
+	} else if err != nil {
+		return errors.Wrap(err, "store: failed to insert the recording signature")
+	}
+	return nil
 }
 
-// Inserts control data recording
-func (db *DataStoreMongo) InsertControlRecording(ctx context.Context,
-	sessionID string,
-	sessionBytes []byte) error {
+// GetRecordingSignature returns the signature of a session recording, or
+// nil if the recording is not signed
+func (db *DataStoreMongo) GetRecordingSignature(ctx context.Context,
+	sessionID string) (*model.RecordingSignature, error) {
+	coll := db.client.Database(DbName).
+		Collection(RecordingSignaturesCollectionName)
+
+	signature := &model.RecordingSignature{}
+	err := coll.FindOne(ctx,
+		mstore.WithTenantID(ctx, bson.M{dbFieldID: sessionID}),
+	).Decode(signature)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "store: failed to get the recording signature")
+	}
+	return signature, nil
+}
+
+// InsertRecordingText indexes the decoded text of a chunk of a session
+// recording; the text expires with the recording.
+func (db *DataStoreMongo) InsertRecordingText(ctx context.Context,
+	text *model.RecordingText) error {
 	coll := db.client.Database(DbName).
-		Collection(ControlCollectionName)
+		Collection(RecordingTextCollectionName)
 
 	now := clock.Now().UTC()
-	recording := model.ControlData{
-		ID:        uuid.New(),
-		SessionID: sessionID,
-		Control:   sessionBytes,
-		CreatedTs: now,
-		ExpireTs:  now.Add(db.recordingExpire),
+	expire, err := db.recordingExpireTs(ctx, text.SessionID, now)
+	if err != nil {
+		return err
 	}
-	_, err := coll.InsertOne(ctx,
-		mstore.WithTenantID(ctx, &recording),
+	text.ID = uuid.New()
+	text.CreatedTs = now
+	text.ExpireTs = expire
+	_, err = coll.InsertOne(ctx,
+		mstore.WithTenantID(ctx, text),
 	)
 	return err
 }
 
+// SearchRecordings looks up the session recordings with lines matching the
+// query, case-insensitively; the sessions are sorted by the most recent
+// match, and up to maxSearchMatches lines are returned for each session.
+func (db *DataStoreMongo) SearchRecordings(ctx context.Context,
+	filter model.SearchFilter) ([]model.SearchResult, error) {
+	coll := db.client.Database(DbName).
+		Collection(RecordingTextCollectionName)
+
+	pattern := regexp.QuoteMeta(filter.Query)
+	match := bson.D{
+		{Key: dbFieldLines + ".text", Value: primitive.Regex{
+			Pattern: pattern,
+			Options: "i",
+		}},
+	}
+	if filter.DeviceID != "" {
+		match = append(match, bson.E{Key: dbFieldDeviceID, Value: filter.DeviceID})
+	}
+	if filter.UserID != "" {
+		match = append(match, bson.E{Key: dbFieldUserID, Value: filter.UserID})
+	}
+	if filter.From != nil || filter.To != nil {
+		createdTs := bson.D{}
+		if filter.From != nil {
+			createdTs = append(createdTs, bson.E{Key: "$gte", Value: *filter.From})
+		}
+		if filter.To != nil {
+			createdTs = append(createdTs, bson.E{Key: "$lt", Value: *filter.To})
+		}
+		match = append(match, bson.E{Key: dbFieldCreatedTs, Value: createdTs})
+	}
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: mstore.WithTenantID(ctx, match)}},
+		{{Key: "$project", Value: bson.M{
+			dbFieldSessionID: 1,
+			dbFieldDeviceID:  1,
+			dbFieldUserID:    1,
+			dbFieldCreatedTs: 1,
+			dbFieldLines: bson.M{"$filter": bson.M{
+				"input": "$" + dbFieldLines,
+				"cond": bson.M{"$regexMatch": bson.M{
+					"input":   "$$this.text",
+					"regex":   pattern,
+					"options": "i",
+				}},
+			}},
+		}}},
+		{{Key: "$unwind", Value: "$" + dbFieldLines}},
+		{{Key: "$sort", Value: bson.D{
+			{Key: dbFieldCreatedTs, Value: 1},
+			{Key: dbFieldLines + ".offset", Value: 1},
+		}}},
+		{{Key: "$group", Value: bson.M{
+			dbFieldID:       "$" + dbFieldSessionID,
+			dbFieldDeviceID: bson.M{"$first": "$" + dbFieldDeviceID},
+			dbFieldUserID:   bson.M{"$first": "$" + dbFieldUserID},
+			"last_ts":       bson.M{"$max": "$" + dbFieldCreatedTs},
+			"matches": bson.M{"$push": bson.M{
+				"offset":    "$" + dbFieldLines + ".offset",
+				"snippet":   "$" + dbFieldLines + ".text",
+				"timestamp": "$" + dbFieldCreatedTs,
+			}},
+		}}},
+		{{Key: "$sort", Value: bson.D{
+			{Key: "last_ts", Value: -1},
+			{Key: dbFieldID, Value: 1},
+		}}},
+	}
+	if filter.Skip > 0 {
+		pipeline = append(pipeline, bson.D{{Key: "$skip", Value: filter.Skip}})
+	}
+	if filter.Limit > 0 {
+		pipeline = append(pipeline, bson.D{{Key: "$limit", Value: filter.Limit}})
+	}
+	pipeline = append(pipeline, bson.D{{Key: "$project", Value: bson.M{
+		dbFieldDeviceID: 1,
+		dbFieldUserID:   1,
+		"matches":       bson.M{"$slice": bson.A{"$matches", maxSearchMatches}},
+	}}})
+
+	cur, err := coll.Aggregate(ctx, pipeline,
+		mopts.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return nil, errors.Wrap(err, "mongo: failed to search the recordings")
+	}
+	results := []model.SearchResult{}
+	if err = cur.All(ctx, &results); err != nil {
+		return nil, errors.Wrap(err, "mongo: failed to decode the search results")
+	}
+	return results, nil
+}
+
+// RenewSessionLeases extends the leases of the sessions held by the
+// instance up to the expire time. Session IDs are unique across tenants.
+func (db *DataStoreMongo) RenewSessionLeases(
+	ctx context.Context,
+	sessionIDs []string,
+	expire time.Time,
+) error {
+	return db.renewLeases(ctx, SessionsCollectionName, sessionIDs, expire)
+}
+
+// RenewDeviceLeases extends the leases of the device connections held by
+// the instance up to the expire time. Device IDs are unique across tenants.
+func (db *DataStoreMongo) RenewDeviceLeases(
+	ctx context.Context,
+	deviceIDs []string,
+	expire time.Time,
+) error {
+	return db.renewLeases(ctx, DevicesCollectionName, deviceIDs, expire)
+}
+
+func (db *DataStoreMongo) renewLeases(
+	ctx context.Context,
+	collName string,
+	ids []string,
+	expire time.Time,
+) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	coll := db.client.Database(DbName).Collection(collName)
+	_, err := coll.UpdateMany(ctx,
+		bson.D{{Key: dbFieldID, Value: bson.D{{Key: "$in", Value: ids}}}},
+		bson.D{{Key: "$set", Value: bson.D{
+			{Key: dbFieldLeaseTs, Value: expire},
+		}}},
+	)
+	if err != nil {
+		return errors.Wrapf(err, "store: failed to renew the %s leases", collName)
+	}
+	return nil
+}
+
+// DeleteExpiredSession deletes one of the sessions whose lease expired
+// before the given time, across all tenants, and returns it; it returns
+// nil if there are no expired sessions. Deleting the sessions one at a
+// time guarantees each of them is released by a single caller.
+func (db *DataStoreMongo) DeleteExpiredSession(
+	ctx context.Context,
+	before time.Time,
+) (*model.Session, error) {
+	collSess := db.client.Database(DbName).Collection(SessionsCollectionName)
+
+	sess := new(model.Session)
+	err := collSess.FindOneAndDelete(ctx, bson.D{
+		{Key: dbFieldLeaseTs, Value: bson.D{{Key: "$lt", Value: before}}},
+	}).Decode(sess)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "store: failed to delete expired session")
+	}
+	return sess, nil
+}
+
+// DisconnectExpiredDevices marks as disconnected the connected devices,
+// across all tenants, whose lease expired before the given time and returns
+// the number of devices updated.
+func (db *DataStoreMongo) DisconnectExpiredDevices(
+	ctx context.Context,
+	before time.Time,
+) (int64, error) {
+	coll := db.client.Database(DbName).Collection(DevicesCollectionName)
+
+	now := clock.Now().UTC()
+	res, err := coll.UpdateMany(ctx,
+		bson.D{
+			{Key: dbFieldStatus, Value: model.DeviceStatusConnected},
+			{Key: dbFieldLeaseTs, Value: bson.D{{Key: "$lt", Value: before}}},
+		},
+		bson.D{
+			{Key: "$set", Value: bson.D{
+				{Key: dbFieldStatus, Value: model.DeviceStatusDisconnected},
+				{Key: dbFieldUpdatedTs, Value: now},
+			}},
+			{Key: "$unset", Value: bson.D{
+				{Key: dbFieldLeaseTs, Value: ""},
+			}},
+		},
+	)
+	if err != nil {
+		return 0, errors.Wrap(err, "store: failed to disconnect expired devices")
+	}
+	return res.ModifiedCount, nil
+}
+
+// GetTenantPolicy returns the session policy of the tenant, or nil if the
+// tenant has no policy
+func (db *DataStoreMongo) GetTenantPolicy(
+	ctx context.Context,
+	tenantID string,
+) (*model.TenantPolicy, error) {
+	coll := db.client.Database(DbName).Collection(TenantPoliciesCollectionName)
+
+	policy := &model.TenantPolicy{}
+	err := coll.FindOne(ctx, bson.M{dbFieldID: tenantID}).Decode(policy)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "store: failed to get tenant policy")
+	}
+	return policy, nil
+}
+
+// SetTenantPolicy replaces the session policy of the tenant
+func (db *DataStoreMongo) SetTenantPolicy(
+	ctx context.Context,
+	tenantID string,
+	policy *model.TenantPolicy,
+) error {
+	coll := db.client.Database(DbName).Collection(TenantPoliciesCollectionName)
+
+	replaceOpts := &mopts.ReplaceOptions{}
+	replaceOpts.SetUpsert(true)
+	_, err := coll.ReplaceOne(ctx,
+		bson.M{dbFieldID: tenantID},
+		policy,
+		replaceOpts,
+	)
+	if err != nil {
+		return errors.Wrap(err, "store: failed to set tenant policy")
+	}
+	return nil
+}
+
 // Close disconnects the client
 func (db *DataStoreMongo) Close() error {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
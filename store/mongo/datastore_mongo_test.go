@@ -19,6 +19,7 @@ import (
 	"compress/gzip"
 	"context"
 	"encoding/base64"
+	"fmt"
 	"testing"
 	"time"
 
@@ -29,12 +30,15 @@ import (
 	"github.com/google/uuid"
 	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	mopts "go.mongodb.org/mongo-driver/mongo/options"
 
+	"github.com/mendersoftware/deviceconnect/app"
 	"github.com/mendersoftware/deviceconnect/model"
 	"github.com/mendersoftware/deviceconnect/store"
+	"github.com/mendersoftware/deviceconnect/store/objectstore"
 	"github.com/mendersoftware/go-lib-micro/identity"
 	mstore "github.com/mendersoftware/go-lib-micro/store/v2"
 )
@@ -229,6 +233,101 @@ func TestAllocateSession(t *testing.T) {
 	}
 }
 
+func TestAllocateSessionQuota(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping TestAllocateSessionQuota in short mode.")
+	}
+	const (
+		tenantID = "123456789012345678901234"
+		userID   = "9f56b9c3-d510-4107-9686-8a1c4969e02d"
+		deviceID = "818c6ec3-051e-42ce-be79-7f75bc2b2da9"
+	)
+	testCases := []struct {
+		Name string
+
+		Existing []model.Session
+		Policy   *model.SessionPolicy
+
+		Erre error
+	}{{
+		Name: "ok, no policy",
+
+		Existing: []model.Session{{UserID: userID, DeviceID: deviceID}},
+	}, {
+		Name: "ok, within the quotas",
+
+		Existing: []model.Session{{UserID: userID, DeviceID: "another-device"}},
+		Policy: &model.SessionPolicy{
+			MaxTenantSessions: 2,
+			MaxUserSessions:   2,
+			MaxDeviceSessions: 1,
+		},
+	}, {
+		Name: "error, tenant quota exceeded",
+
+		Existing: []model.Session{{UserID: "another-user", DeviceID: "another-device"}},
+		Policy: &model.SessionPolicy{
+			MaxTenantSessions: 1,
+		},
+		Erre: store.ErrTenantSessionQuota,
+	}, {
+		Name: "error, user quota exceeded",
+
+		Existing: []model.Session{{UserID: userID, DeviceID: "another-device"}},
+		Policy: &model.SessionPolicy{
+			MaxUserSessions:   1,
+			MaxDeviceSessions: 1,
+		},
+		Erre: store.ErrUserSessionQuota,
+	}, {
+		Name: "error, device quota exceeded",
+
+		Existing: []model.Session{{UserID: "another-user", DeviceID: deviceID}},
+		Policy: &model.SessionPolicy{
+			MaxUserSessions:   1,
+			MaxDeviceSessions: 1,
+		},
+		Erre: store.ErrDeviceSessionQuota,
+	}}
+
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.Name, func(t *testing.T) {
+			ds := DataStoreMongo{client: db.Client()}
+			defer ds.DropDatabase()
+			ctx := context.Background()
+
+			for i, sess := range tc.Existing {
+				sess.ID = fmt.Sprintf("existing-%d", i)
+				sess.TenantID = tenantID
+				sess.StartTS = time.Now()
+				err := ds.AllocateSession(ctx, &sess)
+				require.NoError(t, err)
+			}
+
+			sess := &model.Session{
+				ID:       "0ff7cda3-a398-43b0-9776-6622cb6aa110",
+				UserID:   userID,
+				DeviceID: deviceID,
+				TenantID: tenantID,
+				StartTS:  time.Now(),
+				Policy:   tc.Policy,
+			}
+			err := ds.AllocateSession(ctx, sess)
+			if tc.Erre != nil {
+				assert.EqualError(t, err, tc.Erre.Error())
+				count, err := db.Client().Database(DbName).
+					Collection(SessionsCollectionName).
+					CountDocuments(ctx, bson.M{"_id": sess.ID})
+				assert.NoError(t, err)
+				assert.Zero(t, count, "the session was not released")
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
 func TestDeleteSession(t *testing.T) {
 	if testing.Short() {
 		t.Skip("skipping TestDeleteSession in short mode.")
@@ -426,6 +525,807 @@ func TestGetSession(t *testing.T) {
 	}
 }
 
+func TestFindSessions(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping TestFindSessions in short mode.")
+	}
+	const tenantID = "000000000000000000000000"
+	now := time.Now().UTC().Round(time.Second)
+	sessions := []model.Session{{
+		ID:       "00000000-0000-0000-0000-000000000000",
+		UserID:   "00000000-0000-0000-0000-000000000001",
+		DeviceID: "00000000-0000-0000-0000-000000000002",
+		TenantID: tenantID,
+		Types:    []string{model.SessionTypeTerminal},
+		StartTS:  now.Add(-time.Minute),
+	}, {
+		ID:       "00000000-0000-0000-0000-000000000003",
+		UserID:   "00000000-0000-0000-0000-000000000001",
+		DeviceID: "00000000-0000-0000-0000-000000000004",
+		TenantID: tenantID,
+		Types:    []string{model.SessionTypePortForward},
+		StartTS:  now,
+	}, {
+		ID:       "00000000-0000-0000-0000-000000000005",
+		UserID:   "00000000-0000-0000-0000-000000000006",
+		DeviceID: "00000000-0000-0000-0000-000000000002",
+		TenantID: "123456789012345678901234",
+		StartTS:  now,
+	}}
+	testCases := []struct {
+		Name string
+
+		Filter model.SessionFilter
+
+		Sessions []model.Session
+		Count    int64
+	}{{
+		Name: "ok, all tenant sessions",
+
+		Sessions: []model.Session{sessions[1], sessions[0]},
+		Count:    2,
+	}, {
+		Name: "ok, by device",
+
+		Filter: model.SessionFilter{
+			DeviceID: "00000000-0000-0000-0000-000000000002",
+		},
+		Sessions: []model.Session{sessions[0]},
+		Count:    1,
+	}, {
+		Name: "ok, by user and type",
+
+		Filter: model.SessionFilter{
+			UserID: "00000000-0000-0000-0000-000000000001",
+			Type:   model.SessionTypePortForward,
+		},
+		Sessions: []model.Session{sessions[1]},
+		Count:    1,
+	}, {
+		Name: "ok, paginated",
+
+		Filter: model.SessionFilter{
+			Skip:  1,
+			Limit: 1,
+		},
+		Sessions: []model.Session{sessions[0]},
+		Count:    2,
+	}}
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.Name, func(t *testing.T) {
+			ds := &DataStoreMongo{client: db.Client()}
+			defer ds.DropDatabase()
+
+			for _, sess := range sessions {
+				err := ds.AllocateSession(context.Background(), &sess)
+				if err != nil {
+					panic(errors.Wrap(err,
+						"[TEST ERR] Failed to prepare test case",
+					))
+				}
+			}
+			ctx := identity.WithContext(context.Background(),
+				&identity.Identity{Tenant: tenantID},
+			)
+
+			res, err := ds.FindSessions(ctx, tc.Filter)
+			if assert.NoError(t, err) {
+				assert.Equal(t, tc.Sessions, res)
+			}
+			count, err := ds.CountSessions(ctx, tc.Filter)
+			if assert.NoError(t, err) {
+				assert.Equal(t, tc.Count, count)
+			}
+		})
+	}
+}
+
+func TestAddSessionType(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping TestAddSessionType in short mode.")
+	}
+	ds := &DataStoreMongo{client: db.Client()}
+	defer ds.DropDatabase()
+
+	ctx := context.Background()
+	sess := &model.Session{
+		ID:       "00000000-0000-0000-0000-000000000000",
+		UserID:   "00000000-0000-0000-0000-000000000001",
+		DeviceID: "00000000-0000-0000-0000-000000000002",
+		StartTS:  time.Now().UTC().Round(time.Second),
+	}
+	err := ds.AllocateSession(ctx, sess)
+	assert.NoError(t, err)
+
+	err = ds.AddSessionType(ctx, sess.ID, model.SessionTypeTerminal)
+	assert.NoError(t, err)
+	err = ds.AddSessionType(ctx, sess.ID, model.SessionTypeTerminal)
+	assert.NoError(t, err)
+	err = ds.AddSessionType(ctx, sess.ID, model.SessionTypePortForward)
+	assert.NoError(t, err)
+
+	res, err := ds.GetSession(ctx, sess.ID)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{
+			model.SessionTypeTerminal,
+			model.SessionTypePortForward,
+		}, res.Types)
+	}
+
+	err = ds.AddSessionType(ctx, "not-found", model.SessionTypeTerminal)
+	assert.EqualError(t, err, store.ErrSessionNotFound.Error())
+}
+
+func TestSessionWriters(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping TestSessionWriters in short mode.")
+	}
+	ds := &DataStoreMongo{client: db.Client()}
+	defer ds.DropDatabase()
+
+	ctx := context.Background()
+	sess := &model.Session{
+		ID:       "00000000-0000-0000-0000-000000000000",
+		UserID:   "00000000-0000-0000-0000-000000000001",
+		DeviceID: "00000000-0000-0000-0000-000000000002",
+		StartTS:  time.Now().UTC().Round(time.Second),
+	}
+	err := ds.AllocateSession(ctx, sess)
+	assert.NoError(t, err)
+
+	const (
+		writer1 = "00000000-0000-0000-0000-000000000003"
+		writer2 = "00000000-0000-0000-0000-000000000004"
+	)
+	err = ds.AddSessionWriter(ctx, sess.ID, writer1)
+	assert.NoError(t, err)
+	err = ds.AddSessionWriter(ctx, sess.ID, writer1)
+	assert.NoError(t, err)
+	err = ds.AddSessionWriter(ctx, sess.ID, writer2)
+	assert.NoError(t, err)
+
+	res, err := ds.GetSession(ctx, sess.ID)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{writer1, writer2}, res.Writers)
+	}
+
+	err = ds.RemoveSessionWriter(ctx, sess.ID, writer1)
+	assert.NoError(t, err)
+	res, err = ds.GetSession(ctx, sess.ID)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{writer2}, res.Writers)
+	}
+
+	err = ds.AddSessionWriter(ctx, "not-found", writer1)
+	assert.EqualError(t, err, store.ErrSessionNotFound.Error())
+	err = ds.RemoveSessionWriter(ctx, "not-found", writer1)
+	assert.EqualError(t, err, store.ErrSessionNotFound.Error())
+}
+
+func TestSetSessionEndReason(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping TestSetSessionEndReason in short mode.")
+	}
+	ds := &DataStoreMongo{client: db.Client()}
+	defer ds.DropDatabase()
+
+	ctx := context.Background()
+	sess := &model.Session{
+		ID:       "00000000-0000-0000-0000-000000000000",
+		UserID:   "00000000-0000-0000-0000-000000000001",
+		DeviceID: "00000000-0000-0000-0000-000000000002",
+		StartTS:  time.Now().UTC().Round(time.Second),
+	}
+	err := ds.AllocateSession(ctx, sess)
+	assert.NoError(t, err)
+
+	err = ds.SetSessionEndReason(ctx, sess.ID, model.SessionEndReasonIdle)
+	assert.NoError(t, err)
+
+	res, err := ds.DeleteSession(ctx, sess.ID)
+	if assert.NoError(t, err) {
+		assert.Equal(t, model.SessionEndReasonIdle, res.EndReason)
+	}
+
+	err = ds.SetSessionEndReason(ctx, sess.ID, model.SessionEndReasonIdle)
+	assert.EqualError(t, err, store.ErrSessionNotFound.Error())
+}
+
+func TestSessionLeases(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping TestSessionLeases in short mode.")
+	}
+	ds := &DataStoreMongo{client: db.Client()}
+	defer ds.DropDatabase()
+
+	ctx := context.Background()
+	now := time.Now().UTC().Round(time.Millisecond)
+	sessions := []*model.Session{{
+		ID:            "00000000-0000-0000-0000-000000000000",
+		UserID:        "00000000-0000-0000-0000-000000000001",
+		DeviceID:      "00000000-0000-0000-0000-000000000002",
+		TenantID:      "tenant1",
+		Types:         []string{model.SessionTypeTerminal},
+		StartTS:       now,
+		LeaseExpireTs: now.Add(-time.Minute),
+	}, {
+		ID:            "00000000-0000-0000-0000-000000000010",
+		UserID:        "00000000-0000-0000-0000-000000000001",
+		DeviceID:      "00000000-0000-0000-0000-000000000002",
+		TenantID:      "tenant2",
+		StartTS:       now,
+		LeaseExpireTs: now.Add(-time.Minute),
+	}, {
+		ID:       "00000000-0000-0000-0000-000000000020",
+		UserID:   "00000000-0000-0000-0000-000000000001",
+		DeviceID: "00000000-0000-0000-0000-000000000002",
+		TenantID: "tenant1",
+		StartTS:  now,
+	}}
+	for _, sess := range sessions {
+		err := ds.AllocateSession(ctx, sess)
+		require.NoError(t, err)
+	}
+
+	err := ds.RenewSessionLeases(ctx,
+		[]string{sessions[1].ID}, now.Add(time.Minute))
+	require.NoError(t, err)
+
+	sess, err := ds.DeleteExpiredSession(ctx, now)
+	require.NoError(t, err)
+	if assert.NotNil(t, sess) {
+		assert.Equal(t, sessions[0].ID, sess.ID)
+		assert.Equal(t, "tenant1", sess.TenantID)
+		assert.Equal(t, []string{model.SessionTypeTerminal}, sess.Types)
+	}
+
+	// the renewed session and the session without lease are kept
+	sess, err = ds.DeleteExpiredSession(ctx, now)
+	assert.NoError(t, err)
+	assert.Nil(t, sess)
+
+	sess, err = ds.DeleteExpiredSession(ctx, now.Add(2*time.Minute))
+	require.NoError(t, err)
+	if assert.NotNil(t, sess) {
+		assert.Equal(t, sessions[1].ID, sess.ID)
+		assert.Equal(t, "tenant2", sess.TenantID)
+	}
+
+	err = ds.RenewSessionLeases(ctx, nil, now)
+	assert.NoError(t, err)
+}
+
+func TestDeviceLeases(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping TestDeviceLeases in short mode.")
+	}
+	ds := &DataStoreMongo{client: db.Client()}
+	defer ds.DropDatabase()
+
+	ctx := context.Background()
+	now := time.Now().UTC().Round(time.Millisecond)
+	devices := []struct {
+		tenantID string
+		deviceID string
+	}{
+		{tenantID: "tenant1", deviceID: "device1"},
+		{tenantID: "tenant2", deviceID: "device2"},
+		{tenantID: "tenant1", deviceID: "device3"},
+	}
+	for _, dev := range devices {
+		err := ds.UpsertDeviceStatus(ctx, dev.tenantID, dev.deviceID,
+			model.DeviceStatusConnected)
+		require.NoError(t, err)
+	}
+
+	err := ds.RenewDeviceLeases(ctx,
+		[]string{"device1", "device2"}, now.Add(-time.Minute))
+	require.NoError(t, err)
+	err = ds.RenewDeviceLeases(ctx, []string{"device2"}, now.Add(time.Minute))
+	require.NoError(t, err)
+
+	count, err := ds.DisconnectExpiredDevices(ctx, now)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), count)
+
+	device, err := ds.GetDevice(ctx, "tenant1", "device1")
+	require.NoError(t, err)
+	assert.Equal(t, model.DeviceStatusDisconnected, device.Status)
+	assert.True(t, device.LeaseExpireTs.IsZero())
+
+	// the device with a valid lease and the device without lease are kept
+	for _, dev := range devices[1:] {
+		device, err := ds.GetDevice(ctx, dev.tenantID, dev.deviceID)
+		require.NoError(t, err)
+		assert.Equal(t, model.DeviceStatusConnected, device.Status)
+	}
+
+	// a new connection discards the expired lease of the previous one
+	err = ds.RenewDeviceLeases(ctx, []string{"device2"}, now.Add(-time.Minute))
+	require.NoError(t, err)
+	err = ds.UpsertDeviceStatus(ctx, "tenant2", "device2", model.DeviceStatusConnected)
+	require.NoError(t, err)
+	count, err = ds.DisconnectExpiredDevices(ctx, now)
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), count)
+}
+
+func TestTenantPolicy(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping TestTenantPolicy in short mode.")
+	}
+	ds := &DataStoreMongo{client: db.Client()}
+	defer ds.DropDatabase()
+
+	ctx := context.Background()
+	const tenantID = "000000000000000000000000"
+
+	policy, err := ds.GetTenantPolicy(ctx, tenantID)
+	assert.NoError(t, err)
+	assert.Nil(t, policy)
+
+	idleTimeout := 300
+	err = ds.SetTenantPolicy(ctx, tenantID, &model.TenantPolicy{
+		IdleTimeout: &idleTimeout,
+	})
+	assert.NoError(t, err)
+	policy, err = ds.GetTenantPolicy(ctx, tenantID)
+	if assert.NoError(t, err) && assert.NotNil(t, policy) {
+		assert.Equal(t, &idleTimeout, policy.IdleTimeout)
+	}
+
+	err = ds.SetTenantPolicy(ctx, tenantID, &model.TenantPolicy{})
+	assert.NoError(t, err)
+	policy, err = ds.GetTenantPolicy(ctx, tenantID)
+	if assert.NoError(t, err) && assert.NotNil(t, policy) {
+		assert.Nil(t, policy.IdleTimeout)
+	}
+
+	policy, err = ds.GetTenantPolicy(ctx, "another-tenant")
+	assert.NoError(t, err)
+	assert.Nil(t, policy)
+}
+
+func TestRecordingChunks(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping TestRecordingChunks in short mode.")
+	}
+	ds := &DataStoreMongo{client: db.Client(), recordingExpire: time.Hour}
+	defer ds.DropDatabase()
+
+	ctx := identity.WithContext(context.Background(), &identity.Identity{
+		Tenant: "000000000000000000000000",
+	})
+	const sessionID = "00000000-0000-0000-0000-000000000001"
+
+	chain := model.NewRecordingChain(sessionID)
+	var expected []model.RecordingChunk
+	for _, data := range []string{"one", "two", "three"} {
+		link := chain.Next([]byte(data))
+		err := ds.InsertControlRecording(ctx, sessionID, []byte(data), link)
+		assert.NoError(t, err)
+		chain.Advance(link)
+		expected = append(expected, model.RecordingChunk{
+			ChunkLink: link,
+			Data:      []byte(data),
+		})
+	}
+	chunks, err := ds.GetRecordingChunks(ctx, sessionID, model.RecordingStreamControl)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, chunks)
+
+	chunks, err = ds.GetRecordingChunks(ctx, sessionID, model.RecordingStreamOutput)
+	assert.NoError(t, err)
+	assert.Empty(t, chunks)
+
+	_, err = ds.GetRecordingChunks(ctx, sessionID, "keystrokes")
+	assert.ErrorIs(t, err, ErrUnknownRecordingStream)
+
+	signature, err := ds.GetRecordingSignature(ctx, sessionID)
+	assert.NoError(t, err)
+	assert.Nil(t, signature)
+
+	err = ds.InsertRecordingSignature(ctx, &model.RecordingSignature{
+		SessionID: sessionID,
+		KeyID:     "key",
+		Digest:    []byte("digest"),
+		Signature: []byte("signature"),
+	})
+	assert.NoError(t, err)
+	signature, err = ds.GetRecordingSignature(ctx, sessionID)
+	if assert.NoError(t, err) && assert.NotNil(t, signature) {
+		assert.Equal(t, "key", signature.KeyID)
+		assert.Equal(t, []byte("signature"), signature.Signature)
+	}
+	err = ds.InsertRecordingSignature(ctx, &model.RecordingSignature{
+		SessionID: sessionID,
+	})
+	assert.ErrorIs(t, err, store.ErrRecordingSigned)
+}
+
+func TestRecordingRetention(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping TestRecordingRetention in short mode.")
+	}
+	ds := &DataStoreMongo{client: db.Client(), recordingExpire: time.Hour}
+	defer ds.DropDatabase()
+
+	const (
+		tenantID      = "000000000000000000000000"
+		sessionID     = "00000000-0000-0000-0000-000000000001"
+		heldSessionID = "00000000-0000-0000-0000-000000000002"
+	)
+	ctx := identity.WithContext(context.Background(), &identity.Identity{
+		Tenant: tenantID,
+	})
+	recordings := db.Client().Database(DbName).Collection(RecordingsCollectionName)
+	expiry := func(sessionID string) []time.Duration {
+		cursor, err := recordings.Find(ctx, bson.M{dbFieldSessionID: sessionID})
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		var docs []model.Recording
+		assert.NoError(t, cursor.All(ctx, &docs))
+		var expiry []time.Duration
+		for _, doc := range docs {
+			if doc.ExpireTs.IsZero() {
+				expiry = append(expiry, 0)
+			} else {
+				expiry = append(expiry, doc.ExpireTs.Sub(doc.CreatedTs))
+			}
+		}
+		return expiry
+	}
+
+	// the recordings expire after the recording expiration by default
+	err := ds.InsertSessionRecording(ctx, sessionID, []byte("one"), model.ChunkLink{})
+	assert.NoError(t, err)
+	err = ds.InsertSessionRecording(ctx, heldSessionID, []byte("one"), model.ChunkLink{})
+	assert.NoError(t, err)
+	assert.Equal(t, []time.Duration{time.Hour}, expiry(sessionID))
+
+	// the recordings of the sessions on legal hold never expire
+	hold, err := ds.GetLegalHold(ctx, heldSessionID)
+	assert.NoError(t, err)
+	assert.Nil(t, hold)
+	err = ds.SetLegalHold(ctx, &model.LegalHold{
+		SessionID: heldSessionID,
+		Reason:    "case 42",
+		CreatedTs: time.Now().UTC().Truncate(time.Millisecond),
+	})
+	assert.NoError(t, err)
+	hold, err = ds.GetLegalHold(ctx, heldSessionID)
+	if assert.NoError(t, err) && assert.NotNil(t, hold) {
+		assert.Equal(t, "case 42", hold.Reason)
+	}
+	err = ds.InsertSessionRecording(ctx, heldSessionID, []byte("two"), model.ChunkLink{})
+	assert.NoError(t, err)
+	assert.Equal(t, []time.Duration{0, 0}, expiry(heldSessionID))
+
+	// the retention of the tenant applies to the recordings stored
+	week := 7 * 24 * 3600
+	err = ds.SetTenantPolicy(ctx, tenantID, &model.TenantPolicy{
+		RecordingRetention: &week,
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, ds.UpdateRecordingExpiry(ctx, ""))
+	assert.Equal(t, []time.Duration{7 * 24 * time.Hour}, expiry(sessionID))
+	assert.Equal(t, []time.Duration{0, 0}, expiry(heldSessionID))
+
+	err = ds.InsertRecordingText(ctx, &model.RecordingText{SessionID: sessionID})
+	assert.NoError(t, err)
+	var text model.RecordingText
+	err = db.Client().Database(DbName).Collection(RecordingTextCollectionName).
+		FindOne(ctx, bson.M{dbFieldSessionID: sessionID}).Decode(&text)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 7*24*time.Hour, text.ExpireTs.Sub(text.CreatedTs))
+	}
+
+	// releasing the hold, the recording expires after the retention
+	assert.NoError(t, ds.DeleteLegalHold(ctx, heldSessionID))
+	assert.Equal(t,
+		[]time.Duration{7 * 24 * time.Hour, 7 * 24 * time.Hour},
+		expiry(heldSessionID))
+	assert.ErrorIs(t, ds.DeleteLegalHold(ctx, heldSessionID), store.ErrLegalHoldNotFound)
+	hold, err = ds.GetLegalHold(ctx, heldSessionID)
+	assert.NoError(t, err)
+	assert.Nil(t, hold)
+}
+
+func TestRecordingPolicies(t *testing.T) {
+	now := time.Now()
+	cache := newRecordingPolicies(time.Minute)
+	ctx := identity.WithContext(context.Background(), &identity.Identity{
+		Tenant: "tenant",
+	})
+	key := recordingPolicyKey(ctx, "session")
+	assert.Equal(t, "tenant/session", key)
+
+	_, ok := cache.get(key, now)
+	assert.False(t, ok)
+	cache.set(key, recordingPolicy{retention: time.Hour, cachedTs: now})
+	policy, ok := cache.get(key, now.Add(time.Second))
+	if assert.True(t, ok) {
+		assert.Equal(t, now.Add(2*time.Hour), policy.expireTs(now.Add(time.Hour)))
+	}
+
+	// the policies expire after the ttl, and are swept
+	_, ok = cache.get(key, now.Add(time.Minute))
+	assert.False(t, ok)
+	other := recordingPolicyKey(ctx, "other")
+	cache.set(other, recordingPolicy{held: true, cachedTs: now.Add(time.Minute)})
+	assert.Len(t, cache.policies, 1)
+	policy, ok = cache.get(other, now.Add(time.Minute))
+	if assert.True(t, ok) {
+		assert.True(t, policy.expireTs(now).IsZero())
+	}
+
+	// the policies of the tenant are invalidated at once
+	cache.set(key, recordingPolicy{cachedTs: now.Add(time.Minute)})
+	cache.set("tenant2/session", recordingPolicy{cachedTs: now.Add(time.Minute)})
+	cache.invalidate(recordingPolicyKey(ctx, ""))
+	assert.Len(t, cache.policies, 1)
+	_, ok = cache.get("tenant2/session", now.Add(time.Minute))
+	assert.True(t, ok)
+
+	// the nil cache caches nothing
+	var none *recordingPolicies
+	none.set(key, recordingPolicy{cachedTs: now})
+	_, ok = none.get(key, now)
+	assert.False(t, ok)
+	none.invalidate("")
+}
+
+func TestDeleteSessionRecordings(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping TestDeleteSessionRecordings in short mode.")
+	}
+	ds := &DataStoreMongo{client: db.Client(), recordingExpire: time.Hour}
+	defer ds.DropDatabase()
+
+	const (
+		sessionID      = "00000000-0000-0000-0000-000000000001"
+		otherSessionID = "00000000-0000-0000-0000-000000000002"
+	)
+	ctx := identity.WithContext(context.Background(), &identity.Identity{
+		Tenant: "000000000000000000000000",
+	})
+	otherCtx := identity.WithContext(context.Background(), &identity.Identity{
+		Tenant: "000000000000000000000001",
+	})
+
+	for _, sess := range []struct {
+		ctx context.Context
+		*model.RecordedSession
+	}{
+		{ctx, &model.RecordedSession{SessionID: sessionID, DeviceID: "device", UserID: "user"}},
+		{ctx, &model.RecordedSession{SessionID: otherSessionID, DeviceID: "other",
+			UserID: "user"}},
+		{otherCtx, &model.RecordedSession{SessionID: "other-tenant", DeviceID: "device",
+			UserID: "user"}},
+	} {
+		err := ds.InsertRecordedSession(sess.ctx, sess.RecordedSession)
+		assert.NoError(t, err)
+		err = ds.InsertSessionRecording(sess.ctx, sess.SessionID, []byte("data"),
+			model.ChunkLink{})
+		assert.NoError(t, err)
+		err = ds.InsertRecordingText(sess.ctx, &model.RecordingText{SessionID: sess.SessionID})
+		assert.NoError(t, err)
+	}
+
+	recorded, err := ds.GetRecordedSession(ctx, sessionID)
+	if assert.NoError(t, err) && assert.NotNil(t, recorded) {
+		assert.Equal(t, "device", recorded.DeviceID)
+		assert.Equal(t, time.Hour, recorded.ExpireTs.Sub(recorded.CreatedTs))
+	}
+	recorded, err = ds.GetRecordedSession(ctx, "other-tenant")
+	assert.NoError(t, err)
+	assert.Nil(t, recorded)
+
+	// the recorded sessions are scoped by tenant
+	sessions, err := ds.FindRecordedSessions(ctx, model.RecordingFilter{UserID: "user"})
+	assert.NoError(t, err)
+	assert.Len(t, sessions, 2)
+	sessions, err = ds.FindRecordedSessions(ctx, model.RecordingFilter{DeviceID: "device"})
+	if assert.NoError(t, err) && assert.Len(t, sessions, 1) {
+		assert.Equal(t, sessionID, sessions[0].SessionID)
+	}
+
+	// the sessions recorded before the catalogue match no filter
+	err = ds.InsertRecordedSession(ctx, &model.RecordedSession{SessionID: "legacy"})
+	assert.NoError(t, err)
+	sessions, err = ds.FindUnattributedRecordedSessions(ctx)
+	if assert.NoError(t, err) && assert.Len(t, sessions, 1) {
+		assert.Equal(t, "legacy", sessions[0].SessionID)
+	}
+
+	found, err := ds.HasSessionRecording(ctx, sessionID)
+	assert.NoError(t, err)
+	assert.True(t, found)
+	found, err = ds.HasSessionRecording(ctx, "other-tenant")
+	assert.NoError(t, err)
+	assert.False(t, found)
+
+	assert.NoError(t, ds.DeleteSessionRecordings(ctx, []string{sessionID}))
+	found, err = ds.HasSessionRecording(ctx, sessionID)
+	assert.NoError(t, err)
+	assert.False(t, found)
+	chunks, err := ds.GetRecordingChunks(ctx, sessionID, model.RecordingStreamOutput)
+	assert.NoError(t, err)
+	assert.Empty(t, chunks)
+	recorded, err = ds.GetRecordedSession(ctx, sessionID)
+	assert.NoError(t, err)
+	assert.Nil(t, recorded)
+	count, err := db.Client().Database(DbName).Collection(RecordingTextCollectionName).
+		CountDocuments(ctx, bson.M{dbFieldSessionID: sessionID})
+	assert.NoError(t, err)
+	assert.Zero(t, count)
+
+	// the recordings of the other sessions are kept
+	chunks, err = ds.GetRecordingChunks(ctx, otherSessionID, model.RecordingStreamOutput)
+	assert.NoError(t, err)
+	assert.Len(t, chunks, 1)
+	chunks, err = ds.GetRecordingChunks(otherCtx, "other-tenant", model.RecordingStreamOutput)
+	assert.NoError(t, err)
+	assert.Len(t, chunks, 1)
+}
+
+func TestFallbackRecordingStorage(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping TestFallbackRecordingStorage in short mode.")
+	}
+	const (
+		sessionID       = "00000000-0000-0000-0000-000000000001"
+		legacySessionID = "00000000-0000-0000-0000-000000000002"
+	)
+	ctx := identity.WithContext(context.Background(), &identity.Identity{
+		Tenant: "000000000000000000000000",
+	})
+	database := &DataStoreMongo{client: db.Client(), recordingExpire: time.Hour}
+	defer database.DropDatabase()
+	bucket, err := objectstore.NewFilesystem(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds := &DataStoreMongo{
+		client:          db.Client(),
+		recordingExpire: time.Hour,
+		recordings: newFallbackRecordingStorage(
+			objectstore.NewRecordingStorage(bucket),
+			NewRecordingStorage(db.Client()),
+		),
+	}
+
+	// the recordings stored in the database before switching the storage
+	for _, id := range []string{sessionID, legacySessionID} {
+		err = database.InsertSessionRecording(ctx, id, []byte("database"),
+			model.ChunkLink{Sequence: 1})
+		assert.NoError(t, err)
+	}
+	err = ds.InsertSessionRecording(ctx, sessionID, []byte("storage"),
+		model.ChunkLink{Sequence: 2})
+	assert.NoError(t, err)
+
+	chunks, err := ds.GetRecordingChunks(ctx, sessionID, model.RecordingStreamOutput)
+	if assert.NoError(t, err) && assert.Len(t, chunks, 2) {
+		assert.Equal(t, []byte("database"), chunks[0].Data)
+		assert.Equal(t, []byte("storage"), chunks[1].Data)
+	}
+	found, err := ds.HasSessionRecording(ctx, legacySessionID)
+	assert.NoError(t, err)
+	assert.True(t, found)
+
+	// the legal holds apply to the chunks of the database
+	err = ds.SetLegalHold(ctx, &model.LegalHold{
+		SessionID: legacySessionID,
+		CreatedTs: time.Now().UTC(),
+	})
+	assert.NoError(t, err)
+	count, err := db.Client().Database(DbName).Collection(RecordingsCollectionName).
+		CountDocuments(ctx, bson.M{
+			dbFieldSessionID: legacySessionID,
+			dbFieldExpireTs:  bson.M{"$exists": true},
+		})
+	assert.NoError(t, err)
+	assert.Zero(t, count)
+
+	// the deletions apply to the chunks of the database
+	err = ds.DeleteSessionRecordings(ctx, []string{sessionID, legacySessionID})
+	assert.NoError(t, err)
+	for _, id := range []string{sessionID, legacySessionID} {
+		found, err = ds.HasSessionRecording(ctx, id)
+		assert.NoError(t, err)
+		assert.False(t, found)
+	}
+}
+
+func TestRecordingEncryption(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping TestRecordingEncryption in short mode.")
+	}
+	oldKey := bytes.Repeat([]byte{0x01}, masterKeySize)
+	newKey := bytes.Repeat([]byte{0x02}, masterKeySize)
+	encryption, _ := NewRecordingEncryption(oldKey)
+	plain := &DataStoreMongo{client: db.Client(), recordingExpire: time.Hour}
+	ds := &DataStoreMongo{
+		client:          db.Client(),
+		recordingExpire: time.Hour,
+		encryption:      encryption,
+	}
+	defer ds.DropDatabase()
+
+	const tenantID = "000000000000000000000000"
+	ctx := identity.WithContext(context.Background(), &identity.Identity{
+		Tenant: tenantID,
+	})
+	const sessionID = "00000000-0000-0000-0000-000000000001"
+
+	// the recordings stored before the encryption remain readable
+	first := model.ChunkLink{Sequence: 1}
+	err := plain.InsertControlRecording(ctx, sessionID, []byte("one"), first)
+	assert.NoError(t, err)
+	second := model.ChunkLink{Sequence: 2}
+	err = ds.InsertControlRecording(ctx, sessionID, []byte("two"), second)
+	assert.NoError(t, err)
+
+	var stored model.ControlData
+	err = db.Client().Database(DbName).Collection(ControlCollectionName).
+		FindOne(ctx, bson.M{dbFieldKeyID: bson.M{"$exists": true}}).
+		Decode(&stored)
+	if assert.NoError(t, err) {
+		assert.Equal(t, tenantID, stored.KeyID)
+		assert.NotContains(t, string(stored.Control), "two")
+	}
+	expected := []model.RecordingChunk{
+		{ChunkLink: first, Data: []byte("one")},
+		{ChunkLink: second, Data: []byte("two")},
+	}
+	chunks, err := ds.GetRecordingChunks(ctx, sessionID, model.RecordingStreamControl)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, chunks)
+
+	_, err = plain.GetRecordingChunks(ctx, sessionID, model.RecordingStreamControl)
+	assert.ErrorIs(t, err, ErrRecordingEncryptionDisabled)
+
+	// the playback decrypts the recordings
+	var gzipped bytes.Buffer
+	gz := gzip.NewWriter(&gzipped)
+	_, _ = gz.Write([]byte("root@device:~# "))
+	_ = gz.Close()
+	err = ds.InsertSessionRecording(ctx, sessionID, gzipped.Bytes(), model.ChunkLink{})
+	assert.NoError(t, err)
+	var playback bytes.Buffer
+	err = ds.WriteSessionRecords(ctx, sessionID, &playback)
+	assert.NoError(t, err)
+	assert.Contains(t, playback.String(), "root@device:~# ")
+
+	// rotate the master key
+	rotating, _ := NewRecordingEncryption(newKey, oldKey)
+	ds.encryption = rotating
+	chunks, err = ds.GetRecordingChunks(ctx, sessionID, model.RecordingStreamControl)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, chunks)
+	rotated, err := ds.RotateRecordingKeys(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, rotated)
+	rotated, err = ds.RotateRecordingKeys(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, rotated)
+
+	ds.encryption, _ = NewRecordingEncryption(newKey)
+	chunks, err = ds.GetRecordingChunks(ctx, sessionID, model.RecordingStreamControl)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, chunks)
+
+	ds.encryption, _ = NewRecordingEncryption(oldKey)
+	_, err = ds.GetRecordingChunks(ctx, sessionID, model.RecordingStreamControl)
+	assert.ErrorIs(t, err, ErrMasterKeyUnknown)
+
+	_, err = plain.RotateRecordingKeys(ctx)
+	assert.ErrorIs(t, err, ErrRecordingEncryptionDisabled)
+}
+
 type sessionWriterTest struct {
 	c chan []byte
 }
@@ -435,6 +1335,117 @@ func (s *sessionWriterTest) Write(d []byte) (int, error) {
 	return len(d), nil
 }
 
+func TestSearchRecordings(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping TestSearchRecordings in short mode.")
+	}
+	ds := &DataStoreMongo{client: db.Client(), recordingExpire: time.Hour}
+	defer ds.DropDatabase()
+
+	ctx := identity.WithContext(context.Background(), &identity.Identity{
+		Tenant: "tenant1",
+	})
+	ctxOther := identity.WithContext(context.Background(), &identity.Identity{
+		Tenant: "tenant2",
+	})
+	for _, insert := range []struct {
+		ctx  context.Context
+		text *model.RecordingText
+	}{{
+		ctx: ctx,
+		text: &model.RecordingText{
+			SessionID: "session1",
+			DeviceID:  "device1",
+			UserID:    "user1",
+			Lines: []model.RecordingTextLine{
+				{Offset: 0, Text: "root@device:~# ls /etc"},
+				{Offset: 30, Text: "root@device:~# cat /etc/shadow"},
+			},
+		},
+	}, {
+		ctx: ctx,
+		text: &model.RecordingText{
+			SessionID: "session1",
+			DeviceID:  "device1",
+			UserID:    "user1",
+			Lines: []model.RecordingTextLine{
+				{Offset: 100, Text: "root@device:~# RM -RF /tmp/x"},
+			},
+		},
+	}, {
+		ctx: ctx,
+		text: &model.RecordingText{
+			SessionID: "session2",
+			DeviceID:  "device2",
+			UserID:    "user2",
+			Lines: []model.RecordingTextLine{
+				{Offset: 10, Text: "$ sudo rm -rf /var/cache"},
+			},
+		},
+	}, {
+		ctx: ctxOther,
+		text: &model.RecordingText{
+			SessionID: "session3",
+			DeviceID:  "device3",
+			UserID:    "user3",
+			Lines: []model.RecordingTextLine{
+				{Offset: 0, Text: "$ rm -rf /"},
+			},
+		},
+	}} {
+		err := ds.InsertRecordingText(insert.ctx, insert.text)
+		require.NoError(t, err)
+	}
+
+	results, err := ds.SearchRecordings(ctx, model.SearchFilter{Query: "rm -rf"})
+	require.NoError(t, err)
+	if assert.Len(t, results, 2) {
+		// the sessions with the most recent matches come first
+		assert.Equal(t, "session2", results[0].SessionID)
+		assert.Equal(t, "device2", results[0].DeviceID)
+		assert.Equal(t, "user2", results[0].UserID)
+		if assert.Len(t, results[0].Matches, 1) {
+			assert.Equal(t, 10, results[0].Matches[0].Offset)
+			assert.Equal(t, "$ sudo rm -rf /var/cache", results[0].Matches[0].Snippet)
+		}
+		assert.Equal(t, "session1", results[1].SessionID)
+		if assert.Len(t, results[1].Matches, 1) {
+			assert.Equal(t, 100, results[1].Matches[0].Offset)
+		}
+	}
+
+	results, err = ds.SearchRecordings(ctx, model.SearchFilter{
+		Query:    "/etc/",
+		DeviceID: "device1",
+	})
+	require.NoError(t, err)
+	if assert.Len(t, results, 1) && assert.Len(t, results[0].Matches, 1) {
+		assert.Equal(t, 30, results[0].Matches[0].Offset)
+	}
+
+	results, err = ds.SearchRecordings(ctx, model.SearchFilter{
+		Query:  "rm -rf",
+		UserID: "user1",
+		Skip:   1,
+		Limit:  10,
+	})
+	require.NoError(t, err)
+	assert.Empty(t, results)
+
+	future := time.Now().Add(time.Hour)
+	results, err = ds.SearchRecordings(ctx, model.SearchFilter{
+		Query: "rm -rf",
+		From:  &future,
+	})
+	require.NoError(t, err)
+	assert.Empty(t, results)
+
+	// the query is matched literally
+	results, err = ds.SearchRecordings(ctx, model.SearchFilter{Query: "r.*f"})
+	require.NoError(t, err)
+	assert.Empty(t, results)
+}
+
 func TestGetSessionRecording(t *testing.T) {
 	testCases := []struct {
 		Name string
@@ -646,7 +1657,8 @@ func TestSetSessionRecording(t *testing.T) {
 
 			_, err := idxView.CreateMany(tc.Ctx, indexModels)
 
-			ds.InsertSessionRecording(tc.Ctx, tc.SessionID, tc.RecordingData)
+			ds.InsertSessionRecording(tc.Ctx, tc.SessionID, tc.RecordingData,
+				model.ChunkLink{})
 
 			if tc.Expire {
 				t.Logf("set expiration to: %ds, sleeping 60s (default check interval).",
@@ -671,3 +1683,47 @@ func TestSetSessionRecording(t *testing.T) {
 		})
 	}
 }
+
+func TestSendTimestampMessage(t *testing.T) {
+	start := time.Date(2023, 3, 31, 12, 0, 0, 0, time.UTC)
+	var lastTimestamp time.Time
+	var buf bytes.Buffer
+	delays := func() []interface{} {
+		var values []interface{}
+		dec := msgpack.NewDecoder(&buf)
+		for buf.Len() > 0 {
+			var msg ws.ProtoMsg
+			if !assert.NoError(t, dec.Decode(&msg)) {
+				break
+			}
+			assert.Equal(t, model.DelayMessageName, msg.Header.MsgType)
+			values = append(values, msg.Header.Properties[model.DelayMessageValueField])
+		}
+		return values
+	}
+
+	// the first timestamp starts the timing
+	_, err := sendTimestampMessage(app.Control{
+		Type:      app.TimestampMessage,
+		Timestamp: start,
+	}, &lastTimestamp, "session", &buf)
+	assert.NoError(t, err)
+	assert.Empty(t, delays())
+
+	_, err = sendTimestampMessage(app.Control{
+		Type:      app.TimestampMessage,
+		Offset:    10,
+		Timestamp: start.Add(1250 * time.Millisecond),
+	}, &lastTimestamp, "session", &buf)
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{uint16(1250)}, delays())
+
+	// the delays longer than the two bytes delay value are split
+	_, err = sendTimestampMessage(app.Control{
+		Type:      app.TimestampMessage,
+		Offset:    20,
+		Timestamp: start.Add(1250*time.Millisecond + 70*time.Second),
+	}, &lastTimestamp, "session", &buf)
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{uint16(65535), uint16(4465)}, delays())
+}
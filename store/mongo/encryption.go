@@ -0,0 +1,424 @@
+// Copyright 2023 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package mongo
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/mendersoftware/go-lib-micro/config"
+	"github.com/mendersoftware/go-lib-micro/identity"
+	mstore "github.com/mendersoftware/go-lib-micro/store/v2"
+
+	dconfig "github.com/mendersoftware/deviceconnect/config"
+	"github.com/mendersoftware/deviceconnect/model"
+)
+
+var (
+	ErrMasterKeyInvalid = errors.New("invalid recording master key")
+	ErrMasterKeyUnknown = errors.New(
+		"the recording data key is wrapped by an unknown master key")
+	ErrRecordingEncryptionDisabled = errors.New(
+		"the recordings are encrypted and no master key is configured")
+)
+
+const (
+	// masterKeySize is the size of the master keys and of the data keys,
+	// for AES-256
+	masterKeySize = 32
+
+	// defaultRecordingKeyID is the ID of the data key of the recordings
+	// without tenant
+	defaultRecordingKeyID = "default"
+
+	dbFieldWrappedKey  = "wrapped_key"
+	dbFieldMasterKeyID = "master_key_id"
+)
+
+// ParseRecordingMasterKey decodes the base64-encoded 256-bit master key
+func ParseRecordingMasterKey(s string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, errors.Wrap(ErrMasterKeyInvalid, err.Error())
+	} else if len(key) != masterKeySize {
+		return nil, errors.Wrapf(ErrMasterKeyInvalid,
+			"the key is %d bytes long instead of %d", len(key), masterKeySize)
+	}
+	return key, nil
+}
+
+// LoadRecordingMasterKey returns the master key from its base64-encoded
+// value or, if empty, from the file at path; the key is nil if neither is
+// set.
+func LoadRecordingMasterKey(value, path string) ([]byte, error) {
+	if value == "" && path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read the recording master key")
+		}
+		value = string(data)
+	}
+	if value == "" {
+		return nil, nil
+	}
+	return ParseRecordingMasterKey(value)
+}
+
+// masterKey is a master key wrapping the data keys
+type masterKey struct {
+	id   string
+	aead cipher.AEAD
+}
+
+func newMasterKey(key []byte) (*masterKey, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, errors.Wrap(ErrMasterKeyInvalid, err.Error())
+	}
+	sum := sha256.Sum256(key)
+	return &masterKey{
+		id:   hex.EncodeToString(sum[:8]),
+		aead: aead,
+	}, nil
+}
+
+// RecordingEncryption encrypts the session recordings at rest with
+// envelope encryption: the chunks of each tenant are encrypted with the
+// tenant's data key, stored wrapped by the master key. The previous master
+// keys unwrap the data keys until they are rotated.
+type RecordingEncryption struct {
+	master   *masterKey
+	previous map[string]*masterKey
+
+	mu       sync.Mutex
+	dataKeys map[string]cipher.AEAD
+}
+
+// NewRecordingEncryption returns the encryption of the recordings with the
+// master key, and the previous master keys
+func NewRecordingEncryption(master []byte, previous ...[]byte) (*RecordingEncryption, error) {
+	current, err := newMasterKey(master)
+	if err != nil {
+		return nil, err
+	}
+	e := &RecordingEncryption{
+		master:   current,
+		previous: make(map[string]*masterKey, len(previous)),
+		dataKeys: make(map[string]cipher.AEAD),
+	}
+	for _, key := range previous {
+		mk, err := newMasterKey(key)
+		if err != nil {
+			return nil, err
+		}
+		e.previous[mk.id] = mk
+	}
+	return e, nil
+}
+
+// setupRecordingEncryption returns the encryption of the recordings from
+// the configuration, or nil if no master key is configured
+func setupRecordingEncryption(c config.Reader) (*RecordingEncryption, error) {
+	master, err := LoadRecordingMasterKey(
+		c.GetString(dconfig.SettingRecordingMasterKey),
+		c.GetString(dconfig.SettingRecordingMasterKeyFile),
+	)
+	if err != nil {
+		return nil, err
+	}
+	previous, err := LoadRecordingMasterKey(
+		c.GetString(dconfig.SettingRecordingPreviousMasterKey),
+		c.GetString(dconfig.SettingRecordingPreviousMasterKeyFile),
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "previous master key")
+	}
+	if master == nil {
+		if previous != nil {
+			return nil, errors.Wrap(ErrMasterKeyInvalid,
+				"a previous master key is set without master key")
+		}
+		return nil, nil
+	}
+	if previous == nil {
+		return NewRecordingEncryption(master)
+	}
+	return NewRecordingEncryption(master, previous)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts and authenticates the plaintext and the additional data,
+// prefixing the ciphertext with the random nonce
+func seal(aead cipher.AEAD, plaintext, additionalData []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+// open decrypts and authenticates the ciphertext sealed with seal
+func open(aead cipher.AEAD, ciphertext, additionalData []byte) ([]byte, error) {
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce, ciphertext := ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, additionalData)
+}
+
+// chunkAdditionalData binds the encrypted chunks to their session and
+// stream, so that they cannot be moved to another recording
+func chunkAdditionalData(sessionID, stream string) []byte {
+	return []byte(sessionID + "\x00" + stream)
+}
+
+// wrapKey wraps the data key with the current master key
+func (e *RecordingEncryption) wrapKey(keyID string, key []byte) ([]byte, error) {
+	return seal(e.master.aead, key, []byte(keyID))
+}
+
+// unwrapKey unwraps the data key with the master key that wrapped it
+func (e *RecordingEncryption) unwrapKey(key *model.RecordingKey) ([]byte, error) {
+	mk := e.previous[key.MasterKeyID]
+	if key.MasterKeyID == e.master.id {
+		mk = e.master
+	} else if mk == nil {
+		return nil, errors.Wrapf(ErrMasterKeyUnknown, "data key %q", key.ID)
+	}
+	dataKey, err := open(mk.aead, key.WrappedKey, []byte(key.ID))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to unwrap the data key %q", key.ID)
+	}
+	return dataKey, nil
+}
+
+func (e *RecordingEncryption) cachedDataKey(keyID string) cipher.AEAD {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.dataKeys[keyID]
+}
+
+func (e *RecordingEncryption) cacheDataKey(keyID string, aead cipher.AEAD) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.dataKeys[keyID] = aead
+}
+
+// recordingKeyID returns the ID of the data key of the tenant in the
+// context
+func recordingKeyID(ctx context.Context) string {
+	if id := identity.FromContext(ctx); id != nil && id.Tenant != "" {
+		return id.Tenant
+	}
+	return defaultRecordingKeyID
+}
+
+// recordingDataKey returns the data key with the ID, unwrapped; the data
+// key of the tenant is created on first use if create is true.
+func (db *DataStoreMongo) recordingDataKey(
+	ctx context.Context,
+	keyID string,
+	create bool,
+) (cipher.AEAD, error) {
+	if aead := db.encryption.cachedDataKey(keyID); aead != nil {
+		return aead, nil
+	}
+	coll := db.client.Database(DbName).Collection(RecordingKeysCollectionName)
+
+	var key model.RecordingKey
+	err := coll.FindOne(ctx,
+		mstore.WithTenantID(ctx, bson.M{dbFieldID: keyID}),
+	).Decode(&key)
+	if err == mongo.ErrNoDocuments && create {
+		err = db.createRecordingDataKey(ctx, keyID, &key)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "store: failed to get the recording data key")
+	}
+	dataKey, err := db.encryption.unwrapKey(&key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	db.encryption.cacheDataKey(keyID, aead)
+	return aead, nil
+}
+
+// createRecordingDataKey generates and stores the data key of the tenant;
+// if another instance stored it first, the stored key is returned.
+func (db *DataStoreMongo) createRecordingDataKey(
+	ctx context.Context,
+	keyID string,
+	key *model.RecordingKey,
+) error {
+	coll := db.client.Database(DbName).Collection(RecordingKeysCollectionName)
+
+	dataKey := make([]byte, masterKeySize)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return err
+	}
+	wrapped, err := db.encryption.wrapKey(keyID, dataKey)
+	if err != nil {
+		return err
+	}
+	now := clock.Now().UTC()
+	*key = model.RecordingKey{
+		ID:          keyID,
+		WrappedKey:  wrapped,
+		MasterKeyID: db.encryption.master.id,
+		CreatedTs:   now,
+		UpdatedTs:   now,
+	}
+	_, err = coll.InsertOne(ctx, mstore.WithTenantID(ctx, key))
+	if mongo.IsDuplicateKeyError(err) {
+		return coll.FindOne(ctx,
+			mstore.WithTenantID(ctx, bson.M{dbFieldID: keyID}),
+		).Decode(key)
+	}
+	return err
+}
+
+// sealRecordingChunk encrypts the chunk of a recording stream with the data
+// key of the tenant, returning the ID of the data key; the chunk is
+// returned as is if the encryption is disabled.
+func (db *DataStoreMongo) sealRecordingChunk(
+	ctx context.Context,
+	sessionID, stream string,
+	data []byte,
+) ([]byte, string, error) {
+	if db.encryption == nil {
+		return data, "", nil
+	}
+	keyID := recordingKeyID(ctx)
+	aead, err := db.recordingDataKey(ctx, keyID, true)
+	if err != nil {
+		return nil, "", err
+	}
+	data, err = seal(aead, data, chunkAdditionalData(sessionID, stream))
+	if err != nil {
+		return nil, "", errors.Wrap(err, "store: failed to encrypt the recording")
+	}
+	return data, keyID, nil
+}
+
+// openRecordingChunk decrypts the chunk of a recording stream encrypted
+// with the data key with the ID; the chunks recorded without encryption
+// have no data key.
+func (db *DataStoreMongo) openRecordingChunk(
+	ctx context.Context,
+	sessionID, stream, keyID string,
+	data []byte,
+) ([]byte, error) {
+	if keyID == "" {
+		return data, nil
+	} else if db.encryption == nil {
+		return nil, ErrRecordingEncryptionDisabled
+	}
+	aead, err := db.recordingDataKey(ctx, keyID, false)
+	if err != nil {
+		return nil, err
+	}
+	data, err = open(aead, data, chunkAdditionalData(sessionID, stream))
+	if err != nil {
+		return nil, errors.Wrap(err, "store: failed to decrypt the recording")
+	}
+	return data, nil
+}
+
+// chunkOpener returns the function decrypting the chunks of a recording
+// stream of the session, for the readers of the recordings
+func (db *DataStoreMongo) chunkOpener(
+	ctx context.Context,
+	sessionID, stream string,
+) func(keyID string, data []byte) ([]byte, error) {
+	return func(keyID string, data []byte) ([]byte, error) {
+		return db.openRecordingChunk(ctx, sessionID, stream, keyID, data)
+	}
+}
+
+// RotateRecordingKeys re-wraps the data keys wrapped by the previous master
+// keys with the current master key, returning the number of keys rotated
+func (db *DataStoreMongo) RotateRecordingKeys(ctx context.Context) (int, error) {
+	if db.encryption == nil {
+		return 0, ErrRecordingEncryptionDisabled
+	}
+	coll := db.client.Database(DbName).Collection(RecordingKeysCollectionName)
+
+	cursor, err := coll.Find(ctx, bson.M{
+		dbFieldMasterKeyID: bson.M{"$ne": db.encryption.master.id},
+	})
+	if err != nil {
+		return 0, errors.Wrap(err, "store: failed to get the recording data keys")
+	}
+	defer cursor.Close(ctx)
+
+	rotated := 0
+	for cursor.Next(ctx) {
+		var key model.RecordingKey
+		if err := cursor.Decode(&key); err != nil {
+			return rotated, err
+		}
+		dataKey, err := db.encryption.unwrapKey(&key)
+		if err != nil {
+			return rotated, err
+		}
+		wrapped, err := db.encryption.wrapKey(key.ID, dataKey)
+		if err != nil {
+			return rotated, err
+		}
+		res, err := coll.UpdateOne(ctx,
+			bson.M{
+				dbFieldID:          key.ID,
+				dbFieldMasterKeyID: key.MasterKeyID,
+			},
+			bson.M{"$set": bson.M{
+				dbFieldWrappedKey:  wrapped,
+				dbFieldMasterKeyID: db.encryption.master.id,
+				dbFieldUpdatedTs:   clock.Now().UTC(),
+			}},
+		)
+		if err != nil {
+			return rotated, errors.Wrap(err, "store: failed to rotate the recording data key")
+		}
+		rotated += int(res.ModifiedCount)
+	}
+	if err := cursor.Err(); err != nil {
+		return rotated, errors.Wrap(err, "store: failed to get the recording data keys")
+	}
+	return rotated, nil
+}
@@ -0,0 +1,161 @@
+// Copyright 2023 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package mongo
+
+import (
+	"bytes"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mendersoftware/deviceconnect/model"
+)
+
+func TestLoadRecordingMasterKey(t *testing.T) {
+	key := bytes.Repeat([]byte{0x42}, masterKeySize)
+	encoded := base64.StdEncoding.EncodeToString(key)
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "master.key")
+	if err := os.WriteFile(keyFile, []byte(encoded+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		Name  string
+		Value string
+		Path  string
+
+		Key   []byte
+		Error error
+	}{{
+		Name:  "ok, value",
+		Value: encoded,
+		Path:  filepath.Join(dir, "missing.key"),
+
+		Key: key,
+	}, {
+		Name: "ok, file",
+		Path: keyFile,
+
+		Key: key,
+	}, {
+		Name: "ok, no key",
+	}, {
+		Name:  "error, not base64",
+		Value: "not a key!",
+
+		Error: ErrMasterKeyInvalid,
+	}, {
+		Name:  "error, short key",
+		Value: base64.StdEncoding.EncodeToString(key[:16]),
+
+		Error: ErrMasterKeyInvalid,
+	}}
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			key, err := LoadRecordingMasterKey(tc.Value, tc.Path)
+			if tc.Error != nil {
+				assert.ErrorIs(t, err, tc.Error)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, tc.Key, key)
+			}
+		})
+	}
+
+	_, err := LoadRecordingMasterKey("", filepath.Join(dir, "missing.key"))
+	assert.Error(t, err)
+}
+
+func TestRecordingEncryptionKeys(t *testing.T) {
+	oldKey := bytes.Repeat([]byte{0x01}, masterKeySize)
+	newKey := bytes.Repeat([]byte{0x02}, masterKeySize)
+	dataKey := bytes.Repeat([]byte{0x03}, masterKeySize)
+
+	previous, err := NewRecordingEncryption(oldKey)
+	if !assert.NoError(t, err) {
+		return
+	}
+	wrapped, err := previous.wrapKey("tenant", dataKey)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(wrapped), string(dataKey))
+	key := &model.RecordingKey{
+		ID:          "tenant",
+		WrappedKey:  wrapped,
+		MasterKeyID: previous.master.id,
+	}
+
+	// the previous master key unwraps the data keys until rotated
+	rotating, err := NewRecordingEncryption(newKey, oldKey)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NotEqual(t, previous.master.id, rotating.master.id)
+	unwrapped, err := rotating.unwrapKey(key)
+	assert.NoError(t, err)
+	assert.Equal(t, dataKey, unwrapped)
+
+	current, _ := NewRecordingEncryption(newKey)
+	_, err = current.unwrapKey(key)
+	assert.ErrorIs(t, err, ErrMasterKeyUnknown)
+
+	// the wrapped key is bound to the ID of the data key
+	_, err = previous.unwrapKey(&model.RecordingKey{
+		ID:          "other tenant",
+		WrappedKey:  wrapped,
+		MasterKeyID: previous.master.id,
+	})
+	assert.Error(t, err)
+
+	_, err = NewRecordingEncryption(newKey[:7])
+	assert.ErrorIs(t, err, ErrMasterKeyInvalid)
+}
+
+func TestSealRecordingChunk(t *testing.T) {
+	aead, err := newAEAD(bytes.Repeat([]byte{0x03}, masterKeySize))
+	if !assert.NoError(t, err) {
+		return
+	}
+	const sessionID = "00000000-0000-0000-0000-000000000001"
+	data := []byte("root@device:~# cat /etc/shadow")
+	additionalData := chunkAdditionalData(sessionID, model.RecordingStreamOutput)
+
+	sealed, err := seal(aead, data, additionalData)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(sealed), string(data))
+	again, _ := seal(aead, data, additionalData)
+	assert.NotEqual(t, sealed, again)
+
+	opened, err := open(aead, sealed, additionalData)
+	assert.NoError(t, err)
+	assert.Equal(t, data, opened)
+
+	// the chunks cannot be moved to another session or stream
+	_, err = open(aead, sealed,
+		chunkAdditionalData(sessionID, model.RecordingStreamInput))
+	assert.Error(t, err)
+	_, err = open(aead, sealed, chunkAdditionalData(
+		"00000000-0000-0000-0000-000000000002", model.RecordingStreamOutput))
+	assert.Error(t, err)
+
+	sealed[len(sealed)-1] ^= 0xff
+	_, err = open(aead, sealed, additionalData)
+	assert.Error(t, err)
+	_, err = open(aead, sealed[:4], additionalData)
+	assert.Error(t, err)
+}
@@ -0,0 +1,54 @@
+// Copyright 2023 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package mongo
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	mopts "go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/mendersoftware/go-lib-micro/mongo/migrate"
+	mstore "github.com/mendersoftware/go-lib-micro/store/v2"
+)
+
+// migration_2_1_0 indexes the sessions by user for counting the
+// concurrent sessions of the users.
+type migration_2_1_0 struct {
+	client *mongo.Client
+	db     string
+}
+
+func (m *migration_2_1_0) Up(from migrate.Version) error {
+	if m.db != DbName {
+		return nil
+	}
+	ctx := context.Background()
+	collSess := m.client.Database(DbName).Collection(SessionsCollectionName)
+	_, err := collSess.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{
+			{Key: mstore.FieldTenantID, Value: 1},
+			{Key: dbFieldUserID, Value: 1},
+		},
+		Options: mopts.Index().
+			SetName(mstore.FieldTenantID + "_" + dbFieldUserID),
+	})
+	return err
+}
+
+func (m *migration_2_1_0) Version() migrate.Version {
+	return migrate.MakeVersion(2, 1, 0)
+}
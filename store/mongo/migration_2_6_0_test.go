@@ -0,0 +1,71 @@
+// Copyright 2023 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package mongo
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+
+	mstore "github.com/mendersoftware/go-lib-micro/store/v2"
+)
+
+func TestMigration_2_6_0(t *testing.T) {
+	db := db.Client().Database(DbName)
+	defer db.Drop(context.Background())
+	ctx := context.Background()
+
+	err := Migrate(ctx, DbName, "2.6.0", db.Client(), true)
+	require.NoError(t, err)
+
+	for _, idx := range []struct {
+		coll string
+		name string
+		keys bson.D
+	}{{
+		coll: LegalHoldsCollectionName,
+		name: mstore.FieldTenantID,
+		keys: bson.D{
+			{Key: mstore.FieldTenantID, Value: int32(1)},
+		},
+	}, {
+		coll: RecordingSignaturesCollectionName,
+		name: mstore.FieldTenantID,
+		keys: bson.D{
+			{Key: mstore.FieldTenantID, Value: int32(1)},
+		},
+	}} {
+		specs, err := db.Collection(idx.coll).
+			Indexes().
+			ListSpecifications(ctx)
+		require.NoError(t, err)
+
+		found := false
+		for _, spec := range specs {
+			if spec.Name != idx.name {
+				continue
+			}
+			found = true
+			var keys bson.D
+			err := bson.Unmarshal(spec.KeysDocument, &keys)
+			require.NoError(t, err)
+			assert.Equal(t, idx.keys, keys)
+		}
+		assert.True(t, found, "index %s on %s not found", idx.name, idx.coll)
+	}
+}
@@ -0,0 +1,146 @@
+// Copyright 2023 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package mongo
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	mopts "go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/mendersoftware/go-lib-micro/mongo/migrate"
+	mstore "github.com/mendersoftware/go-lib-micro/store/v2"
+)
+
+// migration_2_7_0 indexes the catalogue of the recorded sessions by user
+// and by device, for deleting the recordings of the users and of the
+// devices, and expires the catalogue with the recordings. The sessions
+// recorded before are catalogued from the indexed text of their recording,
+// if any, or else from the chunks of their recording, their user and device
+// unknown.
+type migration_2_7_0 struct {
+	client *mongo.Client
+	db     string
+}
+
+func (m *migration_2_7_0) Up(from migrate.Version) error {
+	if m.db != DbName {
+		return nil
+	}
+	ctx := context.Background()
+	database := m.client.Database(DbName)
+	coll := database.Collection(RecordedSessionsCollectionName)
+	_, err := coll.Indexes().CreateMany(ctx, []mongo.IndexModel{{
+		Keys: bson.D{
+			{Key: mstore.FieldTenantID, Value: 1},
+			{Key: dbFieldUserID, Value: 1},
+		},
+		Options: mopts.Index().
+			SetName(mstore.FieldTenantID + "_" + dbFieldUserID),
+	}, {
+		Keys: bson.D{
+			{Key: mstore.FieldTenantID, Value: 1},
+			{Key: dbFieldDeviceID, Value: 1},
+		},
+		Options: mopts.Index().
+			SetName(mstore.FieldTenantID + "_" + dbFieldDeviceID),
+	}, {
+		Keys: bson.D{{Key: dbFieldExpireTs, Value: 1}},
+		Options: mopts.Index().
+			SetExpireAfterSeconds(0).
+			SetName(IndexNameLogsExpire),
+	}})
+	if err != nil {
+		return err
+	}
+
+	// the recordings without indexed text are catalogued from their
+	// chunks, their user and device unknown
+	for _, name := range []string{
+		RecordingTextCollectionName,
+		RecordingsCollectionName,
+		ControlCollectionName,
+		InputCollectionName,
+	} {
+		attributed := name == RecordingTextCollectionName
+		if err := m.catalogueRecordings(ctx, name, attributed); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// catalogueRecordings catalogues the sessions recorded in the collection,
+// keeping the sessions catalogued before; the documents of the collection
+// hold the user and the device of the session if attributed.
+func (m *migration_2_7_0) catalogueRecordings(
+	ctx context.Context,
+	name string,
+	attributed bool,
+) error {
+	group := bson.D{
+		{Key: dbFieldID, Value: bson.D{
+			{Key: mstore.FieldTenantID, Value: "$" + mstore.FieldTenantID},
+			{Key: dbFieldSessionID, Value: "$" + dbFieldSessionID},
+		}},
+		{Key: dbFieldCreatedTs, Value: bson.D{
+			{Key: "$min", Value: "$" + dbFieldCreatedTs},
+		}},
+		{Key: dbFieldExpireTs, Value: bson.D{
+			{Key: "$max", Value: "$" + dbFieldExpireTs},
+		}},
+	}
+	var deviceID, userID interface{} = 1, 1
+	if attributed {
+		group = append(group, bson.E{Key: dbFieldDeviceID, Value: bson.D{
+			{Key: "$first", Value: "$" + dbFieldDeviceID},
+		}}, bson.E{Key: dbFieldUserID, Value: bson.D{
+			{Key: "$first", Value: "$" + dbFieldUserID},
+		}})
+	} else {
+		deviceID = bson.D{{Key: "$literal", Value: ""}}
+		userID = bson.D{{Key: "$literal", Value: ""}}
+	}
+	cursor, err := m.client.Database(DbName).Collection(name).
+		Aggregate(ctx, mongo.Pipeline{
+			{{Key: "$group", Value: group}},
+			{{Key: "$project", Value: bson.D{
+				{Key: dbFieldID, Value: "$" + dbFieldID + "." + dbFieldSessionID},
+				{Key: mstore.FieldTenantID,
+					Value: "$" + dbFieldID + "." + mstore.FieldTenantID},
+				{Key: dbFieldDeviceID, Value: deviceID},
+				{Key: dbFieldUserID, Value: userID},
+				{Key: dbFieldCreatedTs, Value: 1},
+				// the recordings on legal hold never expire
+				{Key: dbFieldExpireTs, Value: bson.D{
+					{Key: "$ifNull", Value: bson.A{"$" + dbFieldExpireTs, "$$REMOVE"}},
+				}},
+			}}},
+			{{Key: "$merge", Value: bson.D{
+				{Key: "into", Value: RecordedSessionsCollectionName},
+				{Key: "whenMatched", Value: "keepExisting"},
+				{Key: "whenNotMatched", Value: "insert"},
+			}}},
+		})
+	if err != nil {
+		return err
+	}
+	return cursor.Close(ctx)
+}
+
+func (m *migration_2_7_0) Version() migrate.Version {
+	return migrate.MakeVersion(2, 7, 0)
+}
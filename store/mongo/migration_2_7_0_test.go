@@ -0,0 +1,142 @@
+// Copyright 2023 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package mongo
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/mendersoftware/go-lib-micro/identity"
+	mstore "github.com/mendersoftware/go-lib-micro/store/v2"
+
+	"github.com/mendersoftware/deviceconnect/model"
+)
+
+func TestMigration_2_7_0(t *testing.T) {
+	db := db.Client().Database(DbName)
+	defer db.Drop(context.Background())
+	ctx := context.Background()
+
+	err := Migrate(ctx, DbName, "2.6.0", db.Client(), true)
+	require.NoError(t, err)
+
+	// the sessions recorded before are catalogued from their text
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	tenantCtx := identity.WithContext(ctx, &identity.Identity{Tenant: "tenant"})
+	for i, expireTs := range []time.Time{now.Add(time.Hour), now.Add(2 * time.Hour)} {
+		_, err := db.Collection(RecordingTextCollectionName).InsertOne(ctx,
+			mstore.WithTenantID(tenantCtx, &model.RecordingText{
+				ID:        uuid.New(),
+				SessionID: "session",
+				DeviceID:  "device",
+				UserID:    "user",
+				CreatedTs: now.Add(time.Duration(i) * time.Minute),
+				ExpireTs:  expireTs,
+			}))
+		require.NoError(t, err)
+	}
+
+	// and from their chunks, if not indexed
+	_, err = db.Collection(RecordingsCollectionName).InsertOne(ctx,
+		mstore.WithTenantID(tenantCtx, &model.Recording{
+			ID:        uuid.New(),
+			SessionID: "session",
+			CreatedTs: now.Add(-time.Minute),
+			ExpireTs:  now.Add(3 * time.Hour),
+		}))
+	require.NoError(t, err)
+	_, err = db.Collection(ControlCollectionName).InsertOne(ctx,
+		mstore.WithTenantID(tenantCtx, &model.ControlData{
+			ID:        uuid.New(),
+			SessionID: "legacy",
+			CreatedTs: now,
+			ExpireTs:  now.Add(time.Hour),
+		}))
+	require.NoError(t, err)
+
+	err = Migrate(ctx, DbName, "2.7.0", db.Client(), true)
+	require.NoError(t, err)
+
+	var sess model.RecordedSession
+	err = db.Collection(RecordedSessionsCollectionName).FindOne(ctx,
+		bson.M{mstore.FieldTenantID: "tenant", dbFieldID: "session"},
+	).Decode(&sess)
+	require.NoError(t, err)
+	assert.Equal(t, model.RecordedSession{
+		SessionID: "session",
+		DeviceID:  "device",
+		UserID:    "user",
+		CreatedTs: now,
+		ExpireTs:  now.Add(2 * time.Hour),
+	}, sess)
+
+	// the user and the device of the sessions not indexed are unknown
+	var legacy model.RecordedSession
+	err = db.Collection(RecordedSessionsCollectionName).FindOne(ctx,
+		bson.M{mstore.FieldTenantID: "tenant", dbFieldID: "legacy"},
+	).Decode(&legacy)
+	require.NoError(t, err)
+	assert.Equal(t, model.RecordedSession{
+		SessionID: "legacy",
+		CreatedTs: now,
+		ExpireTs:  now.Add(time.Hour),
+	}, legacy)
+
+	for _, idx := range []struct {
+		name string
+		keys bson.D
+	}{{
+		name: mstore.FieldTenantID + "_" + dbFieldUserID,
+		keys: bson.D{
+			{Key: mstore.FieldTenantID, Value: int32(1)},
+			{Key: dbFieldUserID, Value: int32(1)},
+		},
+	}, {
+		name: mstore.FieldTenantID + "_" + dbFieldDeviceID,
+		keys: bson.D{
+			{Key: mstore.FieldTenantID, Value: int32(1)},
+			{Key: dbFieldDeviceID, Value: int32(1)},
+		},
+	}, {
+		name: IndexNameLogsExpire,
+		keys: bson.D{
+			{Key: dbFieldExpireTs, Value: int32(1)},
+		},
+	}} {
+		specs, err := db.Collection(RecordedSessionsCollectionName).
+			Indexes().
+			ListSpecifications(ctx)
+		require.NoError(t, err)
+
+		found := false
+		for _, spec := range specs {
+			if spec.Name != idx.name {
+				continue
+			}
+			found = true
+			var keys bson.D
+			err := bson.Unmarshal(spec.KeysDocument, &keys)
+			require.NoError(t, err)
+			assert.Equal(t, idx.keys, keys)
+		}
+		assert.True(t, found, "index %s not found", idx.name)
+	}
+}
@@ -26,7 +26,7 @@ import (
 
 const (
 	// DbVersion is the current schema version
-	DbVersion = "2.0.1"
+	DbVersion = "2.7.0"
 
 	// DbName is the database name
 	DbName = "deviceconnect"
@@ -72,6 +72,34 @@ func Migrate(ctx context.Context,
 				client: client,
 				db:     dbName,
 			},
+			&migration_2_1_0{
+				client: client,
+				db:     dbName,
+			},
+			&migration_2_2_0{
+				client: client,
+				db:     dbName,
+			},
+			&migration_2_3_0{
+				client: client,
+				db:     dbName,
+			},
+			&migration_2_4_0{
+				client: client,
+				db:     dbName,
+			},
+			&migration_2_5_0{
+				client: client,
+				db:     dbName,
+			},
+			&migration_2_6_0{
+				client: client,
+				db:     dbName,
+			},
+			&migration_2_7_0{
+				client: client,
+				db:     dbName,
+			},
 			// NOTE: Future migrations need only be applied to DbName
 		}
 		err = m.Apply(ctx, *ver, migrations)
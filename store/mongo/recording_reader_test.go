@@ -118,7 +118,8 @@ func TestReadRecording(t *testing.T) {
 
 			ctx, cancel := context.WithTimeout(context.TODO(), time.Second*10)
 			defer cancel()
-			reader := NewRecordingReader(ctx, c)
+			reader := NewRecordingReader(ctx,
+				newChunkCursor(c, model.RecordingStreamOutput))
 			assert.NotNil(t, reader)
 			buffer := make([]byte, tc.ReadBufferSize)
 			s := ""
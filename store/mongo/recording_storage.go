@@ -0,0 +1,444 @@
+// Copyright 2023 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package mongo
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	mopts "go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/mendersoftware/go-lib-micro/config"
+	mstore "github.com/mendersoftware/go-lib-micro/store/v2"
+
+	dconfig "github.com/mendersoftware/deviceconnect/config"
+	"github.com/mendersoftware/deviceconnect/model"
+	"github.com/mendersoftware/deviceconnect/store"
+	"github.com/mendersoftware/deviceconnect/store/objectstore"
+)
+
+// recordingStreams maps the recording streams to their collection and the
+// field holding the chunks
+var recordingStreams = map[string]struct {
+	collection string
+	field      string
+}{
+	model.RecordingStreamOutput:  {RecordingsCollectionName, "recording"},
+	model.RecordingStreamControl: {ControlCollectionName, "control"},
+	model.RecordingStreamInput:   {InputCollectionName, "input"},
+}
+
+// RecordingStorage stores the recording streams in the collections of the
+// database, where they expire by the TTL indexes on expire_ts
+type RecordingStorage struct {
+	client *mongo.Client
+}
+
+// NewRecordingStorage returns the recording storage in the database
+func NewRecordingStorage(client *mongo.Client) *RecordingStorage {
+	return &RecordingStorage{client: client}
+}
+
+// setupRecordingStorage returns the configured recording storage, or nil
+// for storing the recordings in the database; the recordings stored in the
+// database before configuring the storage remain available through it.
+func setupRecordingStorage(
+	c config.Reader,
+	client *mongo.Client,
+) (store.RecordingStorage, error) {
+	switch backend := c.GetString(dconfig.SettingRecordingStorageBackend); backend {
+	case store.RecordingBackendMongo, "":
+		return nil, nil
+	case store.RecordingBackendFilesystem:
+		bucket, err := objectstore.NewFilesystem(
+			c.GetString(dconfig.SettingRecordingStoragePath),
+		)
+		if err != nil {
+			return nil, err
+		}
+		return newFallbackRecordingStorage(
+			objectstore.NewRecordingStorage(bucket),
+			NewRecordingStorage(client),
+		), nil
+	case store.RecordingBackendS3:
+		bucket, err := objectstore.NewS3(objectstore.S3Config{
+			Endpoint:        c.GetString(dconfig.SettingRecordingStorageS3Endpoint),
+			Region:          c.GetString(dconfig.SettingRecordingStorageS3Region),
+			Bucket:          c.GetString(dconfig.SettingRecordingStorageS3Bucket),
+			AccessKeyID:     c.GetString(dconfig.SettingRecordingStorageS3AccessKeyID),
+			SecretAccessKey: c.GetString(dconfig.SettingRecordingStorageS3SecretAccessKey),
+			PathStyle:       c.GetBool(dconfig.SettingRecordingStorageS3PathStyle),
+		})
+		if err != nil {
+			return nil, err
+		}
+		return newFallbackRecordingStorage(
+			objectstore.NewRecordingStorage(bucket),
+			NewRecordingStorage(client),
+		), nil
+	default:
+		return nil, errors.Errorf("unknown recording storage backend %q", backend)
+	}
+}
+
+// fallbackRecordingStorage stores the recordings in the configured storage
+// and keeps serving the recordings stored in the collections of the
+// database before configuring it: the chunks of the database are read
+// first, the retention changes and the deletions apply to both, and the
+// chunks of the database keep expiring by the TTL indexes.
+type fallbackRecordingStorage struct {
+	store.RecordingStorage
+	database store.RecordingStorage
+}
+
+func newFallbackRecordingStorage(
+	storage store.RecordingStorage,
+	database store.RecordingStorage,
+) *fallbackRecordingStorage {
+	return &fallbackRecordingStorage{
+		RecordingStorage: storage,
+		database:         database,
+	}
+}
+
+// GetChunks returns the chunks of a recording stream of a session stored
+// in the database, followed by the chunks stored in the storage
+func (s *fallbackRecordingStorage) GetChunks(
+	ctx context.Context,
+	sessionID, stream string,
+) (store.ChunkIterator, error) {
+	databaseChunks, err := s.database.GetChunks(ctx, sessionID, stream)
+	if err != nil {
+		return nil, err
+	}
+	chunks, err := s.RecordingStorage.GetChunks(ctx, sessionID, stream)
+	if err != nil {
+		_ = databaseChunks.Close(ctx)
+		return nil, err
+	}
+	return &chainedChunks{
+		iterators: []store.ChunkIterator{databaseChunks, chunks},
+	}, nil
+}
+
+// SetChunksRetention sets the expiry of the chunks in the database and in
+// the storage
+func (s *fallbackRecordingStorage) SetChunksRetention(
+	ctx context.Context,
+	sessionID string,
+	excluded []string,
+	retention time.Duration,
+) error {
+	err := s.database.SetChunksRetention(ctx, sessionID, excluded, retention)
+	if err != nil {
+		return err
+	}
+	return s.RecordingStorage.SetChunksRetention(ctx, sessionID, excluded, retention)
+}
+
+// DeleteChunks deletes the chunks of the sessions in the database and in
+// the storage
+func (s *fallbackRecordingStorage) DeleteChunks(
+	ctx context.Context,
+	sessionIDs []string,
+) (int, error) {
+	deleted, err := s.database.DeleteChunks(ctx, sessionIDs)
+	if err != nil {
+		return deleted, err
+	}
+	n, err := s.RecordingStorage.DeleteChunks(ctx, sessionIDs)
+	return deleted + n, err
+}
+
+// chainedChunks iterates over the chunks of the iterators, one after the
+// other
+type chainedChunks struct {
+	iterators []store.ChunkIterator
+	current   int
+}
+
+func (c *chainedChunks) Next(ctx context.Context) bool {
+	for ; c.current < len(c.iterators); c.current++ {
+		it := c.iterators[c.current]
+		if it.Next(ctx) {
+			return true
+		} else if it.Err() != nil {
+			return false
+		}
+	}
+	return false
+}
+
+func (c *chainedChunks) Chunk() *model.StoredChunk {
+	return c.iterators[c.current].Chunk()
+}
+
+func (c *chainedChunks) Err() error {
+	if c.current < len(c.iterators) {
+		return c.iterators[c.current].Err()
+	}
+	return nil
+}
+
+func (c *chainedChunks) Close(ctx context.Context) error {
+	var err error
+	for _, it := range c.iterators {
+		if e := it.Close(ctx); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// PutChunks stores chunks of the recording streams, inserting the chunks
+// of each stream at once
+func (s *RecordingStorage) PutChunks(ctx context.Context, chunks []*model.StoredChunk) error {
+	documents := make(map[string][]interface{}, len(recordingStreams))
+	for _, chunk := range chunks {
+		document, err := chunkDocument(chunk)
+		if err != nil {
+			return err
+		}
+		documents[chunk.Stream] = append(documents[chunk.Stream],
+			mstore.WithTenantID(ctx, document))
+	}
+	for _, stream := range model.RecordingStreams {
+		if len(documents[stream]) == 0 {
+			continue
+		}
+		coll := s.client.Database(DbName).
+			Collection(recordingStreams[stream].collection)
+		_, err := coll.InsertMany(ctx, documents[stream])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// chunkDocument returns the document of the chunk in the collection of its
+// recording stream
+func chunkDocument(chunk *model.StoredChunk) (interface{}, error) {
+	switch chunk.Stream {
+	case model.RecordingStreamOutput:
+		return &model.Recording{
+			ID:        uuid.New(),
+			SessionID: chunk.SessionID,
+			Recording: chunk.Data,
+			ChunkLink: chunk.ChunkLink,
+			KeyID:     chunk.KeyID,
+			CreatedTs: chunk.CreatedTs,
+			ExpireTs:  chunk.ExpireTs,
+		}, nil
+	case model.RecordingStreamControl:
+		return &model.ControlData{
+			ID:        uuid.New(),
+			SessionID: chunk.SessionID,
+			Control:   chunk.Data,
+			ChunkLink: chunk.ChunkLink,
+			KeyID:     chunk.KeyID,
+			CreatedTs: chunk.CreatedTs,
+			ExpireTs:  chunk.ExpireTs,
+		}, nil
+	case model.RecordingStreamInput:
+		return &model.InputData{
+			ID:        uuid.New(),
+			SessionID: chunk.SessionID,
+			Input:     chunk.Data,
+			ChunkLink: chunk.ChunkLink,
+			KeyID:     chunk.KeyID,
+			CreatedTs: chunk.CreatedTs,
+			ExpireTs:  chunk.ExpireTs,
+		}, nil
+	}
+	return nil, ErrUnknownRecordingStream
+}
+
+// GetChunks returns the chunks of a recording stream of a session
+func (s *RecordingStorage) GetChunks(
+	ctx context.Context,
+	sessionID, stream string,
+) (store.ChunkIterator, error) {
+	recordingStream, ok := recordingStreams[stream]
+	if !ok {
+		return nil, ErrUnknownRecordingStream
+	}
+	coll := s.client.Database(DbName).
+		Collection(recordingStream.collection)
+
+	findOptions := mopts.Find().
+		SetSort(bson.D{
+			{Key: dbFieldSequence, Value: 1},
+			{Key: dbFieldCreatedTs, Value: 1},
+		})
+	cursor, err := coll.Find(ctx,
+		mstore.WithTenantID(ctx, bson.M{
+			dbFieldSessionID: sessionID,
+		}),
+		findOptions,
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "store: failed to get the recording chunks")
+	}
+	return newChunkCursor(cursor, stream), nil
+}
+
+// DeleteExpiredChunks is a no-op: the chunks expire by the TTL indexes
+func (s *RecordingStorage) DeleteExpiredChunks(
+	ctx context.Context,
+	before time.Time,
+) (int, error) {
+	return 0, nil
+}
+
+// SetChunksRetention sets the expiry of the chunks of the session, or of
+// all the sessions of the tenant but the excluded ones
+func (s *RecordingStorage) SetChunksRetention(
+	ctx context.Context,
+	sessionID string,
+	excluded []string,
+	retention time.Duration,
+) error {
+	for _, stream := range model.RecordingStreams {
+		coll := s.client.Database(DbName).
+			Collection(recordingStreams[stream].collection)
+		_, err := coll.UpdateMany(ctx,
+			retentionFilter(ctx, dbFieldSessionID, sessionID, excluded),
+			retentionUpdate(retention),
+		)
+		if err != nil {
+			return errors.Wrap(err, "store: failed to update the recordings expiry")
+		}
+	}
+	return nil
+}
+
+// DeleteChunks deletes the chunks of the sessions of the tenant
+func (s *RecordingStorage) DeleteChunks(
+	ctx context.Context,
+	sessionIDs []string,
+) (int, error) {
+	deleted := 0
+	for _, stream := range model.RecordingStreams {
+		coll := s.client.Database(DbName).
+			Collection(recordingStreams[stream].collection)
+		res, err := coll.DeleteMany(ctx,
+			mstore.WithTenantID(ctx, bson.M{
+				dbFieldSessionID: bson.M{"$in": sessionIDs},
+			}),
+		)
+		if err != nil {
+			return deleted, errors.Wrap(err, "store: failed to delete the recording chunks")
+		}
+		deleted += int(res.DeletedCount)
+	}
+	return deleted, nil
+}
+
+// retentionFilter selects the documents of the tenant whose field holds the
+// session ID: the documents of the session, or of all the sessions but the
+// excluded ones if sessionID is empty
+func retentionFilter(
+	ctx context.Context,
+	field, sessionID string,
+	excluded []string,
+) bson.D {
+	filter := bson.M{dbFieldCreatedTs: bson.M{"$type": "date"}}
+	if sessionID != "" {
+		filter[field] = sessionID
+	} else if len(excluded) > 0 {
+		filter[field] = bson.M{"$nin": excluded}
+	}
+	return mstore.WithTenantID(ctx, filter)
+}
+
+// retentionUpdate sets the expiry of the documents to their creation time
+// plus the retention, or removes it for the documents never to expire
+func retentionUpdate(retention time.Duration) interface{} {
+	if retention <= 0 {
+		return bson.M{"$unset": bson.M{dbFieldExpireTs: ""}}
+	}
+	return mongo.Pipeline{{{
+		Key: "$set",
+		Value: bson.D{{
+			Key: dbFieldExpireTs,
+			Value: bson.D{{
+				Key:   "$add",
+				Value: bson.A{"$" + dbFieldCreatedTs, retention.Milliseconds()},
+			}},
+		}},
+	}}}
+}
+
+// chunkCursor iterates over the chunk documents of a recording stream
+type chunkCursor struct {
+	cursor *mongo.Cursor
+	stream string
+	field  string
+	chunk  model.StoredChunk
+}
+
+func newChunkCursor(cursor *mongo.Cursor, stream string) *chunkCursor {
+	return &chunkCursor{
+		cursor: cursor,
+		stream: stream,
+		field:  recordingStreams[stream].field,
+	}
+}
+
+func (c *chunkCursor) Next(ctx context.Context) bool {
+	if !c.cursor.Next(ctx) {
+		return false
+	}
+	doc := c.cursor.Current
+	c.chunk = model.StoredChunk{Stream: c.stream}
+	c.chunk.SessionID, _ = doc.Lookup(dbFieldSessionID).StringValueOK()
+	if seq, ok := doc.Lookup(dbFieldSequence).AsInt64OK(); ok {
+		c.chunk.Sequence = int(seq)
+	}
+	// the current document is only valid until the next one
+	if _, hash, ok := doc.Lookup(dbFieldHash).BinaryOK(); ok {
+		c.chunk.Hash = append([]byte(nil), hash...)
+	}
+	c.chunk.Format, _ = doc.Lookup(dbFieldFormat).StringValueOK()
+	c.chunk.Offset, _ = doc.Lookup(dbFieldOffset).AsInt64OK()
+	c.chunk.KeyID, _ = doc.Lookup(dbFieldKeyID).StringValueOK()
+	if _, data, ok := doc.Lookup(c.field).BinaryOK(); ok {
+		c.chunk.Data = append([]byte(nil), data...)
+	}
+	if ts, ok := doc.Lookup(dbFieldCreatedTs).DateTimeOK(); ok {
+		c.chunk.CreatedTs = time.UnixMilli(ts).UTC()
+	}
+	if ts, ok := doc.Lookup(dbFieldExpireTs).DateTimeOK(); ok {
+		c.chunk.ExpireTs = time.UnixMilli(ts).UTC()
+	}
+	return true
+}
+
+func (c *chunkCursor) Chunk() *model.StoredChunk {
+	return &c.chunk
+}
+
+func (c *chunkCursor) Err() error {
+	return c.cursor.Err()
+}
+
+func (c *chunkCursor) Close(ctx context.Context) error {
+	return c.cursor.Close(ctx)
+}
@@ -59,7 +59,9 @@ func sendRecordingMessage(data []byte, sessionID string, w io.Writer) (int, erro
 
 func (r *RecordingWriter) Write(d []byte) (n int, err error) {
 	n, err = sendRecordingMessage(d, r.sessionID, r.w)
-	if n == 0 || err != nil {
+	if err != nil {
+		return 0, err
+	} else if n == 0 {
 		return 0, io.ErrShortWrite
 	}
 	return n, nil
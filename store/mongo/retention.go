@@ -0,0 +1,514 @@
+// Copyright 2023 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package mongo
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	mopts "go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/mendersoftware/go-lib-micro/identity"
+	"github.com/mendersoftware/go-lib-micro/log"
+	mstore "github.com/mendersoftware/go-lib-micro/store/v2"
+
+	"github.com/mendersoftware/deviceconnect/model"
+	"github.com/mendersoftware/deviceconnect/store"
+)
+
+// recordingRetention returns the retention of the session recordings of
+// the tenant in the context: the retention of the tenant policy, if any, or
+// the recording expiration
+func (db *DataStoreMongo) recordingRetention(ctx context.Context) (time.Duration, error) {
+	var tenantID string
+	if id := identity.FromContext(ctx); id != nil {
+		tenantID = id.Tenant
+	}
+	policy, err := db.GetTenantPolicy(ctx, tenantID)
+	if err != nil {
+		return 0, err
+	} else if policy != nil && policy.RecordingRetention != nil {
+		return time.Duration(*policy.RecordingRetention) * time.Second, nil
+	}
+	return db.recordingExpire, nil
+}
+
+// heldSessions returns the sessions on legal hold among the sessions
+func (db *DataStoreMongo) heldSessions(
+	ctx context.Context,
+	sessionIDs []string,
+) (map[string]bool, error) {
+	coll := db.client.Database(DbName).Collection(LegalHoldsCollectionName)
+
+	filter := bson.M{}
+	if sessionIDs != nil {
+		filter[dbFieldID] = bson.M{"$in": sessionIDs}
+	}
+	cursor, err := coll.Find(ctx,
+		mstore.WithTenantID(ctx, filter),
+		mopts.Find().SetProjection(bson.M{dbFieldID: 1}),
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "store: failed to get the legal holds")
+	}
+	defer cursor.Close(ctx)
+
+	held := map[string]bool{}
+	for cursor.Next(ctx) {
+		if id, ok := cursor.Current.Lookup(dbFieldID).StringValueOK(); ok {
+			held[id] = true
+		}
+	}
+	return held, errors.Wrap(cursor.Err(), "store: failed to get the legal holds")
+}
+
+// recordingPolicyTTL is how long the retention and the legal hold of the
+// sessions are cached storing their recordings: the recordings stored
+// meanwhile by the other instances get the expiry of the changes made after
+// at most as long.
+const recordingPolicyTTL = time.Minute
+
+// recordingPolicy is the retention and the legal hold of the recording of
+// a session
+type recordingPolicy struct {
+	retention time.Duration
+	held      bool
+	cachedTs  time.Time
+}
+
+// expireTs returns the expiry of the data of the recording created at the
+// time, zero if the session is on legal hold
+func (p recordingPolicy) expireTs(created time.Time) time.Time {
+	if p.held {
+		return time.Time{}
+	}
+	return created.Add(p.retention)
+}
+
+// recordingPolicies caches the recording policies of the sessions, by
+// tenant and session, for up to ttl; the expired policies are swept once
+// per ttl. The nil cache caches nothing.
+type recordingPolicies struct {
+	ttl      time.Duration
+	mutex    sync.Mutex
+	policies map[string]recordingPolicy
+	sweptTs  time.Time
+}
+
+func newRecordingPolicies(ttl time.Duration) *recordingPolicies {
+	return &recordingPolicies{
+		ttl:      ttl,
+		policies: make(map[string]recordingPolicy),
+	}
+}
+
+// recordingPolicyKey returns the key of the cached policy of the session,
+// or the prefix of the keys of all the sessions if sessionID is empty, of
+// the tenant in the context
+func recordingPolicyKey(ctx context.Context, sessionID string) string {
+	var tenantID string
+	if id := identity.FromContext(ctx); id != nil {
+		tenantID = id.Tenant
+	}
+	return tenantID + "/" + sessionID
+}
+
+func (c *recordingPolicies) get(key string, now time.Time) (recordingPolicy, bool) {
+	if c == nil {
+		return recordingPolicy{}, false
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	policy, ok := c.policies[key]
+	if !ok || now.Sub(policy.cachedTs) >= c.ttl {
+		return recordingPolicy{}, false
+	}
+	return policy, true
+}
+
+func (c *recordingPolicies) set(key string, policy recordingPolicy) {
+	if c == nil {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if policy.cachedTs.Sub(c.sweptTs) >= c.ttl {
+		for k, p := range c.policies {
+			if policy.cachedTs.Sub(p.cachedTs) >= c.ttl {
+				delete(c.policies, k)
+			}
+		}
+		c.sweptTs = policy.cachedTs
+	}
+	c.policies[key] = policy
+}
+
+// invalidate drops the cached policies whose key starts with the prefix
+func (c *recordingPolicies) invalidate(prefix string) {
+	if c == nil {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for key := range c.policies {
+		if strings.HasPrefix(key, prefix) {
+			delete(c.policies, key)
+		}
+	}
+}
+
+// recordingPolicy returns the recording policy of the session, cached
+func (db *DataStoreMongo) recordingPolicy(
+	ctx context.Context,
+	sessionID string,
+) (recordingPolicy, error) {
+	key := recordingPolicyKey(ctx, sessionID)
+	now := clock.Now()
+	if policy, ok := db.policies.get(key, now); ok {
+		return policy, nil
+	}
+	held, err := db.heldSessions(ctx, []string{sessionID})
+	if err != nil {
+		return recordingPolicy{}, err
+	}
+	retention, err := db.recordingRetention(ctx)
+	if err != nil {
+		return recordingPolicy{}, err
+	}
+	policy := recordingPolicy{
+		retention: retention,
+		held:      held[sessionID],
+		cachedTs:  now,
+	}
+	db.policies.set(key, policy)
+	return policy, nil
+}
+
+// recordingExpireTs returns the expiry of the data of the recording of the
+// session created at the time, zero if the session is on legal hold
+func (db *DataStoreMongo) recordingExpireTs(
+	ctx context.Context,
+	sessionID string,
+	created time.Time,
+) (time.Time, error) {
+	policy, err := db.recordingPolicy(ctx, sessionID)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return policy.expireTs(created), nil
+}
+
+// UpdateRecordingExpiry sets the expiry of the recording of the session, or
+// of the recordings of all the sessions of the tenant if sessionID is empty,
+// after the retention of the tenant; the recordings of the sessions on legal
+// hold never expire.
+func (db *DataStoreMongo) UpdateRecordingExpiry(
+	ctx context.Context,
+	sessionID string,
+) error {
+	if err := db.updateRecordingExpiry(ctx, sessionID); err != nil {
+		return err
+	}
+	db.policyChanged(ctx, sessionID)
+	return nil
+}
+
+func (db *DataStoreMongo) updateRecordingExpiry(
+	ctx context.Context,
+	sessionID string,
+) error {
+	retention, err := db.recordingRetention(ctx)
+	if err != nil {
+		return err
+	}
+	var excluded []string
+	if sessionID != "" {
+		held, err := db.heldSessions(ctx, []string{sessionID})
+		if err != nil {
+			return err
+		} else if held[sessionID] {
+			retention = 0
+		}
+	} else {
+		held, err := db.heldSessions(ctx, nil)
+		if err != nil {
+			return err
+		}
+		for id := range held {
+			excluded = append(excluded, id)
+		}
+	}
+	return db.setRecordingRetention(ctx, sessionID, excluded, retention)
+}
+
+// policyChanged drops the cached recording policy of the session, or of all
+// the sessions of the tenant if sessionID is empty, and updates the expiry
+// of the recordings again once the policies cached by all the instances
+// expired, for the recordings they stored meanwhile after the former
+// policy.
+func (db *DataStoreMongo) policyChanged(ctx context.Context, sessionID string) {
+	if db.policies == nil {
+		return
+	}
+	db.policies.invalidate(recordingPolicyKey(ctx, sessionID))
+	id := identity.FromContext(ctx)
+	time.AfterFunc(db.policies.ttl, func() {
+		ctx := identity.WithContext(context.Background(), id)
+		if err := db.updateRecordingExpiry(ctx, sessionID); err != nil {
+			log.FromContext(ctx).Errorf(
+				"failed to update the expiry of the session recordings: %s",
+				err.Error())
+		}
+	})
+}
+
+// setRecordingRetention sets the expiry of the chunks, the signatures and
+// the indexed text of the recordings
+func (db *DataStoreMongo) setRecordingRetention(
+	ctx context.Context,
+	sessionID string,
+	excluded []string,
+	retention time.Duration,
+) error {
+	database := db.client.Database(DbName)
+	for _, coll := range []struct {
+		name  string
+		field string
+	}{
+		{RecordingSignaturesCollectionName, dbFieldID},
+		{RecordingTextCollectionName, dbFieldSessionID},
+		{RecordedSessionsCollectionName, dbFieldID},
+	} {
+		_, err := database.Collection(coll.name).UpdateMany(ctx,
+			retentionFilter(ctx, coll.field, sessionID, excluded),
+			retentionUpdate(retention),
+		)
+		if err != nil {
+			return errors.Wrap(err, "store: failed to update the recordings expiry")
+		}
+	}
+	return db.recordingStorage().SetChunksRetention(ctx, sessionID, excluded, retention)
+}
+
+// SetLegalHold places the recording of the session on legal hold, keeping
+// it from expiring
+func (db *DataStoreMongo) SetLegalHold(ctx context.Context, hold *model.LegalHold) error {
+	coll := db.client.Database(DbName).Collection(LegalHoldsCollectionName)
+
+	_, err := coll.ReplaceOne(ctx,
+		mstore.WithTenantID(ctx, bson.M{dbFieldID: hold.SessionID}),
+		mstore.WithTenantID(ctx, hold),
+		mopts.Replace().SetUpsert(true),
+	)
+	if err != nil {
+		return errors.Wrap(err, "store: failed to set the legal hold")
+	}
+	if err := db.setRecordingRetention(ctx, hold.SessionID, nil, 0); err != nil {
+		return err
+	}
+	db.policyChanged(ctx, hold.SessionID)
+	return nil
+}
+
+// GetLegalHold returns the legal hold of the session, or nil if the
+// session is not on legal hold
+func (db *DataStoreMongo) GetLegalHold(
+	ctx context.Context,
+	sessionID string,
+) (*model.LegalHold, error) {
+	coll := db.client.Database(DbName).Collection(LegalHoldsCollectionName)
+
+	hold := &model.LegalHold{}
+	err := coll.FindOne(ctx,
+		mstore.WithTenantID(ctx, bson.M{dbFieldID: sessionID}),
+	).Decode(hold)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "store: failed to get the legal hold")
+	}
+	return hold, nil
+}
+
+// DeleteLegalHold releases the legal hold of the session: the recording
+// expires again after the retention of the tenant from its creation
+func (db *DataStoreMongo) DeleteLegalHold(ctx context.Context, sessionID string) error {
+	coll := db.client.Database(DbName).Collection(LegalHoldsCollectionName)
+
+	res, err := coll.DeleteOne(ctx,
+		mstore.WithTenantID(ctx, bson.M{dbFieldID: sessionID}),
+	)
+	if err != nil {
+		return errors.Wrap(err, "store: failed to delete the legal hold")
+	} else if res.DeletedCount == 0 {
+		return store.ErrLegalHoldNotFound
+	}
+	return db.UpdateRecordingExpiry(ctx, sessionID)
+}
+
+// InsertRecordedSession catalogues the recorded session, expiring with the
+// recording
+func (db *DataStoreMongo) InsertRecordedSession(
+	ctx context.Context,
+	sess *model.RecordedSession,
+) error {
+	coll := db.client.Database(DbName).Collection(RecordedSessionsCollectionName)
+
+	if sess.CreatedTs.IsZero() {
+		sess.CreatedTs = clock.Now().UTC()
+	}
+	expireTs, err := db.recordingExpireTs(ctx, sess.SessionID, sess.CreatedTs)
+	if err != nil {
+		return err
+	}
+	sess.ExpireTs = expireTs
+	_, err = coll.InsertOne(ctx, mstore.WithTenantID(ctx, sess))
+	if err != nil {
+		return errors.Wrap(err, "store: failed to insert the recorded session")
+	}
+	return nil
+}
+
+// GetRecordedSession returns the recorded session, or nil if the session is
+// not catalogued
+func (db *DataStoreMongo) GetRecordedSession(
+	ctx context.Context,
+	sessionID string,
+) (*model.RecordedSession, error) {
+	coll := db.client.Database(DbName).Collection(RecordedSessionsCollectionName)
+
+	sess := &model.RecordedSession{}
+	err := coll.FindOne(ctx,
+		mstore.WithTenantID(ctx, bson.M{dbFieldID: sessionID}),
+	).Decode(sess)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "store: failed to get the recorded session")
+	}
+	return sess, nil
+}
+
+// FindRecordedSessions returns the recorded sessions of the user or of the
+// device in the filter
+func (db *DataStoreMongo) FindRecordedSessions(
+	ctx context.Context,
+	filter model.RecordingFilter,
+) ([]model.RecordedSession, error) {
+	query := bson.D{}
+	if filter.DeviceID != "" {
+		query = append(query, bson.E{Key: dbFieldDeviceID, Value: filter.DeviceID})
+	}
+	if filter.UserID != "" {
+		query = append(query, bson.E{Key: dbFieldUserID, Value: filter.UserID})
+	}
+	return db.findRecordedSessions(ctx, query)
+}
+
+func (db *DataStoreMongo) findRecordedSessions(
+	ctx context.Context,
+	query bson.D,
+) ([]model.RecordedSession, error) {
+	coll := db.client.Database(DbName).Collection(RecordedSessionsCollectionName)
+
+	cursor, err := coll.Find(ctx,
+		mstore.WithTenantID(ctx, query),
+		mopts.Find().SetSort(bson.D{{Key: dbFieldCreatedTs, Value: 1}}),
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "store: failed to find the recorded sessions")
+	}
+	sessions := []model.RecordedSession{}
+	if err := cursor.All(ctx, &sessions); err != nil {
+		return nil, errors.Wrap(err, "store: failed to decode the recorded sessions")
+	}
+	return sessions, nil
+}
+
+// FindUnattributedRecordedSessions returns the recorded sessions whose user
+// and device are unknown, catalogued from the recordings made before the
+// catalogue: the filters on the user or the device never match them.
+func (db *DataStoreMongo) FindUnattributedRecordedSessions(
+	ctx context.Context,
+) ([]model.RecordedSession, error) {
+	return db.findRecordedSessions(ctx, bson.D{
+		{Key: dbFieldDeviceID, Value: ""},
+		{Key: dbFieldUserID, Value: ""},
+	})
+}
+
+// HasSessionRecording reports if chunks of the recording of the session are
+// stored, catalogued or not
+func (db *DataStoreMongo) HasSessionRecording(
+	ctx context.Context,
+	sessionID string,
+) (bool, error) {
+	storage := db.recordingStorage()
+	for _, stream := range model.RecordingStreams {
+		chunks, err := storage.GetChunks(ctx, sessionID, stream)
+		if err != nil {
+			return false, err
+		}
+		found := chunks.Next(ctx)
+		err = chunks.Err()
+		_ = chunks.Close(ctx)
+		if err != nil {
+			return false, errors.Wrap(err, "store: failed to get the recording chunks")
+		} else if found {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// DeleteSessionRecordings deletes the recordings of the sessions: the
+// chunks of the recording streams, the signatures, the indexed text and,
+// last, the catalogue entries, for the deletion to be retried on failure.
+func (db *DataStoreMongo) DeleteSessionRecordings(
+	ctx context.Context,
+	sessionIDs []string,
+) error {
+	if len(sessionIDs) == 0 {
+		return nil
+	}
+	_, err := db.recordingStorage().DeleteChunks(ctx, sessionIDs)
+	if err != nil {
+		return err
+	}
+	database := db.client.Database(DbName)
+	for _, coll := range []struct {
+		name  string
+		field string
+	}{
+		{RecordingSignaturesCollectionName, dbFieldID},
+		{RecordingTextCollectionName, dbFieldSessionID},
+		{RecordedSessionsCollectionName, dbFieldID},
+	} {
+		_, err := database.Collection(coll.name).DeleteMany(ctx,
+			mstore.WithTenantID(ctx, bson.M{
+				coll.field: bson.M{"$in": sessionIDs},
+			}),
+		)
+		if err != nil {
+			return errors.Wrap(err, "store: failed to delete the session recordings")
+		}
+	}
+	return nil
+}
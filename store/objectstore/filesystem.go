@@ -0,0 +1,151 @@
+// Copyright 2023 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package objectstore
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// tempPrefix is the prefix of the files being written
+const tempPrefix = ".tmp-"
+
+// Filesystem stores the objects as the files of a local directory
+type Filesystem struct {
+	root string
+}
+
+// NewFilesystem returns the bucket of the objects in the directory,
+// creating the directory if needed
+func NewFilesystem(root string) (*Filesystem, error) {
+	if root == "" {
+		return nil, errors.New("objectstore: no filesystem path configured")
+	}
+	if err := os.MkdirAll(root, 0700); err != nil {
+		return nil, errors.Wrap(err, "objectstore: failed to create the directory")
+	}
+	return &Filesystem{root: filepath.Clean(root)}, nil
+}
+
+func (f *Filesystem) path(key string) (string, error) {
+	if key == "" || path.Clean(key) != key || strings.HasPrefix(key, "/") ||
+		strings.HasPrefix(key, "../") {
+		return "", errors.Wrap(ErrInvalidObjectKey, key)
+	}
+	return filepath.Join(f.root, filepath.FromSlash(key)), nil
+}
+
+// PutObject writes the object to a temporary file, renamed once complete
+func (f *Filesystem) PutObject(ctx context.Context, key string, data []byte) error {
+	name, err := f.path(key)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(name)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, tempPrefix)
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if errClose := tmp.Close(); err == nil {
+		err = errClose
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), name)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+	}
+	return err
+}
+
+func (f *Filesystem) GetObject(ctx context.Context, key string) ([]byte, error) {
+	name, err := f.path(key)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrObjectNotFound
+	}
+	return data, err
+}
+
+// ListObjects walks the directory of the prefix, in lexical order
+func (f *Filesystem) ListObjects(
+	ctx context.Context,
+	prefix string,
+	fn func(key string) error,
+) error {
+	dir := f.root
+	if i := strings.LastIndex(prefix, "/"); i > 0 {
+		var err error
+		dir, err = f.path(prefix[:i])
+		if err != nil {
+			return err
+		}
+	}
+	err := filepath.WalkDir(dir, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		} else if d.IsDir() || strings.HasPrefix(d.Name(), tempPrefix) {
+			return nil
+		}
+		rel, err := filepath.Rel(f.root, name)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		return fn(key)
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// DeleteObject deletes the object, and the directories left empty
+func (f *Filesystem) DeleteObject(ctx context.Context, key string) error {
+	name, err := f.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(name)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	for dir := filepath.Dir(name); dir != f.root && len(dir) > len(f.root); {
+		if os.Remove(dir) != nil {
+			break
+		}
+		dir = filepath.Dir(dir)
+	}
+	return nil
+}
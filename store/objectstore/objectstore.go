@@ -0,0 +1,721 @@
+// Copyright 2023 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+// Package objectstore stores the session recordings as objects, in a local
+// filesystem or in an S3-compatible object storage.
+package objectstore
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/mendersoftware/go-lib-micro/identity"
+
+	"github.com/mendersoftware/deviceconnect/model"
+	"github.com/mendersoftware/deviceconnect/store"
+)
+
+var (
+	ErrObjectNotFound         = errors.New("objectstore: object not found")
+	ErrInvalidObjectKey       = errors.New("objectstore: invalid object key")
+	ErrUnknownRecordingStream = errors.New("objectstore: unknown recording stream")
+)
+
+// Bucket stores the objects by key; the keys are slash-separated paths.
+type Bucket interface {
+	PutObject(ctx context.Context, key string, data []byte) error
+	// GetObject returns the object, or ErrObjectNotFound
+	GetObject(ctx context.Context, key string) ([]byte, error)
+	// ListObjects calls fn with the keys of the objects starting with
+	// the prefix, in lexicographical order
+	ListObjects(ctx context.Context, prefix string, fn func(key string) error) error
+	// DeleteObject deletes the object, if it exists
+	DeleteObject(ctx context.Context, key string) error
+}
+
+// noTenant is the path of the recordings without tenant
+const noTenant = "default"
+
+var pathSegment = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9_.-]*$`)
+
+// chunkObject is the object of a chunk; the position and the creation time
+// of the chunk are in the key, for listing and expiring the chunks without
+// reading them.
+type chunkObject struct {
+	Hash   []byte `bson:"hash,omitempty"`
+	Format string `bson:"format,omitempty"`
+	Offset int64  `bson:"offset,omitempty"`
+	KeyID  string `bson:"key_id,omitempty"`
+	Data   []byte `bson:"data"`
+}
+
+// The retention of the chunks is kept apart from the chunks, in the objects
+// <tenant>/.retention, for all the sessions of the tenant, and
+// <tenant>/.session-retention/<session>, for the sessions on legal hold or
+// released from it: the chunks expire after the retention of their session,
+// if any, or of their tenant from their creation, and changing the retention
+// rewrites these objects only.
+const (
+	tenantRetentionName = ".retention"
+	sessionRetentionDir = ".session-retention"
+)
+
+// The chunks are indexed by expiry in the empty objects
+// .expiry/<minute>/<tenant>/<session>, from the minute the chunks of the
+// session start expiring, and .expiry/<minute>/<tenant>/.tenant, from the
+// minute the retention of the tenant changed: the expired chunks are looked
+// up in the sessions indexed until now only, which are indexed again at the
+// expiry of their remaining chunks.
+const (
+	expiryIndexDir    = ".expiry"
+	expiryIndexLayout = "200601021504"
+	expiryIndexTenant = ".tenant"
+
+	// expiryIndexedTTL is how long the instance remembers indexing a
+	// session at a minute, not to index it again storing its chunks
+	expiryIndexedTTL = time.Hour
+)
+
+// errExpiryIndexDone stops listing the expiry index at the first entry
+// not due yet
+var errExpiryIndexDone = errors.New("objectstore: expiry index done")
+
+// retentionObject is the object of a retention; zero retention keeps the
+// chunks forever.
+type retentionObject struct {
+	Retention time.Duration `bson:"retention"`
+}
+
+// RecordingStorage stores the chunks of the recording streams as the
+// objects <tenant>/<session>/<stream>/<sequence>-<created>-<id> of the
+// bucket, sorting by sequence and creation time.
+type RecordingStorage struct {
+	bucket Bucket
+
+	mutex sync.Mutex
+	// retained are the retentions of the tenants known to be recorded
+	retained map[string]time.Duration
+	// indexed are the entries of the expiry index written by the instance
+	// storing chunks, swept every expiryIndexedTTL
+	indexed   map[string]time.Time
+	indexedTs time.Time
+}
+
+// NewRecordingStorage returns the recording storage in the bucket
+func NewRecordingStorage(bucket Bucket) *RecordingStorage {
+	return &RecordingStorage{
+		bucket:   bucket,
+		retained: make(map[string]time.Duration),
+		indexed:  make(map[string]time.Time),
+	}
+}
+
+// sessionPrefix returns the prefix of the objects of the session, or of
+// all the sessions if sessionID is empty, of the tenant in the context
+func sessionPrefix(ctx context.Context, sessionID string) (string, error) {
+	tenant := noTenant
+	if id := identity.FromContext(ctx); id != nil && id.Tenant != "" {
+		tenant = id.Tenant
+	}
+	if !pathSegment.MatchString(tenant) {
+		return "", ErrInvalidObjectKey
+	}
+	if sessionID == "" {
+		return tenant + "/", nil
+	} else if !pathSegment.MatchString(sessionID) {
+		return "", ErrInvalidObjectKey
+	}
+	return tenant + "/" + sessionID + "/", nil
+}
+
+// streamPrefix returns the prefix of the objects of the recording stream
+// of the session, of the tenant in the context
+func streamPrefix(ctx context.Context, sessionID, stream string) (string, error) {
+	if sessionID == "" {
+		return "", ErrInvalidObjectKey
+	}
+	prefix, err := sessionPrefix(ctx, sessionID)
+	if err != nil {
+		return "", err
+	}
+	known := false
+	for _, s := range model.RecordingStreams {
+		known = known || s == stream
+	}
+	if !known {
+		return "", ErrUnknownRecordingStream
+	}
+	return prefix + stream + "/", nil
+}
+
+// chunkName returns the name of the object of the chunk
+func chunkName(chunk *model.StoredChunk) string {
+	return fmt.Sprintf("%010d-%019d-%s",
+		chunk.Sequence,
+		unixNano(chunk.CreatedTs),
+		uuid.NewString(),
+	)
+}
+
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+// parseChunkName parses the name of the object of a chunk
+func parseChunkName(name string, chunk *model.StoredChunk) error {
+	parts := strings.SplitN(name, "-", 3)
+	if len(parts) != 3 {
+		return errors.Wrap(ErrInvalidObjectKey, name)
+	}
+	seq, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return errors.Wrap(ErrInvalidObjectKey, name)
+	}
+	created, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return errors.Wrap(ErrInvalidObjectKey, name)
+	}
+	chunk.Sequence = seq
+	chunk.CreatedTs = time.Unix(0, created).UTC()
+	return nil
+}
+
+// expireTs returns the expiry of the chunk created at the time after the
+// retention, zero if the chunk never expires
+func expireTs(created time.Time, retention time.Duration) time.Time {
+	if retention <= 0 {
+		return time.Time{}
+	}
+	return created.Add(retention)
+}
+
+// getRetention returns the retention of the object, and false if the
+// object does not exist
+func (s *RecordingStorage) getRetention(
+	ctx context.Context,
+	key string,
+) (time.Duration, bool, error) {
+	data, err := s.bucket.GetObject(ctx, key)
+	if err == ErrObjectNotFound {
+		return 0, false, nil
+	} else if err != nil {
+		return 0, false, errors.Wrap(err,
+			"objectstore: failed to get the recording chunks retention")
+	}
+	var object retentionObject
+	if err := bson.Unmarshal(data, &object); err != nil {
+		return 0, false, err
+	}
+	return object.Retention, true, nil
+}
+
+func (s *RecordingStorage) putRetention(
+	ctx context.Context,
+	key string,
+	retention time.Duration,
+) error {
+	data, err := bson.Marshal(retentionObject{Retention: retention})
+	if err != nil {
+		return err
+	}
+	err = s.bucket.PutObject(ctx, key, data)
+	return errors.Wrap(err, "objectstore: failed to set the recording chunks retention")
+}
+
+// sessionRetention returns the retention of the chunks of the session of
+// the tenant whose objects start with the prefix: the retention of the
+// session, if any, or of the tenant, zero if none is recorded
+func (s *RecordingStorage) sessionRetention(
+	ctx context.Context,
+	tenantPrefix, sessionID string,
+) (time.Duration, error) {
+	retention, ok, err := s.getRetention(ctx,
+		tenantPrefix+sessionRetentionDir+"/"+sessionID)
+	if err != nil || ok {
+		return retention, err
+	}
+	retention, _, err = s.getRetention(ctx, tenantPrefix+tenantRetentionName)
+	return retention, err
+}
+
+// syncRetention records the retention of the chunks stored for the tenant
+// in the context as the retention of the tenant, unless already recorded:
+// the retention of the chunks follows the retention of the tenant policy or
+// the recording expiration, which changes with the configuration. The
+// tenant is indexed for expiry now when its retention changes, for its
+// chunks to expire after the new retention.
+func (s *RecordingStorage) syncRetention(ctx context.Context, retention time.Duration) error {
+	prefix, err := sessionPrefix(ctx, "")
+	if err != nil {
+		return err
+	}
+	key := prefix + tenantRetentionName
+	s.mutex.Lock()
+	retained, ok := s.retained[key]
+	s.mutex.Unlock()
+	if ok && retained == retention {
+		return nil
+	}
+	retained, ok, err = s.getRetention(ctx, key)
+	if err == nil && (!ok || retained != retention) {
+		err = s.putRetention(ctx, key, retention)
+		if err == nil && ok {
+			err = s.putExpiryIndex(ctx,
+				expiryIndexKey(time.Now(), prefix, expiryIndexTenant))
+		}
+	}
+	if err != nil {
+		return err
+	}
+	s.setRetained(key, retention)
+	return nil
+}
+
+func (s *RecordingStorage) setRetained(key string, retention time.Duration) {
+	s.mutex.Lock()
+	s.retained[key] = retention
+	s.mutex.Unlock()
+}
+
+// expiryIndexKey returns the key of the entry of the expiry index of the
+// session, or of all the sessions if name is expiryIndexTenant, of the
+// tenant whose objects start with the prefix
+func expiryIndexKey(expire time.Time, tenantPrefix, name string) string {
+	return expiryIndexDir + "/" + expire.UTC().Format(expiryIndexLayout) + "/" +
+		tenantPrefix + name
+}
+
+func (s *RecordingStorage) putExpiryIndex(ctx context.Context, key string) error {
+	err := s.bucket.PutObject(ctx, key, nil)
+	return errors.Wrap(err, "objectstore: failed to index the recording chunks expiry")
+}
+
+// indexExpiry indexes the session of the tenant in the context at the
+// expiry, unless the instance indexed it at the same minute recently
+func (s *RecordingStorage) indexExpiry(
+	ctx context.Context,
+	sessionID string,
+	expire time.Time,
+) error {
+	prefix, err := sessionPrefix(ctx, "")
+	if err != nil {
+		return err
+	} else if !pathSegment.MatchString(sessionID) {
+		return ErrInvalidObjectKey
+	}
+	key := expiryIndexKey(expire, prefix, sessionID)
+	s.mutex.Lock()
+	_, indexed := s.indexed[key]
+	s.mutex.Unlock()
+	if indexed {
+		return nil
+	}
+	if err := s.putExpiryIndex(ctx, key); err != nil {
+		return err
+	}
+	now := time.Now()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if now.Sub(s.indexedTs) >= expiryIndexedTTL {
+		for k, ts := range s.indexed {
+			if now.Sub(ts) >= expiryIndexedTTL {
+				delete(s.indexed, k)
+			}
+		}
+		s.indexedTs = now
+	}
+	s.indexed[key] = now
+	return nil
+}
+
+// PutChunks stores chunks of the recording streams, one object each; the
+// retention of the chunks, their expiry after their creation, is recorded
+// as the retention of the tenant if it differs from the one recorded, and
+// the sessions are indexed at the first expiry of their chunks. The chunks
+// without expiry are the chunks of the sessions on legal hold.
+func (s *RecordingStorage) PutChunks(ctx context.Context, chunks []*model.StoredChunk) error {
+	expiry := map[string]time.Time{}
+	for _, chunk := range chunks {
+		if chunk.ExpireTs.IsZero() {
+			continue
+		} else if len(expiry) == 0 {
+			err := s.syncRetention(ctx, chunk.ExpireTs.Sub(chunk.CreatedTs))
+			if err != nil {
+				return err
+			}
+		}
+		if first, ok := expiry[chunk.SessionID]; !ok || chunk.ExpireTs.Before(first) {
+			expiry[chunk.SessionID] = chunk.ExpireTs
+		}
+	}
+	for sessionID, expire := range expiry {
+		if err := s.indexExpiry(ctx, sessionID, expire); err != nil {
+			return err
+		}
+	}
+	for _, chunk := range chunks {
+		if err := s.putChunk(ctx, chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *RecordingStorage) putChunk(ctx context.Context, chunk *model.StoredChunk) error {
+	prefix, err := streamPrefix(ctx, chunk.SessionID, chunk.Stream)
+	if err != nil {
+		return err
+	}
+	data, err := bson.Marshal(chunkObject{
+		Hash:   chunk.Hash,
+		Format: chunk.Format,
+		Offset: chunk.Offset,
+		KeyID:  chunk.KeyID,
+		Data:   chunk.Data,
+	})
+	if err != nil {
+		return err
+	}
+	err = s.bucket.PutObject(ctx, prefix+chunkName(chunk), data)
+	return errors.Wrap(err, "objectstore: failed to store the recording chunk")
+}
+
+// GetChunks returns the chunks of a recording stream of a session; the
+// chunks are read as the iterator moves.
+func (s *RecordingStorage) GetChunks(
+	ctx context.Context,
+	sessionID, stream string,
+) (store.ChunkIterator, error) {
+	prefix, err := streamPrefix(ctx, sessionID, stream)
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	err = s.bucket.ListObjects(ctx, prefix, func(key string) error {
+		keys = append(keys, key)
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "objectstore: failed to list the recording chunks")
+	}
+	tenantPrefix, _ := sessionPrefix(ctx, "")
+	retention, err := s.sessionRetention(ctx, tenantPrefix, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	return &chunkIterator{
+		bucket:    s.bucket,
+		sessionID: sessionID,
+		stream:    stream,
+		retention: retention,
+		keys:      keys,
+	}, nil
+}
+
+// DeleteExpiredChunks deletes the chunks of all the tenants which expired
+// before the time, looking them up in the sessions of the expiry index due
+func (s *RecordingStorage) DeleteExpiredChunks(
+	ctx context.Context,
+	before time.Time,
+) (int, error) {
+	var due []string
+	until := before.UTC().Format(expiryIndexLayout)
+	err := s.bucket.ListObjects(ctx, expiryIndexDir+"/", func(key string) error {
+		// .expiry/<minute>/<tenant>/<session>
+		parts := strings.Split(key, "/")
+		if len(parts) != 4 {
+			return nil
+		} else if parts[1] > until {
+			return errExpiryIndexDone
+		}
+		due = append(due, key)
+		return nil
+	})
+	if err != nil && err != errExpiryIndexDone {
+		return 0, errors.Wrap(err, "objectstore: failed to list the recording chunks expiry")
+	}
+	deleted := 0
+	for _, key := range due {
+		parts := strings.Split(key, "/")
+		tenantPrefix := parts[2] + "/"
+		sessionIDs := []string{parts[3]}
+		if parts[3] == expiryIndexTenant {
+			sessionIDs, err = s.tenantSessions(ctx, tenantPrefix)
+			if err != nil {
+				return deleted, err
+			}
+		}
+		keep := false
+		for _, sessionID := range sessionIDs {
+			count, next, err := s.deleteExpiredSessionChunks(ctx,
+				tenantPrefix, sessionID, before)
+			deleted += count
+			if err != nil {
+				return deleted, err
+			} else if next.IsZero() {
+				continue
+			}
+			nextKey := expiryIndexKey(next, tenantPrefix, sessionID)
+			if nextKey == key {
+				keep = true
+			} else if err := s.putExpiryIndex(ctx, nextKey); err != nil {
+				return deleted, err
+			}
+		}
+		if keep {
+			continue
+		}
+		if err := s.bucket.DeleteObject(ctx, key); err != nil {
+			return deleted, errors.Wrap(err,
+				"objectstore: failed to update the recording chunks expiry")
+		}
+	}
+	return deleted, nil
+}
+
+// tenantSessions returns the sessions with chunks of the tenant whose
+// objects start with the prefix
+func (s *RecordingStorage) tenantSessions(
+	ctx context.Context,
+	tenantPrefix string,
+) ([]string, error) {
+	var sessionIDs []string
+	err := s.bucket.ListObjects(ctx, tenantPrefix, func(key string) error {
+		// <tenant>/<session>/<stream>/<chunk>
+		parts := strings.Split(key, "/")
+		if len(parts) != 4 || strings.HasPrefix(parts[1], ".") {
+			return nil
+		} else if n := len(sessionIDs); n == 0 || sessionIDs[n-1] != parts[1] {
+			sessionIDs = append(sessionIDs, parts[1])
+		}
+		return nil
+	})
+	return sessionIDs, errors.Wrap(err, "objectstore: failed to list the recording chunks")
+}
+
+// deleteExpiredSessionChunks deletes the chunks of the session of the
+// tenant whose objects start with the prefix which expired before the
+// time, returning the first expiry of the remaining chunks, zero if they
+// never expire
+func (s *RecordingStorage) deleteExpiredSessionChunks(
+	ctx context.Context,
+	tenantPrefix, sessionID string,
+	before time.Time,
+) (int, time.Time, error) {
+	retention, err := s.sessionRetention(ctx, tenantPrefix, sessionID)
+	if err != nil || retention <= 0 {
+		// the sessions on legal hold are indexed again on release
+		return 0, time.Time{}, err
+	}
+	var (
+		expired []string
+		next    time.Time
+	)
+	err = s.bucket.ListObjects(ctx, tenantPrefix+sessionID+"/", func(key string) error {
+		var chunk model.StoredChunk
+		if parseChunkName(path.Base(key), &chunk) != nil {
+			return nil
+		}
+		expire := expireTs(chunk.CreatedTs, retention)
+		if expire.Before(before) {
+			expired = append(expired, key)
+		} else if next.IsZero() || expire.Before(next) {
+			next = expire
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, time.Time{}, errors.Wrap(err,
+			"objectstore: failed to list the recording chunks")
+	}
+	for i, key := range expired {
+		if err := s.bucket.DeleteObject(ctx, key); err != nil {
+			return i, time.Time{}, errors.Wrap(err,
+				"objectstore: failed to delete the expired recording chunks")
+		}
+	}
+	return len(expired), next, nil
+}
+
+// SetChunksRetention sets the retention of the chunks of the session, or of
+// all the sessions of the tenant but the excluded ones: the retention of the
+// tenant applies to the sessions with their own retention, but the excluded
+// ones, from now on. The sessions whose retention changes are indexed for
+// expiry now, and their chunks indexed again after the retention.
+func (s *RecordingStorage) SetChunksRetention(
+	ctx context.Context,
+	sessionID string,
+	excluded []string,
+	retention time.Duration,
+) error {
+	prefix, err := sessionPrefix(ctx, "")
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	if sessionID != "" {
+		if !pathSegment.MatchString(sessionID) {
+			return ErrInvalidObjectKey
+		}
+		err := s.putRetention(ctx, prefix+sessionRetentionDir+"/"+sessionID, retention)
+		if err != nil {
+			return err
+		}
+		return s.putExpiryIndex(ctx, expiryIndexKey(now, prefix, sessionID))
+	}
+	previous, ok, err := s.getRetention(ctx, prefix+tenantRetentionName)
+	if err != nil {
+		return err
+	}
+	if err := s.putRetention(ctx, prefix+tenantRetentionName, retention); err != nil {
+		return err
+	}
+	s.setRetained(prefix+tenantRetentionName, retention)
+	keep := make(map[string]bool, len(excluded))
+	for _, id := range excluded {
+		keep[prefix+sessionRetentionDir+"/"+id] = true
+	}
+	var released []string
+	err = s.bucket.ListObjects(ctx, prefix+sessionRetentionDir+"/", func(key string) error {
+		if !keep[key] {
+			released = append(released, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "objectstore: failed to list the recording chunks retention")
+	}
+	for _, key := range released {
+		err := s.putExpiryIndex(ctx, expiryIndexKey(now, prefix, path.Base(key)))
+		if err == nil {
+			err = s.bucket.DeleteObject(ctx, key)
+		}
+		if err != nil {
+			return errors.Wrap(err,
+				"objectstore: failed to update the recording chunks retention")
+		}
+	}
+	if ok && previous == retention {
+		return nil
+	}
+	return s.putExpiryIndex(ctx, expiryIndexKey(now, prefix, expiryIndexTenant))
+}
+
+// DeleteChunks deletes the chunks of the sessions of the tenant
+func (s *RecordingStorage) DeleteChunks(ctx context.Context, sessionIDs []string) (int, error) {
+	var keys []string
+	for _, sessionID := range sessionIDs {
+		if sessionID == "" {
+			return 0, ErrInvalidObjectKey
+		}
+		prefix, err := sessionPrefix(ctx, sessionID)
+		if err != nil {
+			return 0, err
+		}
+		err = s.bucket.ListObjects(ctx, prefix, func(key string) error {
+			keys = append(keys, key)
+			return nil
+		})
+		if err != nil {
+			return 0, errors.Wrap(err, "objectstore: failed to list the recording chunks")
+		}
+	}
+	for i, key := range keys {
+		if err := s.bucket.DeleteObject(ctx, key); err != nil {
+			return i, errors.Wrap(err,
+				"objectstore: failed to delete the recording chunks")
+		}
+	}
+	tenantPrefix, _ := sessionPrefix(ctx, "")
+	for _, sessionID := range sessionIDs {
+		err := s.bucket.DeleteObject(ctx, tenantPrefix+sessionRetentionDir+"/"+sessionID)
+		if err != nil {
+			return len(keys), errors.Wrap(err,
+				"objectstore: failed to delete the recording chunks retention")
+		}
+	}
+	return len(keys), nil
+}
+
+// chunkIterator reads the chunks of a recording stream from the bucket
+type chunkIterator struct {
+	bucket    Bucket
+	sessionID string
+	stream    string
+	retention time.Duration
+	keys      []string
+	chunk     model.StoredChunk
+	err       error
+}
+
+func (it *chunkIterator) Next(ctx context.Context) bool {
+	if it.err != nil || len(it.keys) == 0 {
+		return false
+	}
+	key := it.keys[0]
+	it.keys = it.keys[1:]
+
+	it.chunk = model.StoredChunk{
+		SessionID: it.sessionID,
+		Stream:    it.stream,
+	}
+	if it.err = parseChunkName(path.Base(key), &it.chunk); it.err != nil {
+		return false
+	}
+	it.chunk.ExpireTs = expireTs(it.chunk.CreatedTs, it.retention)
+	data, err := it.bucket.GetObject(ctx, key)
+	if err == ErrObjectNotFound {
+		// expired since listed
+		return it.Next(ctx)
+	} else if err != nil {
+		it.err = errors.Wrap(err, "objectstore: failed to get the recording chunk")
+		return false
+	}
+	var object chunkObject
+	if it.err = bson.Unmarshal(data, &object); it.err != nil {
+		return false
+	}
+	it.chunk.Hash = object.Hash
+	it.chunk.Format = object.Format
+	it.chunk.Offset = object.Offset
+	it.chunk.KeyID = object.KeyID
+	it.chunk.Data = object.Data
+	return true
+}
+
+func (it *chunkIterator) Chunk() *model.StoredChunk {
+	return &it.chunk
+}
+
+func (it *chunkIterator) Err() error {
+	return it.err
+}
+
+func (it *chunkIterator) Close(ctx context.Context) error {
+	it.keys = nil
+	return nil
+}
@@ -0,0 +1,385 @@
+// Copyright 2023 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package objectstore
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mendersoftware/go-lib-micro/identity"
+
+	"github.com/mendersoftware/deviceconnect/model"
+)
+
+const (
+	testSessionID     = "00000000-0000-0000-0000-000000000001"
+	testHeldSessionID = "00000000-0000-0000-0000-000000000002"
+)
+
+func readChunks(
+	ctx context.Context,
+	t *testing.T,
+	s *RecordingStorage,
+	sessionID, stream string,
+) []model.StoredChunk {
+	it, err := s.GetChunks(ctx, sessionID, stream)
+	if !assert.NoError(t, err) {
+		return nil
+	}
+	defer it.Close(ctx)
+	var chunks []model.StoredChunk
+	for it.Next(ctx) {
+		chunks = append(chunks, *it.Chunk())
+	}
+	assert.NoError(t, it.Err())
+	return chunks
+}
+
+func testRecordingStorage(t *testing.T, bucket Bucket) {
+	ctx := context.Background()
+	tenantCtx := identity.WithContext(ctx, &identity.Identity{Tenant: "tenant"})
+	s := NewRecordingStorage(bucket)
+	now := time.Now().UTC().Truncate(time.Millisecond)
+
+	chunks := []model.StoredChunk{{
+		SessionID: testSessionID,
+		Stream:    model.RecordingStreamOutput,
+		ChunkLink: model.ChunkLink{
+			Sequence: 2,
+			Hash:     []byte("second"),
+			Format:   model.ChunkFormatGzipStream,
+			Offset:   6,
+		},
+		KeyID:     "tenant",
+		Data:      []byte("world"),
+		CreatedTs: now,
+		ExpireTs:  now.Add(time.Hour),
+	}, {
+		SessionID: testSessionID,
+		Stream:    model.RecordingStreamOutput,
+		ChunkLink: model.ChunkLink{Sequence: 1, Hash: []byte("first")},
+		Data:      []byte("hello "),
+		CreatedTs: now.Add(-2 * time.Hour),
+		ExpireTs:  now.Add(-time.Hour),
+	}, {
+		SessionID: testSessionID,
+		Stream:    model.RecordingStreamInput,
+		Data:      []byte("ls\r"),
+		CreatedTs: now,
+		ExpireTs:  now.Add(time.Hour),
+	}}
+	assert.NoError(t, s.PutChunks(tenantCtx, []*model.StoredChunk{
+		&chunks[0], &chunks[1],
+	}))
+	assert.NoError(t, s.PutChunks(tenantCtx, []*model.StoredChunk{&chunks[2]}))
+
+	output := readChunks(tenantCtx, t, s, testSessionID, model.RecordingStreamOutput)
+	assert.Equal(t, []model.StoredChunk{chunks[1], chunks[0]}, output)
+	input := readChunks(tenantCtx, t, s, testSessionID, model.RecordingStreamInput)
+	assert.Equal(t, []model.StoredChunk{chunks[2]}, input)
+
+	// the chunks are scoped by tenant
+	assert.Empty(t, readChunks(ctx, t, s, testSessionID, model.RecordingStreamOutput))
+
+	deleted, err := s.DeleteExpiredChunks(ctx, now)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, deleted)
+	output = readChunks(tenantCtx, t, s, testSessionID, model.RecordingStreamOutput)
+	assert.Equal(t, []model.StoredChunk{chunks[0]}, output)
+
+	// the chunks of the sessions on legal hold never expire
+	err = s.SetChunksRetention(tenantCtx, testHeldSessionID, nil, 0)
+	assert.NoError(t, err)
+	held := model.StoredChunk{
+		SessionID: testHeldSessionID,
+		Stream:    model.RecordingStreamOutput,
+		Data:      []byte("held"),
+		CreatedTs: now.Add(-24 * time.Hour),
+	}
+	assert.NoError(t, s.PutChunks(tenantCtx, []*model.StoredChunk{&held}))
+	err = s.SetChunksRetention(tenantCtx, "", []string{testHeldSessionID}, 2*time.Hour)
+	assert.NoError(t, err)
+	chunks[0].ExpireTs = now.Add(2 * time.Hour)
+	output = readChunks(tenantCtx, t, s, testSessionID, model.RecordingStreamOutput)
+	assert.Equal(t, []model.StoredChunk{chunks[0]}, output)
+	chunks[2].ExpireTs = now.Add(2 * time.Hour)
+	input = readChunks(tenantCtx, t, s, testSessionID, model.RecordingStreamInput)
+	assert.Equal(t, []model.StoredChunk{chunks[2]}, input)
+	output = readChunks(tenantCtx, t, s, testHeldSessionID, model.RecordingStreamOutput)
+	assert.Equal(t, []model.StoredChunk{held}, output)
+
+	deleted, err = s.DeleteExpiredChunks(ctx, now.Add(24*time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, deleted)
+	output = readChunks(tenantCtx, t, s, testHeldSessionID, model.RecordingStreamOutput)
+	assert.Equal(t, []model.StoredChunk{held}, output)
+
+	// releasing the hold, the chunks expire after the retention, and
+	// follow the retention of the tenant once it changes
+	err = s.SetChunksRetention(tenantCtx, testHeldSessionID, nil, time.Hour)
+	assert.NoError(t, err)
+	held.ExpireTs = held.CreatedTs.Add(time.Hour)
+	output = readChunks(tenantCtx, t, s, testHeldSessionID, model.RecordingStreamOutput)
+	assert.Equal(t, []model.StoredChunk{held}, output)
+	err = s.SetChunksRetention(tenantCtx, "", nil, 48*time.Hour)
+	assert.NoError(t, err)
+	held.ExpireTs = held.CreatedTs.Add(48 * time.Hour)
+	output = readChunks(tenantCtx, t, s, testHeldSessionID, model.RecordingStreamOutput)
+	assert.Equal(t, []model.StoredChunk{held}, output)
+	deleted, err = s.DeleteExpiredChunks(ctx, now.Add(24*time.Hour+time.Minute))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, deleted)
+
+	// deleting the chunks of the session, the chunks of the other tenants
+	// are kept
+	erased := model.StoredChunk{
+		SessionID: testSessionID,
+		Stream:    model.RecordingStreamControl,
+		Data:      []byte("erased"),
+		CreatedTs: now,
+		ExpireTs:  now.Add(time.Hour),
+	}
+	assert.NoError(t, s.PutChunks(tenantCtx, []*model.StoredChunk{&erased}))
+	assert.NoError(t, s.PutChunks(ctx, []*model.StoredChunk{&erased}))
+	deleted, err = s.DeleteChunks(tenantCtx, []string{testSessionID, testHeldSessionID})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, deleted)
+	assert.Empty(t, readChunks(tenantCtx, t, s, testSessionID, model.RecordingStreamControl))
+	control := readChunks(ctx, t, s, testSessionID, model.RecordingStreamControl)
+	assert.Equal(t, []model.StoredChunk{erased}, control)
+	deleted, err = s.DeleteChunks(ctx, []string{testSessionID})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, deleted)
+	_, err = s.DeleteChunks(ctx, []string{""})
+	assert.ErrorIs(t, err, ErrInvalidObjectKey)
+
+	_, err = s.GetChunks(ctx, "../../etc", model.RecordingStreamOutput)
+	assert.ErrorIs(t, err, ErrInvalidObjectKey)
+	err = s.SetChunksRetention(ctx, "../../etc", nil, time.Hour)
+	assert.ErrorIs(t, err, ErrInvalidObjectKey)
+	_, err = s.GetChunks(ctx, testSessionID, "stderr")
+	assert.ErrorIs(t, err, ErrUnknownRecordingStream)
+	err = s.PutChunks(ctx, []*model.StoredChunk{{
+		SessionID: testSessionID,
+		Stream:    "stderr",
+	}})
+	assert.ErrorIs(t, err, ErrUnknownRecordingStream)
+}
+
+// listingBucket records the prefixes listed
+type listingBucket struct {
+	Bucket
+	prefixes []string
+}
+
+func (b *listingBucket) ListObjects(
+	ctx context.Context,
+	prefix string,
+	fn func(key string) error,
+) error {
+	b.prefixes = append(b.prefixes, prefix)
+	return b.Bucket.ListObjects(ctx, prefix, fn)
+}
+
+func TestExpiryIndex(t *testing.T) {
+	fs, err := NewFilesystem(filepath.Join(t.TempDir(), "recordings"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	bucket := &listingBucket{Bucket: fs}
+	s := NewRecordingStorage(bucket)
+	ctx := identity.WithContext(context.Background(), &identity.Identity{Tenant: "tenant"})
+	now := time.Now().UTC().Truncate(time.Millisecond)
+
+	chunks := []model.StoredChunk{{
+		SessionID: testSessionID,
+		Stream:    model.RecordingStreamOutput,
+		Data:      []byte("expired"),
+		CreatedTs: now.Add(-2 * time.Hour),
+		ExpireTs:  now.Add(-time.Hour),
+	}, {
+		SessionID: testSessionID,
+		Stream:    model.RecordingStreamOutput,
+		ChunkLink: model.ChunkLink{Sequence: 1},
+		Data:      []byte("expiring"),
+		CreatedTs: now.Add(-30 * time.Minute),
+		ExpireTs:  now.Add(30 * time.Minute),
+	}, {
+		SessionID: testHeldSessionID,
+		Stream:    model.RecordingStreamOutput,
+		Data:      []byte("kept"),
+		CreatedTs: now,
+		ExpireTs:  now.Add(time.Hour),
+	}}
+	assert.NoError(t, s.PutChunks(ctx, []*model.StoredChunk{
+		&chunks[0], &chunks[1], &chunks[2],
+	}))
+
+	// the expired chunks are looked up in the sessions due only
+	deleted, err := s.DeleteExpiredChunks(ctx, now)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, deleted)
+	assert.Equal(t, []string{
+		expiryIndexDir + "/",
+		"tenant/" + testSessionID + "/",
+	}, bucket.prefixes)
+
+	// the session is indexed again at the expiry of its remaining chunks
+	bucket.prefixes = nil
+	deleted, err = s.DeleteExpiredChunks(ctx, now.Add(time.Minute))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, deleted)
+	assert.Equal(t, []string{expiryIndexDir + "/"}, bucket.prefixes)
+	deleted, err = s.DeleteExpiredChunks(ctx, now.Add(31*time.Minute))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, deleted)
+	assert.Empty(t, readChunks(ctx, t, s, testSessionID, model.RecordingStreamOutput))
+
+	// shortening the retention of the tenant, its sessions are looked up
+	// at once
+	assert.NoError(t, s.SetChunksRetention(ctx, "", nil, time.Minute))
+	deleted, err = s.DeleteExpiredChunks(ctx, now.Add(2*time.Minute))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, deleted)
+
+	// the entries of the sessions without chunks left are dropped once due
+	deleted, err = s.DeleteExpiredChunks(ctx, now.Add(2*time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, deleted)
+	var index []string
+	err = fs.ListObjects(ctx, expiryIndexDir+"/", func(key string) error {
+		index = append(index, key)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Empty(t, index)
+}
+
+func TestRetentionFollowsChunks(t *testing.T) {
+	fs, err := NewFilesystem(filepath.Join(t.TempDir(), "recordings"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	s := NewRecordingStorage(fs)
+	ctx := identity.WithContext(context.Background(), &identity.Identity{Tenant: "tenant"})
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	stored := func(sessionID string, created time.Time, retention time.Duration) {
+		chunk := &model.StoredChunk{
+			SessionID: sessionID,
+			Stream:    model.RecordingStreamOutput,
+			Data:      []byte("output"),
+			CreatedTs: created,
+		}
+		if retention > 0 {
+			chunk.ExpireTs = created.Add(retention)
+		}
+		assert.NoError(t, s.PutChunks(ctx, []*model.StoredChunk{chunk}))
+	}
+	expiry := func(sessionID string) time.Duration {
+		chunks := readChunks(ctx, t, s, sessionID, model.RecordingStreamOutput)
+		if !assert.NotEmpty(t, chunks) {
+			return 0
+		}
+		return chunks[0].ExpireTs.Sub(chunks[0].CreatedTs)
+	}
+
+	stored(testSessionID, now.Add(-90*time.Minute), time.Hour)
+	assert.Equal(t, time.Hour, expiry(testSessionID))
+
+	// the chunks stored after changing the recording expiration change
+	// the retention of the tenant
+	stored(testHeldSessionID, now, 2*time.Hour)
+	assert.Equal(t, 2*time.Hour, expiry(testSessionID))
+	deleted, err := s.DeleteExpiredChunks(ctx, now)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, deleted)
+
+	// the chunks without expiry, of the sessions on legal hold, do not
+	stored(testHeldSessionID, now, 0)
+	assert.Equal(t, 2*time.Hour, expiry(testSessionID))
+
+	// shortening the retention, the chunks expire at once
+	stored(testHeldSessionID, now, 30*time.Minute)
+	assert.Equal(t, 30*time.Minute, expiry(testSessionID))
+	deleted, err = s.DeleteExpiredChunks(ctx, now)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, deleted)
+	assert.Empty(t, readChunks(ctx, t, s, testSessionID, model.RecordingStreamOutput))
+
+	// the retention of the chunks stored after setting the retention of
+	// the tenant applies, the instance caching the retention set
+	assert.NoError(t, s.SetChunksRetention(ctx, "", nil, 3*time.Hour))
+	assert.Equal(t, 3*time.Hour, expiry(testHeldSessionID))
+	stored(testHeldSessionID, now, 30*time.Minute)
+	assert.Equal(t, 30*time.Minute, expiry(testHeldSessionID))
+}
+
+func TestFilesystemRecordingStorage(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "recordings")
+	bucket, err := NewFilesystem(root)
+	if !assert.NoError(t, err) {
+		return
+	}
+	testRecordingStorage(t, bucket)
+
+	// a partially written chunk is not listed
+	dir := filepath.Join(root, "tenant", testSessionID, model.RecordingStreamOutput)
+	assert.NoError(t, os.MkdirAll(dir, 0700))
+	err = os.WriteFile(filepath.Join(dir, tempPrefix+"1"), []byte("partial"), 0600)
+	assert.NoError(t, err)
+	var keys []string
+	prefix := "tenant/" + testSessionID + "/"
+	err = bucket.ListObjects(context.Background(), prefix, func(key string) error {
+		keys = append(keys, key)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Empty(t, keys)
+
+	_, err = bucket.GetObject(context.Background(), "tenant/missing")
+	assert.ErrorIs(t, err, ErrObjectNotFound)
+	_, err = bucket.GetObject(context.Background(), "../outside")
+	assert.ErrorIs(t, err, ErrInvalidObjectKey)
+
+	_, err = NewFilesystem("")
+	assert.Error(t, err)
+}
+
+func TestParseChunkName(t *testing.T) {
+	created := time.Unix(1700000000, 123).UTC()
+	name := chunkName(&model.StoredChunk{
+		ChunkLink: model.ChunkLink{Sequence: 42},
+		CreatedTs: created,
+		ExpireTs:  created.Add(24 * time.Hour),
+	})
+
+	var chunk model.StoredChunk
+	assert.NoError(t, parseChunkName(name, &chunk))
+	assert.Equal(t, 42, chunk.Sequence)
+	assert.Equal(t, created, chunk.CreatedTs)
+
+	// the expiry is not part of the name
+	assert.True(t, chunk.ExpireTs.IsZero())
+	assert.Equal(t, created.Add(time.Hour), expireTs(created, time.Hour))
+	assert.True(t, expireTs(created, 0).IsZero())
+
+	assert.ErrorIs(t, parseChunkName("invalid", &chunk), ErrInvalidObjectKey)
+	assert.ErrorIs(t, parseChunkName("a-b-c", &chunk), ErrInvalidObjectKey)
+}
@@ -0,0 +1,321 @@
+// Copyright 2023 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package objectstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	s3Algorithm    = "AWS4-HMAC-SHA256"
+	s3Service      = "s3"
+	s3DateFormat   = "20060102T150405Z"
+	s3EmptyPayload = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+	// s3MaxErrorBody is the maximum size of the error responses read
+	s3MaxErrorBody = 64 * 1024
+)
+
+// S3Config configures the S3-compatible object storage
+type S3Config struct {
+	// Endpoint is the URL of the object storage, defaulting to the AWS S3
+	// endpoint of the region
+	Endpoint        string
+	Region          string
+	Bucket          string
+	AccessKeyID     string
+	SecretAccessKey string
+	// PathStyle addresses the bucket in the path of the URLs instead of
+	// the host name, as required by MinIO and most S3-compatible storages
+	PathStyle bool
+	// Client is the HTTP client, http.DefaultClient if nil
+	Client *http.Client
+}
+
+// S3 stores the objects in a bucket of an S3-compatible object storage,
+// signing the requests with AWS Signature Version 4
+type S3 struct {
+	config   S3Config
+	endpoint *url.URL
+	client   *http.Client
+	now      func() time.Time
+}
+
+// NewS3 returns the bucket of the S3-compatible object storage
+func NewS3(config S3Config) (*S3, error) {
+	if config.Bucket == "" {
+		return nil, errors.New("objectstore: no S3 bucket configured")
+	}
+	if config.Region == "" {
+		config.Region = "us-east-1"
+	}
+	endpoint := config.Endpoint
+	if endpoint == "" {
+		endpoint = "https://s3." + config.Region + ".amazonaws.com"
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" {
+		return nil, errors.Errorf("objectstore: invalid S3 endpoint %q", endpoint)
+	}
+	client := config.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &S3{
+		config:   config,
+		endpoint: u,
+		client:   client,
+		now:      time.Now,
+	}, nil
+}
+
+// s3URIEncode encodes the string as required by the signature: all the
+// bytes but the unreserved characters, and the slashes if path is true
+func s3URIEncode(s string, path bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (path && c == '/') {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// objectURL returns the URL of the object with the key, or of the bucket
+// if the key is empty
+func (s *S3) objectURL(key string, query url.Values) *url.URL {
+	u := *s.endpoint
+	p := strings.TrimSuffix(u.Path, "/")
+	if s.config.PathStyle {
+		p += "/" + s.config.Bucket
+	} else {
+		u.Host = s.config.Bucket + "." + u.Host
+	}
+	p += "/" + key
+	u.Path = p
+	u.RawPath = s3URIEncode(p, true)
+	u.RawQuery = canonicalQuery(query)
+	return &u
+}
+
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var params []string
+	for _, k := range keys {
+		values := append([]string(nil), query[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			params = append(params, s3URIEncode(k, false)+"="+s3URIEncode(v, false))
+		}
+	}
+	return strings.Join(params, "&")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	_, _ = h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// sign signs the request with AWS Signature Version 4, covering the host
+// and all the headers of the request
+func (s *S3) sign(req *http.Request, payloadHash string) {
+	now := s.now().UTC()
+	amzDate := now.Format(s3DateFormat)
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	scope := date + "/" + s.config.Region + "/" + s3Service + "/aws4_request"
+	stringToSign := s3Algorithm + "\n" + amzDate + "\n" + scope + "\n" +
+		hex.EncodeToString(hash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.config.SecretAccessKey), date)
+	key = hmacSHA256(key, s.config.Region)
+	key = hmacSHA256(key, s3Service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", s3Algorithm+
+		" Credential="+s.config.AccessKeyID+"/"+scope+
+		",SignedHeaders="+signedHeaders+
+		",Signature="+signature)
+}
+
+// s3Error is the error response of the object storage
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+// do sends the signed request, returning the response if successful
+func (s *S3) do(
+	ctx context.Context,
+	method, key string,
+	query url.Values,
+	body []byte,
+) (*http.Response, error) {
+	payloadHash := s3EmptyPayload
+	var reader io.Reader
+	if body != nil {
+		sum := sha256.Sum256(body)
+		payloadHash = hex.EncodeToString(sum[:])
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, "", reader)
+	if err != nil {
+		return nil, err
+	}
+	req.URL = s.objectURL(key, query)
+	req.Host = req.URL.Host
+	s.sign(req, payloadHash)
+
+	rsp, err := s.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "objectstore: S3 %s %q", method, key)
+	}
+	if rsp.StatusCode >= 200 && rsp.StatusCode < 300 {
+		return rsp, nil
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode == http.StatusNotFound && key != "" {
+		return nil, ErrObjectNotFound
+	}
+	var e s3Error
+	data, _ := io.ReadAll(io.LimitReader(rsp.Body, s3MaxErrorBody))
+	if xml.Unmarshal(data, &e) != nil || e.Code == "" {
+		e.Code = rsp.Status
+	}
+	return nil, errors.Errorf("objectstore: S3 %s %q: %s: %s",
+		method, key, e.Code, e.Message)
+}
+
+func (s *S3) PutObject(ctx context.Context, key string, data []byte) error {
+	if data == nil {
+		data = []byte{}
+	}
+	rsp, err := s.do(ctx, http.MethodPut, key, nil, data)
+	if err != nil {
+		return err
+	}
+	return rsp.Body.Close()
+}
+
+func (s *S3) GetObject(ctx context.Context, key string) ([]byte, error) {
+	rsp, err := s.do(ctx, http.MethodGet, key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+	return io.ReadAll(rsp.Body)
+}
+
+// s3ListResult is the result of the ListObjectsV2 requests
+type s3ListResult struct {
+	Contents []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// ListObjects lists the objects with ListObjectsV2, page by page
+func (s *S3) ListObjects(
+	ctx context.Context,
+	prefix string,
+	fn func(key string) error,
+) error {
+	query := url.Values{
+		"list-type": {"2"},
+		"prefix":    {prefix},
+	}
+	for {
+		rsp, err := s.do(ctx, http.MethodGet, "", query, nil)
+		if err != nil {
+			return err
+		}
+		var result s3ListResult
+		err = xml.NewDecoder(rsp.Body).Decode(&result)
+		rsp.Body.Close()
+		if err != nil {
+			return errors.Wrap(err, "objectstore: invalid S3 list response")
+		}
+		for _, object := range result.Contents {
+			if err := fn(object.Key); err != nil {
+				return err
+			}
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return nil
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+func (s *S3) DeleteObject(ctx context.Context, key string) error {
+	rsp, err := s.do(ctx, http.MethodDelete, key, nil, nil)
+	if err == ErrObjectNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return rsp.Body.Close()
+}
@@ -0,0 +1,67 @@
+// Copyright 2023 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package store
+
+import (
+	"context"
+	"time"
+
+	"github.com/mendersoftware/deviceconnect/model"
+)
+
+// The recording storage backends
+const (
+	RecordingBackendMongo      = "mongo"
+	RecordingBackendFilesystem = "filesystem"
+	RecordingBackendS3         = "s3"
+)
+
+// RecordingStorage stores the chunks of the recording streams of the
+// sessions, the terminal output, the control messages and the terminal
+// input, scoped by the tenant in the context.
+type RecordingStorage interface {
+	// PutChunks stores chunks of the recording streams, in order
+	PutChunks(ctx context.Context, chunks []*model.StoredChunk) error
+	// GetChunks returns the chunks of a recording stream of a session,
+	// ordered by sequence and creation time
+	GetChunks(ctx context.Context, sessionID, stream string) (ChunkIterator, error)
+	// DeleteExpiredChunks deletes the chunks of all the tenants which
+	// expired before the time, returning the number of chunks deleted
+	DeleteExpiredChunks(ctx context.Context, before time.Time) (int, error)
+	// SetChunksRetention sets the expiry of the chunks of the session, or
+	// of all the sessions but the excluded ones if sessionID is empty, to
+	// their creation time plus the retention; zero retention keeps the
+	// chunks forever.
+	SetChunksRetention(
+		ctx context.Context,
+		sessionID string,
+		excluded []string,
+		retention time.Duration,
+	) error
+	// DeleteChunks deletes the chunks of the sessions, returning the
+	// number of chunks deleted
+	DeleteChunks(ctx context.Context, sessionIDs []string) (int, error)
+}
+
+// ChunkIterator iterates over the chunks of a recording stream
+type ChunkIterator interface {
+	// Next moves to the next chunk, returning false at the end of the
+	// stream or on error
+	Next(ctx context.Context) bool
+	// Chunk returns the current chunk
+	Chunk() *model.StoredChunk
+	Err() error
+	Close(ctx context.Context) error
+}